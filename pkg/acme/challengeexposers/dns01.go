@@ -0,0 +1,68 @@
+package challengeexposers
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+
+	"github.com/tnozicka/openshift-acme/pkg/dryrun"
+	"github.com/tnozicka/openshift-acme/pkg/logging"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	Dns01HookPresent = "present"
+	Dns01HookCleanup = "cleanup"
+)
+
+// Dns01Hook exposes dns-01 challenges using an external program for the DNS provider.
+// It is called as `Command present|cleanup <fqdn> <value>` and it has to return only after
+// the TXT record is (or isn't anymore) visible to the ACME server.
+type Dns01Hook struct {
+	Command string
+	// DryRun records TXT record changes instead of running the hook if not nil
+	DryRun *dryrun.Recorder
+	// Logger carries context of the object the challenge is exposed for; may be nil
+	Logger *logging.Logger
+}
+
+func getDns01Fqdn(domain string) string {
+	return "_acme-challenge." + domain + "."
+}
+
+func (h *Dns01Hook) run(action string, a *acme.Client, domain string, token string) error {
+	if domain == "" {
+		return errors.New("domain can't be empty")
+	}
+
+	fqdn := getDns01Fqdn(domain)
+	if h.DryRun.Enabled() {
+		verb := dryrun.VerbCreate
+		if action == Dns01HookCleanup {
+			verb = dryrun.VerbDelete
+		}
+		h.DryRun.Record(verb, "TXT record", "", fqdn, "using dns-01 hook '"+h.Command+"'")
+		return nil
+	}
+
+	value, err := a.DNS01ChallengeRecord(token)
+	if err != nil {
+		return err
+	}
+
+	h.Logger.Debugf("Dns-01: running '%s %s %s'", h.Command, action, fqdn)
+	output, err := exec.Command(h.Command, action, fqdn, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("dns-01 hook '%s %s %s' failed: %s; output: '%s'", h.Command, action, fqdn, err, output)
+	}
+
+	return nil
+}
+
+func (h *Dns01Hook) Expose(a *acme.Client, domain string, token string) error {
+	return h.run(Dns01HookPresent, a, domain, token)
+}
+
+func (h *Dns01Hook) Remove(a *acme.Client, domain string, token string) error {
+	return h.run(Dns01HookCleanup, a, domain, token)
+}
@@ -0,0 +1,46 @@
+package challengeexposers
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/acme"
+)
+
+// Webroot exposes http-01 challenges as files served by an existing web server from Path
+type Webroot struct {
+	Path string
+}
+
+func (w *Webroot) getFilePath(a *acme.Client, token string) string {
+	return filepath.Join(w.Path, filepath.FromSlash(a.HTTP01ChallengePath(token)))
+}
+
+func (w *Webroot) Expose(a *acme.Client, domain string, token string) error {
+	if domain == "" {
+		return errors.New("domain can't be empty")
+	}
+
+	key, err := a.HTTP01ChallengeResponse(token)
+	if err != nil {
+		return err
+	}
+
+	path := w.getFilePath(a, token)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, []byte(key), 0644)
+}
+
+func (w *Webroot) Remove(a *acme.Client, domain string, token string) error {
+	err := os.Remove(w.getFilePath(a, token))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package challengeexposers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/acme"
+)
+
+func TestWebroot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := &Webroot{Path: dir}
+	a := &acme.Client{
+		Key: testKey,
+	}
+	token := "IlirfxKKXAsHtmzK29Pj8A"
+	path := filepath.Join(dir, ".well-known", "acme-challenge", token)
+
+	if err := w.Expose(a, "example.com", token); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := a.HTTP01ChallengeResponse(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != expected {
+		t.Errorf("expected '%s', got '%s'", expected, data)
+	}
+
+	if err := w.Remove(a, "example.com", token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("challenge file should have been removed; got error '%v'", err)
+	}
+
+	// removing challenge twice is fine
+	if err := w.Remove(a, "example.com", token); err != nil {
+		t.Error(err)
+	}
+}
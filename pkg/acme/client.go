@@ -8,11 +8,14 @@ import (
 	"crypto/x509/pkix"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"sync"
 	"time"
 
-	"github.com/go-playground/log"
 	"github.com/tnozicka/openshift-acme/pkg/cert"
+	"github.com/tnozicka/openshift-acme/pkg/logging"
 	"golang.org/x/crypto/acme"
 )
 
@@ -21,6 +24,9 @@ import (
 //	return true
 //}
 
+// MaxConcurrentValidations limits how many domains of a single certificate are validated at the same time
+const MaxConcurrentValidations = 10
+
 // Has to support concurrent calls
 type ChallengeExposer interface {
 	// Exposes challenge
@@ -31,9 +37,10 @@ type ChallengeExposer interface {
 }
 
 type Client struct {
-	//Logger *log.Entry
 	Client  *acme.Client
 	Account *acme.Account
+	// Logger carries context of the current attempt; may be nil
+	Logger *logging.Logger
 }
 
 func (c *Client) CreateAccount(ctx context.Context, a *acme.Account, prompt func(tosURL string) bool) (err error) {
@@ -56,28 +63,30 @@ func (c *Client) DeactivateAccount(ctx context.Context, a *acme.Account) error {
 
 // Consider if it needs to return acme.Authorization
 func (c *Client) ValidateDomain(ctx context.Context, domain string, exposers map[string]ChallengeExposer) (authorization *acme.Authorization, err error) {
+	logger := c.Logger.With(logging.FieldDomain, domain)
 	authorization, err = c.Client.Authorize(ctx, domain)
 	if err != nil {
 		return
 	}
 	defer func() {
 		if err != nil && authorization != nil {
-			log.Debugf("Revoking authorization '%s' for domain '%s'", authorization, domain)
+			logger.Debugf("Revoking authorization '%s'", authorization.URI)
 			// We can't use the default context because this call has to be done even if ctx is done (canceling)
 			shortCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 			defer cancel()
-			if e := c.Client.RevokeAuthorization(shortCtx, domain); e != nil {
+			if e := c.Client.RevokeAuthorization(shortCtx, authorization.URI); e != nil {
 				err = fmt.Errorf("%v (+Revoking failed authorization crashed because: %v)", err, e)
 			}
 		}
 	}()
 
 	if authorization.Status == acme.StatusValid {
+		logger.Debugf("Authorization '%s' is already valid", authorization.URI)
 		return
 	}
 
 	// TODO: prefer faster combinations like http-01 before dns-01 with cost based estimation
-	log.Debugf("Authorization: %+v", authorization)
+	logger.Debugf("Authorization '%s' has status '%s' and combinations %v", authorization.URI, authorization.Status, authorization.Combinations)
 
 	found := false
 	for _, combination := range authorization.Combinations {
@@ -115,6 +124,7 @@ func (c *Client) ValidateDomain(ctx context.Context, domain string, exposers map
 					return
 				}
 
+				logger.With(logging.FieldChallenge, chal.Type).Debug("Exposing challenge")
 				err = exposer.Expose(c.Client, domain, chal.Token)
 				if err != nil {
 					return
@@ -143,7 +153,7 @@ func (c *Client) ValidateDomain(ctx context.Context, domain string, exposers map
 			}
 		}
 		if err != nil {
-			log.Error(err)
+			logger.Error(err)
 			return
 		}
 
@@ -158,7 +168,7 @@ func (c *Client) ValidateDomain(ctx context.Context, domain string, exposers map
 	// TODO: consider implementing a timeout in case something went wrong
 	authorization, err = c.Client.WaitAuthorization(ctx, authorization.URI)
 	if err != nil {
-		log.Errorf("Authorization failed: %+v", err)
+		logger.Errorf("Authorization failed: %s", err)
 		return
 	}
 
@@ -182,20 +192,47 @@ func (e DomainsAuthorizationError) Error() (res string) {
 	return fmt.Sprint(e.FailedDomains)
 }
 
-func (c *Client) ObtainCertificate(ctx context.Context, domains []string, exposers map[string]ChallengeExposer, onlyForAllDomains bool) (certificate *cert.Certificate, err error) {
-	defer log.Trace("acme.Client ObtainCertificate").End()
+// IsCAUnavailable tells if err means the ACME server can't issue certificates right now for reasons unrelated
+// to the domains: rate limits, server errors or the server being unreachable. Another CA could succeed.
+func IsCAUnavailable(err error) bool {
+	switch e := err.(type) {
+	case DomainsAuthorizationError:
+		if len(e.FailedDomains) == 0 {
+			return false
+		}
+		for _, d := range e.FailedDomains {
+			if !IsCAUnavailable(d.Err) {
+				return false
+			}
+		}
+		return true
+	case *acme.Error:
+		return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= http.StatusInternalServerError ||
+			e.ProblemType == "urn:acme:error:rateLimited" || e.ProblemType == "urn:acme:error:serverInternal"
+	case *url.Error, net.Error:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Client) ObtainCertificate(ctx context.Context, domains []string, exposers map[string]ChallengeExposer, keyType cert.KeyType, onlyForAllDomains bool) (certificate *cert.Certificate, err error) {
+	defer c.Logger.Trace("acme.Client ObtainCertificate").End()
 	var wg sync.WaitGroup
 	results := make([]error, len(domains))
+	slots := make(chan struct{}, MaxConcurrentValidations)
 	for i, domain := range domains {
 		wg.Add(1)
 		go func(i int, domain string) {
 			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
 			_, err := c.ValidateDomain(ctx, domain, exposers)
 			results[i] = err
 		}(i, domain)
 	}
 	wg.Wait()
-	log.Info("finished validating domains")
+	c.Logger.Info("Finished validating domains")
 
 	validatedDomains := []string{}
 	var domainsError DomainsAuthorizationError
@@ -225,7 +262,7 @@ func (c *Client) ObtainCertificate(ctx context.Context, domains []string, expose
 	if len(domains) > 1 {
 		template.DNSNames = domains
 	}
-	privateKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	privateKey, err := cert.GeneratePrivateKey(keyType)
 	if err != nil {
 		return
 	}
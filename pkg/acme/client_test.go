@@ -1,17 +1,28 @@
 package acme
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"reflect"
+	"sort"
+	"sync"
 	"testing"
 
+	"github.com/go-playground/log"
+	"github.com/tnozicka/openshift-acme/pkg/acme/challengeexposers"
+	"github.com/tnozicka/openshift-acme/pkg/acme/fakeacme"
+	"github.com/tnozicka/openshift-acme/pkg/cert"
 	"golang.org/x/crypto/acme"
 	"golang.org/x/net/context"
 )
@@ -195,3 +206,266 @@ func TestCreateAccount(t *testing.T) {
 		}
 	}
 }
+
+// txtRecords exposes dns-01 challenges into memory for fakeacme's LookupTXT
+type txtRecords struct {
+	mutex   sync.Mutex
+	records map[string][]string
+}
+
+func (r *txtRecords) Expose(a *acme.Client, domain string, token string) error {
+	value, err := a.DNS01ChallengeRecord(token)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	name := "_acme-challenge." + domain
+	r.records[name] = append(r.records[name], value)
+	return nil
+}
+
+func (r *txtRecords) Remove(a *acme.Client, domain string, token string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.records, "_acme-challenge."+domain)
+	return nil
+}
+
+func (r *txtRecords) LookupTXT(name string) ([]string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.records[name], nil
+}
+
+func TestObtainCertificate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	http01, err := challengeexposers.NewHttp01(ctx, "127.0.0.1:0", log.Logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testTable := []struct {
+		name              string
+		challenge         string
+		domains           []string
+		resolvable        []string
+		onlyForAllDomains bool
+		faults            map[string]fakeacme.Problem
+		expectedDomains   []string
+		expectedFailed    []string
+		expectedStatus    int
+		expectedRequests  map[string]int
+	}{
+		{
+			name:            "http-01",
+			challenge:       "http-01",
+			domains:         []string{"example.com", "www.example.com"},
+			resolvable:      []string{"example.com", "www.example.com"},
+			expectedDomains: []string{"example.com", "www.example.com"},
+		},
+		{
+			name:            "dns-01",
+			challenge:       "dns-01",
+			domains:         []string{"example.com", "www.example.com"},
+			expectedDomains: []string{"example.com", "www.example.com"},
+		},
+		{
+			name:            "unreachable domain is left out",
+			challenge:       "http-01",
+			domains:         []string{"example.com", "unreachable.example.com"},
+			resolvable:      []string{"example.com"},
+			expectedDomains: []string{"example.com"},
+		},
+		{
+			name:              "unreachable domain fails all domains",
+			challenge:         "http-01",
+			domains:           []string{"example.com", "unreachable.example.com"},
+			resolvable:        []string{"example.com"},
+			onlyForAllDomains: true,
+			expectedFailed:    []string{"unreachable.example.com"},
+			expectedRequests:  map[string]int{fakeacme.ResourceNewCert: 0},
+		},
+		{
+			name:             "bad nonce is retried",
+			challenge:        "dns-01",
+			domains:          []string{"example.com"},
+			faults:           map[string]fakeacme.Problem{fakeacme.ResourceNewCert: {Type: fakeacme.ProblemBadNonce}},
+			expectedDomains:  []string{"example.com"},
+			expectedRequests: map[string]int{fakeacme.ResourceNewCert: 3},
+		},
+		{
+			name:             "rejected challenge is deactivated",
+			challenge:        "dns-01",
+			domains:          []string{"example.com"},
+			faults:           map[string]fakeacme.Problem{fakeacme.ResourceChallenge: {Type: fakeacme.ProblemUnauthorized, Status: http.StatusForbidden}},
+			expectedFailed:   []string{"example.com"},
+			expectedRequests: map[string]int{fakeacme.ResourceAuthz: 1},
+		},
+		{
+			name:           "rate limited authorization",
+			challenge:      "dns-01",
+			domains:        []string{"example.com"},
+			faults:         map[string]fakeacme.Problem{fakeacme.ResourceNewAuthz: {Type: fakeacme.ProblemRateLimited, Status: http.StatusTooManyRequests}},
+			expectedFailed: []string{"example.com"},
+		},
+		{
+			name:           "server error on issuing",
+			challenge:      "dns-01",
+			domains:        []string{"example.com"},
+			faults:         map[string]fakeacme.Problem{fakeacme.ResourceNewCert: {Type: fakeacme.ProblemServerInternal, Status: http.StatusInternalServerError}},
+			expectedStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, item := range testTable {
+		records := &txtRecords{records: make(map[string][]string)}
+		config := fakeacme.Config{
+			HTTP01Addrs: make(map[string]string),
+			LookupTXT:   records.LookupTXT,
+		}
+		for _, domain := range item.resolvable {
+			config.HTTP01Addrs[domain] = http01.Addr
+		}
+		server, err := fakeacme.NewServer(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for resource, problem := range item.faults {
+			server.FailNext(resource, 2, problem)
+		}
+
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := Client{
+			Client: &acme.Client{Key: key, DirectoryURL: server.DirectoryURL()},
+		}
+		c.Account, err = c.Client.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+		if err != nil {
+			t.Fatalf("%s: %v", item.name, err)
+		}
+
+		exposers := map[string]ChallengeExposer{
+			"http-01": http01,
+			"dns-01":  records,
+		}
+		for challenge := range exposers {
+			if challenge != item.challenge {
+				delete(exposers, challenge)
+			}
+		}
+
+		certificate, err := c.ObtainCertificate(ctx, item.domains, exposers, cert.KeyTypeECDSA256, item.onlyForAllDomains)
+		switch {
+		case item.expectedFailed != nil:
+			domainsErr, ok := err.(DomainsAuthorizationError)
+			if !ok {
+				t.Errorf("%s: expected DomainsAuthorizationError, got %#v", item.name, err)
+				break
+			}
+			var failed []string
+			for _, d := range domainsErr.FailedDomains {
+				failed = append(failed, d.Domain)
+			}
+			if !reflect.DeepEqual(failed, item.expectedFailed) {
+				t.Errorf("%s: expected failed domains %v, got %v", item.name, item.expectedFailed, failed)
+			}
+		case item.expectedStatus != 0:
+			acmeErr, ok := err.(*acme.Error)
+			if !ok || acmeErr.StatusCode != item.expectedStatus {
+				t.Errorf("%s: expected ACME error with status %d, got %#v", item.name, item.expectedStatus, err)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", item.name, err)
+		default:
+			domains := certificate.Domains()
+			sort.Strings(domains)
+			if !reflect.DeepEqual(domains, item.expectedDomains) {
+				t.Errorf("%s: expected domains %v, got %v", item.name, item.expectedDomains, domains)
+			}
+			for _, domain := range domains {
+				_, err := certificate.Certificate.Verify(x509.VerifyOptions{DNSName: domain, Roots: server.Roots()})
+				if err != nil {
+					t.Errorf("%s: %v", item.name, err)
+				}
+			}
+		}
+
+		for resource, expected := range item.expectedRequests {
+			if got := server.Requests(resource); got != expected {
+				t.Errorf("%s: expected %d '%s' requests, got %d", item.name, expected, resource, got)
+			}
+		}
+
+		server.Close()
+	}
+}
+
+func TestIsCAUnavailable(t *testing.T) {
+	rateLimited := &acme.Error{StatusCode: http.StatusTooManyRequests, ProblemType: fakeacme.ProblemRateLimited}
+	unauthorized := &acme.Error{StatusCode: http.StatusForbidden, ProblemType: fakeacme.ProblemUnauthorized}
+
+	testTable := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{
+			name:     "nil",
+			err:      nil,
+			expected: false,
+		},
+		{
+			name:     "rate limited",
+			err:      rateLimited,
+			expected: true,
+		},
+		{
+			name:     "server error",
+			err:      &acme.Error{StatusCode: http.StatusServiceUnavailable},
+			expected: true,
+		},
+		{
+			name:     "unreachable directory",
+			err:      &url.Error{Op: "Get", URL: "https://acme.example.com/directory", Err: errors.New("connection refused")},
+			expected: true,
+		},
+		{
+			name:     "unauthorized",
+			err:      unauthorized,
+			expected: false,
+		},
+		{
+			name: "all domains rate limited",
+			err: DomainsAuthorizationError{FailedDomains: []FailedDomain{
+				{Domain: "a.example.com", Err: rateLimited},
+				{Domain: "b.example.com", Err: rateLimited},
+			}},
+			expected: true,
+		},
+		{
+			name: "domain failed validation",
+			err: DomainsAuthorizationError{FailedDomains: []FailedDomain{
+				{Domain: "a.example.com", Err: rateLimited},
+				{Domain: "b.example.com", Err: unauthorized},
+			}},
+			expected: false,
+		},
+		{
+			name:     "other error",
+			err:      errors.New("unable to satisfy all challenge combinations for ACME authorization"),
+			expected: false,
+		},
+	}
+
+	for _, item := range testTable {
+		if got := IsCAUnavailable(item.err); got != item.expected {
+			t.Errorf("%s: expected %t, got %t", item.name, item.expected, got)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package fakeacme
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	ocspPath = "/ocsp"
+
+	// ResourceOCSP counts OCSP requests in Requests
+	ResourceOCSP = "ocsp"
+)
+
+// Revoke revokes a certificate issued by this server without an ACME request, like a CA does in a mass revocation.
+// It reports whether the certificate was issued by this server.
+func (s *Server) Revoke(certificate *x509.Certificate) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	issued, found := s.certificates[certificate.SerialNumber.Text(16)]
+	if !found {
+		return false
+	}
+	issued.revoked = true
+	return true
+}
+
+// serveOCSP answers OCSP requests POSTed to ocspPath for certificates issued by this server
+func (s *Server) serveOCSP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	request, err := ocsp.ParseRequest(body)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(ocsp.MalformedRequestErrorResponse)
+		return
+	}
+
+	now := time.Now()
+	template := ocsp.Response{
+		SerialNumber: request.SerialNumber,
+		Status:       ocsp.Unknown,
+		ThisUpdate:   now.Add(-time.Minute),
+		NextUpdate:   now.Add(time.Hour),
+	}
+
+	s.mutex.Lock()
+	s.requests[ResourceOCSP]++
+	issued, found := s.certificates[request.SerialNumber.Text(16)]
+	if found {
+		template.Status = ocsp.Good
+		if issued.revoked {
+			template.Status = ocsp.Revoked
+			template.RevokedAt = now.Add(-time.Minute)
+			template.RevocationReason = ocsp.Unspecified
+		}
+	}
+	s.mutex.Unlock()
+
+	response, err := ocsp.CreateResponse(s.ca.certificate, s.ca.certificate, template, s.ca.key)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(ocsp.InternalErrorErrorResponse)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(response)
+}
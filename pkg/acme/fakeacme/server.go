@@ -0,0 +1,860 @@
+// Package fakeacme implements an in-memory ACME CA for hermetic tests.
+//
+// It speaks the ACME draft (v1) protocol used by golang.org/x/crypto/acme: accounts are created
+// with new-reg, domains are authorized with new-authz and its challenges (the counterpart of orders
+// and their authorizations), and new-cert finalizes the request by signing the CSR with an in-memory CA.
+// Validation of http-01 connects to addresses from Config.HTTP01Addrs instead of resolving the domain
+// and dns-01 uses Config.LookupTXT, so no network access or public domain is needed.
+package fakeacme
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	ProblemBadNonce       = "urn:acme:error:badNonce"
+	ProblemMalformed      = "urn:acme:error:malformed"
+	ProblemUnauthorized   = "urn:acme:error:unauthorized"
+	ProblemServerInternal = "urn:acme:error:serverInternal"
+	ProblemRateLimited    = "urn:acme:error:rateLimited"
+	ProblemConnection     = "urn:acme:error:connection"
+	ProblemAlreadyRevoked = "urn:acme:error:alreadyRevoked"
+)
+
+const (
+	ResourceNewReg     = "new-reg"
+	ResourceReg        = "reg"
+	ResourceNewAuthz   = "new-authz"
+	ResourceAuthz      = "authz"
+	ResourceChallenge  = "challenge"
+	ResourceNewCert    = "new-cert"
+	ResourceRevokeCert = "revoke-cert"
+)
+
+const (
+	directoryPath  = "/directory"
+	termsPath      = "/terms"
+	newRegPath     = "/acme/new-reg"
+	regPath        = "/acme/reg/"
+	newAuthzPath   = "/acme/new-authz"
+	authzPath      = "/acme/authz/"
+	challengePath  = "/acme/challenge/"
+	newCertPath    = "/acme/new-cert"
+	certPath       = "/acme/cert/"
+	issuerCertPath = "/acme/issuer-cert"
+	revokeCertPath = "/acme/revoke-cert"
+
+	maxRequestSize = 1 << 20
+
+	// statusDeactivated is missing from golang.org/x/crypto/acme
+	statusDeactivated = "deactivated"
+
+	DefaultCertificateValidity   = 90 * 24 * time.Hour
+	DefaultAuthorizationValidity = 30 * 24 * time.Hour
+)
+
+type Config struct {
+	// HTTP01Addrs maps domains to host:port the http-01 validation connects to;
+	// validation of domains missing here fails as if they didn't resolve
+	HTTP01Addrs map[string]string
+	// LookupTXT returns TXT records of a name like "_acme-challenge.example.com" for dns-01 validation;
+	// dns-01 challenges aren't offered if it's nil
+	LookupTXT func(name string) ([]string, error)
+	// CertificateValidity defaults to DefaultCertificateValidity
+	CertificateValidity time.Duration
+}
+
+// Problem is an ACME error response
+type Problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *Problem) Error() string {
+	return fmt.Sprintf("%d %s: %s", p.Status, p.Type, p.Detail)
+}
+
+func newProblem(status int, problemType string, format string, a ...interface{}) *Problem {
+	return &Problem{
+		Type:   problemType,
+		Detail: fmt.Sprintf(format, a...),
+		Status: status,
+	}
+}
+
+type account struct {
+	id         string
+	thumbprint string
+	contact    []string
+	agreement  string
+}
+
+type challenge struct {
+	Type             string   `json:"type"`
+	URI              string   `json:"uri"`
+	Token            string   `json:"token"`
+	Status           string   `json:"status"`
+	KeyAuthorization string   `json:"keyAuthorization,omitempty"`
+	Error            *Problem `json:"error,omitempty"`
+}
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type authorization struct {
+	id         string
+	account    string
+	Identifier identifier   `json:"identifier"`
+	Status     string       `json:"status"`
+	Expires    time.Time    `json:"expires"`
+	Challenges []*challenge `json:"challenges"`
+	// Combinations lists challenges any of which is sufficient
+	Combinations [][]int `json:"combinations"`
+}
+
+type issuedCertificate struct {
+	der         []byte
+	certificate *x509.Certificate
+	account     string
+	revoked     bool
+}
+
+type fault struct {
+	count   int
+	problem Problem
+}
+
+// Server is a fake ACME CA listening on a local address
+type Server struct {
+	config     Config
+	ca         *ca
+	httpServer *httptest.Server
+	httpClient *http.Client
+
+	mutex          sync.Mutex
+	lastID         int
+	nonces         map[string]bool
+	accounts       map[string]*account
+	authorizations map[string]*authorization
+	certificates   map[string]*issuedCertificate
+	faults         map[string]*fault
+	requests       map[string]int
+}
+
+// NewServer creates a CA and starts serving ACME on a local address; call Close to stop it
+func NewServer(config Config) (*Server, error) {
+	ca, err := newCA()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.CertificateValidity == 0 {
+		config.CertificateValidity = DefaultCertificateValidity
+	}
+
+	s := &Server{
+		config:         config,
+		ca:             ca,
+		nonces:         make(map[string]bool),
+		accounts:       make(map[string]*account),
+		authorizations: make(map[string]*authorization),
+		certificates:   make(map[string]*issuedCertificate),
+		faults:         make(map[string]*fault),
+		requests:       make(map[string]int),
+	}
+	s.httpClient = &http.Client{
+		Transport: &http.Transport{
+			DialContext: s.dialHTTP01,
+		},
+		Timeout: 10 * time.Second,
+	}
+	s.httpServer = httptest.NewServer(s)
+	s.ca.ocspServer = s.httpServer.URL + ocspPath
+
+	return s, nil
+}
+
+func (s *Server) Close() {
+	s.httpServer.Close()
+}
+
+func (s *Server) DirectoryURL() string {
+	return s.httpServer.URL + directoryPath
+}
+
+// CACertificate returns the certificate issuing all certificates of this server
+func (s *Server) CACertificate() *x509.Certificate {
+	return s.ca.certificate
+}
+
+// Roots returns a pool for verifying certificates issued by this server
+func (s *Server) Roots() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.ca.certificate)
+	return pool
+}
+
+// FailNext makes the next n requests for an ACME resource (e.g. ResourceNewCert) fail with the problem.
+// ProblemBadNonce failures are retried by the client.
+func (s *Server) FailNext(resource string, n int, problem Problem) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if problem.Status == 0 {
+		problem.Status = http.StatusBadRequest
+	}
+	s.faults[resource] = &fault{
+		count:   n,
+		problem: problem,
+	}
+}
+
+// Requests returns how many signed requests were received for an ACME resource, including failed ones
+func (s *Server) Requests(resource string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.requests[resource]
+}
+
+// IsRevoked reports whether the certificate was issued by this server and revoked since
+func (s *Server) IsRevoked(certificate *x509.Certificate) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	issued, found := s.certificates[certificate.SerialNumber.Text(16)]
+	return found && issued.revoked
+}
+
+func (s *Server) url(path string) string {
+	return s.httpServer.URL + path
+}
+
+func (s *Server) nextID() string {
+	s.lastID++
+	return strconv.Itoa(s.lastID)
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (s *Server) newNonce() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	nonce := randomToken()
+	s.nonces[nonce] = true
+	return nonce
+}
+
+func (s *Server) useNonce(nonce string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.nonces[nonce] {
+		return false
+	}
+	delete(s.nonces, nonce)
+	return true
+}
+
+// takeFault counts the request and returns an injected problem for it if there is one
+func (s *Server) takeFault(resource string) *Problem {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.requests[resource]++
+	f, found := s.faults[resource]
+	if !found || f.count < 1 {
+		return nil
+	}
+	f.count--
+	p := f.problem
+	return &p
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeProblem(w http.ResponseWriter, p *Problem) {
+	if p.Type == ProblemBadNonce {
+		// let the client retry immediately
+		w.Header().Set("Retry-After", "0")
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == ocspPath {
+		s.serveOCSP(w, r)
+		return
+	}
+
+	w.Header().Set("Replay-Nonce", s.newNonce())
+
+	switch r.Method {
+	case "HEAD":
+		w.WriteHeader(http.StatusOK)
+	case "GET":
+		s.serveGet(w, r)
+	case "POST":
+		s.servePost(w, r)
+	default:
+		writeProblem(w, newProblem(http.StatusMethodNotAllowed, ProblemMalformed, "method %s not allowed", r.Method))
+	}
+}
+
+func (s *Server) serveGet(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	switch {
+	case path == directoryPath:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			ResourceNewReg:     s.url(newRegPath),
+			ResourceNewAuthz:   s.url(newAuthzPath),
+			ResourceNewCert:    s.url(newCertPath),
+			ResourceRevokeCert: s.url(revokeCertPath),
+			"meta": map[string]string{
+				"terms-of-service": s.url(termsPath),
+			},
+		})
+	case path == termsPath:
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, "fakeacme terms of service")
+	case path == issuerCertPath:
+		w.Header().Set("Content-Type", "application/pkix-cert")
+		w.Write(s.ca.certificate.Raw)
+	case strings.HasPrefix(path, certPath):
+		s.mutex.Lock()
+		issued, found := s.certificates[strings.TrimPrefix(path, certPath)]
+		s.mutex.Unlock()
+		if !found {
+			writeProblem(w, newProblem(http.StatusNotFound, ProblemMalformed, "certificate not found"))
+			return
+		}
+		s.writeCertificate(w, http.StatusOK, issued.der)
+	case strings.HasPrefix(path, authzPath):
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		authz, found := s.authorizations[strings.TrimPrefix(path, authzPath)]
+		if !found {
+			writeProblem(w, newProblem(http.StatusNotFound, ProblemMalformed, "authorization not found"))
+			return
+		}
+		if authz.Status == acme.StatusPending {
+			w.Header().Set("Retry-After", "0")
+		}
+		writeJSON(w, http.StatusOK, authz)
+	case strings.HasPrefix(path, challengePath):
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		_, chal, p := s.getChallenge(strings.TrimPrefix(path, challengePath))
+		if p != nil {
+			writeProblem(w, p)
+			return
+		}
+		writeJSON(w, http.StatusOK, chal)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) servePost(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+	if err != nil {
+		writeProblem(w, newProblem(http.StatusBadRequest, ProblemMalformed, "reading request: %v", err))
+		return
+	}
+	req, err := parseJWS(body)
+	if err != nil {
+		writeProblem(w, newProblem(http.StatusBadRequest, ProblemMalformed, "invalid JWS: %v", err))
+		return
+	}
+	if !s.useNonce(req.nonce) {
+		writeProblem(w, newProblem(http.StatusBadRequest, ProblemBadNonce, "JWS has an invalid anti-replay nonce"))
+		return
+	}
+
+	var resource struct {
+		Resource string `json:"resource"`
+	}
+	if err := json.Unmarshal(req.payload, &resource); err != nil {
+		writeProblem(w, newProblem(http.StatusBadRequest, ProblemMalformed, "invalid payload: %v", err))
+		return
+	}
+	if p := s.takeFault(resource.Resource); p != nil {
+		writeProblem(w, p)
+		return
+	}
+
+	thumbprint, err := acme.JWKThumbprint(req.key)
+	if err != nil {
+		writeProblem(w, newProblem(http.StatusBadRequest, ProblemMalformed, "%v", err))
+		return
+	}
+
+	path := r.URL.Path
+	var expected string
+	var handler func(w http.ResponseWriter, id string, thumbprint string, req *jwsRequest)
+	switch {
+	case path == newRegPath:
+		expected, handler = ResourceNewReg, s.newReg
+	case strings.HasPrefix(path, regPath):
+		expected, handler = ResourceReg, s.updateReg
+	case path == newAuthzPath:
+		expected, handler = ResourceNewAuthz, s.newAuthz
+	case strings.HasPrefix(path, authzPath):
+		expected, handler = ResourceAuthz, s.updateAuthz
+	case strings.HasPrefix(path, challengePath):
+		expected, handler = ResourceChallenge, s.acceptChallenge
+	case path == newCertPath:
+		expected, handler = ResourceNewCert, s.newCert
+	case path == revokeCertPath:
+		expected, handler = ResourceRevokeCert, s.revokeCert
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if resource.Resource != expected {
+		writeProblem(w, newProblem(http.StatusBadRequest, ProblemMalformed, "expected resource '%s', got '%s'", expected, resource.Resource))
+		return
+	}
+
+	id := path[strings.LastIndex(path, "/")+1:]
+	if expected == ResourceChallenge {
+		id = strings.TrimPrefix(path, challengePath)
+	}
+	handler(w, id, thumbprint, req)
+}
+
+func (s *Server) writeAccount(w http.ResponseWriter, status int, a *account) {
+	w.Header().Set("Location", s.url(regPath+a.id))
+	w.Header().Add("Link", fmt.Sprintf(`<%s>;rel="next"`, s.url(newAuthzPath)))
+	w.Header().Add("Link", fmt.Sprintf(`<%s>;rel="terms-of-service"`, s.url(termsPath)))
+	writeJSON(w, status, map[string]interface{}{
+		"contact":   a.contact,
+		"agreement": a.agreement,
+	})
+}
+
+type regRequest struct {
+	Contact   []string `json:"contact"`
+	Agreement string   `json:"agreement"`
+}
+
+func (s *Server) newReg(w http.ResponseWriter, _ string, thumbprint string, req *jwsRequest) {
+	var payload regRequest
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeProblem(w, newProblem(http.StatusBadRequest, ProblemMalformed, "invalid payload: %v", err))
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if a, found := s.accounts[thumbprint]; found {
+		w.Header().Set("Location", s.url(regPath+a.id))
+		writeProblem(w, newProblem(http.StatusConflict, ProblemMalformed, "registration key is already in use"))
+		return
+	}
+
+	a := &account{
+		id:         s.nextID(),
+		thumbprint: thumbprint,
+		contact:    payload.Contact,
+		agreement:  payload.Agreement,
+	}
+	s.accounts[thumbprint] = a
+	s.writeAccount(w, http.StatusCreated, a)
+}
+
+func (s *Server) updateReg(w http.ResponseWriter, id string, thumbprint string, req *jwsRequest) {
+	var payload regRequest
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeProblem(w, newProblem(http.StatusBadRequest, ProblemMalformed, "invalid payload: %v", err))
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	a, found := s.accounts[thumbprint]
+	if !found || a.id != id {
+		writeProblem(w, newProblem(http.StatusForbidden, ProblemUnauthorized, "request signed by a key of another account"))
+		return
+	}
+	if payload.Contact != nil {
+		a.contact = payload.Contact
+	}
+	if payload.Agreement != "" {
+		a.agreement = payload.Agreement
+	}
+	s.writeAccount(w, http.StatusAccepted, a)
+}
+
+// writeAuthorization has to be called with the mutex held
+func (s *Server) writeAuthorization(w http.ResponseWriter, status int, authz *authorization) {
+	w.Header().Set("Location", s.url(authzPath+authz.id))
+	writeJSON(w, status, authz)
+}
+
+func (s *Server) newAuthz(w http.ResponseWriter, _ string, thumbprint string, req *jwsRequest) {
+	var payload struct {
+		Identifier identifier `json:"identifier"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeProblem(w, newProblem(http.StatusBadRequest, ProblemMalformed, "invalid payload: %v", err))
+		return
+	}
+	if payload.Identifier.Type != "dns" || payload.Identifier.Value == "" {
+		writeProblem(w, newProblem(http.StatusBadRequest, ProblemMalformed, "invalid identifier %#v", payload.Identifier))
+		return
+	}
+	domain := strings.ToLower(payload.Identifier.Value)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, found := s.accounts[thumbprint]; !found {
+		writeProblem(w, newProblem(http.StatusForbidden, ProblemUnauthorized, "no registration exists matching provided key"))
+		return
+	}
+
+	if authz := s.validAuthorization(thumbprint, domain); authz != nil {
+		s.writeAuthorization(w, http.StatusCreated, authz)
+		return
+	}
+
+	authz := &authorization{
+		id:      s.nextID(),
+		account: thumbprint,
+		Identifier: identifier{
+			Type:  "dns",
+			Value: domain,
+		},
+		Status:  acme.StatusPending,
+		Expires: time.Now().Add(DefaultAuthorizationValidity).UTC(),
+	}
+	types := []string{"http-01"}
+	if s.config.LookupTXT != nil {
+		types = append(types, "dns-01")
+	}
+	for i, t := range types {
+		authz.Challenges = append(authz.Challenges, &challenge{
+			Type:   t,
+			URI:    s.url(fmt.Sprintf("%s%s/%d", challengePath, authz.id, i)),
+			Token:  randomToken(),
+			Status: acme.StatusPending,
+		})
+		authz.Combinations = append(authz.Combinations, []int{i})
+	}
+	s.authorizations[authz.id] = authz
+
+	s.writeAuthorization(w, http.StatusCreated, authz)
+}
+
+// validAuthorization has to be called with the mutex held
+func (s *Server) validAuthorization(thumbprint string, domain string) *authorization {
+	now := time.Now()
+	for _, authz := range s.authorizations {
+		if authz.account == thumbprint && authz.Identifier.Value == domain && authz.Status == acme.StatusValid && authz.Expires.After(now) {
+			return authz
+		}
+	}
+	return nil
+}
+
+func (s *Server) updateAuthz(w http.ResponseWriter, id string, thumbprint string, req *jwsRequest) {
+	var payload struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeProblem(w, newProblem(http.StatusBadRequest, ProblemMalformed, "invalid payload: %v", err))
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	authz, found := s.authorizations[id]
+	if !found {
+		writeProblem(w, newProblem(http.StatusNotFound, ProblemMalformed, "authorization not found"))
+		return
+	}
+	if authz.account != thumbprint {
+		writeProblem(w, newProblem(http.StatusForbidden, ProblemUnauthorized, "authorization belongs to another account"))
+		return
+	}
+	if payload.Status != statusDeactivated {
+		writeProblem(w, newProblem(http.StatusBadRequest, ProblemMalformed, "only deactivation of authorizations is supported"))
+		return
+	}
+	authz.Status = statusDeactivated
+	writeJSON(w, http.StatusOK, authz)
+}
+
+// getChallenge has to be called with the mutex held
+func (s *Server) getChallenge(id string) (*authorization, *challenge, *Problem) {
+	parts := strings.Split(id, "/")
+	if len(parts) != 2 {
+		return nil, nil, newProblem(http.StatusNotFound, ProblemMalformed, "challenge not found")
+	}
+	authz, found := s.authorizations[parts[0]]
+	if !found {
+		return nil, nil, newProblem(http.StatusNotFound, ProblemMalformed, "challenge not found")
+	}
+	i, err := strconv.Atoi(parts[1])
+	if err != nil || i < 0 || i >= len(authz.Challenges) {
+		return nil, nil, newProblem(http.StatusNotFound, ProblemMalformed, "challenge not found")
+	}
+	return authz, authz.Challenges[i], nil
+}
+
+func (s *Server) acceptChallenge(w http.ResponseWriter, id string, thumbprint string, req *jwsRequest) {
+	var payload struct {
+		KeyAuthorization string `json:"keyAuthorization"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeProblem(w, newProblem(http.StatusBadRequest, ProblemMalformed, "invalid payload: %v", err))
+		return
+	}
+
+	s.mutex.Lock()
+	authz, chal, p := s.getChallenge(id)
+	if p == nil && authz.account != thumbprint {
+		p = newProblem(http.StatusForbidden, ProblemUnauthorized, "challenge belongs to another account")
+	}
+	if p != nil {
+		s.mutex.Unlock()
+		writeProblem(w, p)
+		return
+	}
+	if authz.Status != acme.StatusPending || chal.Status != acme.StatusPending {
+		defer s.mutex.Unlock()
+		writeJSON(w, http.StatusAccepted, chal)
+		return
+	}
+	keyAuthorization := chal.Token + "." + thumbprint
+	if payload.KeyAuthorization != keyAuthorization {
+		s.mutex.Unlock()
+		writeProblem(w, newProblem(http.StatusBadRequest, ProblemMalformed, "keyAuthorization doesn't match the challenge and account key"))
+		return
+	}
+	chal.Status = acme.StatusProcessing
+	chal.KeyAuthorization = keyAuthorization
+	domain, challengeType := authz.Identifier.Value, chal.Type
+	s.mutex.Unlock()
+
+	// Validating before responding keeps tests deterministic; the client sees the final state on its first poll
+	err := s.validate(challengeType, domain, chal.Token, keyAuthorization)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err != nil {
+		chal.Status = acme.StatusInvalid
+		chal.Error = err
+		authz.Status = acme.StatusInvalid
+	} else {
+		chal.Status = acme.StatusValid
+		authz.Status = acme.StatusValid
+	}
+	writeJSON(w, http.StatusAccepted, chal)
+}
+
+func (s *Server) dialHTTP01(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	target, found := s.config.HTTP01Addrs[host]
+	if !found {
+		return nil, fmt.Errorf("no such host '%s'", host)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, target)
+}
+
+func (s *Server) validate(challengeType, domain, token, keyAuthorization string) *Problem {
+	switch challengeType {
+	case "http-01":
+		url := "http://" + domain + "/.well-known/acme-challenge/" + token
+		res, err := s.httpClient.Get(url)
+		if err != nil {
+			return newProblem(http.StatusBadRequest, ProblemConnection, "fetching %s: %v", url, err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return newProblem(http.StatusForbidden, ProblemUnauthorized, "invalid response from %s: %d", url, res.StatusCode)
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		if err != nil {
+			return newProblem(http.StatusBadRequest, ProblemConnection, "reading %s: %v", url, err)
+		}
+		if strings.TrimSpace(string(body)) != keyAuthorization {
+			return newProblem(http.StatusForbidden, ProblemUnauthorized, "the key authorization file from %s doesn't match", url)
+		}
+		return nil
+	case "dns-01":
+		name := "_acme-challenge." + domain
+		records, err := s.config.LookupTXT(name)
+		if err != nil {
+			return newProblem(http.StatusBadRequest, ProblemConnection, "looking up TXT records for %s: %v", name, err)
+		}
+		expected := dns01Record(keyAuthorization)
+		for _, record := range records {
+			if record == expected {
+				return nil
+			}
+		}
+		return newProblem(http.StatusForbidden, ProblemUnauthorized, "no matching TXT record found for %s", name)
+	}
+	return newProblem(http.StatusBadRequest, ProblemMalformed, "unsupported challenge type '%s'", challengeType)
+}
+
+func (s *Server) writeCertificate(w http.ResponseWriter, status int, der []byte) {
+	w.Header().Add("Link", fmt.Sprintf(`<%s>;rel="up"`, s.url(issuerCertPath)))
+	w.Header().Set("Content-Type", "application/pkix-cert")
+	w.WriteHeader(status)
+	w.Write(der)
+}
+
+func (s *Server) newCert(w http.ResponseWriter, _ string, thumbprint string, req *jwsRequest) {
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeProblem(w, newProblem(http.StatusBadRequest, ProblemMalformed, "invalid payload: %v", err))
+		return
+	}
+	csrDER, err := base64.RawURLEncoding.DecodeString(payload.CSR)
+	if err != nil {
+		writeProblem(w, newProblem(http.StatusBadRequest, ProblemMalformed, "invalid CSR encoding: %v", err))
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		writeProblem(w, newProblem(http.StatusBadRequest, ProblemMalformed, "invalid CSR: %v", err))
+		return
+	}
+
+	var domains []string
+	seen := make(map[string]bool)
+	for _, name := range append([]string{csr.Subject.CommonName}, csr.DNSNames...) {
+		name = strings.ToLower(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		domains = append(domains, name)
+	}
+	if len(domains) == 0 {
+		writeProblem(w, newProblem(http.StatusBadRequest, ProblemMalformed, "CSR contains no names"))
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, found := s.accounts[thumbprint]; !found {
+		writeProblem(w, newProblem(http.StatusForbidden, ProblemUnauthorized, "no registration exists matching provided key"))
+		return
+	}
+	var unauthorized []string
+	for _, domain := range domains {
+		if s.validAuthorization(thumbprint, domain) == nil {
+			unauthorized = append(unauthorized, domain)
+		}
+	}
+	if len(unauthorized) != 0 {
+		writeProblem(w, newProblem(http.StatusForbidden, ProblemUnauthorized, "authorizations for these names not found or expired: %s", strings.Join(unauthorized, ", ")))
+		return
+	}
+
+	der, certificate, err := s.ca.issue(csr, domains, s.config.CertificateValidity)
+	if err != nil {
+		writeProblem(w, newProblem(http.StatusInternalServerError, ProblemServerInternal, "issuing certificate: %v", err))
+		return
+	}
+	serial := certificate.SerialNumber.Text(16)
+	s.certificates[serial] = &issuedCertificate{
+		der:         der,
+		certificate: certificate,
+		account:     thumbprint,
+	}
+
+	w.Header().Set("Location", s.url(certPath+serial))
+	s.writeCertificate(w, http.StatusCreated, der)
+}
+
+func (s *Server) revokeCert(w http.ResponseWriter, _ string, thumbprint string, req *jwsRequest) {
+	var payload struct {
+		Certificate string `json:"certificate"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeProblem(w, newProblem(http.StatusBadRequest, ProblemMalformed, "invalid payload: %v", err))
+		return
+	}
+	der, err := base64.RawURLEncoding.DecodeString(payload.Certificate)
+	if err != nil {
+		writeProblem(w, newProblem(http.StatusBadRequest, ProblemMalformed, "invalid certificate encoding: %v", err))
+		return
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		writeProblem(w, newProblem(http.StatusBadRequest, ProblemMalformed, "invalid certificate: %v", err))
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	issued, found := s.certificates[certificate.SerialNumber.Text(16)]
+	if !found || !bytes.Equal(issued.der, der) {
+		writeProblem(w, newProblem(http.StatusNotFound, ProblemMalformed, "certificate not found"))
+		return
+	}
+	// either the issuing account or the certificate's key may revoke it
+	certThumbprint, _ := acme.JWKThumbprint(certificate.PublicKey)
+	if issued.account != thumbprint && certThumbprint != thumbprint {
+		writeProblem(w, newProblem(http.StatusForbidden, ProblemUnauthorized, "request isn't signed by the issuing account or the certificate key"))
+		return
+	}
+	if issued.revoked {
+		writeProblem(w, newProblem(http.StatusConflict, ProblemAlreadyRevoked, "certificate is already revoked"))
+		return
+	}
+	issued.revoked = true
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,102 @@
+package fakeacme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/acme"
+)
+
+func TestIssueAndRevoke(t *testing.T) {
+	ctx := context.Background()
+
+	var mutex sync.Mutex
+	records := make(map[string][]string)
+	server, err := NewServer(Config{
+		LookupTXT: func(name string) ([]string, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return records[name], nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &acme.Client{Key: accountKey, DirectoryURL: server.DirectoryURL()}
+	if _, err := client.Register(ctx, &acme.Account{}, acme.AcceptTOS); err != nil {
+		t.Fatal(err)
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "example.com"}}, certKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.CreateCert(ctx, csr, 0, true); err == nil {
+		t.Fatal("certificate for an unauthorized domain has been issued")
+	}
+
+	authz, err := client.Authorize(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chal := range authz.Challenges {
+		if chal.Type != "dns-01" {
+			continue
+		}
+		value, err := client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mutex.Lock()
+		records["_acme-challenge.example.com"] = []string{value}
+		mutex.Unlock()
+		if _, err := client.Accept(ctx, chal); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		t.Fatal(err)
+	}
+
+	der, _, err := client.CreateCert(ctx, csr, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(der) != 2 {
+		t.Fatalf("expected certificate and its issuer, got %d certificates", len(der))
+	}
+	certificate, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := certificate.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: server.Roots()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the certificate key is allowed to revoke it as well
+	if err := client.RevokeCert(ctx, certKey, der[0], acme.CRLReasonKeyCompromise); err != nil {
+		t.Fatal(err)
+	}
+	if !server.IsRevoked(certificate) {
+		t.Error("certificate hasn't been revoked")
+	}
+	if err := client.RevokeCert(ctx, nil, der[0], acme.CRLReasonUnspecified); err == nil {
+		t.Error("revoking a revoked certificate has succeeded")
+	}
+}
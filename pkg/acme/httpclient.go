@@ -0,0 +1,115 @@
+package acme
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DefaultHTTPTimeout limits requests to the ACME server if HTTPClientConfig doesn't set a timeout
+const DefaultHTTPTimeout = 30 * time.Second
+
+// HTTPClientConfig describes how to reach an ACME server, e.g. a private CA signed by a corporate root
+// or one reachable only through an egress proxy. Zero value gives the default client.
+type HTTPClientConfig struct {
+	// CABundle holds PEM encoded certificates trusted in addition to the system roots
+	CABundle []byte
+	// ClientCertificate and ClientKey are PEM encoded certificate and key presented to the ACME server; optional
+	ClientCertificate []byte
+	ClientKey         []byte
+	// ProxyURL is used for all requests; proxy from environment (HTTPS_PROXY, NO_PROXY) is used if empty
+	ProxyURL string
+	// Timeout limits each request including reading the response; 0 means DefaultHTTPTimeout
+	Timeout time.Duration
+}
+
+func (c *HTTPClientConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if len(c.CABundle) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(c.CABundle) {
+			return nil, errors.New("CA bundle doesn't contain any PEM encoded certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(c.ClientCertificate) > 0 || len(c.ClientKey) > 0 {
+		if len(c.ClientCertificate) == 0 || len(c.ClientKey) == 0 {
+			return nil, errors.New("client certificate and key have to be set together")
+		}
+		certificate, err := tls.X509KeyPair(c.ClientCertificate, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
+
+func (c *HTTPClientConfig) proxy() (func(*http.Request) (*url.URL, error), error) {
+	if c.ProxyURL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	proxyURL, err := url.Parse(c.ProxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL '%s': %s", c.ProxyURL, err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("invalid proxy URL '%s': unsupported scheme '%s'", c.ProxyURL, proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL '%s': missing host", c.ProxyURL)
+	}
+
+	return http.ProxyURL(proxyURL), nil
+}
+
+// NewHTTPClient returns a client to be used as acme.Client.HTTPClient
+func (c *HTTPClientConfig) NewHTTPClient() (*http.Client, error) {
+	if c.Timeout < 0 {
+		return nil, fmt.Errorf("timeout can't be negative, got %s", c.Timeout)
+	}
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultHTTPTimeout
+	}
+
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	proxy, err := c.proxy()
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy: proxy,
+			DialContext: (&net.Dialer{
+				Timeout:   timeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSClientConfig:       tlsConfig,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConns:          100,
+		},
+	}, nil
+}
@@ -0,0 +1,207 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/context"
+)
+
+// newTestClientCertificate returns PEM encoded CA certificate and a client certificate with key signed by it
+func newTestClientCertificate(t *testing.T) (caPEM, certPEM, keyPEM []byte) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test client CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "acme-controller"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer})
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return
+}
+
+func serveDirectory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"new-reg": "https://%s/acme/new-reg"}`, r.Host)
+}
+
+func TestHTTPClientConfig(t *testing.T) {
+	clientCA, clientCert, clientKey := newTestClientCertificate(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(clientCA)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", serveDirectory)
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		serveDirectory(w, r)
+	})
+	server := httptest.NewUnstartedServer(mux)
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+	serverCA := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.TLS.Certificates[0].Certificate[0]})
+
+	testTable := []struct {
+		name         string
+		config       HTTPClientConfig
+		path         string
+		invalid      bool
+		discoverFail bool
+	}{
+		{
+			name:         "untrusted server",
+			config:       HTTPClientConfig{ClientCertificate: clientCert, ClientKey: clientKey},
+			path:         "/directory",
+			discoverFail: true,
+		},
+		{
+			name:         "missing client certificate",
+			config:       HTTPClientConfig{CABundle: serverCA},
+			path:         "/directory",
+			discoverFail: true,
+		},
+		{
+			name:   "CA bundle and client certificate",
+			config: HTTPClientConfig{CABundle: serverCA, ClientCertificate: clientCert, ClientKey: clientKey},
+			path:   "/directory",
+		},
+		{
+			name:         "timeout",
+			config:       HTTPClientConfig{CABundle: serverCA, ClientCertificate: clientCert, ClientKey: clientKey, Timeout: 100 * time.Millisecond},
+			path:         "/slow",
+			discoverFail: true,
+		},
+		{
+			name:    "invalid CA bundle",
+			config:  HTTPClientConfig{CABundle: []byte("not a certificate")},
+			invalid: true,
+		},
+		{
+			name:    "client certificate without key",
+			config:  HTTPClientConfig{ClientCertificate: clientCert},
+			invalid: true,
+		},
+		{
+			name:    "client certificate with wrong key",
+			config:  HTTPClientConfig{ClientCertificate: clientCA, ClientKey: clientKey},
+			invalid: true,
+		},
+		{
+			name:    "unsupported proxy scheme",
+			config:  HTTPClientConfig{ProxyURL: "ftp://proxy.example.com"},
+			invalid: true,
+		},
+		{
+			name:    "negative timeout",
+			config:  HTTPClientConfig{Timeout: -time.Second},
+			invalid: true,
+		},
+	}
+
+	for _, item := range testTable {
+		httpClient, err := item.config.NewHTTPClient()
+		if item.invalid {
+			if err == nil {
+				t.Errorf("%s: expected an error", item.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", item.name, err)
+			continue
+		}
+
+		client := &acme.Client{
+			DirectoryURL: server.URL + item.path,
+			HTTPClient:   httpClient,
+		}
+		directory, err := client.Discover(context.Background())
+		if item.discoverFail {
+			if err == nil {
+				t.Errorf("%s: expected discovery to fail", item.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", item.name, err)
+			continue
+		}
+		if directory.RegURL != server.URL+"/acme/new-reg" {
+			t.Errorf("%s: unexpected directory %#v", item.name, directory)
+		}
+	}
+}
+
+func TestHTTPClientConfigProxy(t *testing.T) {
+	proxied := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied <- r.URL.String()
+		serveDirectory(w, r)
+	}))
+	defer proxy.Close()
+
+	httpClient, err := (&HTTPClientConfig{ProxyURL: proxy.URL}).NewHTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &acme.Client{
+		DirectoryURL: "http://acme.example.com/directory",
+		HTTPClient:   httpClient,
+	}
+	if _, err := client.Discover(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if url := <-proxied; url != client.DirectoryURL {
+		t.Errorf("expected proxy to get request for %q, got %q", client.DirectoryURL, url)
+	}
+}
@@ -2,21 +2,103 @@ package cert
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"reflect"
+	"strings"
 	"time"
 )
 
+type KeyType string
+
+const (
+	KeyTypeRSA2048  KeyType = "rsa2048"
+	KeyTypeRSA4096  KeyType = "rsa4096"
+	KeyTypeECDSA256 KeyType = "ecdsa256"
+	KeyTypeECDSA384 KeyType = "ecdsa384"
+
+	DefaultKeyType = KeyTypeRSA4096
+)
+
+func ParseKeyType(s string) (KeyType, error) {
+	switch t := KeyType(s); t {
+	case KeyTypeRSA2048, KeyTypeRSA4096, KeyTypeECDSA256, KeyTypeECDSA384:
+		return t, nil
+	case "":
+		return DefaultKeyType, nil
+	default:
+		return "", fmt.Errorf("unsupported key type '%s'", s)
+	}
+}
+
+func GeneratePrivateKey(t KeyType) (crypto.Signer, error) {
+	switch t {
+	case KeyTypeRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyTypeRSA4096, "":
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case KeyTypeECDSA256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeECDSA384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported key type '%s'", t)
+	}
+}
+
+func EncodePrivateKey(key crypto.Signer) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(k),
+		}), nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{
+			Type:  "EC PRIVATE KEY",
+			Bytes: der,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type '%s'", reflect.TypeOf(key))
+	}
+}
+
+func DecodePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM encoded private key found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported private key type '%s'", block.Type)
+	}
+}
+
 type Certificate struct {
 	Crt         []byte            // PEM encoded
 	Key         []byte            // PEM encoded
 	Certificate *x509.Certificate `json:"-"`
+	// IssuerUrl is the directory URL of the ACME server which issued the certificate; empty if unknown
+	IssuerUrl string `json:",omitempty"`
 }
 
-func NewCertificateFromDER(der [][]byte, privateKey *rsa.PrivateKey) (certificate *Certificate, err error) {
+func NewCertificateFromDER(der [][]byte, privateKey crypto.Signer) (certificate *Certificate, err error) {
 	if len(der) < 1 {
 		err = errors.New("can't create certificate from empty DER array")
 		return
@@ -40,15 +122,79 @@ func NewCertificateFromDER(der [][]byte, privateKey *rsa.PrivateKey) (certificat
 	}
 	certificate.Crt = certBuffer.Bytes()
 
-	keyPem := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
-	})
-	certificate.Key = keyPem
+	certificate.Key, err = EncodePrivateKey(privateKey)
+	if err != nil {
+		return
+	}
 
 	return
 }
 
+// splitCrt returns every PEM encoded certificate from Crt as a separate item
+func (c *Certificate) splitCrt() (certificates [][]byte) {
+	rest := c.Crt
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		certificates = append(certificates, pem.EncodeToMemory(block))
+	}
+}
+
+// JoinPEM concatenates PEM encoded parts making sure every non-empty part ends with a newline
+// so the END line of one block doesn't run into the BEGIN line of the next one
+func JoinPEM(parts ...string) []byte {
+	var buf bytes.Buffer
+	for _, part := range parts {
+		if part == "" {
+			continue
+		}
+		buf.WriteString(part)
+		if !strings.HasSuffix(part, "\n") {
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+// Leaf returns PEM encoded leaf certificate
+func (c *Certificate) Leaf() []byte {
+	certificates := c.splitCrt()
+	if len(certificates) < 1 {
+		return nil
+	}
+
+	return certificates[0]
+}
+
+// Chain returns PEM encoded intermediate certificates (everything in Crt but the leaf)
+func (c *Certificate) Chain() []byte {
+	certificates := c.splitCrt()
+	if len(certificates) < 2 {
+		return nil
+	}
+
+	return bytes.Join(certificates[1:], nil)
+}
+
+// CA returns PEM encoded top-most certificate of the chain returned by ACME server. It's the leaf's issuer
+// only if the chain has a single intermediate and it's nil if the chain holds just the leaf.
+func (c *Certificate) CA() []byte {
+	certificates := c.splitCrt()
+	if len(certificates) < 2 {
+		return nil
+	}
+
+	return certificates[len(certificates)-1]
+}
+
 func (c *Certificate) UpdateTargetCertificate() (err error) {
 	block, _ := pem.Decode(c.Crt)
 	if block == nil {
@@ -88,6 +234,22 @@ func (c *Certificate) IsValid(t time.Time) bool {
 	return IsValid(c, t)
 }
 
+// String describes the certificate without the private key so it can be logged
+func (c *Certificate) String() string {
+	if c == nil {
+		return "<nil>"
+	}
+	if c.Certificate == nil {
+		return "Certificate{unparsed}"
+	}
+	return fmt.Sprintf("Certificate{domains: %v, serial: %s, notBefore: %s, notAfter: %s}", c.Domains(), c.Certificate.SerialNumber, c.Certificate.NotBefore, c.Certificate.NotAfter)
+}
+
+// GoString makes %#v safe to log as well
+func (c *Certificate) GoString() string {
+	return c.String()
+}
+
 func IsValid(c *Certificate, t time.Time) bool {
 	return !(t.Before(c.Certificate.NotBefore) || t.After(c.Certificate.NotAfter))
 }
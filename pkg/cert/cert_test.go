@@ -0,0 +1,154 @@
+package cert
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestChain returns PEM encoded leaf, intermediate and root certificates
+func newTestChain(t *testing.T) (leaf, intermediate, root string) {
+	now := time.Now()
+	issue := func(serial int64, name string, ca bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(serial),
+			Subject:               pkix.Name{CommonName: name},
+			NotBefore:             now.Add(-time.Hour),
+			NotAfter:              now.Add(time.Hour),
+			IsCA:                  ca,
+			BasicConstraintsValid: true,
+		}
+		if parent == nil {
+			parent, parentKey = template, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certificate, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return certificate, key, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	}
+
+	rootCert, rootKey, root := issue(1, "root", true, nil, nil)
+	intermediateCert, intermediateKey, intermediate := issue(2, "intermediate", true, rootCert, rootKey)
+	_, _, leaf = issue(3, "app.example.com", false, intermediateCert, intermediateKey)
+	return
+}
+
+func TestCertificateParts(t *testing.T) {
+	leaf, intermediate, root := newTestChain(t)
+
+	testTable := []struct {
+		name          string
+		crt           []byte
+		expectedLeaf  string
+		expectedChain string
+		expectedCA    string
+	}{
+		{
+			name: "empty",
+			crt:  nil,
+		},
+		{
+			name:         "leaf only",
+			crt:          []byte(leaf),
+			expectedLeaf: leaf,
+		},
+		{
+			name:          "leaf with its issuer",
+			crt:           []byte(leaf + intermediate),
+			expectedLeaf:  leaf,
+			expectedChain: intermediate,
+			expectedCA:    intermediate,
+		},
+		{
+			// the top of the chain, not the leaf's issuer
+			name:          "leaf with intermediates",
+			crt:           []byte(leaf + intermediate + root),
+			expectedLeaf:  leaf,
+			expectedChain: intermediate + root,
+			expectedCA:    root,
+		},
+		{
+			name:          "leaf missing trailing newline",
+			crt:           JoinPEM(strings.TrimSuffix(leaf, "\n"), intermediate),
+			expectedLeaf:  leaf,
+			expectedChain: intermediate,
+			expectedCA:    intermediate,
+		},
+		{
+			name:          "leaf and chain missing trailing newline",
+			crt:           JoinPEM(strings.TrimSuffix(leaf, "\n"), strings.TrimSuffix(intermediate+root, "\n")),
+			expectedLeaf:  leaf,
+			expectedChain: intermediate + root,
+			expectedCA:    root,
+		},
+	}
+
+	for _, item := range testTable {
+		c := &Certificate{Crt: item.crt}
+		if got := c.Leaf(); !bytes.Equal(got, []byte(item.expectedLeaf)) {
+			t.Errorf("%s: expected leaf %q, got %q", item.name, item.expectedLeaf, got)
+		}
+		if got := c.Chain(); !bytes.Equal(got, []byte(item.expectedChain)) {
+			t.Errorf("%s: expected chain %q, got %q", item.name, item.expectedChain, got)
+		}
+		if got := c.CA(); !bytes.Equal(got, []byte(item.expectedCA)) {
+			t.Errorf("%s: expected CA %q, got %q", item.name, item.expectedCA, got)
+		}
+	}
+}
+
+func TestJoinPEM(t *testing.T) {
+	testTable := []struct {
+		name     string
+		parts    []string
+		expected string
+	}{
+		{
+			name:     "empty",
+			expected: "",
+		},
+		{
+			name:     "with newlines",
+			parts:    []string{"a\n", "b\n"},
+			expected: "a\nb\n",
+		},
+		{
+			name:     "missing newline",
+			parts:    []string{"a", "b"},
+			expected: "a\nb\n",
+		},
+		{
+			name:     "single part",
+			parts:    []string{"a"},
+			expected: "a\n",
+		},
+		{
+			name:     "empty part",
+			parts:    []string{"a\n", ""},
+			expected: "a\n",
+		},
+	}
+
+	for _, item := range testTable {
+		if got := string(JoinPEM(item.parts...)); got != item.expected {
+			t.Errorf("%s: expected %q, got %q", item.name, item.expected, got)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package cert
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	maxOCSPResponseSize = 1 << 20
+)
+
+// ErrNoOCSPServer is returned for certificates which don't list an OCSP responder
+var ErrNoOCSPServer = errors.New("certificate doesn't list an OCSP responder")
+
+// Issuer returns the certificate which signed the leaf; it is the first certificate of the chain
+func (c *Certificate) Issuer() (*x509.Certificate, error) {
+	certificates := c.splitCrt()
+	if len(certificates) < 2 {
+		return nil, errors.New("certificate chain doesn't contain the issuer")
+	}
+
+	block, _ := pem.Decode(certificates[1])
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// CheckOCSP asks the OCSP responder listed in the certificate for its revocation status.
+// The response is verified to be signed by the issuer or a responder it delegated to.
+func (c *Certificate) CheckOCSP(ctx context.Context, client *http.Client) (*ocsp.Response, error) {
+	if c.Certificate == nil {
+		if err := c.UpdateTargetCertificate(); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.Certificate.OCSPServer) == 0 {
+		return nil, ErrNoOCSPServer
+	}
+	issuer, err := c.Issuer()
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := ocsp.CreateRequest(c.Certificate, issuer, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create OCSP request: %s", err)
+	}
+
+	server := c.Certificate.OCSPServer[0]
+	req, err := http.NewRequest("POST", server, bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder '%s' returned status %d", server, res.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxOCSPResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := ocsp.ParseResponseForCert(body, c.Certificate, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response from OCSP responder '%s': %s", server, err)
+	}
+
+	return response, nil
+}
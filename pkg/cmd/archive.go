@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/go-playground/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	cmdutil "github.com/tnozicka/openshift-acme/pkg/cmd/util"
+	"github.com/tnozicka/openshift-acme/pkg/openshift/archive"
+)
+
+const (
+	Flag_PassphraseFile_Key = "passphrase-file"
+	Flag_NamespaceMap_Key   = "namespace-map"
+	Flag_Overwrite_Key      = "overwrite"
+)
+
+func readPassphrase(cmd *cobra.Command) ([]byte, error) {
+	path, _ := cmd.Flags().GetString(Flag_PassphraseFile_Key)
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimRight(data, "\r\n"), nil
+}
+
+func NewExportCommand(v *viper.Viper, out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export ACME accounts and certificates",
+		Long:  "Export ACME account secrets (key, URL, contacts and certificate records) and certificate secrets of managed routes from namespaces selected by --" + Flag_Watchnamespace_Key + " into an archive",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 0 {
+				return cmdutil.UsageError(cmd, "Unexpected args: %v", args)
+			}
+
+			passphrase, err := readPassphrase(cmd)
+			if err != nil {
+				return err
+			}
+			if len(passphrase) == 0 {
+				log.Warn("Archive won't be encrypted; it contains private keys")
+			}
+
+			clientset, err := newClientset(v)
+			if err != nil {
+				return err
+			}
+
+			a, err := archive.Collect(clientset.CoreV1(), namespacesFromViper(v))
+			if err != nil {
+				return err
+			}
+			log.Infof("Exporting %d secret(s)", len(a.Secrets))
+
+			w := out
+			path, _ := cmd.Flags().GetString(cmdutil.Flag_File_Key)
+			if path != "-" {
+				f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				w = f
+			}
+
+			return a.Encode(w, passphrase)
+		},
+	}
+
+	cmd.Flags().StringP(cmdutil.Flag_File_Key, "f", "-", "File to write the archive to; '-' means standard output")
+	cmd.Flags().StringP(Flag_PassphraseFile_Key, "", "", "File containing passphrase to encrypt the archive with")
+
+	return cmd
+}
+
+func NewImportCommand(v *viper.Viper, in io.Reader) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import",
+		Short: "Import ACME accounts and certificates",
+		Long:  "Import ACME accounts and certificate secrets from an archive created by export",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 0 {
+				return cmdutil.UsageError(cmd, "Unexpected args: %v", args)
+			}
+
+			mapping := make(map[string]string)
+			items, _ := cmd.Flags().GetStringSlice(Flag_NamespaceMap_Key)
+			for _, item := range items {
+				parts := strings.SplitN(item, "=", 2)
+				if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+					return cmdutil.UsageError(cmd, "Invalid namespace mapping '%s'; expected 'old=new'", item)
+				}
+				mapping[parts[0]] = parts[1]
+			}
+
+			passphrase, err := readPassphrase(cmd)
+			if err != nil {
+				return err
+			}
+
+			r := in
+			path, _ := cmd.Flags().GetString(cmdutil.Flag_File_Key)
+			if path != "-" {
+				f, err := os.Open(path)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				r = f
+			}
+
+			a, err := archive.Decode(r, passphrase)
+			if err != nil {
+				return err
+			}
+
+			if err := a.RemapNamespaces(mapping); err != nil {
+				return err
+			}
+
+			clientset, err := newClientset(v)
+			if err != nil {
+				return err
+			}
+
+			overwrite, _ := cmd.Flags().GetBool(Flag_Overwrite_Key)
+			log.Infof("Importing %d secret(s) exported at %s", len(a.Secrets), a.Created)
+			return a.Restore(clientset.CoreV1(), overwrite)
+		},
+	}
+
+	cmd.Flags().StringP(cmdutil.Flag_File_Key, "f", "-", "File to read the archive from; '-' means standard input")
+	cmd.Flags().StringP(Flag_PassphraseFile_Key, "", "", "File containing passphrase the archive was encrypted with")
+	cmd.Flags().StringSliceP(Flag_NamespaceMap_Key, "", []string{}, "Restore secrets from namespace 'old' into 'new'; format 'old=new'")
+	cmd.Flags().BoolP(Flag_Overwrite_Key, "", false, "Replace secrets which already exist in the target cluster")
+
+	return cmd
+}
@@ -3,12 +3,15 @@ package cmd
 import (
 	"context"
 	"errors"
+	"expvar"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/go-playground/log"
 	"github.com/go-playground/log/handlers/console"
@@ -17,6 +20,8 @@ import (
 	"github.com/tnozicka/openshift-acme/pkg/acme"
 	"github.com/tnozicka/openshift-acme/pkg/acme/challengeexposers"
 	cmdutil "github.com/tnozicka/openshift-acme/pkg/cmd/util"
+	"github.com/tnozicka/openshift-acme/pkg/dryrun"
+	"github.com/tnozicka/openshift-acme/pkg/logging"
 	acme_controller "github.com/tnozicka/openshift-acme/pkg/openshift/controllers/acme"
 	route_controller "github.com/tnozicka/openshift-acme/pkg/openshift/controllers/route"
 	"k8s.io/client-go/kubernetes"
@@ -24,25 +29,43 @@ import (
 )
 
 const (
+	Flag_Config_Key               = "config"
 	Flag_LogLevel_Key             = "loglevel"
+	Flag_LogFormat_Key            = "log-format"
 	Flag_Kubeconfig_Key           = "kubeconfig"
 	Flag_Masterurl_Key            = "masterurl"
 	Flag_Listen_Key               = "listen"
+	Flag_DebugListen_Key          = "debug-listen"
 	Flag_Acmeurl_Key              = "acmeurl"
+	Flag_AcmeCaBundle_Key         = "acme-ca-bundle"
+	Flag_AcmeClientCert_Key       = "acme-client-cert"
+	Flag_AcmeClientKey_Key        = "acme-client-key"
+	Flag_AcmeProxy_Key            = "acme-proxy"
+	Flag_AcmeTimeout_Key          = "acme-timeout"
+	Flag_Contact_Key              = "contact"
+	Flag_SharedAccount_Key        = "shared-account"
+	Flag_SecretLifecycle_Key      = "secret-lifecycle"
+	Flag_RouterShardLabels_Key    = "router-shard-labels"
+	Flag_RelistInterval_Key       = "relist-interval"
+	Flag_DryRun_Key               = "dry-run"
+	Flag_RenewalCheckInterval_Key = "renewal-check-interval"
+	Flag_RetryInterval_Key        = "retry-interval"
+	Flag_RenewalFraction_Key      = "renewal-fraction"
+	Flag_MaxTries_Key             = "max-tries"
+	Flag_OcspCheckInterval_Key    = "ocsp-check-interval"
+	Flag_IssuanceConcurrency_Key  = "issuance-concurrency"
+	Flag_MonitorRoutes_Key        = "monitor-routes"
+	Flag_MonitorExpiryWarning_Key = "monitor-expiry-warning"
+	Flag_DnsHook_Key              = "dns-hook"
 	Flag_Selfservicename_Key      = "selfservicename"
 	Flag_Selfservicenamespace_Key = "selfservicenamespace"
 	Flag_Watchnamespace_Key       = "watch-namespace"
-)
-
-func loglevelToLevels(level int) []log.Level {
-	if level >= len(log.AllLevels) {
-		level = len(log.AllLevels)
-	}
 
-	r := []log.Level{}
-	r = append(r, log.AllLevels[len(log.AllLevels)-level:]...)
-	return r
-}
+	// DryRunPath serves changes planned in dry-run mode
+	DryRunPath = "/dry-run"
+	// MetricsPath serves counters like revoked certificates, issuance queue depth and monitored route certificates as JSON
+	MetricsPath = "/debug/vars"
+)
 
 func NewOpenShiftAcmeCommand(in io.Reader, out, err io.Writer) *cobra.Command {
 	v := viper.New()
@@ -51,6 +74,8 @@ func NewOpenShiftAcmeCommand(in io.Reader, out, err io.Writer) *cobra.Command {
 	replacer := strings.NewReplacer("-", "_")
 	v.SetEnvKeyReplacer(replacer)
 
+	var levelFilter *logging.LevelFilter
+
 	// Parent command to which all subcommands are added.
 	rootCmd := &cobra.Command{
 		Use:   "openshift-acme",
@@ -61,23 +86,64 @@ func NewOpenShiftAcmeCommand(in io.Reader, out, err io.Writer) *cobra.Command {
 				return cmdutil.UsageError(cmd, "Unexpected args: %v", args)
 			}
 
-			return RunServer(v, cmd, out)
+			return RunServer(v, cmd, out, levelFilter)
 		},
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 			// We have to bind Viper in Run because there is only one instance to avoid collisions
-			cmdutil.BindViper(v, cmd.PersistentFlags(), Flag_LogLevel_Key)
-			cmdutil.BindViper(v, cmd.PersistentFlags(), Flag_Kubeconfig_Key)
-			cmdutil.BindViper(v, cmd.PersistentFlags(), Flag_Masterurl_Key)
-			cmdutil.BindViper(v, cmd.PersistentFlags(), Flag_Listen_Key)
-			cmdutil.BindViper(v, cmd.PersistentFlags(), Flag_Acmeurl_Key)
-			cmdutil.BindViper(v, cmd.PersistentFlags(), Flag_Selfservicename_Key)
-			cmdutil.BindViper(v, cmd.PersistentFlags(), Flag_Selfservicenamespace_Key)
-			cmdutil.BindViper(v, cmd.PersistentFlags(), Flag_Watchnamespace_Key)
-
-			// Setup logger
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_Config_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_LogLevel_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_LogFormat_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_Kubeconfig_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_Masterurl_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_Listen_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_DebugListen_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_Acmeurl_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_AcmeCaBundle_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_AcmeClientCert_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_AcmeClientKey_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_AcmeProxy_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_AcmeTimeout_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_Contact_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_SharedAccount_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_SecretLifecycle_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_RouterShardLabels_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_RelistInterval_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_DryRun_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_RenewalCheckInterval_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_RetryInterval_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_RenewalFraction_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_MaxTries_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_OcspCheckInterval_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_IssuanceConcurrency_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_MonitorRoutes_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_MonitorExpiryWarning_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_DnsHook_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_Selfservicename_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_Selfservicenamespace_Key)
+			cmdutil.BindViper(v, cmd.Root().PersistentFlags(), Flag_Watchnamespace_Key)
+
+			// Flags and environment take precedence over the config file
+			configFile := v.GetString(Flag_Config_Key)
+			if configFile != "" {
+				v.SetConfigFile(configFile)
+				if err := v.ReadInConfig(); err != nil {
+					return fmt.Errorf("unable to read config file '%s': %s", configFile, err)
+				}
+			}
+
+			// Setup logger; it is registered for all levels so the loglevel can be changed while running
+			var handler log.Handler
+			switch format := v.GetString(Flag_LogFormat_Key); format {
+			case logging.FormatConsole:
+				handler = console.New()
+			case logging.FormatJSON:
+				handler = logging.NewJSON(os.Stderr)
+			default:
+				return cmdutil.UsageError(cmd, "Unsupported log format '%s'", format)
+			}
 			loglevel := v.GetInt(Flag_LogLevel_Key)
-			cLog := console.New()
-			log.RegisterHandler(cLog, loglevelToLevels(loglevel)...)
+			levelFilter = logging.NewLevelFilter(logging.NewRedactor(handler), loglevel)
+			log.RegisterHandler(levelFilter, log.AllLevels...)
 
 			return nil
 		},
@@ -85,19 +151,59 @@ func NewOpenShiftAcmeCommand(in io.Reader, out, err io.Writer) *cobra.Command {
 		SilenceUsage:  true,
 	}
 
+	rootCmd.PersistentFlags().StringP(Flag_Config_Key, "", "", "Path to YAML or JSON config file with keys named like these flags; flags and environment take precedence. The file is watched and changes of '"+strings.Join(liveConfigKeys, "', '")+"' are applied without restart.")
 	rootCmd.PersistentFlags().Int8P(Flag_LogLevel_Key, "", 8, "Set loglevel")
+	rootCmd.PersistentFlags().StringP(Flag_LogFormat_Key, "", logging.FormatConsole, "Log format: '"+logging.FormatConsole+"' or '"+logging.FormatJSON+"'. Private keys and key authorizations are redacted in both.")
 	rootCmd.PersistentFlags().StringP(Flag_Kubeconfig_Key, "", "", "Absolute path to the kubeconfig file")
 	rootCmd.PersistentFlags().StringP(Flag_Masterurl_Key, "", "", "Kubernetes master URL")
 	rootCmd.PersistentFlags().StringP(Flag_Listen_Key, "", "0.0.0.0:5000", "Listen address for http-01 server")
+	rootCmd.PersistentFlags().StringP(Flag_DebugListen_Key, "", "", "Listen address for metrics at '"+MetricsPath+"' and planned changes at '"+DryRunPath+"'. Disabled if empty. Don't expose it through the controller's Service.")
 	rootCmd.PersistentFlags().StringP(Flag_Acmeurl_Key, "", "https://acme-staging.api.letsencrypt.org/directory", "ACME URL like https://acme-v01.api.letsencrypt.org/directory")
+	rootCmd.PersistentFlags().StringP(Flag_AcmeCaBundle_Key, "", "", "Path to PEM encoded CA certificates trusted for the ACME server in addition to the system roots.")
+	rootCmd.PersistentFlags().StringP(Flag_AcmeClientCert_Key, "", "", "Path to PEM encoded client certificate presented to the ACME server. Requires --"+Flag_AcmeClientKey_Key+".")
+	rootCmd.PersistentFlags().StringP(Flag_AcmeClientKey_Key, "", "", "Path to PEM encoded key of the client certificate.")
+	rootCmd.PersistentFlags().StringP(Flag_AcmeProxy_Key, "", "", "Proxy URL for requests to the ACME server. Defaults to HTTPS_PROXY and NO_PROXY from environment.")
+	rootCmd.PersistentFlags().DurationP(Flag_AcmeTimeout_Key, "", acme.DefaultHTTPTimeout, "Timeout of a single request to the ACME server.")
+	rootCmd.PersistentFlags().StringSliceP(Flag_Contact_Key, "", []string{}, "Contact email(s) used when registering ACME accounts. Can be overridden per namespace with annotation '"+acme_controller.AnnotationNamespaceContactsKey+"'.")
+	rootCmd.PersistentFlags().BoolP(Flag_SharedAccount_Key, "", false, "Use a single ACME account stored in the controller's namespace (selfservicenamespace) for all namespaces instead of one account per namespace.")
+	rootCmd.PersistentFlags().StringP(Flag_SecretLifecycle_Key, "", string(acme_controller.DefaultLifecyclePolicy), "What happens to generated secrets when a route is deleted or stops being managed: 'retain', 'delete' or 'revoke-and-delete'. Can be overridden per route with annotation '"+route_controller.AnnotationLifecyclePolicyKey+"'.")
+	rootCmd.PersistentFlags().StringSliceP(Flag_RouterShardLabels_Key, "", []string{}, "Keys of route labels your router shards select routes by. Only these labels are copied from a route onto the temporary route exposing its http-01 challenge.")
+	rootCmd.PersistentFlags().DurationP(Flag_RelistInterval_Key, "", 30*time.Minute, "How often to list all routes and reconcile them with tracked state. Routes are always relisted at startup and when the watch expires. 0 disables periodic relisting.")
+	rootCmd.PersistentFlags().BoolP(Flag_DryRun_Key, "", false, "Only log and report planned changes at '"+DryRunPath+"' on --"+Flag_DebugListen_Key+"; nothing is sent to the ACME server or written to the API.")
+	rootCmd.PersistentFlags().DurationP(Flag_RenewalCheckInterval_Key, "", 5*time.Minute, "How often certificates are checked for renewal.")
+	rootCmd.PersistentFlags().DurationP(Flag_RetryInterval_Key, "", 5*time.Minute, "How often failed attempts to obtain a certificate are retried.")
+	rootCmd.PersistentFlags().Float64P(Flag_RenewalFraction_Key, "", 2.0/3.0, "Fraction of certificate lifetime after which the certificate is renewed.")
+	rootCmd.PersistentFlags().IntP(Flag_MaxTries_Key, "", 20, "How many times obtaining a certificate is retried before giving up.")
+	rootCmd.PersistentFlags().DurationP(Flag_OcspCheckInterval_Key, "", time.Hour, "How often certificates are checked for revocation with OCSP. Revoked certificates are replaced immediately. 0 disables the checks.")
+	rootCmd.PersistentFlags().IntP(Flag_IssuanceConcurrency_Key, "", acme_controller.DefaultIssuanceConcurrency, "How many certificates are obtained at the same time. Others wait in a queue ordered by priority (expiring soon, new, renewal) and fairly across namespaces.")
+	rootCmd.PersistentFlags().BoolP(Flag_MonitorRoutes_Key, "", false, "Parse certificates of all routes, including those without 'kubernetes.io/tls-acme' annotation, and report expiring, expired and invalid ones and those not covering the route's host as events and at '"+MetricsPath+"'.")
+	rootCmd.PersistentFlags().DurationP(Flag_MonitorExpiryWarning_Key, "", route_controller.DefaultExpiryWarning, "How long before expiry monitored certificates are reported as expiring.")
+	rootCmd.PersistentFlags().StringP(Flag_DnsHook_Key, "", "", "Program managing TXT records at your DNS provider, called as '<hook> present|cleanup <fqdn> <value>'. Enables dns-01 challenges for routes and the '"+ChallengeDns01+"' mode of obtain.")
 	rootCmd.PersistentFlags().StringP(Flag_Selfservicename_Key, "", "acme-controller", "Name of the service pointing to a pod with this program.")
 	rootCmd.PersistentFlags().StringSliceP(Flag_Watchnamespace_Key, "w", []string{""}, "Restrics controller to namespace. If not specified controller watches for routes accross namespaces.")
 	rootCmd.PersistentFlags().StringP(Flag_Selfservicenamespace_Key, "", "", "Namespace of the service pointing to a pod with this program. Defaults to current namespace this program is running inside; if run outside of the cluster defaults to 'default' namespace")
 
+	rootCmd.AddCommand(NewStatusCommand(v, out))
+	rootCmd.AddCommand(NewObtainCommand(v, out))
+	rootCmd.AddCommand(NewExportCommand(v, out))
+	rootCmd.AddCommand(NewImportCommand(v, in))
+
 	return rootCmd
 }
 
-func RunServer(v *viper.Viper, cmd *cobra.Command, out io.Writer) error {
+func newClientset(v *viper.Viper) (*kubernetes.Clientset, error) {
+	kubeConfigPath := v.GetString(Flag_Kubeconfig_Key)
+	masterUrl := v.GetString(Flag_Masterurl_Key)
+	// use the current context in kubeconfig
+	config, err := clientcmd.BuildConfigFromFlags(masterUrl, kubeConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	// create the clientset
+	return kubernetes.NewForConfig(config)
+}
+
+func RunServer(v *viper.Viper, cmd *cobra.Command, out io.Writer, levelFilter *logging.LevelFilter) error {
 	defer log.Trace("Controller finished").End()
 	log.Info("Starting controller")
 
@@ -111,27 +217,66 @@ func RunServer(v *viper.Viper, cmd *cobra.Command, out io.Writer) error {
 	acmeUrl := v.GetString(Flag_Acmeurl_Key)
 	log.Infof("ACME server url is '%s'", acmeUrl)
 
-	kubeConfigPath := v.GetString(Flag_Kubeconfig_Key)
-	masterUrl := v.GetString(Flag_Masterurl_Key)
-	// use the current context in kubeconfig
-	config, err := clientcmd.BuildConfigFromFlags(masterUrl, kubeConfigPath)
+	httpClientConfig, err := httpClientConfigFromViper(v)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	// create the clientset
-	clientset, err := kubernetes.NewForConfig(config)
+
+	clientset, err := newClientset(v)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	watchNamespaces := v.GetStringSlice(Flag_Watchnamespace_Key)
-	// spf13/cobra (sadly) treats []string{""} as []string{} => we need to fix it!
-	if len(watchNamespaces) == 0 {
-		watchNamespaces = []string{""}
+	watchNamespaces := namespacesFromViper(v)
+	log.Debugf("namespaces: %q", watchNamespaces)
+
+	selfServiceNamespace := v.GetString(Flag_Selfservicenamespace_Key)
+	if selfServiceNamespace == "" {
+		namespace, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+		if err != nil {
+			selfServiceNamespace = "default"
+			log.Warnf("Unable to autodetect service namespace. Defaulting to namespace '%s'. Error: %s", selfServiceNamespace, err)
+		} else {
+			selfServiceNamespace = string(namespace)
+		}
+	}
+
+	contacts := v.GetStringSlice(Flag_Contact_Key)
+	log.Infof("ACME account contacts are %v", contacts)
+
+	sharedAccountNamespace := ""
+	if v.GetBool(Flag_SharedAccount_Key) {
+		sharedAccountNamespace = selfServiceNamespace
+		log.Infof("Using shared ACME account from namespace '%s'", sharedAccountNamespace)
+	}
+
+	lifecyclePolicy, err := acme_controller.ParseLifecyclePolicy(v.GetString(Flag_SecretLifecycle_Key))
+	if err != nil {
+		return err
 	}
-	log.Debugf("namespaces: %#v", watchNamespaces)
+	log.Infof("Default secret lifecycle policy is '%s'", lifecyclePolicy)
 
-	ac := acme_controller.NewAcmeController(ctx, clientset.CoreV1(), acmeUrl, watchNamespaces)
+	renewalPolicy, err := renewalPolicyFromViper(v)
+	if err != nil {
+		return err
+	}
+	log.Infof("Renewal policy is %+v", renewalPolicy)
+
+	var dryRun *dryrun.Recorder
+	if v.GetBool(Flag_DryRun_Key) {
+		log.Warn("Running in dry-run mode; no changes will be made")
+		dryRun = dryrun.NewRecorder()
+	}
+
+	ac := acme_controller.NewAcmeController(ctx, clientset.CoreV1(), acmeUrl, contacts, sharedAccountNamespace, watchNamespaces, dryRun)
+	ac.SetRenewalPolicy(renewalPolicy)
+	ac.SetHTTPClientConfig(httpClientConfig)
+	issuanceConcurrency, err := issuanceConcurrencyFromViper(v)
+	if err != nil {
+		return err
+	}
+	ac.IssuanceQueue().SetConcurrency(issuanceConcurrency)
+	expvar.Publish(acme_controller.MetricIssuanceQueue, ac.IssuanceQueue())
 	log.Info("AcmeController bootstraping DB")
 	bootstrapTrace := log.Trace("AcmeController bootstraping DB finished")
 	if err := ac.BootstrapDB(true, true); err != nil {
@@ -150,25 +295,38 @@ func RunServer(v *viper.Viper, cmd *cobra.Command, out io.Writer) error {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if debugAddr := v.GetString(Flag_DebugListen_Key); debugAddr != "" {
+		if _, err := serveDebug(ctx, debugAddr, dryRun); err != nil {
+			return fmt.Errorf("unable to serve debug endpoints on '%s': %s", debugAddr, err)
+		}
+	}
 	challengeExposers := map[string]acme.ChallengeExposer{
 		"http-01": http01,
 	}
-
-	selfServiceNamespace := v.GetString(Flag_Selfservicenamespace_Key)
-	if selfServiceNamespace == "" {
-		namespace, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
-		if err != nil {
-			selfServiceNamespace = "default"
-			log.Warnf("Unable to autodetect service namespace. Defaulting to namespace '%s'. Error: %s", selfServiceNamespace, err)
-		} else {
-			selfServiceNamespace = string(namespace)
+	dnsHook := v.GetString(Flag_DnsHook_Key)
+	if dnsHook != "" {
+		log.Infof("Enabling dns-01 challenges using hook '%s'", dnsHook)
+		challengeExposers["dns-01"] = &challengeexposers.Dns01Hook{
+			Command: dnsHook,
+			DryRun:  dryRun,
 		}
 	}
+
 	selfService := route_controller.ServiceID{
 		Name:      v.GetString(Flag_Selfservicename_Key),
 		Namespace: selfServiceNamespace,
 	}
-	rc, err := route_controller.NewRouteController(ctx, clientset.CoreV1(), ac, challengeExposers, selfService, watchNamespaces)
+	var monitor *route_controller.Monitor
+	if v.GetBool(Flag_MonitorRoutes_Key) {
+		expiryWarning := v.GetDuration(Flag_MonitorExpiryWarning_Key)
+		if expiryWarning < 0 {
+			return fmt.Errorf("--%s can't be negative, got %s", Flag_MonitorExpiryWarning_Key, expiryWarning)
+		}
+		log.Infof("Monitoring certificates of all routes; expiring ones are reported %s before expiry", expiryWarning)
+		monitor = route_controller.NewMonitor(expiryWarning)
+		expvar.Publish(route_controller.MetricRouteCertificates, monitor)
+	}
+	rc, err := route_controller.NewRouteController(ctx, clientset.CoreV1(), ac, challengeExposers, selfService, watchNamespaces, lifecyclePolicy, v.GetStringSlice(Flag_RouterShardLabels_Key), v.GetDuration(Flag_RelistInterval_Key), dryRun, monitor)
 	if err != nil {
 		log.Errorf("Couln't initialize RouteController: '%s'", err)
 		return err
@@ -179,6 +337,15 @@ func RunServer(v *viper.Viper, cmd *cobra.Command, out io.Writer) error {
 	defer cancel()
 	log.Info("RouteController started")
 
+	configFile := v.ConfigFileUsed()
+	if configFile != "" {
+		reloader := newConfigReloader(v, ac, levelFilter)
+		if err := watchConfig(ctx, configFile, reloader.reload); err != nil {
+			return fmt.Errorf("unable to watch config file '%s': %s", configFile, err)
+		}
+		log.Infof("Watching config file '%s' for changes", configFile)
+	}
+
 	acDone := make(chan struct{}, 1)
 	go func() {
 		ac.Wait()
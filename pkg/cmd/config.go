@@ -0,0 +1,232 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-playground/log"
+	"github.com/spf13/viper"
+	"github.com/tnozicka/openshift-acme/pkg/acme"
+	"github.com/tnozicka/openshift-acme/pkg/logging"
+	acme_controller "github.com/tnozicka/openshift-acme/pkg/openshift/controllers/acme"
+)
+
+const (
+	// configMapDataDir is the symlink Kubernetes atomically swaps when a mounted ConfigMap changes
+	configMapDataDir = "..data"
+)
+
+// liveConfigKeys can be changed in the config file while running
+var liveConfigKeys = []string{
+	Flag_LogLevel_Key,
+	Flag_RenewalCheckInterval_Key,
+	Flag_RetryInterval_Key,
+	Flag_RenewalFraction_Key,
+	Flag_MaxTries_Key,
+	Flag_OcspCheckInterval_Key,
+	Flag_IssuanceConcurrency_Key,
+}
+
+// restartConfigKeys take effect only after the controller is restarted
+var restartConfigKeys = []string{
+	Flag_LogFormat_Key,
+	Flag_Kubeconfig_Key,
+	Flag_Masterurl_Key,
+	Flag_Listen_Key,
+	Flag_DebugListen_Key,
+	Flag_Acmeurl_Key,
+	Flag_AcmeCaBundle_Key,
+	Flag_AcmeClientCert_Key,
+	Flag_AcmeClientKey_Key,
+	Flag_AcmeProxy_Key,
+	Flag_AcmeTimeout_Key,
+	Flag_Contact_Key,
+	Flag_SharedAccount_Key,
+	Flag_SecretLifecycle_Key,
+	Flag_RouterShardLabels_Key,
+	Flag_RelistInterval_Key,
+	Flag_DryRun_Key,
+	Flag_MonitorRoutes_Key,
+	Flag_MonitorExpiryWarning_Key,
+	Flag_DnsHook_Key,
+	Flag_Selfservicename_Key,
+	Flag_Selfservicenamespace_Key,
+	Flag_Watchnamespace_Key,
+}
+
+func configSnapshot(v *viper.Viper, keys []string) map[string]string {
+	snapshot := make(map[string]string)
+	for _, key := range keys {
+		snapshot[key] = fmt.Sprint(v.Get(key))
+	}
+	return snapshot
+}
+
+// changedKeys returns sorted keys whose values differ between the snapshots
+func changedKeys(old, new map[string]string) []string {
+	var keys []string
+	for key, value := range new {
+		if old[key] != value {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func renewalPolicyFromViper(v *viper.Viper) (acme_controller.RenewalPolicy, error) {
+	p := acme_controller.RenewalPolicy{
+		CheckInterval:     v.GetDuration(Flag_RenewalCheckInterval_Key),
+		RetryInterval:     v.GetDuration(Flag_RetryInterval_Key),
+		MaxTries:          v.GetInt(Flag_MaxTries_Key),
+		RenewAfter:        v.GetFloat64(Flag_RenewalFraction_Key),
+		OCSPCheckInterval: v.GetDuration(Flag_OcspCheckInterval_Key),
+	}
+	return p, p.Validate()
+}
+
+func issuanceConcurrencyFromViper(v *viper.Viper) (int, error) {
+	n := v.GetInt(Flag_IssuanceConcurrency_Key)
+	if n < 1 {
+		return n, fmt.Errorf("--%s has to be at least 1, got %d", Flag_IssuanceConcurrency_Key, n)
+	}
+	return n, nil
+}
+
+// httpClientConfigFromViper reads files referenced by flags configuring requests to the ACME server
+func httpClientConfigFromViper(v *viper.Viper) (acme.HTTPClientConfig, error) {
+	c := acme.HTTPClientConfig{
+		ProxyURL: v.GetString(Flag_AcmeProxy_Key),
+		Timeout:  v.GetDuration(Flag_AcmeTimeout_Key),
+	}
+
+	for _, item := range []struct {
+		key  string
+		data *[]byte
+	}{
+		{Flag_AcmeCaBundle_Key, &c.CABundle},
+		{Flag_AcmeClientCert_Key, &c.ClientCertificate},
+		{Flag_AcmeClientKey_Key, &c.ClientKey},
+	} {
+		path := v.GetString(item.key)
+		if path == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return c, fmt.Errorf("unable to read --%s: %s", item.key, err)
+		}
+		*item.data = data
+	}
+
+	_, err := c.NewHTTPClient()
+	return c, err
+}
+
+// configReloader applies changes of the config file to the running controller
+type configReloader struct {
+	v           *viper.Viper
+	ac          *acme_controller.AcmeController
+	levelFilter *logging.LevelFilter
+	live        map[string]string
+	restart     map[string]string
+}
+
+func newConfigReloader(v *viper.Viper, ac *acme_controller.AcmeController, levelFilter *logging.LevelFilter) *configReloader {
+	return &configReloader{
+		v:           v,
+		ac:          ac,
+		levelFilter: levelFilter,
+		live:        configSnapshot(v, liveConfigKeys),
+		restart:     configSnapshot(v, restartConfigKeys),
+	}
+}
+
+func (r *configReloader) reload() {
+	if err := r.v.ReadInConfig(); err != nil {
+		log.Errorf("Unable to reload config file '%s'; keeping current configuration: %s", r.v.ConfigFileUsed(), err)
+		return
+	}
+
+	live := configSnapshot(r.v, liveConfigKeys)
+	changed := changedKeys(r.live, live)
+	if len(changed) != 0 {
+		policy, err := renewalPolicyFromViper(r.v)
+		var issuanceConcurrency int
+		if err == nil {
+			issuanceConcurrency, err = issuanceConcurrencyFromViper(r.v)
+		}
+		if err != nil {
+			log.Errorf("Ignoring invalid renewal policy from config file: %s", err)
+		} else {
+			r.ac.SetRenewalPolicy(policy)
+			r.ac.IssuanceQueue().SetConcurrency(issuanceConcurrency)
+			r.levelFilter.SetLevel(r.v.GetInt(Flag_LogLevel_Key))
+			r.live = live
+			log.Infof("Applied config changes of %v", changed)
+		}
+	}
+
+	for _, key := range changedKeys(r.restart, configSnapshot(r.v, restartConfigKeys)) {
+		log.Warnf("Config '%s' changed from '%s' to '%s'; restart is required to apply it", key, r.restart[key], fmt.Sprint(r.v.Get(key)))
+	}
+}
+
+// watchConfig calls reload whenever the content of the config file changes until ctx is cancelled.
+// viper.WatchConfig can't be used because it only reacts to events on the file itself
+// but a mounted ConfigMap is updated by swapping the '..data' symlink in its directory.
+func watchConfig(ctx context.Context, path string, reload func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	path = filepath.Clean(path)
+	dir, name := filepath.Split(path)
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	content, _ := ioutil.ReadFile(path)
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event := <-watcher.Events:
+				base := filepath.Base(event.Name)
+				if base != name && base != configMapDataDir {
+					continue
+				}
+
+				newContent, err := ioutil.ReadFile(path)
+				if err != nil {
+					// the file may be in the middle of being replaced; we'll get another event
+					log.Debugf("Unable to read config file '%s': %s", path, err)
+					continue
+				}
+				if bytes.Equal(content, newContent) {
+					continue
+				}
+				content = newContent
+
+				log.Infof("Config file '%s' changed", path)
+				reload()
+
+			case err := <-watcher.Errors:
+				log.Errorf("Watching config file '%s' failed: %s", path, err)
+
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
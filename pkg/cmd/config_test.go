@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChangedKeys(t *testing.T) {
+	testTable := []struct {
+		name     string
+		old      map[string]string
+		new      map[string]string
+		expected []string
+	}{
+		{"unchanged", map[string]string{"a": "1"}, map[string]string{"a": "1"}, nil},
+		{"changed", map[string]string{"a": "1", "b": "2", "c": "3"}, map[string]string{"a": "1", "b": "x", "c": "y"}, []string{"b", "c"}},
+		{"added", map[string]string{}, map[string]string{"a": "1"}, []string{"a"}},
+	}
+
+	for _, item := range testTable {
+		got := changedKeys(item.old, item.new)
+		if !reflect.DeepEqual(got, item.expected) {
+			t.Errorf("%s: expected %v, got %v", item.name, item.expected, got)
+		}
+	}
+}
+
+// writeConfigMapVersion mimics how kubelet updates a mounted ConfigMap by swapping the '..data' symlink
+func writeConfigMapVersion(t *testing.T, dir, version, content string) {
+	versionDir := filepath.Join(dir, version)
+	if err := os.Mkdir(versionDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(versionDir, "config.yaml"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tmpLink := filepath.Join(dir, "..data_tmp")
+	if err := os.Symlink(version, tmpLink); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmpLink, filepath.Join(dir, configMapDataDir)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "openshift-acme-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeConfigMapVersion(t, dir, "..v1", "loglevel: 3\n")
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.Symlink(filepath.Join(configMapDataDir, "config.yaml"), path); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reloaded := make(chan struct{}, 10)
+	if err := watchConfig(ctx, path, func() { reloaded <- struct{}{} }); err != nil {
+		t.Fatal(err)
+	}
+
+	writeConfigMapVersion(t, dir, "..v2", "loglevel: 5\n")
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("config change wasn't detected")
+	}
+
+	// the same content must not trigger another reload
+	writeConfigMapVersion(t, dir, "..v3", "loglevel: 5\n")
+	select {
+	case <-reloaded:
+		t.Fatal("unchanged config triggered reload")
+	case <-time.After(500 * time.Millisecond):
+	}
+}
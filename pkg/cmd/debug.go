@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/go-playground/log"
+	"github.com/tnozicka/openshift-acme/pkg/dryrun"
+)
+
+// expvarHandler writes all published expvars as JSON; expvar.Handler isn't available before Go 1.8
+func expvarHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprint(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if !first {
+			fmt.Fprint(w, ",\n")
+		}
+		first = false
+		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprint(w, "\n}\n")
+}
+
+// serveDebug serves metrics and, in dry-run mode, planned changes on addr until ctx is done.
+// It is kept apart from the http-01 listener which is reachable by everyone through the controller's Service.
+// It returns the address the server is bound to.
+func serveDebug(ctx context.Context, addr string, dryRun *dryrun.Recorder) (string, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(MetricsPath, expvarHandler)
+	if dryRun.Enabled() {
+		mux.Handle(DryRunPath, dryRun)
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	boundAddr := listener.Addr().String()
+	log.Infof("Debug server listening on http://%s/", boundAddr)
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	go func() {
+		err := http.Serve(listener, mux)
+		if ctx.Err() == nil {
+			log.Errorf("Debug server on %s failed: %s", boundAddr, err)
+		}
+	}()
+
+	return boundAddr, nil
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/tnozicka/openshift-acme/pkg/dryrun"
+)
+
+func TestServeDebug(t *testing.T) {
+	expvar.NewInt("test_serve_debug").Set(42)
+
+	testTable := []struct {
+		name           string
+		dryRun         *dryrun.Recorder
+		expectedDryRun int
+	}{
+		{"without dry run", nil, http.StatusNotFound},
+		{"dry run", dryrun.NewRecorder(), http.StatusOK},
+	}
+
+	for _, item := range testTable {
+		ctx, cancel := context.WithCancel(context.Background())
+		addr, err := serveDebug(ctx, "127.0.0.1:0", item.dryRun)
+		if err != nil {
+			cancel()
+			t.Fatal(err)
+		}
+
+		resp, err := http.Get(fmt.Sprintf("http://%s%s", addr, MetricsPath))
+		if err != nil {
+			cancel()
+			t.Fatal(err)
+		}
+		var vars map[string]interface{}
+		err = json.NewDecoder(resp.Body).Decode(&vars)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("%s: metrics aren't valid JSON: %s", item.name, err)
+		} else if vars["test_serve_debug"] != float64(42) {
+			t.Errorf("%s: expected published variable in metrics, got %v", item.name, vars["test_serve_debug"])
+		}
+
+		resp, err = http.Get(fmt.Sprintf("http://%s%s", addr, DryRunPath))
+		if err != nil {
+			cancel()
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != item.expectedDryRun {
+			t.Errorf("%s: expected status %d for dry-run report, got %d", item.name, item.expectedDryRun, resp.StatusCode)
+		}
+
+		cancel()
+	}
+}
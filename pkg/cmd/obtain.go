@@ -0,0 +1,248 @@
+package cmd
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-playground/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/tnozicka/openshift-acme/pkg/acme"
+	"github.com/tnozicka/openshift-acme/pkg/acme/challengeexposers"
+	"github.com/tnozicka/openshift-acme/pkg/cert"
+	cmdutil "github.com/tnozicka/openshift-acme/pkg/cmd/util"
+	"github.com/tnozicka/openshift-acme/pkg/logging"
+	route_controller "github.com/tnozicka/openshift-acme/pkg/openshift/controllers/route"
+	issuerlib "github.com/tnozicka/openshift-acme/pkg/openshift/issuer"
+	acmelib "golang.org/x/crypto/acme"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	Flag_Domain_Key     = "domain"
+	Flag_AccountKey_Key = "account-key"
+	Flag_Challenge_Key  = "challenge"
+	Flag_Webroot_Key    = "webroot"
+	Flag_KeyType_Key    = "key-type"
+	Flag_DeployHook_Key = "deploy-hook"
+
+	ChallengeStandalone = "standalone"
+	ChallengeWebroot    = "webroot"
+	ChallengeDns01      = "dns-01"
+)
+
+func NewObtainCommand(v *viper.Viper, out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "obtain",
+		Short: "Obtain a certificate once without Kubernetes",
+		Long: "Obtain a certificate for the given domains from the ACME server set by --" + Flag_Acmeurl_Key + " and write it to --" + cmdutil.Flag_OutputDir_Key + ".\n\n" +
+			"Challenge modes:\n" +
+			"  " + ChallengeStandalone + " - serve http-01 challenges on --" + Flag_Listen_Key + "\n" +
+			"  " + ChallengeWebroot + " - write http-01 challenges into --" + Flag_Webroot_Key + " served by an existing web server\n" +
+			"  " + ChallengeDns01 + " - run --" + Flag_DnsHook_Key + " as '<hook> present|cleanup <fqdn> <value>' to manage TXT records",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 0 {
+				return cmdutil.UsageError(cmd, "Unexpected args: %v", args)
+			}
+
+			return RunObtain(v, cmd, out)
+		},
+	}
+
+	cmd.Flags().StringSliceP(Flag_Domain_Key, "d", []string{}, "Domain(s) to obtain the certificate for. The first one is used as the common name.")
+	cmd.Flags().StringP(Flag_AccountKey_Key, "", "", "Path to PEM encoded ACME account key. A new key is generated and registered if the file doesn't exist.")
+	cmd.Flags().StringP(Flag_Challenge_Key, "", ChallengeStandalone, "Challenge mode: '"+ChallengeStandalone+"', '"+ChallengeWebroot+"' or '"+ChallengeDns01+"'")
+	cmd.Flags().StringP(Flag_Webroot_Key, "", "", "Document root of the web server serving the domains; used with '"+ChallengeWebroot+"' challenge mode")
+	cmd.Flags().StringP(Flag_KeyType_Key, "", string(cert.DefaultKeyType), "Certificate key type: rsa2048, rsa4096, ecdsa256 or ecdsa384")
+	cmd.Flags().StringP(cmdutil.Flag_OutputDir_Key, "o", "", "Directory to write the certificate, key and chain into")
+	cmd.Flags().StringP(Flag_DeployHook_Key, "", "", "Shell command run after the certificate is written. OPENSHIFT_ACME_OUTPUT_DIR and OPENSHIFT_ACME_DOMAINS are set in its environment.")
+
+	return cmd
+}
+
+func newObtainExposers(ctx context.Context, v *viper.Viper, cmd *cobra.Command) (map[string]acme.ChallengeExposer, error) {
+	challenge, _ := cmd.Flags().GetString(Flag_Challenge_Key)
+	switch challenge {
+	case ChallengeStandalone:
+		http01, err := challengeexposers.NewHttp01(ctx, v.GetString(Flag_Listen_Key), log.Logger)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]acme.ChallengeExposer{"http-01": http01}, nil
+
+	case ChallengeWebroot:
+		webroot, _ := cmd.Flags().GetString(Flag_Webroot_Key)
+		if webroot == "" {
+			return nil, cmdutil.UsageError(cmd, "--%s is required for '%s' challenge mode", Flag_Webroot_Key, ChallengeWebroot)
+		}
+		return map[string]acme.ChallengeExposer{"http-01": &challengeexposers.Webroot{Path: webroot}}, nil
+
+	case ChallengeDns01:
+		hook := v.GetString(Flag_DnsHook_Key)
+		if hook == "" {
+			return nil, cmdutil.UsageError(cmd, "--%s is required for '%s' challenge mode", Flag_DnsHook_Key, ChallengeDns01)
+		}
+		return map[string]acme.ChallengeExposer{"dns-01": &challengeexposers.Dns01Hook{Command: hook}}, nil
+
+	default:
+		return nil, cmdutil.UsageError(cmd, "Unsupported challenge mode '%s'", challenge)
+	}
+}
+
+// loadOrCreateAccountKey returns the key from path; if the file doesn't exist a new key is written there
+func loadOrCreateAccountKey(path string) (key crypto.Signer, created bool, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		key, err = cert.DecodePrivateKey(data)
+		if err != nil {
+			return nil, false, fmt.Errorf("account key '%s': %s", path, err)
+		}
+		return key, false, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, false, err
+	}
+
+	key, err = cert.GeneratePrivateKey(cert.KeyTypeRSA4096)
+	if err != nil {
+		return nil, false, err
+	}
+	data, err = cert.EncodePrivateKey(key)
+	if err != nil {
+		return nil, false, err
+	}
+	if err = ioutil.WriteFile(path, data, 0600); err != nil {
+		return nil, false, err
+	}
+
+	return key, true, nil
+}
+
+// writeCertificate stores the certificate using the same keys as the secrets created by the controller
+func writeCertificate(dir string, c *cert.Certificate) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	files := []struct {
+		name string
+		data []byte
+		perm os.FileMode
+	}{
+		{api_v1.TLSPrivateKeyKey, c.Key, 0600},
+		{api_v1.TLSCertKey, c.Crt, 0644},
+		{route_controller.SecretDataLeafKey, c.Leaf(), 0644},
+		{route_controller.SecretDataChainKey, c.Chain(), 0644},
+		{route_controller.SecretDataCAKey, c.CA(), 0644},
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		if err := ioutil.WriteFile(path, f.data, f.perm); err != nil {
+			return err
+		}
+		log.Infof("Written '%s'", path)
+	}
+
+	return nil
+}
+
+func RunObtain(v *viper.Viper, cmd *cobra.Command, out io.Writer) error {
+	domains, _ := cmd.Flags().GetStringSlice(Flag_Domain_Key)
+	if len(domains) == 0 {
+		return cmdutil.UsageError(cmd, "At least one --%s is required", Flag_Domain_Key)
+	}
+	accountKeyPath, _ := cmd.Flags().GetString(Flag_AccountKey_Key)
+	if accountKeyPath == "" {
+		return cmdutil.UsageError(cmd, "--%s is required", Flag_AccountKey_Key)
+	}
+	outputDir, _ := cmd.Flags().GetString(cmdutil.Flag_OutputDir_Key)
+	if outputDir == "" {
+		return cmdutil.UsageError(cmd, "--%s is required", cmdutil.Flag_OutputDir_Key)
+	}
+	keyTypeString, _ := cmd.Flags().GetString(Flag_KeyType_Key)
+	keyType, err := cert.ParseKeyType(keyTypeString)
+	if err != nil {
+		return cmdutil.UsageError(cmd, "%s", err)
+	}
+
+	httpClientConfig, err := httpClientConfigFromViper(v)
+	if err != nil {
+		return err
+	}
+	httpClient, err := httpClientConfig.NewHTTPClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	exposers, err := newObtainExposers(ctx, v, cmd)
+	if err != nil {
+		return err
+	}
+
+	accountKey, created, err := loadOrCreateAccountKey(accountKeyPath)
+	if err != nil {
+		return err
+	}
+
+	client := acme.Client{
+		Client: &acmelib.Client{
+			Key:          accountKey,
+			DirectoryURL: v.GetString(Flag_Acmeurl_Key),
+			HTTPClient:   httpClient,
+		},
+		Account: &acmelib.Account{
+			Contact: issuerlib.NormalizeContacts(v.GetStringSlice(Flag_Contact_Key)),
+		},
+		Logger: logging.New(log.F(logging.FieldDomains, domains)),
+	}
+
+	log.Infof("Registering account at '%s' (new key: %t)", client.Client.DirectoryURL, created)
+	client.Account, err = client.Client.Register(ctx, client.Account, acmelib.AcceptTOS)
+	if err != nil {
+		acmeErr, ok := err.(*acmelib.Error)
+		if !ok || acmeErr.StatusCode != http.StatusConflict {
+			return fmt.Errorf("failed to register account: %s", err)
+		}
+		// the key is already registered; ACME v1 identifies accounts by their key so there is nothing else to do
+		log.Info("Account already exists")
+	}
+
+	log.Infof("Obtaining certificate for %v", domains)
+	certificate, err := client.ObtainCertificate(ctx, domains, exposers, keyType, true)
+	if err != nil {
+		return fmt.Errorf("failed to obtain certificate: %s", err)
+	}
+
+	if err := writeCertificate(outputDir, certificate); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Certificate for %v valid until %s written to '%s'\n", domains, certificate.Certificate.NotAfter, outputDir)
+
+	deployHook, _ := cmd.Flags().GetString(Flag_DeployHook_Key)
+	if deployHook != "" {
+		hook := exec.Command("sh", "-c", deployHook)
+		hook.Env = append(os.Environ(),
+			"OPENSHIFT_ACME_OUTPUT_DIR="+outputDir,
+			"OPENSHIFT_ACME_DOMAINS="+strings.Join(domains, ","),
+		)
+		hook.Stdout = out
+		hook.Stderr = out
+		log.Infof("Running deploy hook '%s'", deployHook)
+		if err := hook.Run(); err != nil {
+			return fmt.Errorf("deploy hook failed: %s", err)
+		}
+	}
+
+	return nil
+}
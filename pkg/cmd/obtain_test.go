@@ -0,0 +1,282 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tnozicka/openshift-acme/pkg/acme/fakeacme"
+	"github.com/tnozicka/openshift-acme/pkg/cert"
+	cmdutil "github.com/tnozicka/openshift-acme/pkg/cmd/util"
+	route_controller "github.com/tnozicka/openshift-acme/pkg/openshift/controllers/route"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+)
+
+// freeAddr returns a local address nothing listens on
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// waitUntilFree waits for the http-01 server of a previous run to stop listening on addr
+func waitUntilFree(t *testing.T, addr string) {
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		l, err := net.Listen("tcp", addr)
+		if err == nil {
+			l.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// runObtain runs the obtain command with args and returns its output; certificate keys are ECDSA to keep it fast
+func runObtain(v *viper.Viper, args ...string) (string, error) {
+	var out bytes.Buffer
+	cmd := NewObtainCommand(v, &out)
+	cmd.SetOutput(&out)
+	cmd.SetArgs(append([]string{"--" + Flag_KeyType_Key + "=" + string(cert.KeyTypeECDSA256)}, args...))
+	err := cmd.Execute()
+	return out.String(), err
+}
+
+// checkOutputDir verifies the certificate files written for domain and returns the leaf certificate
+func checkOutputDir(t *testing.T, dir string, ca *fakeacme.Server, domain string) *x509.Certificate {
+	files := make(map[string][]byte)
+	for _, name := range []string{api_v1.TLSPrivateKeyKey, api_v1.TLSCertKey, route_controller.SecretDataLeafKey, route_controller.SecretDataChainKey, route_controller.SecretDataCAKey} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[name] = data
+	}
+
+	info, err := os.Stat(filepath.Join(dir, api_v1.TLSPrivateKeyKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("private key is readable by others: %v", perm)
+	}
+
+	if _, err := tls.X509KeyPair(files[api_v1.TLSCertKey], files[api_v1.TLSPrivateKeyKey]); err != nil {
+		t.Errorf("certificate doesn't match the key: %v", err)
+	}
+	if !bytes.HasPrefix(files[api_v1.TLSCertKey], files[route_controller.SecretDataLeafKey]) ||
+		!bytes.HasSuffix(files[api_v1.TLSCertKey], files[route_controller.SecretDataChainKey]) {
+		t.Errorf("%s isn't the leaf followed by the chain", api_v1.TLSCertKey)
+	}
+
+	block, _ := pem.Decode(files[route_controller.SecretDataLeafKey])
+	if block == nil {
+		t.Fatalf("invalid leaf %q", files[route_controller.SecretDataLeafKey])
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediates := x509.NewCertPool()
+	intermediates.AppendCertsFromPEM(files[route_controller.SecretDataChainKey])
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: domain, Roots: ca.Roots(), Intermediates: intermediates}); err != nil {
+		t.Error(err)
+	}
+
+	return leaf
+}
+
+func TestRunObtainStandalone(t *testing.T) {
+	listen := freeAddr(t)
+	ca, err := fakeacme.NewServer(fakeacme.Config{
+		HTTP01Addrs: map[string]string{"app.example.com": listen},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ca.Close()
+
+	dir, err := ioutil.TempDir("", "obtain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	v := viper.New()
+	v.Set(Flag_Acmeurl_Key, ca.DirectoryURL())
+	v.Set(Flag_Listen_Key, listen)
+
+	accountKey := filepath.Join(dir, "account.key")
+	outputDir := filepath.Join(dir, "out")
+	var serials []string
+	// the second run reuses the account registered by the first one
+	for i := 0; i < 2; i++ {
+		waitUntilFree(t, listen)
+		out, err := runObtain(v, "--domain=app.example.com", "--account-key="+accountKey, "--"+cmdutil.Flag_OutputDir_Key+"="+outputDir)
+		if err != nil {
+			t.Fatalf("run %d: %v; output: %s", i, err, out)
+		}
+		if !strings.Contains(out, outputDir) {
+			t.Errorf("run %d: output doesn't mention the output directory: %s", i, out)
+		}
+		serials = append(serials, checkOutputDir(t, outputDir, ca, "app.example.com").SerialNumber.String())
+	}
+
+	if serials[0] == serials[1] {
+		t.Error("second run didn't replace the certificate")
+	}
+	if n := ca.Requests(fakeacme.ResourceNewCert); n != 2 {
+		t.Errorf("expected 2 certificates to be issued, got %d", n)
+	}
+	if n := ca.Requests(fakeacme.ResourceNewReg); n != 2 {
+		t.Errorf("expected the account to be registered and then found by its key, got %d registrations", n)
+	}
+}
+
+func TestRunObtainDns01(t *testing.T) {
+	dir, err := ioutil.TempDir("", "obtain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the hook keeps a TXT record per file named by its fqdn and logs cleanups
+	recordsDir := filepath.Join(dir, "records")
+	if err := os.Mkdir(recordsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	hook := filepath.Join(dir, "hook.sh")
+	script := fmt.Sprintf(`#!/bin/sh
+case "$1" in
+present) echo "$3" > "%[1]s/$2" ;;
+cleanup) rm "%[1]s/$2" && echo "$2" >> "%[2]s" ;;
+*) exit 1 ;;
+esac
+`, recordsDir, filepath.Join(dir, "cleanups"))
+	if err := ioutil.WriteFile(hook, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := fakeacme.NewServer(fakeacme.Config{
+		LookupTXT: func(name string) ([]string, error) {
+			data, err := ioutil.ReadFile(filepath.Join(recordsDir, name+"."))
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			return []string{strings.TrimSpace(string(data))}, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ca.Close()
+
+	v := viper.New()
+	v.Set(Flag_Acmeurl_Key, ca.DirectoryURL())
+	v.Set(Flag_DnsHook_Key, hook)
+
+	outputDir := filepath.Join(dir, "out")
+	out, err := runObtain(v, "--challenge="+ChallengeDns01, "--domain=app.example.com", "--domain=www.example.com",
+		"--account-key="+filepath.Join(dir, "account.key"), "--"+cmdutil.Flag_OutputDir_Key+"="+outputDir)
+	if err != nil {
+		t.Fatalf("%v; output: %s", err, out)
+	}
+
+	leaf := checkOutputDir(t, outputDir, ca, "www.example.com")
+	if leaf.Subject.CommonName != "app.example.com" {
+		t.Errorf("expected the first domain as common name, got '%s'", leaf.Subject.CommonName)
+	}
+
+	cleanups, err := ioutil.ReadFile(filepath.Join(dir, "cleanups"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fqdn := range []string{"_acme-challenge.app.example.com.", "_acme-challenge.www.example.com."} {
+		if !strings.Contains(string(cleanups), fqdn+"\n") {
+			t.Errorf("TXT record %s wasn't cleaned up: %q", fqdn, cleanups)
+		}
+	}
+	records, err := ioutil.ReadDir(recordsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Errorf("%d TXT record(s) left behind", len(records))
+	}
+}
+
+func TestRunObtainDeployHook(t *testing.T) {
+	listen := freeAddr(t)
+	ca, err := fakeacme.NewServer(fakeacme.Config{
+		HTTP01Addrs: map[string]string{"app.example.com": listen},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ca.Close()
+
+	dir, err := ioutil.TempDir("", "obtain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	v := viper.New()
+	v.Set(Flag_Acmeurl_Key, ca.DirectoryURL())
+	v.Set(Flag_Listen_Key, listen)
+
+	testTable := []struct {
+		name   string
+		hook   string
+		output string
+		err    string
+	}{
+		{
+			name:   "hook sees the written certificate",
+			hook:   `test -s "$OPENSHIFT_ACME_OUTPUT_DIR/tls.crt" && echo "deployed $OPENSHIFT_ACME_DOMAINS"`,
+			output: "deployed app.example.com\n",
+		},
+		{
+			name:   "failing hook",
+			hook:   "echo broken; exit 3",
+			output: "broken\n",
+			err:    "deploy hook failed",
+		},
+	}
+
+	for _, item := range testTable {
+		outputDir := filepath.Join(dir, "out")
+		waitUntilFree(t, listen)
+		out, err := runObtain(v, "--domain=app.example.com", "--account-key="+filepath.Join(dir, "account.key"),
+			"--"+cmdutil.Flag_OutputDir_Key+"="+outputDir, "--deploy-hook="+item.hook)
+		if item.err == "" && err != nil {
+			t.Errorf("%s: %v; output: %s", item.name, err, out)
+		}
+		if item.err != "" && (err == nil || !strings.Contains(err.Error(), item.err)) {
+			t.Errorf("%s: expected error containing %q, got %v", item.name, item.err, err)
+		}
+		if !strings.Contains(out, item.output) {
+			t.Errorf("%s: expected hook output %q, got %q", item.name, item.output, out)
+		}
+		// the certificate is in place even if deploying it failed
+		checkOutputDir(t, outputDir, ca, "app.example.com")
+	}
+}
@@ -0,0 +1,280 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/tnozicka/openshift-acme/pkg/cert"
+	cmdutil "github.com/tnozicka/openshift-acme/pkg/cmd/util"
+	accountlib "github.com/tnozicka/openshift-acme/pkg/openshift/account"
+	oapi "github.com/tnozicka/openshift-acme/pkg/openshift/api"
+	issuerlib "github.com/tnozicka/openshift-acme/pkg/openshift/issuer"
+	"github.com/tnozicka/openshift-acme/pkg/openshift/untypedclient"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	Flag_Output_Key = "output"
+
+	OutputTable = "table"
+	OutputJSON  = "json"
+	OutputYAML  = "yaml"
+
+	MismatchNone          = ""
+	MismatchNoCertificate = "no certificate on route"
+	MismatchNoRecord      = "no recorded certificate"
+	MismatchDiffers       = "differs from recorded certificate"
+	MismatchInvalid       = "invalid certificate on route"
+)
+
+// RouteStatus describes certificate of a single managed route
+type RouteStatus struct {
+	Namespace  string     `json:"namespace"`
+	Name       string     `json:"name"`
+	Domains    []string   `json:"domains"`
+	Issuer     string     `json:"issuer"`
+	NotBefore  *time.Time `json:"notBefore,omitempty"`
+	NotAfter   *time.Time `json:"notAfter,omitempty"`
+	Remaining  string     `json:"remaining,omitempty"`
+	LastUpdate string     `json:"lastUpdate,omitempty"`
+	Mismatch   string     `json:"mismatch,omitempty"`
+}
+
+func NewStatusCommand(v *viper.Viper, out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show certificates of managed routes",
+		Long:  "Show certificates of routes managed by openshift-acme in namespaces selected by --" + Flag_Watchnamespace_Key + " and compare them with certificates recorded in ACME accounts",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 0 {
+				return cmdutil.UsageError(cmd, "Unexpected args: %v", args)
+			}
+
+			output, err := cmd.Flags().GetString(Flag_Output_Key)
+			if err != nil {
+				return err
+			}
+			switch output {
+			case OutputTable, OutputJSON, OutputYAML:
+			default:
+				return cmdutil.UsageError(cmd, "Unsupported output format '%s'", output)
+			}
+
+			return RunStatus(v, output, out)
+		},
+	}
+
+	cmd.Flags().StringP(Flag_Output_Key, "o", OutputTable, "Output format: table, json or yaml")
+
+	return cmd
+}
+
+func RunStatus(v *viper.Viper, output string, out io.Writer) error {
+	clientset, err := newClientset(v)
+	if err != nil {
+		return err
+	}
+	client := clientset.CoreV1()
+
+	// with shared account the records are kept in the controller's namespace
+	sharedRecords := map[string]*accountlib.CertificateRecord{}
+	if v.GetBool(Flag_SharedAccount_Key) && v.GetString(Flag_Selfservicenamespace_Key) != "" {
+		sharedRecords, err = listCertificateRecords(client, v.GetString(Flag_Selfservicenamespace_Key))
+		if err != nil {
+			return err
+		}
+	}
+
+	var statuses []RouteStatus
+	for _, namespace := range namespacesFromViper(v) {
+		records, err := listCertificateRecords(client, namespace)
+		if err != nil {
+			return err
+		}
+		for key, record := range sharedRecords {
+			if _, found := records[key]; !found {
+				records[key] = record
+			}
+		}
+
+		routes, err := listRoutes(client, namespace)
+		if err != nil {
+			return err
+		}
+
+		for _, route := range routes {
+			if route.Annotations["kubernetes.io/tls-acme"] != "true" {
+				continue
+			}
+			statuses = append(statuses, NewRouteStatus(&route, records, time.Now()))
+		}
+	}
+
+	return PrintRouteStatuses(statuses, output, out)
+}
+
+func namespacesFromViper(v *viper.Viper) []string {
+	namespaces := v.GetStringSlice(Flag_Watchnamespace_Key)
+	// spf13/cobra (sadly) treats []string{""} as []string{} => we need to fix it!
+	if len(namespaces) == 0 {
+		namespaces = []string{""}
+	}
+	return namespaces
+}
+
+func listRoutes(client v1core.CoreV1Interface, namespace string) ([]oapi.Route, error) {
+	var url string
+	if namespace == "" {
+		url = "/oapi/v1/routes"
+	} else {
+		url = fmt.Sprintf("/oapi/v1/namespaces/%s/routes", namespace)
+	}
+	body, err := untypedclient.Get(client.RESTClient(), url)
+	if err != nil {
+		return nil, fmt.Errorf("listing routes failed: %s", err)
+	}
+
+	var routeList oapi.RouteList
+	if err := json.Unmarshal(body, &routeList); err != nil {
+		return nil, fmt.Errorf("unmarshaling RouteList failed: %s", err)
+	}
+
+	return routeList.Items, nil
+}
+
+func recordKey(namespace string, domains []string) string {
+	sorted := append([]string{}, domains...)
+	sort.Strings(sorted)
+	return namespace + "/" + strings.Join(sorted, ",")
+}
+
+// listCertificateRecords returns the freshest recorded certificate for every namespace and set of domains
+func listCertificateRecords(client v1core.CoreV1Interface, namespace string) (map[string]*accountlib.CertificateRecord, error) {
+	secretList, err := client.Secrets(namespace).List(api_v1.ListOptions{
+		LabelSelector: accountlib.LabelSelectorAcmeAccount,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing account secrets failed: %s", err)
+	}
+	recordList, err := client.Secrets(namespace).List(api_v1.ListOptions{
+		LabelSelector: accountlib.LabelSelectorAcmeCertificate,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing certificate secrets failed: %s", err)
+	}
+
+	records := make(map[string]*accountlib.CertificateRecord)
+	now := time.Now()
+	for i := range secretList.Items {
+		account, err := accountlib.NewAccountFromSecret(&secretList.Items[i], "")
+		if err != nil {
+			return nil, fmt.Errorf("account '%s/%s': %s", secretList.Items[i].Namespace, secretList.Items[i].Name, err)
+		}
+		account.LoadCertificateRecords(recordList.Items)
+
+		for _, record := range account.Certificates {
+			if record.Certificate == nil || record.Certificate.Certificate == nil {
+				continue
+			}
+			key := recordKey(record.Namespace, record.Domains())
+			existing, found := records[key]
+			if !found || cert.FresherCertificate(existing.Certificate, record.Certificate, now) == record.Certificate {
+				records[key] = record
+			}
+		}
+	}
+
+	return records, nil
+}
+
+func NewRouteStatus(route *oapi.Route, records map[string]*accountlib.CertificateRecord, now time.Time) RouteStatus {
+	s := RouteStatus{
+		Namespace:  route.Namespace,
+		Name:       route.Name,
+		Domains:    []string{route.Spec.Host},
+		Issuer:     route.Annotations[issuerlib.AnnotationRouteIssuerKey],
+		LastUpdate: route.Annotations["kubernetes.io/tls-acme.last-update-time"],
+	}
+	if s.Issuer == "" {
+		s.Issuer = "(default)"
+	}
+
+	record, recorded := records[recordKey(route.Namespace, s.Domains)]
+
+	if route.Spec.Tls == nil || route.Spec.Tls.Certificate == "" {
+		s.Mismatch = MismatchNoCertificate
+		return s
+	}
+
+	c := &cert.Certificate{
+		Crt: cert.JoinPEM(route.Spec.Tls.Certificate, route.Spec.Tls.CaCertificate),
+		Key: []byte(route.Spec.Tls.Key),
+	}
+	if err := c.UpdateTargetCertificate(); err != nil {
+		s.Mismatch = MismatchInvalid
+		return s
+	}
+
+	s.NotBefore = &c.Certificate.NotBefore
+	s.NotAfter = &c.Certificate.NotAfter
+	s.Remaining = (c.Certificate.NotAfter.Sub(now) / time.Minute * time.Minute).String()
+
+	switch {
+	case !recorded:
+		s.Mismatch = MismatchNoRecord
+	case !bytes.Equal(record.Certificate.Certificate.Raw, c.Certificate.Raw):
+		s.Mismatch = MismatchDiffers
+	}
+
+	return s
+}
+
+func PrintRouteStatuses(statuses []RouteStatus, output string, out io.Writer) error {
+	switch output {
+	case OutputJSON:
+		data, err := json.MarshalIndent(statuses, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(out, string(data))
+		return err
+	case OutputYAML:
+		data, err := yaml.Marshal(statuses)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(data)
+		return err
+	}
+
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return "-"
+		}
+		return t.Format(time.RFC3339)
+	}
+	orDash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tNAME\tDOMAINS\tISSUER\tNOT BEFORE\tNOT AFTER\tREMAINING\tLAST UPDATE\tMISMATCH")
+	for _, s := range statuses {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.Namespace, s.Name, strings.Join(s.Domains, ","), s.Issuer,
+			formatTime(s.NotBefore), formatTime(s.NotAfter), orDash(s.Remaining), orDash(s.LastUpdate), orDash(s.Mismatch))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tnozicka/openshift-acme/pkg/acme"
+	"github.com/tnozicka/openshift-acme/pkg/dryrun"
+	accountlib "github.com/tnozicka/openshift-acme/pkg/openshift/account"
+	oapi "github.com/tnozicka/openshift-acme/pkg/openshift/api"
+	"github.com/tnozicka/openshift-acme/pkg/openshift/fakeapi"
+	acmelib "golang.org/x/crypto/acme"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+)
+
+func TestNewRouteStatus(t *testing.T) {
+	recorded, err := dryrun.PlaceholderCertificate([]string{"example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := dryrun.PlaceholderCertificate([]string{"example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := map[string]*accountlib.CertificateRecord{
+		recordKey("ns", []string{"example.com"}): {Namespace: "ns", Certificate: recorded},
+	}
+
+	newRoute := func(namespace string, crt []byte) *oapi.Route {
+		route := &oapi.Route{}
+		route.Namespace = namespace
+		route.Name = "route"
+		route.Spec.Host = "example.com"
+		if crt != nil {
+			route.Spec.Tls = &oapi.TlsConfig{Certificate: string(crt)}
+		}
+		return route
+	}
+
+	testTable := []struct {
+		name     string
+		route    *oapi.Route
+		mismatch string
+	}{
+		{"recorded certificate", newRoute("ns", recorded.Crt), MismatchNone},
+		{"different certificate", newRoute("ns", other.Crt), MismatchDiffers},
+		{"certificate from other namespace", newRoute("other", recorded.Crt), MismatchNoRecord},
+		{"no certificate", newRoute("ns", nil), MismatchNoCertificate},
+		{"garbage", newRoute("ns", []byte("garbage")), MismatchInvalid},
+	}
+
+	for _, item := range testTable {
+		s := NewRouteStatus(item.route, records, time.Now())
+		if s.Mismatch != item.mismatch {
+			t.Errorf("%s: expected mismatch '%s', got '%s'", item.name, item.mismatch, s.Mismatch)
+		}
+	}
+}
+
+func TestRunStatusSharedAccount(t *testing.T) {
+	domains := []string{"app.example.com"}
+	certificate, err := dryrun.PlaceholderCertificate(domains)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := fakeapi.NewServer(fakeapi.Config{})
+	defer api.Close()
+
+	// the shared account and its records live in the controller's namespace
+	account := &accountlib.Account{
+		Client: acme.Client{
+			Client:  &acmelib.Client{Key: key, DirectoryURL: "https://acme.example.com/directory"},
+			Account: &acmelib.Account{URI: "https://acme.example.com/acct/1"},
+		},
+	}
+	accountSecret, err := account.ToSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountSecret.Name = "acme-account"
+	accountSecret.Namespace = "acme"
+	if err := api.Create(fakeapi.ResourceSecrets, "acme", accountSecret); err != nil {
+		t.Fatal(err)
+	}
+	records := accountlib.NewCertificateSecret(accountSecret, "test", domains)
+	if err := accountlib.SetCertificateRecords(records, []*accountlib.CertificateRecord{{Namespace: "test", Certificate: certificate}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.Create(fakeapi.ResourceSecrets, "acme", records); err != nil {
+		t.Fatal(err)
+	}
+
+	route := &oapi.Route{
+		ObjectMeta: api_v1.ObjectMeta{
+			Name:        "app",
+			Annotations: map[string]string{"kubernetes.io/tls-acme": "true"},
+		},
+		Spec: oapi.RouteSpec{
+			Host: "app.example.com",
+			Tls:  &oapi.TlsConfig{Certificate: string(certificate.Crt)},
+		},
+	}
+	if err := api.Create(fakeapi.ResourceRoutes, "test", route); err != nil {
+		t.Fatal(err)
+	}
+
+	testTable := []struct {
+		name          string
+		sharedAccount bool
+		mismatch      string
+	}{
+		{"shared account", true, MismatchNone},
+		{"per namespace accounts", false, MismatchNoRecord},
+	}
+
+	for _, item := range testTable {
+		v := viper.New()
+		v.Set(Flag_Masterurl_Key, api.RESTConfig().Host)
+		v.Set(Flag_Watchnamespace_Key, []string{"test"})
+		v.Set(Flag_Selfservicenamespace_Key, "acme")
+		v.Set(Flag_SharedAccount_Key, item.sharedAccount)
+
+		var out bytes.Buffer
+		if err := RunStatus(v, OutputJSON, &out); err != nil {
+			t.Fatalf("%s: %v", item.name, err)
+		}
+		var statuses []RouteStatus
+		if err := json.Unmarshal(out.Bytes(), &statuses); err != nil {
+			t.Fatalf("%s: %v: %s", item.name, err, out.String())
+		}
+		if len(statuses) != 1 || statuses[0].Mismatch != item.mismatch {
+			t.Errorf("%s: expected mismatch '%s', got %#v", item.name, item.mismatch, statuses)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package dryrun
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-playground/log"
+	"github.com/tnozicka/openshift-acme/pkg/cert"
+)
+
+const (
+	VerbCreate   = "create"
+	VerbUpdate   = "update"
+	VerbDelete   = "delete"
+	VerbRequest  = "request"
+	VerbRegister = "register"
+	VerbRevoke   = "revoke"
+
+	// Token is used in place of challenge tokens which would be issued by the ACME server
+	Token = "dry-run"
+)
+
+// Action is a change the controller would have made
+type Action struct {
+	Time      time.Time `json:"time"`
+	Verb      string    `json:"verb"`
+	Kind      string    `json:"kind"`
+	Namespace string    `json:"namespace,omitempty"`
+	Name      string    `json:"name"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+func (a *Action) key() string {
+	return a.Verb + "/" + a.Kind + "/" + a.Namespace + "/" + a.Name
+}
+
+// Recorder collects planned actions instead of executing them.
+// nil Recorder means dry-run is disabled.
+type Recorder struct {
+	mutex   sync.Mutex
+	actions []*Action
+	index   map[string]*Action
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{
+		index: make(map[string]*Action),
+	}
+}
+
+func (r *Recorder) Enabled() bool {
+	return r != nil
+}
+
+// Record logs the action and adds it to the plan; repeated actions only refresh the existing record
+func (r *Recorder) Record(verb, kind, namespace, name, detail string) {
+	if r == nil {
+		return
+	}
+
+	log.Infof("DRY-RUN: would %s %s '%s/%s' %s", verb, kind, namespace, name, detail)
+
+	a := &Action{
+		Time:      time.Now(),
+		Verb:      verb,
+		Kind:      kind,
+		Namespace: namespace,
+		Name:      name,
+		Detail:    detail,
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	existing, found := r.index[a.key()]
+	if found {
+		*existing = *a
+		return
+	}
+	r.index[a.key()] = a
+	r.actions = append(r.actions, a)
+}
+
+func (r *Recorder) Actions() []Action {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	actions := make([]Action, 0, len(r.actions))
+	for _, a := range r.actions {
+		actions = append(actions, *a)
+	}
+
+	return actions
+}
+
+func (r *Recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	data, err := json.MarshalIndent(r.Actions(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// PlaceholderCertificate returns self-signed certificate for domains standing in for one the ACME server would issue
+func PlaceholderCertificate(domains []string) (*cert.Certificate, error) {
+	if len(domains) < 1 {
+		return nil, fmt.Errorf("can't create placeholder certificate without domains")
+	}
+
+	privateKey, err := cert.GeneratePrivateKey(cert.KeyTypeECDSA256)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: domains[0]},
+		DNSNames:     domains,
+		NotBefore:    now,
+		NotAfter:     now.Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, privateKey.Public(), privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return cert.NewCertificateFromDER([][]byte{der}, privateKey)
+}
@@ -0,0 +1,44 @@
+package dryrun
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRecorder(t *testing.T) {
+	var disabled *Recorder
+	if disabled.Enabled() {
+		t.Error("nil recorder must be disabled")
+	}
+	// must not panic
+	disabled.Record(VerbCreate, "secret", "ns", "name", "")
+
+	r := NewRecorder()
+	r.Record(VerbCreate, "secret", "ns", "a", "first")
+	r.Record(VerbUpdate, "route", "ns", "a", "")
+	r.Record(VerbCreate, "secret", "ns", "a", "second")
+
+	actions := r.Actions()
+	if len(actions) != 2 {
+		t.Fatalf("expected 2 actions, got %d: %#v", len(actions), actions)
+	}
+	if actions[0].Detail != "second" {
+		t.Errorf("repeated action should refresh the existing record; got detail '%s'", actions[0].Detail)
+	}
+}
+
+func TestPlaceholderCertificate(t *testing.T) {
+	domains := []string{"example.com", "www.example.com"}
+	c, err := PlaceholderCertificate(domains)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(c.Domains(), domains) {
+		t.Errorf("expected domains %v, got %v", domains, c.Domains())
+	}
+	if !c.IsValid(time.Now()) {
+		t.Error("placeholder certificate should be valid now")
+	}
+}
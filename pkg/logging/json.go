@@ -0,0 +1,81 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/go-playground/log"
+)
+
+const (
+	FormatConsole = "console"
+	FormatJSON    = "json"
+)
+
+// JSON handler writes one JSON object per entry; fields are added as top level keys
+type JSON struct {
+	writer io.Writer
+}
+
+func NewJSON(w io.Writer) *JSON {
+	return &JSON{
+		writer: w,
+	}
+}
+
+// Format returns entry as a JSON object terminated by new line
+func (j *JSON) Format(e *log.Entry) ([]byte, error) {
+	m := map[string]interface{}{
+		"time":  e.Timestamp.Format(time.RFC3339Nano),
+		"level": e.Level.String(),
+		"msg":   e.Message,
+	}
+	if e.Line != 0 {
+		m["caller"] = fmt.Sprintf("%s:%d", e.File, e.Line)
+	}
+
+	for _, f := range e.Fields {
+		key := f.Key
+		if _, found := m[key]; found {
+			key = "fields." + key
+		}
+
+		value := f.Value
+		switch v := value.(type) {
+		case error:
+			value = v.Error()
+		case fmt.Stringer:
+			value = v.String()
+		}
+		if _, err := json.Marshal(value); err != nil {
+			value = fmt.Sprintf("%+v", value)
+		}
+		m[key] = value
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func (j *JSON) Run() chan<- *log.Entry {
+	ch := make(chan *log.Entry, 3)
+
+	go func() {
+		for e := range ch {
+			data, err := j.Format(e)
+			if err != nil {
+				msg, _ := json.Marshal("unable to format log entry: " + err.Error())
+				data = []byte(`{"level":"ERROR","msg":` + string(msg) + "}\n")
+			}
+			j.writer.Write(data)
+			e.Consumed()
+		}
+	}()
+
+	return ch
+}
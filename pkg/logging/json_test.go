@@ -0,0 +1,53 @@
+package logging
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-playground/log"
+)
+
+func TestJSONFormat(t *testing.T) {
+	e := &log.Entry{
+		Level:     log.WarnLevel,
+		Timestamp: time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC),
+		Message:   "Authorization failed",
+		File:      "client.go",
+		Line:      42,
+		Fields: []log.Field{
+			{Key: FieldNamespace, Value: "ns"},
+			{Key: FieldDomains, Value: []string{"example.com"}},
+			{Key: "error", Value: errors.New("timeout")},
+			{Key: "msg", Value: "collision"},
+			{Key: "channel", Value: make(chan int)},
+		},
+	}
+
+	data, err := NewJSON(nil).Format(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("invalid JSON %q: %s", data, err)
+	}
+	delete(got, "channel")
+
+	expected := map[string]interface{}{
+		"time":       "2017-01-02T03:04:05Z",
+		"level":      "WARN",
+		"msg":        "Authorization failed",
+		"caller":     "client.go:42",
+		"namespace":  "ns",
+		"domains":    []interface{}{"example.com"},
+		"error":      "timeout",
+		"fields.msg": "collision",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %#v, got %#v", expected, got)
+	}
+}
@@ -0,0 +1,55 @@
+package logging
+
+import (
+	"sync/atomic"
+
+	"github.com/go-playground/log"
+)
+
+// LevelFilter forwards entries to the underlying handler only if their level is enabled.
+// go-playground/log can't unregister handlers so changing levels at runtime requires
+// registering the filter for all levels once and changing the filter instead.
+type LevelFilter struct {
+	handler log.Handler
+	// loglevel is the number of enabled levels counted from the most severe one
+	loglevel int32
+}
+
+func NewLevelFilter(handler log.Handler, loglevel int) *LevelFilter {
+	f := &LevelFilter{
+		handler: handler,
+	}
+	f.SetLevel(loglevel)
+	return f
+}
+
+// SetLevel enables the top loglevel levels, the same way as the --loglevel flag
+func (f *LevelFilter) SetLevel(loglevel int) {
+	atomic.StoreInt32(&f.loglevel, int32(loglevel))
+}
+
+func (f *LevelFilter) Level() int {
+	return int(atomic.LoadInt32(&f.loglevel))
+}
+
+// Enabled reports whether entries with level l are forwarded
+func (f *LevelFilter) Enabled(l log.Level) bool {
+	return int(l) >= len(log.AllLevels)-f.Level()
+}
+
+func (f *LevelFilter) Run() chan<- *log.Entry {
+	out := f.handler.Run()
+	in := make(chan *log.Entry)
+
+	go func() {
+		for e := range in {
+			if !f.Enabled(e.Level) {
+				e.Consumed()
+				continue
+			}
+			out <- e
+		}
+	}()
+
+	return in
+}
@@ -0,0 +1,107 @@
+package logging
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/go-playground/log"
+)
+
+const (
+	FieldNamespace = "namespace"
+	FieldRoute     = "route"
+	FieldDomains   = "domains"
+	FieldDomain    = "domain"
+	FieldAccount   = "account"
+	FieldAttempt   = "attempt"
+	FieldChallenge = "challenge"
+)
+
+// Logger adds context fields to every entry it logs.
+// Unlike log.WithFields, which returns a pooled entry valid for a single message,
+// a Logger can be stored and passed around. nil Logger logs without fields.
+type Logger struct {
+	fields []log.Field
+}
+
+func New(fields ...log.Field) *Logger {
+	return &Logger{
+		fields: fields,
+	}
+}
+
+// With returns a copy of the logger with an additional field
+func (l *Logger) With(key string, value interface{}) *Logger {
+	fields := make([]log.Field, 0, len(l.Fields())+1)
+	fields = append(fields, l.Fields()...)
+	fields = append(fields, log.Field{Key: key, Value: value})
+	return New(fields...)
+}
+
+func (l *Logger) Fields() []log.Field {
+	if l == nil {
+		return nil
+	}
+	return l.fields
+}
+
+// copyFields protects the logger's fields from handlers appending to the entry
+func (l *Logger) copyFields() []log.Field {
+	fields := make([]log.Field, len(l.Fields()))
+	copy(fields, l.Fields())
+	return fields
+}
+
+func (l *Logger) handle(level log.Level, message string) {
+	e := &log.Entry{
+		Level:     level,
+		Timestamp: time.Now().UTC(),
+		Message:   strings.TrimRight(message, "\r\n\t "),
+		Fields:    l.copyFields(),
+	}
+	// same levels the global logger records caller info for
+	if level == log.DebugLevel || level >= log.WarnLevel {
+		_, e.File, e.Line, _ = runtime.Caller(2)
+	}
+
+	log.HandleEntry(e)
+}
+
+func (l *Logger) Debug(v ...interface{}) {
+	l.handle(log.DebugLevel, fmt.Sprint(v...))
+}
+
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.handle(log.DebugLevel, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Info(v ...interface{}) {
+	l.handle(log.InfoLevel, fmt.Sprint(v...))
+}
+
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.handle(log.InfoLevel, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Warn(v ...interface{}) {
+	l.handle(log.WarnLevel, fmt.Sprint(v...))
+}
+
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.handle(log.WarnLevel, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Error(v ...interface{}) {
+	l.handle(log.ErrorLevel, fmt.Sprint(v...))
+}
+
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.handle(log.ErrorLevel, fmt.Sprintf(format, v...))
+}
+
+// Trace logs message with duration when End is called on the result
+func (l *Logger) Trace(message string) log.Traceable {
+	return log.WithFields(l.copyFields()...).Trace(message)
+}
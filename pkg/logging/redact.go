@@ -0,0 +1,78 @@
+package logging
+
+import (
+	"crypto"
+	"fmt"
+	"regexp"
+
+	"github.com/go-playground/log"
+)
+
+const Redacted = "[REDACTED]"
+
+var (
+	privateKeyRegexp = regexp.MustCompile(`(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----.*?(-----END [A-Z ]*PRIVATE KEY-----|$)`)
+	// key authorization is "<token>.<base64url SHA-256 thumbprint of account key>"
+	keyAuthorizationRegexp = regexp.MustCompile(`[A-Za-z0-9_-]{16,}\.[A-Za-z0-9_-]{43}`)
+)
+
+// RedactString replaces PEM encoded private keys and ACME key authorizations
+func RedactString(s string) string {
+	s = privateKeyRegexp.ReplaceAllString(s, Redacted)
+	s = keyAuthorizationRegexp.ReplaceAllString(s, Redacted)
+	return s
+}
+
+// RedactValue returns value safe to log; values which aren't basic types are formatted first
+func RedactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	case crypto.Signer, crypto.Decrypter:
+		return Redacted
+	case string:
+		return RedactString(v)
+	case []string:
+		r := make([]string, len(v))
+		for i := range v {
+			r[i] = RedactString(v[i])
+		}
+		return r
+	case []byte:
+		return RedactString(string(v))
+	case error:
+		return RedactString(v.Error())
+	case fmt.Stringer:
+		return RedactString(v.String())
+	default:
+		return RedactString(fmt.Sprintf("%+v", v))
+	}
+}
+
+// Redactor removes secrets from entries before passing them to the underlying handler
+type Redactor struct {
+	handler log.Handler
+}
+
+func NewRedactor(handler log.Handler) *Redactor {
+	return &Redactor{
+		handler: handler,
+	}
+}
+
+func (r *Redactor) Run() chan<- *log.Entry {
+	out := r.handler.Run()
+	in := make(chan *log.Entry)
+
+	go func() {
+		for e := range in {
+			e.Message = RedactString(e.Message)
+			for i := range e.Fields {
+				e.Fields[i].Value = RedactValue(e.Fields[i].Value)
+			}
+			out <- e
+		}
+	}()
+
+	return in
+}
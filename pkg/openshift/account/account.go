@@ -19,6 +19,7 @@ import (
 
 const (
 	AnnotationAcmeAccountContactsKey = "kubernetes.io/acme.account-contacts"
+	AnnotationAcmeDirectoryUrlKey    = "kubernetes.io/acme.directory-url"
 	DataAcmeAccountCertificatesKey   = "kubernetes.io-acme.account-certificates"
 	DataAcmeAccountUrlKey            = "acme.account-url"
 	DataTlslKey                      = "tls.key"
@@ -34,9 +35,19 @@ type Authorization struct {
 	acmelib.Authorization
 }
 
+// CertificateRecord is a certificate issued by the account for objects in Namespace.
+// Namespace is empty for records created before accounts could be shared across namespaces
+// and those belong to the namespace of the account.
+type CertificateRecord struct {
+	Namespace string `json:",omitempty"`
+	*cert.Certificate
+}
+
+// Account is an ACME account stored in a secret. Certificates holds records loaded from its certificate secrets
+// and from the account secret itself for accounts created before each set of domains got its own secret.
 type Account struct {
 	Client         acme.Client
-	Certificates   []*cert.Certificate
+	Certificates   []*CertificateRecord
 	authorizations []*Authorization
 	Secret         *api_v1.Secret
 }
@@ -59,6 +70,14 @@ func NewAccountFromSecret(secret *api_v1.Secret, acmeUrl string) (a *Account, er
 	}
 	url := string(urlBytes)
 
+	// accounts created by older versions don't have the directory recorded
+	if secret.Annotations != nil {
+		directoryUrl, found := secret.Annotations[AnnotationAcmeDirectoryUrlKey]
+		if found && directoryUrl != "" {
+			acmeUrl = directoryUrl
+		}
+	}
+
 	block, _ := pem.Decode(keyPem)
 	if block == nil {
 		err = errors.New("existing account has invalid PEM encoded private key")
@@ -104,6 +123,12 @@ func NewAccountFromSecret(secret *api_v1.Secret, acmeUrl string) (a *Account, er
 				// TODO: update secret.status to tell it to the user
 			}
 			for _, c := range a.Certificates {
+				if c.Certificate == nil {
+					continue
+				}
+				if c.Namespace == "" {
+					c.Namespace = secret.Namespace
+				}
 				c.UpdateTargetCertificate()
 			}
 		}
@@ -141,13 +166,6 @@ func (a *Account) ToSecret() (*api_v1.Secret, error) {
 	a.Secret.Data[DataAcmeAccountUrlKey] = []byte(a.Client.Account.URI)
 	a.Secret.Data[DataTlslKey] = keyPem
 
-	certificates, err := json.Marshal(a.Certificates)
-	if err != nil {
-		err = fmt.Errorf("unable to marshal certificates '%s': %s", certificates, err)
-		return nil, err
-	}
-	a.Secret.Data[DataAcmeAccountCertificatesKey] = certificates
-
 	if a.Secret.Annotations == nil {
 		a.Secret.Annotations = make(map[string]string)
 	}
@@ -158,6 +176,7 @@ func (a *Account) ToSecret() (*api_v1.Secret, error) {
 		return nil, err
 	}
 	a.Secret.Annotations[AnnotationAcmeAccountContactsKey] = string(contact)
+	a.Secret.Annotations[AnnotationAcmeDirectoryUrlKey] = a.Client.Client.DirectoryURL
 
 	return a.Secret, nil
 }
@@ -0,0 +1,165 @@
+package account
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-playground/log"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// LabelAcmeCertificateType marks a secret holding certificate records for one set of domains (value of LabelAcmeTypeKey)
+	LabelAcmeCertificateType = "certificate"
+
+	// AnnotationAcmeAccountSecretKey is the name of the account secret the certificate records belong to
+	AnnotationAcmeAccountSecretKey = "kubernetes.io/acme.account-secret"
+	// AnnotationAcmeDomainsKey lists the domains of the certificate records, comma separated
+	AnnotationAcmeDomainsKey = "kubernetes.io/acme.domains"
+	// AnnotationAcmeNamespaceKey is the namespace of the objects using the certificates
+	AnnotationAcmeNamespaceKey = "kubernetes.io/acme.namespace"
+
+	DataAcmeCertificatesKey = "kubernetes.io-acme.certificates"
+
+	// MaxCertificateRecords is how many certificates are kept for a set of domains: the current and the previous one
+	MaxCertificateRecords = 2
+)
+
+var (
+	LabelSelectorAcmeCertificate = fmt.Sprintf("%s=%s", LabelAcmeTypeKey, LabelAcmeCertificateType)
+)
+
+// CertificateSecretName returns the name of the secret holding certificate records issued by the account
+// for domains in namespace. The secret lives in the namespace of the account.
+func CertificateSecretName(accountSecretName string, namespace string, domains []string) string {
+	sorted := append([]string{}, domains...)
+	sort.Strings(sorted)
+	hash := sha256.Sum256([]byte(namespace + "/" + strings.Join(sorted, ",")))
+	return fmt.Sprintf("%s.%x", accountSecretName, hash[:8])
+}
+
+// NewCertificateSecret returns an empty secret for certificate records of the account
+func NewCertificateSecret(accountSecret *api_v1.Secret, namespace string, domains []string) *api_v1.Secret {
+	return &api_v1.Secret{
+		ObjectMeta: api_v1.ObjectMeta{
+			Name:      CertificateSecretName(accountSecret.Name, namespace, domains),
+			Namespace: accountSecret.Namespace,
+			Labels: map[string]string{
+				LabelAcmeTypeKey: LabelAcmeCertificateType,
+			},
+			Annotations: map[string]string{
+				AnnotationAcmeAccountSecretKey: accountSecret.Name,
+				AnnotationAcmeDomainsKey:       strings.Join(domains, ","),
+				AnnotationAcmeNamespaceKey:     namespace,
+			},
+		},
+		Type: api_v1.SecretTypeOpaque,
+	}
+}
+
+// CertificateRecordsFromSecret returns the records stored in a certificate secret
+func CertificateRecordsFromSecret(secret *api_v1.Secret) ([]*CertificateRecord, error) {
+	var records []*CertificateRecord
+	data, found := secret.Data[DataAcmeCertificatesKey]
+	if !found {
+		return records, nil
+	}
+
+	err := json.Unmarshal(data, &records)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal certificates in secret '%s/%s': %s", secret.Namespace, secret.Name, err)
+	}
+
+	r := make([]*CertificateRecord, 0, len(records))
+	for _, c := range records {
+		if c.Certificate == nil {
+			continue
+		}
+		if err := c.UpdateTargetCertificate(); err != nil {
+			log.Debugf("ignoring malformed certificate in secret '%s/%s': %s", secret.Namespace, secret.Name, err)
+			continue
+		}
+		r = append(r, c)
+	}
+
+	return r, nil
+}
+
+// SetCertificateRecords stores records into a certificate secret
+func SetCertificateRecords(secret *api_v1.Secret, records []*CertificateRecord) error {
+	data, err := json.Marshal(records)
+	if err != nil {
+		return fmt.Errorf("unable to marshal certificates: %s", err)
+	}
+
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+	secret.Data[DataAcmeCertificatesKey] = data
+
+	return nil
+}
+
+// byNotAfterDesc sorts records by expiration of their certificates, the latest first
+type byNotAfterDesc []*CertificateRecord
+
+func (r byNotAfterDesc) Len() int      { return len(r) }
+func (r byNotAfterDesc) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byNotAfterDesc) Less(i, j int) bool {
+	return r[i].Certificate.Certificate.NotAfter.After(r[j].Certificate.Certificate.NotAfter)
+}
+
+// PruneCertificateRecords drops expired records and keeps at most MaxCertificateRecords of the freshest ones,
+// freshest first. All records are expected to be for the same namespace and domains.
+func PruneCertificateRecords(records []*CertificateRecord, now time.Time) []*CertificateRecord {
+	r := make([]*CertificateRecord, 0, len(records))
+	for _, c := range records {
+		if c.Certificate == nil || c.Certificate.Certificate == nil {
+			continue
+		}
+		if now.After(c.Certificate.Certificate.NotAfter) {
+			continue
+		}
+		r = append(r, c)
+	}
+
+	sort.Stable(byNotAfterDesc(r))
+
+	if len(r) > MaxCertificateRecords {
+		r = r[:MaxCertificateRecords]
+	}
+
+	return r
+}
+
+// LoadCertificateRecords adds records from certificate secrets belonging to this account
+func (a *Account) LoadCertificateRecords(secrets []api_v1.Secret) {
+	for i := range secrets {
+		secret := &secrets[i]
+		if secret.Namespace != a.Secret.Namespace || secret.Annotations[AnnotationAcmeAccountSecretKey] != a.Secret.Name {
+			continue
+		}
+
+		records, err := CertificateRecordsFromSecret(secret)
+		if err != nil {
+			log.Debug(err)
+			// ignore this error because it was caused by invalid value put in there by user
+			continue
+		}
+		a.Certificates = append(a.Certificates, records...)
+	}
+}
+
+// HasLegacyCertificates tells if the account secret still holds certificate records
+// in the format used before each set of domains got its own secret
+func (a *Account) HasLegacyCertificates() bool {
+	if a.Secret == nil {
+		return false
+	}
+	_, found := a.Secret.Data[DataAcmeAccountCertificatesKey]
+	return found
+}
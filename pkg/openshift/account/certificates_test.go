@@ -0,0 +1,66 @@
+package account
+
+import (
+	"crypto/x509"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tnozicka/openshift-acme/pkg/cert"
+)
+
+func newTestRecord(serial int64, notAfter time.Time) *CertificateRecord {
+	return &CertificateRecord{
+		Namespace: "test",
+		Certificate: &cert.Certificate{
+			Certificate: &x509.Certificate{
+				SerialNumber: big.NewInt(serial),
+				NotAfter:     notAfter,
+			},
+		},
+	}
+}
+
+func TestPruneCertificateRecords(t *testing.T) {
+	now := time.Now()
+	expired := newTestRecord(1, now.Add(-time.Hour))
+	previous := newTestRecord(2, now.Add(time.Hour))
+	older := newTestRecord(3, now.Add(time.Minute))
+	current := newTestRecord(4, now.Add(24*time.Hour))
+	unparsed := &CertificateRecord{Namespace: "test", Certificate: &cert.Certificate{}}
+
+	testTable := []struct {
+		name     string
+		records  []*CertificateRecord
+		expected []*CertificateRecord
+	}{
+		{
+			name:     "empty",
+			records:  nil,
+			expected: []*CertificateRecord{},
+		},
+		{
+			name:     "only expired",
+			records:  []*CertificateRecord{expired, unparsed},
+			expected: []*CertificateRecord{},
+		},
+		{
+			name:     "ordered freshest first",
+			records:  []*CertificateRecord{previous, expired, current},
+			expected: []*CertificateRecord{current, previous},
+		},
+		{
+			name:     "keeps current and previous",
+			records:  []*CertificateRecord{older, current, previous},
+			expected: []*CertificateRecord{current, previous},
+		},
+	}
+
+	for _, item := range testTable {
+		got := PruneCertificateRecords(item.records, now)
+		if !reflect.DeepEqual(got, item.expected) {
+			t.Errorf("%s: expected %v, got %v", item.name, item.expected, got)
+		}
+	}
+}
@@ -17,6 +17,16 @@ type RoutePort struct {
 	TargetPort string `json:"targetPort"`
 }
 
+const (
+	TlsTerminationEdge        = "edge"
+	TlsTerminationPassthrough = "passthrough"
+	TlsTerminationReencrypt   = "reencrypt"
+
+	InsecureEdgeTerminationPolicyNone     = "None"
+	InsecureEdgeTerminationPolicyAllow    = "Allow"
+	InsecureEdgeTerminationPolicyRedirect = "Redirect"
+)
+
 type TlsConfig struct {
 	Termination                   string `json:"termination,omitempty"`
 	Certificate                   string `json:"certificate,omitempty"`
@@ -44,6 +54,7 @@ type RouteIngressCondition struct {
 
 type RouteIngress struct {
 	Host           string                  `json:"host,omitempty"`
+	RouterName     string                  `json:"routerName,omitempty"`
 	RouteName      string                  `json:"routeName,omitempty"`
 	Conditions     []RouteIngressCondition `json:"conditions,omitempty"`
 	WildcardPolicy string                  `json:"wildcardPolicy,omitempty"`
@@ -53,9 +64,28 @@ type RouteStatus struct {
 	Ingress []RouteIngress `json:"ingress,"`
 }
 
+// RouterAdmission returns whether the route was admitted for every router that has reported its Admitted condition
+func (s *RouteStatus) RouterAdmission() map[string]bool {
+	admission := make(map[string]bool)
+	for _, ingress := range s.Ingress {
+		for _, condition := range ingress.Conditions {
+			if condition.Type == "Admitted" {
+				admission[ingress.RouterName] = condition.Status == "True"
+			}
+		}
+	}
+	return admission
+}
+
 type Route struct {
 	unversioned.TypeMeta `json:",inline"`
 	apiv1.ObjectMeta     `json:"metadata,omitempty"`
 	Spec                 RouteSpec   `json:"spec"`
 	Status               RouteStatus `json:"status"`
 }
+
+type RouteList struct {
+	unversioned.TypeMeta `json:",inline"`
+	unversioned.ListMeta `json:"metadata,omitempty"`
+	Items                []Route `json:"items"`
+}
@@ -0,0 +1,329 @@
+package archive
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/go-playground/log"
+	accountlib "github.com/tnozicka/openshift-acme/pkg/openshift/account"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	kerrors "k8s.io/client-go/pkg/api/errors"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// Version of the archive format
+	Version = 1
+
+	EncryptionAESGCM = "aes-256-gcm+pbkdf2-sha256"
+
+	pbkdf2Iterations = 100000
+	saltLength       = 16
+
+	// annotation marking certificate secrets created by the controller
+	annotationLastUpdateTimeKey = "kubernetes.io/tls-acme.last-update-time"
+)
+
+// Archive holds ACME account secrets with their certificate records and certificate secrets of managed routes
+type Archive struct {
+	Version int             `json:"version"`
+	Created time.Time       `json:"created"`
+	Secrets []api_v1.Secret `json:"secrets"`
+}
+
+// envelope is what gets written to the file; exactly one of Archive and Ciphertext is set
+type envelope struct {
+	Version    int      `json:"version"`
+	Encryption string   `json:"encryption,omitempty"`
+	Iterations int      `json:"iterations,omitempty"`
+	Salt       []byte   `json:"salt,omitempty"`
+	Nonce      []byte   `json:"nonce,omitempty"`
+	Ciphertext []byte   `json:"ciphertext,omitempty"`
+	Archive    *Archive `json:"archive,omitempty"`
+}
+
+func isAccountSecret(secret *api_v1.Secret) bool {
+	return secret.Labels[accountlib.LabelAcmeTypeKey] == accountlib.LabelAcmeAccountType
+}
+
+func isCertificateRecordsSecret(secret *api_v1.Secret) bool {
+	return secret.Labels[accountlib.LabelAcmeTypeKey] == accountlib.LabelAcmeCertificateType
+}
+
+func isCertificateSecret(secret *api_v1.Secret) bool {
+	_, found := secret.Annotations[annotationLastUpdateTimeKey]
+	return found && secret.Type == api_v1.SecretTypeTLS
+}
+
+// cleanSecret drops everything bound to the source cluster
+func cleanSecret(secret api_v1.Secret) api_v1.Secret {
+	return api_v1.Secret{
+		ObjectMeta: api_v1.ObjectMeta{
+			Name:        secret.Name,
+			Namespace:   secret.Namespace,
+			Labels:      secret.Labels,
+			Annotations: secret.Annotations,
+		},
+		Type: secret.Type,
+		Data: secret.Data,
+	}
+}
+
+// Collect reads all account and certificate secrets from namespaces; empty namespace means all namespaces
+func Collect(client v1core.CoreV1Interface, namespaces []string) (*Archive, error) {
+	a := &Archive{
+		Version: Version,
+		Created: time.Now().UTC(),
+	}
+
+	seen := make(map[string]bool)
+	for _, namespace := range namespaces {
+		secretList, err := client.Secrets(namespace).List(api_v1.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("listing secrets in namespace '%s' failed: %s", namespace, err)
+		}
+
+		for _, secret := range secretList.Items {
+			if !isAccountSecret(&secret) && !isCertificateRecordsSecret(&secret) && !isCertificateSecret(&secret) {
+				continue
+			}
+
+			key := secret.Namespace + "/" + secret.Name
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			a.Secrets = append(a.Secrets, cleanSecret(secret))
+		}
+	}
+
+	return a, nil
+}
+
+// RemapNamespaces moves secrets and certificate records between namespaces according to mapping (old => new)
+func (a *Archive) RemapNamespaces(mapping map[string]string) error {
+	remap := func(namespace string) string {
+		if newNamespace, found := mapping[namespace]; found {
+			return newNamespace
+		}
+		return namespace
+	}
+
+	for i := range a.Secrets {
+		secret := &a.Secrets[i]
+		oldNamespace := secret.Namespace
+		secret.Namespace = remap(oldNamespace)
+
+		key := accountlib.DataAcmeAccountCertificatesKey
+		switch {
+		case isAccountSecret(secret):
+		case isCertificateRecordsSecret(secret):
+			// the name is derived from the namespace the records belong to
+			key = accountlib.DataAcmeCertificatesKey
+			namespace := remap(secret.Annotations[accountlib.AnnotationAcmeNamespaceKey])
+			domains := strings.Split(secret.Annotations[accountlib.AnnotationAcmeDomainsKey], ",")
+			secret.Name = accountlib.CertificateSecretName(secret.Annotations[accountlib.AnnotationAcmeAccountSecretKey], namespace, domains)
+			secret.Annotations[accountlib.AnnotationAcmeNamespaceKey] = namespace
+		default:
+			continue
+		}
+
+		data, found := secret.Data[key]
+		if !found {
+			continue
+		}
+
+		var records []*accountlib.CertificateRecord
+		if err := json.Unmarshal(data, &records); err != nil {
+			return fmt.Errorf("account '%s/%s': unable to unmarshal certificates: %s", oldNamespace, secret.Name, err)
+		}
+		for _, record := range records {
+			// empty namespace means the namespace of the account
+			if record.Namespace != "" {
+				record.Namespace = remap(record.Namespace)
+			}
+		}
+		data, err := json.Marshal(records)
+		if err != nil {
+			return err
+		}
+		secret.Data[key] = data
+	}
+
+	return nil
+}
+
+// Restore creates the secrets; existing secrets are only replaced if overwrite is set
+func (a *Archive) Restore(client v1core.CoreV1Interface, overwrite bool) error {
+	for _, secret := range a.Secrets {
+		secret := secret
+		existing, err := client.Secrets(secret.Namespace).Get(secret.Name)
+		if err != nil {
+			if !kerrors.IsNotFound(err) {
+				return err
+			}
+
+			log.Infof("Creating secret '%s/%s'", secret.Namespace, secret.Name)
+			if _, err := client.Secrets(secret.Namespace).Create(&secret); err != nil {
+				return fmt.Errorf("creating secret '%s/%s' failed: %s", secret.Namespace, secret.Name, err)
+			}
+			continue
+		}
+
+		if !overwrite {
+			log.Warnf("Skipping secret '%s/%s' because it already exists", secret.Namespace, secret.Name)
+			continue
+		}
+
+		log.Infof("Replacing secret '%s/%s'", secret.Namespace, secret.Name)
+		if existing.Type != secret.Type {
+			return fmt.Errorf("can't replace secret '%s/%s' of type '%s' with type '%s'", secret.Namespace, secret.Name, existing.Type, secret.Type)
+		}
+		existing.Labels = secret.Labels
+		existing.Annotations = secret.Annotations
+		existing.Data = secret.Data
+		if _, err := client.Secrets(secret.Namespace).Update(existing); err != nil {
+			return fmt.Errorf("updating secret '%s/%s' failed: %s", secret.Namespace, secret.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// pbkdf2 implements PBKDF2 with HMAC-SHA256 (RFC 2898)
+func pbkdf2(password, salt []byte, iterations, keyLength int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLength := prf.Size()
+	blocks := (keyLength + hashLength - 1) / hashLength
+
+	var buf [4]byte
+	dk := make([]byte, 0, blocks*hashLength)
+	u := make([]byte, hashLength)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf[:], uint32(block))
+		prf.Write(buf[:])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLength:]
+		copy(u, t)
+
+		for n := 2; n <= iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = u[:0]
+			u = prf.Sum(u)
+			for i := range u {
+				t[i] ^= u[i]
+			}
+		}
+	}
+
+	return dk[:keyLength]
+}
+
+func newGCM(passphrase, salt []byte, iterations int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2(passphrase, salt, iterations, 32))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encode writes the archive; it is encrypted if passphrase isn't empty
+func (a *Archive) Encode(w io.Writer, passphrase []byte) error {
+	e := envelope{
+		Version: Version,
+	}
+
+	if len(passphrase) == 0 {
+		e.Archive = a
+	} else {
+		plaintext, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+
+		e.Encryption = EncryptionAESGCM
+		e.Iterations = pbkdf2Iterations
+		e.Salt = make([]byte, saltLength)
+		if _, err := io.ReadFull(rand.Reader, e.Salt); err != nil {
+			return err
+		}
+		gcm, err := newGCM(passphrase, e.Salt, e.Iterations)
+		if err != nil {
+			return err
+		}
+		e.Nonce = make([]byte, gcm.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, e.Nonce); err != nil {
+			return err
+		}
+		e.Ciphertext = gcm.Seal(nil, e.Nonce, plaintext, nil)
+	}
+
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Decode reads archive written by Encode
+func Decode(r io.Reader, passphrase []byte) (*Archive, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var e envelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("malformed archive: %s", err)
+	}
+	if e.Version != Version {
+		return nil, fmt.Errorf("unsupported archive version %d", e.Version)
+	}
+
+	switch e.Encryption {
+	case "":
+		if e.Archive == nil {
+			return nil, errors.New("malformed archive: missing content")
+		}
+		return e.Archive, nil
+	case EncryptionAESGCM:
+		if len(passphrase) == 0 {
+			return nil, errors.New("archive is encrypted but no passphrase was given")
+		}
+		gcm, err := newGCM(passphrase, e.Salt, e.Iterations)
+		if err != nil {
+			return nil, err
+		}
+		if len(e.Nonce) != gcm.NonceSize() {
+			return nil, errors.New("malformed archive: invalid nonce")
+		}
+		plaintext, err := gcm.Open(nil, e.Nonce, e.Ciphertext, nil)
+		if err != nil {
+			return nil, errors.New("unable to decrypt archive: wrong passphrase or corrupted data")
+		}
+
+		var a Archive
+		if err := json.Unmarshal(plaintext, &a); err != nil {
+			return nil, fmt.Errorf("malformed archive: %s", err)
+		}
+		return &a, nil
+	default:
+		return nil, fmt.Errorf("unsupported archive encryption '%s'", e.Encryption)
+	}
+}
@@ -0,0 +1,134 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	accountlib "github.com/tnozicka/openshift-acme/pkg/openshift/account"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+)
+
+func TestPbkdf2(t *testing.T) {
+	// RFC 7914, section 11
+	expected := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	got := hex.EncodeToString(pbkdf2([]byte("passwd"), []byte("salt"), 1, 64))
+	if got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+}
+
+func newTestArchive() *Archive {
+	return &Archive{
+		Version: Version,
+		Secrets: []api_v1.Secret{
+			{
+				ObjectMeta: api_v1.ObjectMeta{
+					Name:      "acme-account",
+					Namespace: "old",
+					Labels:    map[string]string{accountlib.LabelAcmeTypeKey: accountlib.LabelAcmeAccountType},
+				},
+				Data: map[string][]byte{
+					accountlib.DataAcmeAccountCertificatesKey: []byte(`[{"Namespace":"old","Crt":null,"Key":null},{"Crt":null,"Key":null},{"Namespace":"other","Crt":null,"Key":null}]`),
+				},
+			},
+			{
+				ObjectMeta: api_v1.ObjectMeta{
+					Name:      accountlib.CertificateSecretName("acme-account", "old", []string{"example.com"}),
+					Namespace: "old",
+					Labels:    map[string]string{accountlib.LabelAcmeTypeKey: accountlib.LabelAcmeCertificateType},
+					Annotations: map[string]string{
+						accountlib.AnnotationAcmeAccountSecretKey: "acme-account",
+						accountlib.AnnotationAcmeDomainsKey:       "example.com",
+						accountlib.AnnotationAcmeNamespaceKey:     "old",
+					},
+				},
+				Data: map[string][]byte{
+					accountlib.DataAcmeCertificatesKey: []byte(`[{"Namespace":"old","Crt":null,"Key":null}]`),
+				},
+			},
+		},
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	testTable := []struct {
+		name              string
+		encodePassphrase  string
+		decodePassphrase  string
+		expectDecodeError bool
+	}{
+		{"plain", "", "", false},
+		{"encrypted", "secret", "secret", false},
+		{"wrong passphrase", "secret", "wrong", true},
+		{"missing passphrase", "secret", "", true},
+	}
+
+	for _, item := range testTable {
+		a := newTestArchive()
+		var buf bytes.Buffer
+		if err := a.Encode(&buf, []byte(item.encodePassphrase)); err != nil {
+			t.Fatalf("%s: %s", item.name, err)
+		}
+
+		if item.encodePassphrase != "" && bytes.Contains(buf.Bytes(), []byte("acme-account")) {
+			t.Errorf("%s: encrypted archive contains plaintext", item.name)
+		}
+
+		decoded, err := Decode(&buf, []byte(item.decodePassphrase))
+		if item.expectDecodeError {
+			if err == nil {
+				t.Errorf("%s: expected an error", item.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", item.name, err)
+		}
+		if !reflect.DeepEqual(a, decoded) {
+			t.Errorf("%s: expected %#v, got %#v", item.name, a, decoded)
+		}
+	}
+}
+
+func TestRemapNamespaces(t *testing.T) {
+	a := newTestArchive()
+	if err := a.RemapNamespaces(map[string]string{"old": "new"}); err != nil {
+		t.Fatal(err)
+	}
+
+	secret := a.Secrets[0]
+	if secret.Namespace != "new" {
+		t.Errorf("expected namespace 'new', got '%s'", secret.Namespace)
+	}
+
+	var records []accountlib.CertificateRecord
+	if err := json.Unmarshal(secret.Data[accountlib.DataAcmeAccountCertificatesKey], &records); err != nil {
+		t.Fatal(err)
+	}
+	var namespaces []string
+	for _, record := range records {
+		namespaces = append(namespaces, record.Namespace)
+	}
+	expected := []string{"new", "", "other"}
+	if !reflect.DeepEqual(namespaces, expected) {
+		t.Errorf("expected record namespaces %v, got %v", expected, namespaces)
+	}
+
+	secret = a.Secrets[1]
+	expectedName := accountlib.CertificateSecretName("acme-account", "new", []string{"example.com"})
+	if secret.Namespace != "new" || secret.Name != expectedName {
+		t.Errorf("expected certificate secret 'new/%s', got '%s/%s'", expectedName, secret.Namespace, secret.Name)
+	}
+	if secret.Annotations[accountlib.AnnotationAcmeNamespaceKey] != "new" {
+		t.Errorf("expected namespace annotation 'new', got '%s'", secret.Annotations[accountlib.AnnotationAcmeNamespaceKey])
+	}
+	if err := json.Unmarshal(secret.Data[accountlib.DataAcmeCertificatesKey], &records); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Namespace != "new" {
+		t.Errorf("expected a record in namespace 'new', got %#v", records)
+	}
+}
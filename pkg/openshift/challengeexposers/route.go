@@ -6,12 +6,14 @@ import (
 	"encoding/base32"
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/go-playground/log"
 	"github.com/tnozicka/openshift-acme/pkg/acme"
+	"github.com/tnozicka/openshift-acme/pkg/dryrun"
+	"github.com/tnozicka/openshift-acme/pkg/logging"
 	oapi "github.com/tnozicka/openshift-acme/pkg/openshift/api"
 	"github.com/tnozicka/openshift-acme/pkg/openshift/untypedclient"
 	acmelib "golang.org/x/crypto/acme"
@@ -21,11 +23,31 @@ import (
 	"k8s.io/client-go/pkg/util/intstr"
 )
 
+var (
+	// RouterPropagationDelay is how long Expose waits for the router to pick up the temporary route
+	RouterPropagationDelay = 10 * time.Second
+	// RouterAdmissionTimeout is how long Expose waits for all RouterNames to admit the temporary route
+	RouterAdmissionTimeout = 2 * time.Minute
+)
+
+const routerAdmissionPollInterval = 1 * time.Second
+
 type Route struct {
 	UnderlyingExposer          acme.ChallengeExposer
 	Client                     v1core.CoreV1Interface
 	Namespace                  string
 	SelfServiceEndpointSubsets []api_v1.EndpointSubset
+	InFlight                   *InFlight
+	// Owner is set as owner of all temporary objects if not nil
+	Owner *api_v1.OwnerReference
+	// DryRun records temporary objects instead of creating them if not nil
+	DryRun *dryrun.Recorder
+	// Logger carries context of the object the challenge is exposed for; may be nil
+	Logger *logging.Logger
+	// Labels are set on the temporary route so router shards selecting routes by labels admit it
+	Labels map[string]string
+	// RouterNames are the router shards serving the original route; Expose waits until each of them admits the temporary route
+	RouterNames []string
 }
 
 func getDomainHash(domain string) string {
@@ -34,34 +56,76 @@ func getDomainHash(domain string) string {
 	return hashString
 }
 
-func getTmpRouteName(domain string) string {
-	return "acme-" + getDomainHash(domain)
+// getTmpRouteName includes the token so concurrent challenges for the same domain never share objects
+func getTmpRouteName(domain string, token string) string {
+	return "acme-" + getDomainHash(domain) + "-" + getTokenHash(token)
 }
 
-func (r *Route) Expose(a *acmelib.Client, domain string, token string) error {
-	// TODO: consider handling errors vs. logging in concurrent functions
+func getTokenHash(token string) string {
+	return getDomainHash(token)
+}
+
+// setMeta marks temporary objects as ours so they can be found by Sweeper
+func (r *Route) setMeta(meta *api_v1.ObjectMeta, token string) {
+	if meta.Labels == nil {
+		meta.Labels = make(map[string]string)
+	}
+	meta.Labels[LabelExposerKey] = LabelExposerRoute
+	meta.Labels[LabelTokenHashKey] = getTokenHash(token)
+	meta.Labels[LabelCreatedKey] = strconv.FormatInt(time.Now().Unix(), 10)
+
+	if r.Owner != nil {
+		meta.OwnerReferences = []api_v1.OwnerReference{*r.Owner}
+	}
+}
+
+// isOwned checks that an existing object was created by this exposer for the same challenge
+func isOwned(meta *api_v1.ObjectMeta, token string) bool {
+	return meta.Labels[LabelExposerKey] == LabelExposerRoute && meta.Labels[LabelTokenHashKey] == getTokenHash(token)
+}
+
+func foreignObjectError(kind string, namespace string, name string) error {
+	return fmt.Errorf("route challenge exposer: refusing to modify %s '%s/%s' because it wasn't created by this controller for this challenge", kind, namespace, name)
+}
 
-	tmpName := getTmpRouteName(domain)
+func (r *Route) Expose(a *acmelib.Client, domain string, token string) (err error) {
+	tmpName := getTmpRouteName(domain, token)
 	namespace := r.Namespace
 
+	if r.DryRun.Enabled() {
+		for _, kind := range []string{"endpoints", "service", "route"} {
+			r.DryRun.Record(dryrun.VerbCreate, kind, namespace, tmpName, "to expose http-01 challenge for "+domain)
+		}
+		return nil
+	}
+
+	// Remove won't be called if we fail so let Sweeper clean up whatever we've created
+	r.InFlight.Add(namespace, tmpName)
+	defer func() {
+		if err != nil {
+			r.InFlight.Remove(namespace, tmpName)
+		}
+	}()
+
 	maxTries := 10
 	var wg sync.WaitGroup
+	errCh := make(chan error, 3)
 
 	// Create temporary endpoints
+	wg.Add(1)
 	go func() {
-		wg.Add(1)
 		defer wg.Done()
 
 		updateEndpoints := func(endpoints *api_v1.Endpoints) {
+			r.setMeta(&endpoints.ObjectMeta, token)
 			endpoints.Subsets = r.SelfServiceEndpointSubsets
 		}
 
 		for i := 1; i <= maxTries; i++ {
-			log.Debugf("Creating Endpoints %s/%s for exposing (%d/%d)", namespace, tmpName, i, maxTries)
+			r.Logger.Debugf("Creating Endpoints %s/%s for exposing (%d/%d)", namespace, tmpName, i, maxTries)
 			endpoints, err := r.Client.Endpoints(namespace).Get(tmpName)
 			if err != nil {
-				kerr, ok := err.(*kerrors.StatusError)
-				if ok && kerr.Status().Code == 404 {
+				if kerrors.IsNotFound(err) {
 					// There are no endpoints present - this is good
 					// (it means that previous object was properly cleaned)
 					// we will create new one
@@ -74,49 +138,52 @@ func (r *Route) Expose(a *acmelib.Client, domain string, token string) error {
 
 					endpoints, err = r.Client.Endpoints(namespace).Create(endpoints)
 					if err != nil {
-						kerr, ok := err.(*kerrors.StatusError)
-						if ok && kerr.Status().Code == 409 {
+						if kerrors.IsAlreadyExists(err) {
 							// Endpoints have been created in the meantime
-							log.Warnf("route challenge exposer: creating endpoints %s/%s failed because of collision: %s", tmpName, namespace, err)
+							r.Logger.Warnf("route challenge exposer: creating endpoints %s/%s failed because of collision: %s", namespace, tmpName, err)
 							continue
-						} else {
-							log.Errorf("route challenge exposer: creating endpoints %s/%s failed: %s", tmpName, namespace, err)
-							return
 						}
+						errCh <- fmt.Errorf("route challenge exposer: creating endpoints %s/%s failed: %s", namespace, tmpName, err)
+						return
 					}
 
-					return
-				} else {
-					log.Errorf("route challenge exposer: reading endpoints %s/%s failed: %s", tmpName, namespace, err)
 					return
 				}
+				errCh <- fmt.Errorf("route challenge exposer: reading endpoints %s/%s failed: %s", namespace, tmpName, err)
+				return
+			}
+
+			if !isOwned(&endpoints.ObjectMeta, token) {
+				errCh <- foreignObjectError("endpoints", namespace, tmpName)
+				return
 			}
 
 			updateEndpoints(endpoints)
 
 			endpoints, err = r.Client.Endpoints(namespace).Update(endpoints)
 			if err != nil {
-				kerr, ok := err.(*kerrors.StatusError)
-				if ok && kerr.Status().Code == 409 {
+				if kerrors.IsConflict(err) {
 					// There has been a change on endpoints
-					log.Warnf("route challenge exposer: updating endpoints %s/%s failed because of collision: %s", tmpName, namespace, err)
+					r.Logger.Warnf("route challenge exposer: updating endpoints %s/%s failed because of collision: %s", namespace, tmpName, err)
 					continue
-				} else {
-					log.Errorf("route challenge exposer: updating endpoints %s/%s failed: %s", tmpName, namespace, err)
-					return
 				}
+				errCh <- fmt.Errorf("route challenge exposer: updating endpoints %s/%s failed: %s", namespace, tmpName, err)
+				return
 			}
 
 			return
 		}
+
+		errCh <- fmt.Errorf("route challenge exposer: creating endpoints %s/%s failed after %d attempts", namespace, tmpName, maxTries)
 	}()
 
 	// Create temporary service
+	wg.Add(1)
 	go func() {
-		wg.Add(1)
 		defer wg.Done()
 
 		updateService := func(service *api_v1.Service) {
+			r.setMeta(&service.ObjectMeta, token)
 			service.Spec.ClusterIP = "None"
 			service.Spec.Ports = []api_v1.ServicePort{
 				{Name: "http", Protocol: "TCP", Port: 80, TargetPort: intstr.IntOrString{Type: intstr.Int, IntVal: 80}},
@@ -124,11 +191,10 @@ func (r *Route) Expose(a *acmelib.Client, domain string, token string) error {
 		}
 
 		for i := 1; i <= maxTries; i++ {
-			log.Debugf("Creating Service %s/%s for exposing (%d/%d)", namespace, tmpName, i, maxTries)
+			r.Logger.Debugf("Creating Service %s/%s for exposing (%d/%d)", namespace, tmpName, i, maxTries)
 			service, err := r.Client.Services(namespace).Get(tmpName)
 			if err != nil {
-				kerr, ok := err.(*kerrors.StatusError)
-				if ok && kerr.Status().Code == 404 {
+				if kerrors.IsNotFound(err) {
 					// There is no service present - this is good
 					// (it means that previous object was properly cleaned)
 					// we will create new one
@@ -141,51 +207,60 @@ func (r *Route) Expose(a *acmelib.Client, domain string, token string) error {
 
 					service, err = r.Client.Services(namespace).Create(service)
 					if err != nil {
-						kerr, ok := err.(*kerrors.StatusError)
-						if ok && kerr.Status().Code == 409 {
+						if kerrors.IsAlreadyExists(err) {
 							// Service has been created in the meantime
-							log.Warnf("route challenge exposer: creating service %s/%s failed because of collision: %s", tmpName, namespace, err)
+							r.Logger.Warnf("route challenge exposer: creating service %s/%s failed because of collision: %s", namespace, tmpName, err)
 							continue
-						} else {
-							log.Errorf("route challenge exposer: creating service %s/%s failed: %s", tmpName, namespace, err)
-							return
 						}
+						errCh <- fmt.Errorf("route challenge exposer: creating service %s/%s failed: %s", namespace, tmpName, err)
+						return
 					}
 
-					return
-				} else {
-					log.Errorf("route challenge exposer: reading service %s/%s failed: %s", tmpName, namespace, err)
 					return
 				}
+				errCh <- fmt.Errorf("route challenge exposer: reading service %s/%s failed: %s", namespace, tmpName, err)
+				return
+			}
+
+			if !isOwned(&service.ObjectMeta, token) {
+				errCh <- foreignObjectError("service", namespace, tmpName)
+				return
 			}
 
 			updateService(service)
 
 			service, err = r.Client.Services(namespace).Update(service)
 			if err != nil {
-				kerr, ok := err.(*kerrors.StatusError)
-				if ok && kerr.Status().Code == 409 {
-					// There has been a change on endpoint
-					log.Warnf("route challenge exposer: updating service %s/%s failed because of collision: %s", tmpName, namespace, err)
+				if kerrors.IsConflict(err) {
+					// There has been a change on service
+					r.Logger.Warnf("route challenge exposer: updating service %s/%s failed because of collision: %s", namespace, tmpName, err)
 					continue
-				} else {
-					log.Errorf("route challenge exposer: updating service %s/%s failed: %s", tmpName, namespace, err)
-					return
 				}
+				errCh <- fmt.Errorf("route challenge exposer: updating service %s/%s failed: %s", namespace, tmpName, err)
+				return
 			}
 
 			return
 		}
+
+		errCh <- fmt.Errorf("route challenge exposer: creating service %s/%s failed after %d attempts", namespace, tmpName, maxTries)
 	}()
 
 	// Create temporary route
+	wg.Add(1)
 	go func() {
-		wg.Add(1)
 		defer wg.Done()
 
 		typeUrl := fmt.Sprintf("/oapi/v1/namespaces/%s/routes", namespace)
 		resourceUrl := fmt.Sprintf("/oapi/v1/namespaces/%s/routes/%s", namespace, tmpName)
 		updateRoute := func(route *oapi.Route) {
+			if route.Labels == nil {
+				route.Labels = make(map[string]string)
+			}
+			for key, value := range r.Labels {
+				route.Labels[key] = value
+			}
+			r.setMeta(&route.ObjectMeta, token)
 			route.Spec.Host = domain
 			route.Spec.Path = a.HTTP01ChallengePath(token)
 			route.Spec.To.Kind = "Service"
@@ -199,13 +274,12 @@ func (r *Route) Expose(a *acmelib.Client, domain string, token string) error {
 		}
 
 		for i := 1; i <= maxTries; i++ {
-			log.Debugf("Creating Route %s/%s for exposing (%d/%d)", namespace, tmpName, i, maxTries)
+			r.Logger.Debugf("Creating Route %s/%s for exposing (%d/%d)", namespace, tmpName, i, maxTries)
 
 			var route oapi.Route
 			rawRoute, err := untypedclient.Get(r.Client.RESTClient(), resourceUrl)
 			if err != nil {
-				kerr, ok := err.(*kerrors.StatusError)
-				if ok && kerr.Status().Code == 404 {
+				if kerrors.IsNotFound(err) {
 					// There is no route present - this is good
 					// (it means that previous object was properly cleaned)
 					// we will create new one
@@ -216,104 +290,198 @@ func (r *Route) Expose(a *acmelib.Client, domain string, token string) error {
 
 					payload, err := json.Marshal(&route)
 					if err != nil {
-						log.Errorf("route challenge exposer: marshaling Route failed: %s", err)
+						errCh <- fmt.Errorf("route challenge exposer: marshaling Route failed: %s", err)
 						return
 					}
 					rawRoute, err = untypedclient.Post(r.Client.RESTClient(), typeUrl, payload)
 					if err != nil {
-						kerr, ok := err.(*kerrors.StatusError)
-						if ok && kerr.Status().Code == 409 {
+						if kerrors.IsAlreadyExists(err) {
 							// Route has been created in the meantime
-							log.Warnf("route challenge exposer: creating route %s/%s failed because of collision: %s", tmpName, namespace, err)
+							r.Logger.Warnf("route challenge exposer: creating route %s/%s failed because of collision: %s", namespace, tmpName, err)
 							continue
-						} else {
-							log.Errorf("route challenge exposer: creating route %s/%s failed: %s; raw: %s", tmpName, namespace, err, rawRoute)
-							return
 						}
+						errCh <- fmt.Errorf("route challenge exposer: creating route %s/%s failed: %s; raw: %s", namespace, tmpName, err, rawRoute)
+						return
 					}
 
-					return
-				} else {
-					log.Errorf("route challenge exposer: reading route %s/%s failed: %s", tmpName, namespace, err)
-					return
-				}
-			} else {
-				err := json.Unmarshal(rawRoute, &route)
-				if err != nil {
-					log.Errorf("route challenge exposer: unmarshaling Route %s/%s failed: %s", tmpName, namespace, err)
 					return
 				}
+				errCh <- fmt.Errorf("route challenge exposer: reading route %s/%s failed: %s", namespace, tmpName, err)
+				return
+			}
+
+			err = json.Unmarshal(rawRoute, &route)
+			if err != nil {
+				errCh <- fmt.Errorf("route challenge exposer: unmarshaling Route %s/%s failed: %s", namespace, tmpName, err)
+				return
+			}
+
+			if !isOwned(&route.ObjectMeta, token) {
+				errCh <- foreignObjectError("route", namespace, tmpName)
+				return
 			}
 
 			updateRoute(&route)
 
 			payload, err := json.Marshal(route)
 			if err != nil {
-				log.Errorf("route challenge exposer: marshaling Route failed: %s", err)
+				errCh <- fmt.Errorf("route challenge exposer: marshaling Route failed: %s", err)
 				return
 			}
 			rawRoute, err = untypedclient.Patch(r.Client.RESTClient(), resourceUrl, payload)
 			if err != nil {
-				kerr, ok := err.(*kerrors.StatusError)
-				if ok && kerr.Status().Code == 409 {
+				if kerrors.IsConflict(err) {
 					// There has been a change on route
-					log.Warnf("route challenge exposer: updating route %s/%s failed because of collision: %s", tmpName, namespace, err)
+					r.Logger.Warnf("route challenge exposer: updating route %s/%s failed because of collision: %s", namespace, tmpName, err)
 					continue
-				} else {
-					log.Errorf("route challenge exposer: updating route %s/%s failed: %s", tmpName, namespace, err)
-					return
 				}
+				errCh <- fmt.Errorf("route challenge exposer: updating route %s/%s failed: %s", namespace, tmpName, err)
+				return
 			}
 
 			return
 		}
+
+		errCh <- fmt.Errorf("route challenge exposer: creating route %s/%s failed after %d attempts", namespace, tmpName, maxTries)
 	}()
 
 	wg.Wait()
-	// FIXME: wait for route to be picked up by the router!!!
-	time.Sleep(10 * time.Second)
+	close(errCh)
+
+	for e := range errCh {
+		r.Logger.Error(e)
+		if err == nil {
+			err = e
+		} else {
+			err = fmt.Errorf("%s; %s", err, e)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	err = r.waitForAdmission(namespace, tmpName)
+	if err != nil {
+		r.Logger.Error(err)
+		return err
+	}
+
+	// FIXME: admission doesn't mean the router has already reloaded its configuration
+	time.Sleep(RouterPropagationDelay)
 
 	return r.UnderlyingExposer.Expose(a, domain, token)
 }
 
+// waitForAdmission waits until the temporary route is admitted by every router serving the original route
+func (r *Route) waitForAdmission(namespace string, name string) error {
+	if len(r.RouterNames) == 0 {
+		return nil
+	}
+
+	url := fmt.Sprintf("/oapi/v1/namespaces/%s/routes/%s", namespace, name)
+	deadline := time.Now().Add(RouterAdmissionTimeout)
+	for {
+		rawRoute, err := untypedclient.Get(r.Client.RESTClient(), url)
+		if err != nil {
+			return fmt.Errorf("route challenge exposer: reading route %s/%s failed: %s", namespace, name, err)
+		}
+		var route oapi.Route
+		err = json.Unmarshal(rawRoute, &route)
+		if err != nil {
+			return fmt.Errorf("route challenge exposer: unmarshaling Route %s/%s failed: %s", namespace, name, err)
+		}
+
+		admission := route.Status.RouterAdmission()
+		var pending []string
+		for _, router := range r.RouterNames {
+			admitted, found := admission[router]
+			if !found {
+				pending = append(pending, router)
+				continue
+			}
+			if !admitted {
+				return fmt.Errorf("route challenge exposer: route %s/%s was rejected by router '%s'", namespace, name, router)
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("route challenge exposer: route %s/%s hasn't been admitted by router(s) %v within %s", namespace, name, pending, RouterAdmissionTimeout)
+		}
+		r.Logger.Debugf("Waiting for route %s/%s to be admitted by router(s) %v", namespace, name, pending)
+		time.Sleep(routerAdmissionPollInterval)
+	}
+}
+
 func (r *Route) Remove(a *acmelib.Client, domain string, token string) error {
 	// TODO: consider handling errors vs. logging in concurrent functions
 
-	tmpName := getTmpRouteName(domain)
+	tmpName := getTmpRouteName(domain, token)
 	namespace := r.Namespace
 
+	if r.DryRun.Enabled() {
+		for _, kind := range []string{"service", "endpoints", "route"} {
+			r.DryRun.Record(dryrun.VerbDelete, kind, namespace, tmpName, "after http-01 challenge for "+domain)
+		}
+		return nil
+	}
+
+	// whatever fails to be deleted will be picked up by Sweeper
+	defer r.InFlight.Remove(namespace, tmpName)
+
 	var wg sync.WaitGroup
+	errCh := make(chan error, 3)
 
-	// Remove service and endpoints
-	// (endpoints are removed automatically when service is deleted)
+	// Remove service
+	wg.Add(1)
 	go func() {
-		wg.Add(1)
 		defer wg.Done()
 
 		err := r.Client.Services(namespace).Delete(tmpName, &api_v1.DeleteOptions{})
-		if err != nil {
-			log.Errorf("route challenge exposer: deleting service '%s/%s' failed: %s", namespace, tmpName, err)
-			return
+		if err != nil && !kerrors.IsNotFound(err) {
+			errCh <- fmt.Errorf("route challenge exposer: deleting service '%s/%s' failed: %s", namespace, tmpName, err)
+		}
+	}()
+
+	// Remove endpoints
+	// (endpoints of a service without selector are not removed when the service is deleted)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		err := r.Client.Endpoints(namespace).Delete(tmpName, &api_v1.DeleteOptions{})
+		if err != nil && !kerrors.IsNotFound(err) {
+			errCh <- fmt.Errorf("route challenge exposer: deleting endpoints '%s/%s' failed: %s", namespace, tmpName, err)
 		}
 	}()
 
 	// Remove route
+	wg.Add(1)
 	go func() {
-		wg.Add(1)
 		defer wg.Done()
 
 		url := fmt.Sprintf("/oapi/v1/namespaces/%s/routes/%s", namespace, tmpName)
 		body, err := untypedclient.Delete(r.Client.RESTClient(), url, []byte{})
-		if err != nil {
-			log.Errorf("route challenge exposer: deleting route '%s/%s': %s; %#v", namespace, tmpName, err, string(body))
-			return
+		if err != nil && !kerrors.IsNotFound(err) {
+			errCh <- fmt.Errorf("route challenge exposer: deleting route '%s/%s': %s; %#v", namespace, tmpName, err, string(body))
 		}
-
 	}()
 
 	err := r.UnderlyingExposer.Remove(a, domain, token)
 
 	wg.Wait()
+	close(errCh)
+
+	for e := range errCh {
+		r.Logger.Error(e)
+		if err == nil {
+			err = e
+		} else {
+			err = fmt.Errorf("%s; %s", err, e)
+		}
+	}
 
 	return err
 }
@@ -0,0 +1,154 @@
+package challengeexposers
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	oapi "github.com/tnozicka/openshift-acme/pkg/openshift/api"
+	"github.com/tnozicka/openshift-acme/pkg/openshift/fakeapi"
+	acmelib "golang.org/x/crypto/acme"
+	"k8s.io/client-go/kubernetes"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+)
+
+func TestGetTmpRouteName(t *testing.T) {
+	names := map[string]bool{}
+	for _, item := range []struct {
+		domain string
+		token  string
+	}{
+		{"example.com", "token-a"},
+		{"example.com", "token-b"},
+		{"www.example.com", "token-a"},
+	} {
+		name := getTmpRouteName(item.domain, item.token)
+		if len(name) > 63 {
+			t.Errorf("name '%s' for domain '%s' and token '%s' is longer than 63 characters", name, item.domain, item.token)
+		}
+		if names[name] {
+			t.Errorf("name '%s' for domain '%s' and token '%s' collides with another challenge", name, item.domain, item.token)
+		}
+		names[name] = true
+	}
+}
+
+func TestIsOwned(t *testing.T) {
+	r := &Route{}
+	owned := api_v1.ObjectMeta{}
+	r.setMeta(&owned, "token")
+
+	testTable := []struct {
+		name  string
+		meta  api_v1.ObjectMeta
+		token string
+		owned bool
+	}{
+		{"created for the token", owned, "token", true},
+		{"created for different token", owned, "other-token", false},
+		{"no labels", api_v1.ObjectMeta{}, "token", false},
+		{"foreign labels", api_v1.ObjectMeta{Labels: map[string]string{"app": "acme"}}, "token", false},
+		{"token hash without exposer", api_v1.ObjectMeta{Labels: map[string]string{LabelTokenHashKey: getTokenHash("token")}}, "token", false},
+	}
+
+	for _, item := range testTable {
+		if got := isOwned(&item.meta, item.token); got != item.owned {
+			t.Errorf("%s: expected owned=%t, got %t", item.name, item.owned, got)
+		}
+	}
+}
+
+type nopExposer struct{}
+
+func (nopExposer) Expose(a *acmelib.Client, domain string, token string) error { return nil }
+func (nopExposer) Remove(a *acmelib.Client, domain string, token string) error { return nil }
+
+func TestExposeShardedRouters(t *testing.T) {
+	defer func(delay, timeout time.Duration) {
+		RouterPropagationDelay = delay
+		RouterAdmissionTimeout = timeout
+	}(RouterPropagationDelay, RouterAdmissionTimeout)
+	RouterPropagationDelay = 0
+	RouterAdmissionTimeout = 100 * time.Millisecond
+
+	api := fakeapi.NewServer(fakeapi.Config{
+		AdmitRoutes: true,
+		Routers: map[string]string{
+			"public":   "shard=public",
+			"internal": "shard=internal",
+		},
+	})
+	defer api.Close()
+	clientset, err := kubernetes.NewForConfig(api.RESTConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testTable := []struct {
+		name        string
+		labels      map[string]string
+		routerNames []string
+		err         string
+	}{
+		{
+			name:        "admitted by the shard serving the route",
+			labels:      map[string]string{"shard": "public", "app": "web"},
+			routerNames: []string{"public"},
+		},
+		{
+			name:        "no router shards known",
+			routerNames: nil,
+		},
+		{
+			name:        "missing shard labels",
+			routerNames: []string{"public"},
+			err:         "hasn't been admitted by router(s) [public]",
+		},
+		{
+			name:        "not admitted by every shard",
+			labels:      map[string]string{"shard": "internal"},
+			routerNames: []string{"public", "internal"},
+			err:         "hasn't been admitted by router(s) [public]",
+		},
+	}
+
+	a := &acmelib.Client{}
+	for i, item := range testTable {
+		r := &Route{
+			UnderlyingExposer: nopExposer{},
+			Client:            clientset.CoreV1(),
+			Namespace:         "test",
+			InFlight:          NewInFlight(),
+			Labels:            item.labels,
+			RouterNames:       item.routerNames,
+		}
+		domain := "app.example.com"
+		token := fmt.Sprintf("token-%d", i)
+
+		err := r.Expose(a, domain, token)
+		if item.err == "" && err != nil {
+			t.Errorf("%s: %v", item.name, err)
+		}
+		if item.err != "" && (err == nil || !strings.Contains(err.Error(), item.err)) {
+			t.Errorf("%s: expected error containing %q, got %v", item.name, item.err, err)
+		}
+
+		var route oapi.Route
+		if err := api.Get(fakeapi.ResourceRoutes, "test", getTmpRouteName(domain, token), &route); err != nil {
+			t.Fatalf("%s: %v", item.name, err)
+		}
+		for key, value := range item.labels {
+			if route.Labels[key] != value {
+				t.Errorf("%s: expected label %s=%s on temporary route, got labels %v", item.name, key, value, route.Labels)
+			}
+		}
+		if !isOwned(&route.ObjectMeta, token) {
+			t.Errorf("%s: temporary route has lost its exposer labels: %v", item.name, route.Labels)
+		}
+
+		if err := r.Remove(a, domain, token); err != nil {
+			t.Errorf("%s: %v", item.name, err)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package challengeexposers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-playground/log"
+	"github.com/tnozicka/openshift-acme/pkg/dryrun"
+	oapi "github.com/tnozicka/openshift-acme/pkg/openshift/api"
+	"github.com/tnozicka/openshift-acme/pkg/openshift/untypedclient"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	kerrors "k8s.io/client-go/pkg/api/errors"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// LabelExposerKey marks temporary objects created by a challenge exposer
+	LabelExposerKey   = "kubernetes.io/acme.exposer"
+	LabelExposerRoute = "route"
+	// LabelTokenHashKey holds hash of the challenge token the object was created for
+	LabelTokenHashKey = "kubernetes.io/acme.token-hash"
+	// LabelCreatedKey holds unix time of creation
+	LabelCreatedKey = "kubernetes.io/acme.created"
+)
+
+var (
+	LabelSelectorRouteExposer = fmt.Sprintf("%s=%s", LabelExposerKey, LabelExposerRoute)
+)
+
+// InFlight tracks temporary objects backing challenges that are being validated right now
+type InFlight struct {
+	mutex   sync.Mutex
+	objects map[string]int // namespace/name => number of challenges using it
+}
+
+func NewInFlight() *InFlight {
+	return &InFlight{
+		objects: make(map[string]int),
+	}
+}
+
+func inFlightKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+func (f *InFlight) Add(namespace, name string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.objects[inFlightKey(namespace, name)]++
+}
+
+func (f *InFlight) Remove(namespace, name string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	key := inFlightKey(namespace, name)
+	f.objects[key]--
+	if f.objects[key] <= 0 {
+		delete(f.objects, key)
+	}
+}
+
+func (f *InFlight) Contains(namespace, name string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	_, found := f.objects[inFlightKey(namespace, name)]
+	return found
+}
+
+// Sweeper deletes temporary objects left behind by challenge exposers,
+// e.g. when the controller crashed between Expose and Remove.
+type Sweeper struct {
+	Client     v1core.CoreV1Interface
+	InFlight   *InFlight
+	Namespaces []string
+	// MinAge protects objects which are just being created
+	MinAge time.Duration
+	// DryRun records orphans instead of deleting them if not nil
+	DryRun *dryrun.Recorder
+}
+
+func (s *Sweeper) isOrphan(meta *api_v1.ObjectMeta, now time.Time) bool {
+	if meta.Labels[LabelExposerKey] != LabelExposerRoute {
+		return false
+	}
+
+	created := meta.CreationTimestamp.Time
+	if v, found := meta.Labels[LabelCreatedKey]; found {
+		if unix, err := strconv.ParseInt(v, 10, 64); err == nil {
+			created = time.Unix(unix, 0)
+		}
+	}
+	if now.Sub(created) < s.MinAge {
+		return false
+	}
+
+	return !s.InFlight.Contains(meta.Namespace, meta.Name)
+}
+
+func (s *Sweeper) sweepRoutes(namespace string, now time.Time) error {
+	var typeUrl string
+	if namespace == "" {
+		typeUrl = "/oapi/v1/routes"
+	} else {
+		typeUrl = fmt.Sprintf("/oapi/v1/namespaces/%s/routes", namespace)
+	}
+
+	body, err := untypedclient.Get(s.Client.RESTClient(), typeUrl+"?labelSelector="+url.QueryEscape(LabelSelectorRouteExposer))
+	if err != nil {
+		return fmt.Errorf("listing routes failed: %s", err)
+	}
+
+	var routeList oapi.RouteList
+	if err := json.Unmarshal(body, &routeList); err != nil {
+		return fmt.Errorf("unmarshaling RouteList failed: %s", err)
+	}
+
+	for _, route := range routeList.Items {
+		if !s.isOrphan(&route.ObjectMeta, now) {
+			continue
+		}
+
+		if s.DryRun.Enabled() {
+			s.DryRun.Record(dryrun.VerbDelete, "route", route.Namespace, route.Name, "orphaned by a challenge exposer")
+			continue
+		}
+
+		log.Infof("Sweeper: deleting orphaned route '%s/%s'", route.Namespace, route.Name)
+		resourceUrl := fmt.Sprintf("/oapi/v1/namespaces/%s/routes/%s", route.Namespace, route.Name)
+		body, err := untypedclient.Delete(s.Client.RESTClient(), resourceUrl, []byte{})
+		if err != nil && !kerrors.IsNotFound(err) {
+			log.Errorf("Sweeper: deleting route '%s/%s' failed: %s; %s", route.Namespace, route.Name, err, string(body))
+		}
+	}
+
+	return nil
+}
+
+func (s *Sweeper) sweepServices(namespace string, now time.Time) error {
+	serviceList, err := s.Client.Services(namespace).List(api_v1.ListOptions{
+		LabelSelector: LabelSelectorRouteExposer,
+	})
+	if err != nil {
+		return fmt.Errorf("listing services failed: %s", err)
+	}
+
+	for _, service := range serviceList.Items {
+		if !s.isOrphan(&service.ObjectMeta, now) {
+			continue
+		}
+
+		if s.DryRun.Enabled() {
+			s.DryRun.Record(dryrun.VerbDelete, "service", service.Namespace, service.Name, "orphaned by a challenge exposer")
+			continue
+		}
+
+		log.Infof("Sweeper: deleting orphaned service '%s/%s'", service.Namespace, service.Name)
+		err := s.Client.Services(service.Namespace).Delete(service.Name, &api_v1.DeleteOptions{})
+		if err != nil && !kerrors.IsNotFound(err) {
+			log.Errorf("Sweeper: deleting service '%s/%s' failed: %s", service.Namespace, service.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Sweeper) sweepEndpoints(namespace string, now time.Time) error {
+	endpointsList, err := s.Client.Endpoints(namespace).List(api_v1.ListOptions{
+		LabelSelector: LabelSelectorRouteExposer,
+	})
+	if err != nil {
+		return fmt.Errorf("listing endpoints failed: %s", err)
+	}
+
+	for _, endpoints := range endpointsList.Items {
+		if !s.isOrphan(&endpoints.ObjectMeta, now) {
+			continue
+		}
+
+		if s.DryRun.Enabled() {
+			s.DryRun.Record(dryrun.VerbDelete, "endpoints", endpoints.Namespace, endpoints.Name, "orphaned by a challenge exposer")
+			continue
+		}
+
+		log.Infof("Sweeper: deleting orphaned endpoints '%s/%s'", endpoints.Namespace, endpoints.Name)
+		err := s.Client.Endpoints(endpoints.Namespace).Delete(endpoints.Name, &api_v1.DeleteOptions{})
+		if err != nil && !kerrors.IsNotFound(err) {
+			log.Errorf("Sweeper: deleting endpoints '%s/%s' failed: %s", endpoints.Namespace, endpoints.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Sweep does a single pass over all namespaces
+func (s *Sweeper) Sweep() error {
+	now := time.Now()
+
+	var errs []error
+	for _, namespace := range s.Namespaces {
+		for _, sweep := range []func(string, time.Time) error{s.sweepRoutes, s.sweepServices, s.sweepEndpoints} {
+			if err := sweep(namespace, now); err != nil {
+				errs = append(errs, fmt.Errorf("namespace '%s': %s", namespace, err))
+			}
+		}
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("sweeping failed: %v", errs)
+	}
+
+	return nil
+}
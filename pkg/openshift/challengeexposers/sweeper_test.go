@@ -0,0 +1,222 @@
+package challengeexposers
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tnozicka/openshift-acme/pkg/dryrun"
+	oapi "github.com/tnozicka/openshift-acme/pkg/openshift/api"
+	"github.com/tnozicka/openshift-acme/pkg/openshift/fakeapi"
+	"k8s.io/client-go/kubernetes"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+)
+
+func TestInFlight(t *testing.T) {
+	f := NewInFlight()
+	if f.Contains("test", "a") {
+		t.Fatal("empty InFlight contains test/a")
+	}
+
+	f.Add("test", "a")
+	f.Add("test", "a")
+	f.Add("other", "b")
+	if !f.Contains("test", "a") || !f.Contains("other", "b") {
+		t.Fatal("InFlight is missing added objects")
+	}
+	if f.Contains("test", "b") || f.Contains("other", "a") {
+		t.Error("InFlight contains objects from a different namespace")
+	}
+
+	// the object is in flight until every challenge using it is done
+	f.Remove("test", "a")
+	if !f.Contains("test", "a") {
+		t.Error("test/a was removed while still used by another challenge")
+	}
+	f.Remove("test", "a")
+	if f.Contains("test", "a") {
+		t.Error("test/a is still in flight after its last challenge was removed")
+	}
+
+	// removing an object which isn't tracked doesn't leave anything behind
+	f.Remove("test", "missing")
+	if f.Contains("test", "missing") {
+		t.Error("removing an unknown object made it in flight")
+	}
+}
+
+// sweeperObjects are named by whether the sweeper should delete them
+var sweeperObjects = []struct {
+	name     string
+	labels   func(now time.Time) map[string]string
+	inFlight bool
+	orphan   bool
+}{
+	{
+		name:   "orphan",
+		labels: func(now time.Time) map[string]string { return exposerLabels(now.Add(-time.Hour)) },
+		orphan: true,
+	},
+	{
+		name:     "in-flight",
+		labels:   func(now time.Time) map[string]string { return exposerLabels(now.Add(-time.Hour)) },
+		inFlight: true,
+	},
+	{
+		name:   "young",
+		labels: func(now time.Time) map[string]string { return exposerLabels(now) },
+	},
+	{
+		name: "foreign",
+		labels: func(now time.Time) map[string]string {
+			return map[string]string{LabelCreatedKey: strconv.FormatInt(now.Add(-time.Hour).Unix(), 10)}
+		},
+	},
+	{
+		name: "other-exposer",
+		labels: func(now time.Time) map[string]string {
+			labels := exposerLabels(now.Add(-time.Hour))
+			labels[LabelExposerKey] = "other"
+			return labels
+		},
+	},
+}
+
+func exposerLabels(created time.Time) map[string]string {
+	return map[string]string{
+		LabelExposerKey:   LabelExposerRoute,
+		LabelTokenHashKey: getTokenHash("token"),
+		LabelCreatedKey:   strconv.FormatInt(created.Unix(), 10),
+	}
+}
+
+// createSweeperObjects creates a route, service and endpoints in namespace "test" for every sweeperObjects item
+func createSweeperObjects(t *testing.T, api *fakeapi.Server, inFlight *InFlight) {
+	now := time.Now()
+	for _, item := range sweeperObjects {
+		meta := api_v1.ObjectMeta{Name: item.name, Labels: item.labels(now)}
+		for _, object := range []struct {
+			resource string
+			object   interface{}
+		}{
+			{fakeapi.ResourceRoutes, &oapi.Route{ObjectMeta: meta, Spec: oapi.RouteSpec{Host: "app.example.com"}}},
+			{fakeapi.ResourceServices, &api_v1.Service{ObjectMeta: meta}},
+			{fakeapi.ResourceEndpoints, &api_v1.Endpoints{ObjectMeta: meta}},
+		} {
+			if err := api.Create(object.resource, "test", object.object); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if item.inFlight {
+			inFlight.Add("test", item.name)
+		}
+	}
+}
+
+func remainingNames(t *testing.T, api *fakeapi.Server, resource string) []string {
+	var names []string
+	switch resource {
+	case fakeapi.ResourceRoutes:
+		var routes []oapi.Route
+		if err := api.List(resource, "test", "", &routes); err != nil {
+			t.Fatal(err)
+		}
+		for _, route := range routes {
+			names = append(names, route.Name)
+		}
+	case fakeapi.ResourceServices:
+		var services []api_v1.Service
+		if err := api.List(resource, "test", "", &services); err != nil {
+			t.Fatal(err)
+		}
+		for _, service := range services {
+			names = append(names, service.Name)
+		}
+	case fakeapi.ResourceEndpoints:
+		var endpoints []api_v1.Endpoints
+		if err := api.List(resource, "test", "", &endpoints); err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range endpoints {
+			names = append(names, e.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestSweeper(t *testing.T) {
+	var kept []string
+	for _, item := range sweeperObjects {
+		if !item.orphan {
+			kept = append(kept, item.name)
+		}
+	}
+	sort.Strings(kept)
+
+	testTable := []struct {
+		name   string
+		dryRun *dryrun.Recorder
+	}{
+		{"deletes orphans", nil},
+		{"dry run", dryrun.NewRecorder()},
+	}
+
+	for _, item := range testTable {
+		api := fakeapi.NewServer(fakeapi.Config{})
+		clientset, err := kubernetes.NewForConfig(api.RESTConfig())
+		if err != nil {
+			api.Close()
+			t.Fatal(err)
+		}
+
+		s := &Sweeper{
+			Client:     clientset.CoreV1(),
+			InFlight:   NewInFlight(),
+			Namespaces: []string{"test"},
+			MinAge:     10 * time.Minute,
+			DryRun:     item.dryRun,
+		}
+		createSweeperObjects(t, api, s.InFlight)
+
+		if err := s.Sweep(); err != nil {
+			t.Errorf("%s: %v", item.name, err)
+		}
+
+		for _, resource := range []string{fakeapi.ResourceRoutes, fakeapi.ResourceServices, fakeapi.ResourceEndpoints} {
+			names := remainingNames(t, api, resource)
+			expected := kept
+			if item.dryRun.Enabled() {
+				expected = append([]string{"orphan"}, kept...)
+				sort.Strings(expected)
+			}
+			if !reflect.DeepEqual(names, expected) {
+				t.Errorf("%s: expected %s %v to be left, got %v", item.name, resource, expected, names)
+			}
+		}
+
+		for _, action := range api.Actions() {
+			if action.Verb == fakeapi.VerbDelete && (item.dryRun.Enabled() || action.Name != "orphan") {
+				t.Errorf("%s: unexpected deletion of %s '%s/%s'", item.name, action.Resource, action.Namespace, action.Name)
+			}
+		}
+
+		if item.dryRun.Enabled() {
+			var planned []string
+			for _, action := range item.dryRun.Actions() {
+				if action.Verb != dryrun.VerbDelete || action.Namespace != "test" || action.Name != "orphan" {
+					t.Errorf("%s: unexpected planned action %#v", item.name, action)
+				}
+				planned = append(planned, action.Kind)
+			}
+			sort.Strings(planned)
+			if expected := []string{"endpoints", "route", "service"}; !reflect.DeepEqual(planned, expected) {
+				t.Errorf("%s: expected planned deletion of %v, got %v", item.name, expected, planned)
+			}
+		}
+
+		api.Close()
+	}
+}
@@ -1,62 +1,173 @@
 package acme
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-playground/log"
 	"github.com/tnozicka/openshift-acme/pkg/acme"
 	"github.com/tnozicka/openshift-acme/pkg/cert"
+	"github.com/tnozicka/openshift-acme/pkg/dryrun"
+	"github.com/tnozicka/openshift-acme/pkg/logging"
 	accountlib "github.com/tnozicka/openshift-acme/pkg/openshift/account"
+	issuerlib "github.com/tnozicka/openshift-acme/pkg/openshift/issuer"
 	acmelib "golang.org/x/crypto/acme"
 	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
 	kerrors "k8s.io/client-go/pkg/api/errors"
 	api_v1 "k8s.io/client-go/pkg/api/v1"
 )
 
+const (
+	// AnnotationNamespaceContactsKey overrides account contacts for a namespace (comma separated emails)
+	AnnotationNamespaceContactsKey = "kubernetes.io/acme.contacts"
+)
+
 type AcmeObject interface {
 	GetDomains() []string
 	GetNamespace() string
 	GetUID() string
+	GetIssuerName() string
 	GetCertificate() *cert.Certificate
+	// GetExistingCertificates returns certificates the object already carries, e.g. from another tool,
+	// which can be adopted instead of issuing a new one
+	GetExistingCertificates() []*cert.Certificate
 	UpdateCertificate(c *cert.Certificate) error
 	GetExposers() map[string]acme.ChallengeExposer
+	GetLifecyclePolicy() LifecyclePolicy
+	// GetObjectReference identifies the object in events
+	GetObjectReference() api_v1.ObjectReference
+	// GetLogger returns logger with context identifying the object
+	GetLogger() *logging.Logger
+	// DeleteCertificate deletes generated secret and, unless the object itself was deleted, removes the certificate from it
+	DeleteCertificate(objectDeleted bool) error
 }
 
 type AcmeController struct {
-	kclient              v1core.CoreV1Interface
-	acmeDirectoryUrl     string
-	ctx                  context.Context
-	wg                   sync.WaitGroup
-	Db                   *CertDB
-	renewalCheckInterval time.Duration
-	retryCheckInterval   time.Duration
-	maxTries             int
-	watchNamespaces      []string
-}
-
-func NewAcmeController(ctx context.Context, kclient v1core.CoreV1Interface, acmeDirectoryUrl string, watchNamespaces []string) (rc *AcmeController) {
+	kclient          v1core.CoreV1Interface
+	acmeDirectoryUrl string
+	defaultIssuer    *issuerlib.Issuer
+	contacts         []string
+	// sharedAccountNamespace holds the account for the global issuer used by all namespaces; disabled if empty
+	sharedAccountNamespace string
+	ctx                    context.Context
+	wg                     sync.WaitGroup
+	Db                     *CertDB
+	renewalPolicy          RenewalPolicy
+	renewalPolicyMutex     sync.RWMutex
+	watchNamespaces        []string
+	// dryRun records planned changes instead of making them; disabled if nil
+	dryRun         *dryrun.Recorder
+	dryRunAccounts map[string]*accountlib.Account
+	dryRunMutex    sync.Mutex
+}
+
+func NewAcmeController(ctx context.Context, kclient v1core.CoreV1Interface, acmeDirectoryUrl string, contacts []string, sharedAccountNamespace string, watchNamespaces []string, dryRun *dryrun.Recorder) (rc *AcmeController) {
 	rc = &AcmeController{
 		ctx:              ctx,
 		kclient:          kclient,
 		acmeDirectoryUrl: acmeDirectoryUrl,
-		Db:               NewCertDB(ctx, kclient),
-		watchNamespaces:  watchNamespaces,
+		defaultIssuer: &issuerlib.Issuer{
+			DirectoryUrl: acmeDirectoryUrl,
+			KeyType:      cert.DefaultKeyType,
+		},
+		contacts:               issuerlib.NormalizeContacts(contacts),
+		sharedAccountNamespace: sharedAccountNamespace,
+		Db:                     NewCertDB(ctx, kclient, dryRun),
+		watchNamespaces:        watchNamespaces,
+		dryRun:                 dryRun,
+		dryRunAccounts:         make(map[string]*accountlib.Account),
 	}
 
-	if rc.renewalCheckInterval <= 0 {
-		rc.renewalCheckInterval = 5 * time.Minute
+	rc.Db.issuerAccount = rc.AcmeAccount
+	rc.Db.queue = NewIssuanceQueue(DefaultIssuanceConcurrency)
+	rc.SetRenewalPolicy(DefaultRenewalPolicy())
+
+	return
+}
+
+// RenewalPolicy controls when certificates are renewed and failed attempts retried; it can be changed while running
+type RenewalPolicy struct {
+	// CheckInterval is how often certificates are checked for renewal
+	CheckInterval time.Duration
+	// RetryInterval is how often failed attempts are retried
+	RetryInterval time.Duration
+	// MaxTries is how many times obtaining a certificate is retried before giving up
+	MaxTries int
+	// RenewAfter is the fraction of certificate lifetime after which it gets renewed
+	RenewAfter float64
+	// OCSPCheckInterval is how often revocation of certificates is checked with OCSP; 0 disables the checks
+	OCSPCheckInterval time.Duration
+}
+
+func DefaultRenewalPolicy() RenewalPolicy {
+	return RenewalPolicy{
+		CheckInterval:     5 * time.Minute,
+		RetryInterval:     5 * time.Minute,
+		MaxTries:          20,
+		RenewAfter:        2.0 / 3.0,
+		OCSPCheckInterval: time.Hour,
 	}
+}
 
-	if rc.retryCheckInterval <= 0 {
-		rc.retryCheckInterval = 5 * time.Minute
+// Validate returns an error if the policy can't be used
+func (p RenewalPolicy) Validate() error {
+	if p.CheckInterval <= 0 {
+		return fmt.Errorf("renewal check interval must be positive, got %s", p.CheckInterval)
+	}
+	if p.RetryInterval <= 0 {
+		return fmt.Errorf("retry interval must be positive, got %s", p.RetryInterval)
 	}
+	if p.MaxTries < 0 {
+		return fmt.Errorf("max tries can't be negative, got %d", p.MaxTries)
+	}
+	if p.OCSPCheckInterval < 0 {
+		return fmt.Errorf("OCSP check interval can't be negative, got %s", p.OCSPCheckInterval)
+	}
+	if p.RenewAfter <= 0 || p.RenewAfter >= 1 {
+		return fmt.Errorf("renewal fraction must be between 0 and 1, got %g", p.RenewAfter)
+	}
+	return nil
+}
 
-	rc.maxTries = 20
+// RenewTime returns the time after which a certificate valid in the given period should be renewed
+func (p RenewalPolicy) RenewTime(notBefore, notAfter time.Time) time.Time {
+	return notBefore.Add(time.Duration(float64(notAfter.Sub(notBefore)) * p.RenewAfter))
+}
 
-	return
+// SetRenewalPolicy replaces the renewal policy; new intervals apply after the current wait ends
+func (ac *AcmeController) SetRenewalPolicy(p RenewalPolicy) {
+	ac.renewalPolicyMutex.Lock()
+	defer ac.renewalPolicyMutex.Unlock()
+
+	ac.renewalPolicy = p
+}
+
+// SetHTTPClientConfig configures requests to the ACME server of the global issuer; it has to be called before BootstrapDB
+func (ac *AcmeController) SetHTTPClientConfig(config acme.HTTPClientConfig) {
+	ac.defaultIssuer.HTTPClient = config
+}
+
+// IssuanceQueue returns the queue through which all certificates are obtained
+func (ac *AcmeController) IssuanceQueue() *IssuanceQueue {
+	return ac.Db.queue
+}
+
+func (ac *AcmeController) RenewalPolicy() RenewalPolicy {
+	ac.renewalPolicyMutex.RLock()
+	defer ac.renewalPolicyMutex.RUnlock()
+
+	return ac.renewalPolicy
 }
 
 func (ac *AcmeController) retryLoop() {
@@ -66,8 +177,9 @@ func (ac *AcmeController) retryLoop() {
 loop:
 	for {
 		select {
-		case <-time.After(ac.retryCheckInterval):
+		case <-time.After(ac.RenewalPolicy().RetryInterval):
 			log.Debug("Retry check triggered by scheadule.")
+			maxTries := ac.RenewalPolicy().MaxTries
 
 			certEntries := ac.Db.GetCertEntryShallowSnapshot()
 			for _, certEntry := range certEntries {
@@ -79,7 +191,7 @@ loop:
 						return
 					}
 
-					if certEntry.failedCounter <= 0 || certEntry.failedCounter > ac.maxTries {
+					if certEntry.failedCounter <= 0 || certEntry.failedCounter > maxTries {
 						return
 					}
 
@@ -92,7 +204,7 @@ loop:
 					if o == nil {
 						return
 					}
-					log.Infof("retryLoop: start obtaining certificate for: '%s'", o.GetDomains())
+					o.GetLogger().Infof("retryLoop: start obtaining certificate (attempt %d/%d)", certEntry.failedCounter+1, maxTries+1)
 
 					certEntry.startObtainingCertificate()
 				}()
@@ -111,9 +223,10 @@ func (ac *AcmeController) renewLoop() {
 loop:
 	for {
 		select {
-		case <-time.After(ac.renewalCheckInterval):
+		case <-time.After(ac.RenewalPolicy().CheckInterval):
 			log.Debug("Renewal check triggered by scheadule.")
 			now := time.Now()
+			policy := ac.RenewalPolicy()
 
 			certEntries := ac.Db.GetCertEntryShallowSnapshot()
 			for _, certEntry := range certEntries {
@@ -130,22 +243,22 @@ loop:
 						return
 					}
 
+					logger := certEntry.logger()
 					notBefore := certEntry.certificate.Certificate.NotBefore
 					notAfter := certEntry.certificate.Certificate.NotAfter
 
 					// sanity check
 					if notBefore.After(notAfter) {
 						// TODO: report error in cert object's annotations
-						log.Debugf("renewLoop: Invalid certificate: %#v", certEntry.certificate.Certificate)
+						logger.Debugf("renewLoop: Invalid certificate %s", certEntry.certificate)
 						return
 					}
 
-					// TODO: make this configurable
-					renewTime := notBefore.Add(2 * (notAfter.Sub(notBefore)) / 3)
+					renewTime := policy.RenewTime(notBefore, notAfter)
 					renew := now.After(renewTime)
-					log.Debugf("notBefore=%s, notAfter=%s, renewTime=%s; renew=%t", notBefore, notAfter, renewTime, renew)
+					logger.Debugf("notBefore=%s, notAfter=%s, renewTime=%s; renew=%t", notBefore, notAfter, renewTime, renew)
 					if renew {
-						log.Debugf("renewLoop: renewing certificate for: '%s'", certEntry.certificate.Domains())
+						logger.Infof("renewLoop: renewing certificate %s", certEntry.certificate)
 						certEntry.startObtainingCertificate()
 					}
 				}()
@@ -164,13 +277,172 @@ func (ac *AcmeController) Start() {
 	go ac.retryLoop()
 	ac.wg.Add(1)
 	go ac.renewLoop()
+	ac.wg.Add(1)
+	go ac.ocspLoop()
+	ac.wg.Add(1)
+	go func() {
+		defer ac.wg.Done()
+		ac.Db.queue.Run(ac.ctx)
+	}()
 }
 
 func (rc *AcmeController) Wait() {
 	rc.wg.Wait()
 }
 
-func (ac *AcmeController) AcmeAccount(namespace string) (a *accountlib.Account, err error) {
+// Issuer returns the issuer selected by name in a namespace. Empty name selects the namespace default issuer
+// and if there isn't any the global one configured by flags.
+func (ac *AcmeController) Issuer(namespace string, name string) (*issuerlib.Issuer, error) {
+	if name != "" {
+		cm, err := ac.kclient.ConfigMaps(namespace).Get(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get issuer '%s/%s': %s", namespace, name, err)
+		}
+
+		if cm.Labels[accountlib.LabelAcmeTypeKey] != issuerlib.LabelAcmeIssuerType {
+			return nil, fmt.Errorf("configmap '%s/%s' is not an issuer: missing label '%s=%s'", namespace, name, accountlib.LabelAcmeTypeKey, issuerlib.LabelAcmeIssuerType)
+		}
+
+		return issuerlib.NewIssuerFromConfigMap(cm)
+	}
+
+	cmList, err := ac.kclient.ConfigMaps(namespace).List(api_v1.ListOptions{
+		LabelSelector: issuerlib.LabelSelectorAcmeIssuer,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var defaultIssuer *issuerlib.Issuer
+	for i := range cmList.Items {
+		cm := &cmList.Items[i]
+		if cm.Annotations[issuerlib.AnnotationAcmeIssuerDefaultKey] != "true" {
+			continue
+		}
+
+		// pick the one with lowest name to be consistent if there are more
+		if defaultIssuer != nil && defaultIssuer.Name < cm.Name {
+			continue
+		}
+
+		issuer, err := issuerlib.NewIssuerFromConfigMap(cm)
+		if err != nil {
+			log.Warn(err)
+			continue
+		}
+		defaultIssuer = issuer
+	}
+
+	if defaultIssuer == nil {
+		return ac.defaultIssuer, nil
+	}
+
+	return defaultIssuer, nil
+}
+
+// HTTPClient returns a client for requests to the issuer's ACME server
+func (ac *AcmeController) HTTPClient(issuer *issuerlib.Issuer) (*http.Client, error) {
+	config := issuer.HTTPClient
+	if issuer.ClientCertificateSecretName != "" {
+		secret, err := ac.kclient.Secrets(issuer.Namespace).Get(issuer.ClientCertificateSecretName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get client certificate for issuer '%s/%s': %s", issuer.Namespace, issuer.Name, err)
+		}
+		config.ClientCertificate = secret.Data[api_v1.TLSCertKey]
+		config.ClientKey = secret.Data[api_v1.TLSPrivateKeyKey]
+	}
+
+	client, err := config.NewHTTPClient()
+	if err != nil {
+		return nil, fmt.Errorf("issuer '%s/%s': %s", issuer.Namespace, issuer.Name, err)
+	}
+
+	return client, nil
+}
+
+// accountHTTPClient returns a client for the issuer the account in secret was registered for.
+// Accounts of issuers which can't be read anymore get the default client.
+func (ac *AcmeController) accountHTTPClient(secret *api_v1.Secret) *http.Client {
+	issuer := ac.defaultIssuer
+	if name := secret.Labels[issuerlib.LabelAcmeIssuerKey]; name != "" {
+		var err error
+		issuer, err = ac.Issuer(secret.Namespace, name)
+		if err != nil {
+			log.Warnf("Using default HTTP client for account '%s/%s': %s", secret.Namespace, secret.Name, err)
+			return nil
+		}
+	}
+
+	client, err := ac.HTTPClient(issuer)
+	if err != nil {
+		log.Warnf("Using default HTTP client for account '%s/%s': %s", secret.Namespace, secret.Name, err)
+		return nil
+	}
+
+	return client
+}
+
+// FallbackIssuers returns issuers used in order when the issuer's ACME server is unavailable.
+// Fallbacks which can't be read are skipped.
+func (ac *AcmeController) FallbackIssuers(issuer *issuerlib.Issuer) []*issuerlib.Issuer {
+	var fallbacks []*issuerlib.Issuer
+	for _, name := range issuer.Fallbacks {
+		fallback, err := ac.Issuer(issuer.Namespace, name)
+		if err != nil {
+			log.Warnf("Skipping fallback of issuer '%s/%s': %s", issuer.Namespace, issuer.Name, err)
+			continue
+		}
+		fallbacks = append(fallbacks, fallback)
+	}
+	return fallbacks
+}
+
+// AccountContacts returns contacts for an account. Contacts set on an issuer take precedence
+// over namespace annotation which overrides the ones from flags.
+func (ac *AcmeController) AccountContacts(namespace string, issuer *issuerlib.Issuer) []string {
+	if len(issuer.Contacts) > 0 {
+		return issuer.Contacts
+	}
+
+	ns, err := ac.kclient.Namespaces().Get(namespace)
+	if err != nil {
+		log.Debugf("Unable to get namespace '%s' to read contacts: %s", namespace, err)
+		return ac.contacts
+	}
+
+	contacts, found := ns.Annotations[AnnotationNamespaceContactsKey]
+	if found {
+		return issuerlib.ParseContacts(contacts)
+	}
+
+	return ac.contacts
+}
+
+func equalContacts(lhs, rhs []string) bool {
+	if len(lhs) == 0 && len(rhs) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(lhs, rhs)
+}
+
+// AccountNamespace returns the namespace holding the account for objects in a namespace.
+// Issuers defined in a namespace always keep their accounts there.
+func (ac *AcmeController) AccountNamespace(namespace string, issuer *issuerlib.Issuer) string {
+	if ac.sharedAccountNamespace != "" && issuer.Name == "" {
+		return ac.sharedAccountNamespace
+	}
+	return namespace
+}
+
+func (ac *AcmeController) AcmeAccount(namespace string, issuer *issuerlib.Issuer) (a *accountlib.Account, err error) {
+	namespace = ac.AccountNamespace(namespace, issuer)
+	contacts := ac.AccountContacts(namespace, issuer)
+
+	httpClient, err := ac.HTTPClient(issuer)
+	if err != nil {
+		return
+	}
+
 	secretList, err := ac.kclient.Secrets(namespace).List(api_v1.ListOptions{
 		LabelSelector: accountlib.LabelSelectorAcmeAccount,
 	})
@@ -178,18 +450,33 @@ func (ac *AcmeController) AcmeAccount(namespace string) (a *accountlib.Account,
 		return
 	}
 
-	if len(secretList.Items) < 1 {
+	// accounts without the issuer label were created by older versions for the global issuer
+	var accountSecrets []*api_v1.Secret
+	for i := range secretList.Items {
+		if secretList.Items[i].Labels[issuerlib.LabelAcmeIssuerKey] == issuer.Name {
+			accountSecrets = append(accountSecrets, &secretList.Items[i])
+		}
+	}
+
+	if len(accountSecrets) < 1 {
+		if ac.dryRun.Enabled() {
+			return ac.planAccount(namespace, issuer, contacts)
+		}
+
 		// there is no ACME account present => create new one
 		a = &accountlib.Account{
 			Client: acme.Client{
 				Client: &acmelib.Client{
-					DirectoryURL: ac.acmeDirectoryUrl,
+					DirectoryURL: issuer.DirectoryUrl,
+					HTTPClient:   httpClient,
+				},
+				Account: &acmelib.Account{
+					Contact: contacts,
 				},
-				Account: &acmelib.Account{},
 			},
 		}
 
-		log.Infof("Creating new account in namespace %s", namespace)
+		log.Infof("Creating new account in namespace %s for issuer '%s'", namespace, issuer.Name)
 		defer log.Tracef("Creating new account in namespace %s finished", namespace).End()
 		if err = a.Client.CreateAccount(ac.ctx, a.Client.Account, acmelib.AcceptTOS); err != nil {
 			return nil, err
@@ -199,7 +486,10 @@ func (ac *AcmeController) AcmeAccount(namespace string) (a *accountlib.Account,
 		if err != nil {
 			return nil, err
 		}
-		newSecret.Name = "acme-account"
+		newSecret.Name = issuer.AccountSecretName()
+		if issuer.Name != "" {
+			newSecret.Labels[issuerlib.LabelAcmeIssuerKey] = issuer.Name
+		}
 		secret, err := ac.kclient.Secrets(namespace).Create(newSecret)
 		if err != nil {
 			return nil, err
@@ -208,13 +498,72 @@ func (ac *AcmeController) AcmeAccount(namespace string) (a *accountlib.Account,
 	} else {
 		// there is at least 1 account, but there could be more
 		// TODO: we should probably pick up the one with highest registration URL to be consistent
-		a, err = accountlib.NewAccountFromSecret(&secretList.Items[0], ac.acmeDirectoryUrl)
+		a, err = accountlib.NewAccountFromSecret(accountSecrets[0], issuer.DirectoryUrl)
 		if err != nil {
 			err = fmt.Errorf("acmeClient: '%s'", err)
 			return
 		}
+		a.Client.Client.HTTPClient = httpClient
+
+		if !equalContacts(a.Client.Account.Contact, contacts) {
+			log.Infof("Updating contacts for account '%s/%s' from %v to %v", namespace, a.Secret.Name, a.Client.Account.Contact, contacts)
+			a.Client.Account.Contact = contacts
+			if ac.dryRun.Enabled() {
+				ac.dryRun.Record(dryrun.VerbUpdate, "account", namespace, a.Secret.Name, fmt.Sprintf("with contacts %v", contacts))
+			} else if err := a.UpdateRemote(ac.ctx); err != nil {
+				// the account is still usable; we will retry with the next object
+				log.Errorf("Failed to update contacts for account '%s/%s' on ACME server: %s", namespace, a.Secret.Name, err)
+			} else if err := ac.UpdateAcmeAccount(a); err != nil {
+				log.Errorf("Failed to save contacts for account '%s/%s': %s", namespace, a.Secret.Name, err)
+			}
+		}
+	}
+
+	return a, nil
+}
+
+// planAccount records account registration and returns an unregistered account standing in for it
+func (ac *AcmeController) planAccount(namespace string, issuer *issuerlib.Issuer, contacts []string) (*accountlib.Account, error) {
+	name := issuer.AccountSecretName()
+	key := namespace + "/" + name
+
+	ac.dryRunMutex.Lock()
+	defer ac.dryRunMutex.Unlock()
+
+	a, found := ac.dryRunAccounts[key]
+	if !found {
+		privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+
+		a = &accountlib.Account{
+			Client: acme.Client{
+				Client: &acmelib.Client{
+					Key:          privateKey,
+					DirectoryURL: issuer.DirectoryUrl,
+				},
+				Account: &acmelib.Account{
+					URI:     "dry-run:" + key,
+					Contact: contacts,
+				},
+			},
+			Secret: &api_v1.Secret{
+				ObjectMeta: api_v1.ObjectMeta{
+					Name:      name,
+					Namespace: namespace,
+					Labels: map[string]string{
+						accountlib.LabelAcmeTypeKey: accountlib.LabelAcmeAccountType,
+					},
+				},
+			},
+		}
+		ac.dryRunAccounts[key] = a
 	}
 
+	ac.dryRun.Record(dryrun.VerbRegister, "account", namespace, name, fmt.Sprintf("at %s with contacts %v", issuer.DirectoryUrl, contacts))
+	ac.dryRun.Record(dryrun.VerbCreate, "secret", namespace, name, "to store the account")
+
 	return a, nil
 }
 
@@ -231,7 +580,7 @@ func (ac *AcmeController) UpdateAcmeAccount(a *accountlib.Account) (err error) {
 			kerr, ok := err.(*kerrors.StatusError)
 			if ok && kerr.Status().Code == 409 {
 				// there is a conflict for the update, someone is trying to change it as well
-				log.Debugf("UpdateAcmeAccount failed because of conflict: '%#v'", kerr.ErrStatus)
+				log.Debugf("UpdateAcmeAccount failed because of conflict: %s", kerr.ErrStatus.Message)
 				continue
 			} else {
 				return fmt.Errorf("UpdateAcmeAccount: %#v", secret)
@@ -244,27 +593,195 @@ func (ac *AcmeController) UpdateAcmeAccount(a *accountlib.Account) (err error) {
 }
 
 func (ac *AcmeController) Manage(o AcmeObject) (err error) {
-	account, err := ac.AcmeAccount(o.GetNamespace())
+	issuer, err := ac.Issuer(o.GetNamespace(), o.GetIssuerName())
+	if err != nil {
+		// misconfigured issuer is a user error and it shouldn't break processing of other objects
+		o.GetLogger().Errorf("Skipping object '%s': %s", o.GetUID(), err)
+		return nil
+	}
+	account, err := ac.AcmeAccount(o.GetNamespace(), issuer)
 	if err != nil {
 		return err
 	}
-	ac.Db.AddObject(account, o)
+	fallbacks := ac.FallbackIssuers(issuer)
+	if !ac.Db.HasCertificate(account, o.GetNamespace(), o.GetDomains()...) {
+		certificate := ac.adoptableCertificate(o, append([]*issuerlib.Issuer{issuer}, fallbacks...))
+		if certificate != nil && ac.Db.AdoptCertificate(account, o.GetNamespace(), o.GetDomains(), certificate) {
+			o.GetLogger().Infof("Adopted existing certificate %s", certificate)
+			// AddObject won't update the object which already serves the certificate but its secret may be missing
+			if err := o.UpdateCertificate(certificate); err != nil {
+				o.GetLogger().Errorf("Unable to store adopted certificate %s: %s", certificate, err)
+			}
+		}
+	}
+	ac.Db.AddObject(account, issuer, fallbacks, o)
 	return
 }
 
-func (ac *AcmeController) Done(o AcmeObject) (err error) {
-	account, err := ac.AcmeAccount(o.GetNamespace())
+// adoptionRoots returns system roots extended with CA bundles of the issuers
+func adoptionRoots(issuers []*issuerlib.Issuer) *x509.CertPool {
+	roots, err := x509.SystemCertPool()
+	if err != nil || roots == nil {
+		roots = x509.NewCertPool()
+	}
+	for _, issuer := range issuers {
+		roots.AppendCertsFromPEM(issuer.HTTPClient.CABundle)
+	}
+	return roots
+}
+
+// adoptableCertificate returns a certificate the object already carries if it can be used instead of issuing a new one.
+// It has to cover exactly the object's domains, match its key, chain to a root trusted by the system or by one of the issuers,
+// be valid and not yet due for renewal. Self-signed certificates are never adopted.
+func (ac *AcmeController) adoptableCertificate(o AcmeObject, issuers []*issuerlib.Issuer) *cert.Certificate {
+	logger := o.GetLogger()
+	now := time.Now()
+	policy := ac.RenewalPolicy()
+	var roots *x509.CertPool
+
+	for _, c := range o.GetExistingCertificates() {
+		if c == nil || len(c.Crt) == 0 || len(c.Key) == 0 {
+			continue
+		}
+		if _, err := tls.X509KeyPair(c.Crt, c.Key); err != nil {
+			logger.Debugf("Not adopting existing certificate: %s", err)
+			continue
+		}
+		if err := c.UpdateTargetCertificate(); err != nil {
+			logger.Debugf("Not adopting existing certificate: %s", err)
+			continue
+		}
+		if bytes.Equal(c.Certificate.RawSubject, c.Certificate.RawIssuer) {
+			logger.Debugf("Not adopting self-signed certificate %s", c)
+			continue
+		}
+		if !c.IsValid(now) || now.After(policy.RenewTime(c.Certificate.NotBefore, c.Certificate.NotAfter)) {
+			logger.Debugf("Not adopting certificate %s because it is due for renewal", c)
+			continue
+		}
+		if !equalDomains(c.Domains(), o.GetDomains()) {
+			logger.Debugf("Not adopting certificate %s because it is for different domains", c)
+			continue
+		}
+
+		if roots == nil {
+			roots = adoptionRoots(issuers)
+		}
+		intermediates := x509.NewCertPool()
+		intermediates.AppendCertsFromPEM(c.Chain())
+		trusted := true
+		for _, domain := range o.GetDomains() {
+			_, err := c.Certificate.Verify(x509.VerifyOptions{
+				DNSName:       domain,
+				Roots:         roots,
+				Intermediates: intermediates,
+				CurrentTime:   now,
+			})
+			if err != nil {
+				logger.Debugf("Not adopting certificate %s: %s", c, err)
+				trusted = false
+				break
+			}
+		}
+		if !trusted {
+			continue
+		}
+
+		return c
+	}
+
+	return nil
+}
+
+func equalDomains(a, b []string) bool {
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return reflect.DeepEqual(a, b)
+}
+
+// IsManaged returns true if the object is tracked by the controller
+func (ac *AcmeController) IsManaged(o AcmeObject) bool {
+	return ac.Db.HasObject(o)
+}
+
+// Objects returns objects managed in the namespace; empty namespace means all namespaces
+func (ac *AcmeController) Objects(namespace string) []AcmeObject {
+	return ac.Db.GetObjectsSnapshot(namespace)
+}
+
+// Done stops managing the object and applies its lifecycle policy
+func (ac *AcmeController) Done(o AcmeObject, objectDeleted bool) (err error) {
+	policy := o.GetLifecyclePolicy()
+	account, certificate, lastObject := ac.Db.RemoveObject(o)
+
+	if policy == LifecyclePolicyRetain {
+		return nil
+	}
+
+	if policy == LifecyclePolicyRevokeAndDelete && lastObject && certificate != nil && certificate.Certificate != nil {
+		o.GetLogger().Infof("Revoking certificate %s", certificate)
+		if ac.dryRun.Enabled() {
+			ac.dryRun.Record(dryrun.VerbRevoke, "certificate", o.GetNamespace(), strings.Join(certificate.Domains(), ","), "for "+o.GetUID())
+		} else {
+			err = ac.issuingAccount(o, account, certificate).Client.Client.RevokeCert(ac.ctx, nil, certificate.Certificate.Raw, acmelib.CRLReasonCessationOfOperation)
+			if err != nil {
+				return fmt.Errorf("failed to revoke certificate for '%s': %s", o.GetUID(), err)
+			}
+		}
+		ac.Db.RemoveCertificate(account, o.GetNamespace(), certificate)
+	}
+
+	o.GetLogger().Infof("Deleting certificate (lifecycle policy: %s)", policy)
+	return o.DeleteCertificate(objectDeleted)
+}
+
+// issuingAccount returns the account of the fallback issuer which issued the certificate
+// or account if the certificate was issued by the object's issuer or it isn't known
+func (ac *AcmeController) issuingAccount(o AcmeObject, account *accountlib.Account, certificate *cert.Certificate) *accountlib.Account {
+	if certificate.IssuerUrl == "" || certificate.IssuerUrl == account.Client.Client.DirectoryURL {
+		return account
+	}
+
+	issuer, err := ac.Issuer(o.GetNamespace(), o.GetIssuerName())
 	if err != nil {
-		return err
+		o.GetLogger().Warnf("Unable to find issuer of certificate %s: %s", certificate, err)
+		return account
 	}
-	ac.Db.RemoveObject(account, o)
-	return
+	for _, fallback := range ac.FallbackIssuers(issuer) {
+		if fallback.DirectoryUrl != certificate.IssuerUrl {
+			continue
+		}
+		fallbackAccount, err := ac.AcmeAccount(o.GetNamespace(), fallback)
+		if err != nil {
+			o.GetLogger().Warnf("Unable to get account of issuer '%s/%s': %s", fallback.Namespace, fallback.Name, err)
+			return account
+		}
+		return fallbackAccount
+	}
+
+	return account
 }
 
 func (ac *AcmeController) BootstrapDB(updateAccounts bool, updateStatus bool) error {
-	for _, namespace := range ac.watchNamespaces {
+	namespaces := ac.watchNamespaces
+	if ac.sharedAccountNamespace != "" {
+		covered := false
+		for _, namespace := range namespaces {
+			if namespace == "" || namespace == ac.sharedAccountNamespace {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			namespaces = append([]string{ac.sharedAccountNamespace}, namespaces...)
+		}
+	}
+
+	for _, namespace := range namespaces {
 		log.Debugf("AcmeCotroller: Bootstraping namespace '%s'", namespace)
-		err := ac.Db.Bootstrap(ac.ctx, namespace, ac.acmeDirectoryUrl, updateAccounts, updateStatus)
+		err := ac.Db.Bootstrap(ac.ctx, namespace, ac.acmeDirectoryUrl, ac.accountHTTPClient, updateAccounts, updateStatus)
 		if err != nil {
 			return err
 		}
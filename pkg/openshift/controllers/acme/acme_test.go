@@ -0,0 +1,217 @@
+package acme
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/tnozicka/openshift-acme/pkg/acme/fakeacme"
+	accountlib "github.com/tnozicka/openshift-acme/pkg/openshift/account"
+	"github.com/tnozicka/openshift-acme/pkg/openshift/fakeapi"
+	issuerlib "github.com/tnozicka/openshift-acme/pkg/openshift/issuer"
+	"k8s.io/client-go/kubernetes"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+)
+
+func newTestNamespace(name string, annotations map[string]string) *api_v1.Namespace {
+	return &api_v1.Namespace{
+		ObjectMeta: api_v1.ObjectMeta{
+			Name:        name,
+			Annotations: annotations,
+		},
+	}
+}
+
+func TestAccountContacts(t *testing.T) {
+	api := fakeapi.NewServer(fakeapi.Config{})
+	defer api.Close()
+	clientset, err := kubernetes.NewForConfig(api.RESTConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, namespace := range []*api_v1.Namespace{
+		newTestNamespace("plain", nil),
+		newTestNamespace("team", map[string]string{AnnotationNamespaceContactsKey: "team@example.com, mailto:ops@example.com"}),
+		newTestNamespace("nobody", map[string]string{AnnotationNamespaceContactsKey: ""}),
+	} {
+		if err := api.Create(fakeapi.ResourceNamespaces, "", namespace); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ac := NewAcmeController(ctx, clientset.CoreV1(), "http://localhost/directory", []string{"admin@example.com"}, "", nil, nil)
+
+	testTable := []struct {
+		name      string
+		namespace string
+		issuer    *issuerlib.Issuer
+		contacts  []string
+	}{
+		{
+			name:      "contacts from flags",
+			namespace: "plain",
+			issuer:    ac.defaultIssuer,
+			contacts:  []string{"mailto:admin@example.com"},
+		},
+		{
+			name:      "missing namespace falls back to flags",
+			namespace: "missing",
+			issuer:    ac.defaultIssuer,
+			contacts:  []string{"mailto:admin@example.com"},
+		},
+		{
+			name:      "namespace annotation overrides flags",
+			namespace: "team",
+			issuer:    ac.defaultIssuer,
+			contacts:  []string{"mailto:team@example.com", "mailto:ops@example.com"},
+		},
+		{
+			name:      "empty namespace annotation removes contacts",
+			namespace: "nobody",
+			issuer:    ac.defaultIssuer,
+			contacts:  nil,
+		},
+		{
+			name:      "issuer contacts take precedence",
+			namespace: "team",
+			issuer:    &issuerlib.Issuer{Name: "custom", Contacts: []string{"mailto:issuer@example.com"}},
+			contacts:  []string{"mailto:issuer@example.com"},
+		},
+	}
+
+	for _, item := range testTable {
+		got := ac.AccountContacts(item.namespace, item.issuer)
+		if !equalContacts(got, item.contacts) {
+			t.Errorf("%s: expected contacts %v, got %v", item.name, item.contacts, got)
+		}
+	}
+}
+
+// accountSecretContacts returns contacts stored in the only account secret in the namespace
+func accountSecretContacts(t *testing.T, api *fakeapi.Server, namespace string) []string {
+	var secrets []api_v1.Secret
+	if err := api.List(fakeapi.ResourceSecrets, namespace, accountlib.LabelSelectorAcmeAccount, &secrets); err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != 1 {
+		t.Fatalf("expected 1 account secret in namespace '%s', got %d", namespace, len(secrets))
+	}
+
+	var contacts []string
+	if err := json.Unmarshal([]byte(secrets[0].Annotations[accountlib.AnnotationAcmeAccountContactsKey]), &contacts); err != nil {
+		t.Fatal(err)
+	}
+	return contacts
+}
+
+func TestAcmeAccountContacts(t *testing.T) {
+	ca, err := fakeacme.NewServer(fakeacme.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ca.Close()
+
+	api := fakeapi.NewServer(fakeapi.Config{})
+	defer api.Close()
+	clientset, err := kubernetes.NewForConfig(api.RESTConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := api.Create(fakeapi.ResourceNamespaces, "", newTestNamespace("test", nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ac := NewAcmeController(ctx, clientset.CoreV1(), ca.DirectoryURL(), []string{"admin@example.com"}, "", []string{"test"}, nil)
+
+	steps := []struct {
+		name       string
+		annotation *string
+		removed    bool
+		contacts   []string
+		updated    bool
+	}{
+		{
+			name:     "account is registered with contacts from flags",
+			contacts: []string{"mailto:admin@example.com"},
+		},
+		{
+			name:     "unchanged contacts aren't updated",
+			contacts: []string{"mailto:admin@example.com"},
+		},
+		{
+			name:       "namespace annotation updates the account",
+			annotation: &[]string{"team@example.com"}[0],
+			contacts:   []string{"mailto:team@example.com"},
+			updated:    true,
+		},
+		{
+			name:     "removing the annotation brings back contacts from flags",
+			removed:  true,
+			contacts: []string{"mailto:admin@example.com"},
+			updated:  true,
+		},
+	}
+
+	for i, step := range steps {
+		if step.annotation != nil || step.removed {
+			var namespace api_v1.Namespace
+			if err := api.Get(fakeapi.ResourceNamespaces, "", "test", &namespace); err != nil {
+				t.Fatal(err)
+			}
+			namespace.Annotations = nil
+			if step.annotation != nil {
+				namespace.Annotations = map[string]string{AnnotationNamespaceContactsKey: *step.annotation}
+			}
+			if err := api.Update(fakeapi.ResourceNamespaces, "", &namespace); err != nil {
+				t.Fatal(err)
+			}
+		}
+		updatesBefore := ca.Requests(fakeacme.ResourceReg)
+
+		issuer, err := ac.Issuer("test", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := ac.AcmeAccount("test", issuer)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+
+		if !equalContacts(a.Client.Account.Contact, step.contacts) {
+			t.Errorf("%s: expected account contacts %v, got %v", step.name, step.contacts, a.Client.Account.Contact)
+		}
+		if stored := accountSecretContacts(t, api, "test"); !equalContacts(stored, step.contacts) {
+			t.Errorf("%s: expected account secret contacts %v, got %v", step.name, step.contacts, stored)
+		}
+		// registration itself updates the account to agree to the terms of service
+		if updated := ca.Requests(fakeacme.ResourceReg) > updatesBefore; i > 0 && updated != step.updated {
+			t.Errorf("%s: expected account update on the ACME server=%t, got %t", step.name, step.updated, updated)
+		}
+		if n := ca.Requests(fakeacme.ResourceNewReg); n != 1 {
+			t.Errorf("%s: expected the account to be registered once, got %d registrations", step.name, n)
+		}
+	}
+
+	// the contacts reported by the ACME server are the ones stored
+	var secrets []api_v1.Secret
+	if err := api.List(fakeapi.ResourceSecrets, "test", accountlib.LabelSelectorAcmeAccount, &secrets); err != nil {
+		t.Fatal(err)
+	}
+	a, err := accountlib.NewAccountFromSecret(&secrets[0], ca.DirectoryURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := a.Client.Client.GetReg(ctx, a.Client.Account.URI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(account.Contact, a.Client.Account.Contact) {
+		t.Errorf("ACME server has contacts %v, account secret has %v", account.Contact, a.Client.Account.Contact)
+	}
+}
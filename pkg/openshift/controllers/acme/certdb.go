@@ -7,17 +7,27 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"fmt"
+	"net/http"
 	"sync"
 	"time"
 
 	"github.com/go-playground/log"
 	"github.com/tnozicka/openshift-acme/pkg/cert"
+	"github.com/tnozicka/openshift-acme/pkg/dryrun"
+	"github.com/tnozicka/openshift-acme/pkg/logging"
 	accountlib "github.com/tnozicka/openshift-acme/pkg/openshift/account"
+	issuerlib "github.com/tnozicka/openshift-acme/pkg/openshift/issuer"
 	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
 	kerrors "k8s.io/client-go/pkg/api/errors"
 	api_v1 "k8s.io/client-go/pkg/api/v1"
 )
 
+// certKey identifies certificate entry; certificates are never shared across namespaces
+// even if they belong to the same account
+func certKey(namespace string, domains ...string) string {
+	return namespace + "/" + hashDomains(domains...)
+}
+
 func hashDomains(domains ...string) string {
 	var buffer bytes.Buffer
 	for _, domain := range domains {
@@ -32,26 +42,35 @@ func accountKeyString(account *accountlib.Account) string {
 	return base64.StdEncoding.EncodeToString(keyBytes)
 }
 
+// IssuerAccountFunc returns the account for objects in namespace using the issuer, registering it if needed
+type IssuerAccountFunc func(namespace string, issuer *issuerlib.Issuer) (*accountlib.Account, error)
+
 type DbAccountEntry struct {
 	account                 *accountlib.Account
 	kclient                 v1core.CoreV1Interface
 	certificatesMutex       sync.Mutex
-	syncCertificatesChannel chan []*cert.Certificate
+	syncCertificatesChannel chan []*accountlib.CertificateRecord
 	syncCertificatesWg      sync.WaitGroup
+	dryRun                  *dryrun.Recorder
 	ctx                     context.Context
 	ctxCancel               context.CancelFunc
 	db                      map[string]*DbCertEntry
+	// issuerAccount gets accounts of fallback issuers
+	issuerAccount IssuerAccountFunc
+	// queue limits concurrent issuance; certificates are obtained right away if it's nil
+	queue *IssuanceQueue
 }
 
-func NewDbAccountEntry(ctx context.Context, account *accountlib.Account, kclient v1core.CoreV1Interface) *DbAccountEntry {
+func NewDbAccountEntry(ctx context.Context, account *accountlib.Account, kclient v1core.CoreV1Interface, dryRun *dryrun.Recorder) *DbAccountEntry {
 	ctx, cancel := context.WithCancel(ctx)
 	e := &DbAccountEntry{
 		account:                 account,
 		kclient:                 kclient,
+		dryRun:                  dryRun,
 		db:                      make(map[string]*DbCertEntry),
 		ctx:                     ctx,
 		ctxCancel:               cancel,
-		syncCertificatesChannel: make(chan []*cert.Certificate, 100),
+		syncCertificatesChannel: make(chan []*accountlib.CertificateRecord, 100),
 	}
 
 	e.syncCertificatesWg.Add(1)
@@ -60,11 +79,24 @@ func NewDbAccountEntry(ctx context.Context, account *accountlib.Account, kclient
 	return e
 }
 
-func (e *DbAccountEntry) GetCertEntry(domainHash string) (entry *DbCertEntry) {
-	entry, present := e.db[domainHash]
+func accountURI(account *accountlib.Account) string {
+	if account.Client.Account == nil {
+		return ""
+	}
+	return account.Client.Account.URI
+}
+
+// logger returns logger with the account
+func (e *DbAccountEntry) logger() *logging.Logger {
+	return logging.New(log.F(logging.FieldAccount, accountURI(e.account)))
+}
+
+func (e *DbAccountEntry) GetCertEntry(namespace string, domains ...string) (entry *DbCertEntry) {
+	key := certKey(namespace, domains...)
+	entry, present := e.db[key]
 	if !present {
-		entry = NewDbCertEntry(e.ctx, e)
-		e.db[domainHash] = entry
+		entry = NewDbCertEntry(e.ctx, e, namespace)
+		e.db[key] = entry
 	}
 
 	return
@@ -72,45 +104,29 @@ func (e *DbAccountEntry) GetCertEntry(domainHash string) (entry *DbCertEntry) {
 
 func (e *DbAccountEntry) syncCertificatesLoop() {
 	defer e.syncCertificatesWg.Done()
-	defer log.Debug("DbAccountEntry - SyncCertificates - finished")
+	logger := e.logger()
+	defer logger.Debug("DbAccountEntry - SyncCertificates - finished")
 
 loop:
 	for {
 		select {
-		case <-e.syncCertificatesChannel:
-			cachedSecret, err := e.GetAccountSecret()
-			if err != nil {
-				log.Errorf("SyncCertificates: %s", err)
-			}
-
-			syncTries := 3
-			for i := 0; i < syncTries; i++ {
-				secret, err := e.kclient.Secrets(cachedSecret.Namespace).Get(cachedSecret.Name)
-				if err != nil {
-					if kerrors.IsNotFound(err) {
-						log.Errorf("SyncCertificates: %s", err)
-						break
-					} else {
-						log.Errorf("SyncCertificates attempt %d/%d failed: %s", i, syncTries, err)
-						continue
-					}
+		case records := <-e.syncCertificatesChannel:
+			synced := make(map[string]bool)
+			for _, record := range records {
+				if record.Certificate == nil || record.Certificate.Certificate == nil {
+					continue
 				}
-
-				if secret.Data == nil {
-					secret.Data = make(map[string][]byte)
+				domains := record.Domains()
+				key := certKey(record.Namespace, domains...)
+				if synced[key] {
+					continue
 				}
-				// FIXME: merge instead of rewrite
-				secret.Data[accountlib.DataAcmeAccountCertificatesKey] = cachedSecret.Data[accountlib.DataAcmeAccountCertificatesKey]
+				synced[key] = true
 
-				secret, err = e.kclient.Secrets(secret.Namespace).Update(secret)
+				err := e.SyncCertificateRecords(record.Namespace, domains)
 				if err != nil {
-					log.Errorf("SyncCertificates attempt %d/%d failed: %s", i, syncTries, err)
-					continue
+					logger.Errorf("SyncCertificates: %s", err)
 				}
-
-				log.Debugf("Synced certificate for %s/%s", cachedSecret.Namespace, cachedSecret.Name)
-
-				break
 			}
 		case <-e.ctx.Done():
 			break loop
@@ -125,32 +141,179 @@ func (e *DbAccountEntry) GetAccountSecret() (*api_v1.Secret, error) {
 	return e.account.ToSecret()
 }
 
-func (e *DbAccountEntry) AddCertificates(c ...*cert.Certificate) {
+// getCertificateRecords returns records for namespace and domains; mutex is held by calling method
+func (e *DbAccountEntry) getCertificateRecords(namespace string, domains []string) []*accountlib.CertificateRecord {
+	key := certKey(namespace, domains...)
+	var records []*accountlib.CertificateRecord
+	for _, record := range e.account.Certificates {
+		if record.Certificate == nil || record.Certificate.Certificate == nil {
+			continue
+		}
+		if certKey(record.Namespace, record.Domains()...) == key {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// pruneCertificateRecords keeps only the current and previous certificate for namespace and domains;
+// mutex is held by calling method
+func (e *DbAccountEntry) pruneCertificateRecords(namespace string, domains []string) {
+	key := certKey(namespace, domains...)
+	records := make([]*accountlib.CertificateRecord, 0, len(e.account.Certificates))
+	for _, record := range e.account.Certificates {
+		if record.Certificate != nil && record.Certificate.Certificate != nil && certKey(record.Namespace, record.Domains()...) == key {
+			continue
+		}
+		records = append(records, record)
+	}
+	pruned := accountlib.PruneCertificateRecords(e.getCertificateRecords(namespace, domains), time.Now())
+	e.account.Certificates = append(records, pruned...)
+}
+
+// SyncCertificateRecords writes records for namespace and domains into their certificate secret
+// and removes the secret if there are none left
+func (e *DbAccountEntry) SyncCertificateRecords(namespace string, domains []string) error {
 	e.certificatesMutex.Lock()
-	defer e.certificatesMutex.Unlock()
+	records := e.getCertificateRecords(namespace, domains)
+	accountSecret := e.account.Secret
+	e.certificatesMutex.Unlock()
 
-	e.account.Certificates = append(e.account.Certificates, c...)
+	if accountSecret == nil {
+		return fmt.Errorf("account '%s' has no secret to store certificate records with", accountURI(e.account))
+	}
+	newSecret := accountlib.NewCertificateSecret(accountSecret, namespace, domains)
+	if err := accountlib.SetCertificateRecords(newSecret, records); err != nil {
+		return err
+	}
+
+	if e.dryRun.Enabled() {
+		if len(records) == 0 {
+			e.dryRun.Record(dryrun.VerbDelete, "secret", newSecret.Namespace, newSecret.Name, "with expired certificate records")
+		} else {
+			e.dryRun.Record(dryrun.VerbUpdate, "secret", newSecret.Namespace, newSecret.Name, "to store certificate records")
+		}
+		return nil
+	}
+
+	logger := e.logger()
+	var err error
+	syncTries := 3
+	for i := 0; i < syncTries; i++ {
+		var secret *api_v1.Secret
+		secret, err = e.kclient.Secrets(newSecret.Namespace).Get(newSecret.Name)
+		if err != nil {
+			if !kerrors.IsNotFound(err) {
+				logger.Errorf("SyncCertificates attempt %d/%d failed: %s", i, syncTries, err)
+				continue
+			}
+
+			if len(records) == 0 {
+				return nil
+			}
+			_, err = e.kclient.Secrets(newSecret.Namespace).Create(newSecret)
+			if err != nil {
+				logger.Errorf("SyncCertificates attempt %d/%d failed: %s", i, syncTries, err)
+				continue
+			}
+			logger.Debugf("Created certificate records %s/%s", newSecret.Namespace, newSecret.Name)
+			return nil
+		}
+
+		if len(records) == 0 {
+			err = e.kclient.Secrets(secret.Namespace).Delete(secret.Name, nil)
+			if err != nil && !kerrors.IsNotFound(err) {
+				logger.Errorf("SyncCertificates attempt %d/%d failed: %s", i, syncTries, err)
+				continue
+			}
+			logger.Debugf("Deleted certificate records %s/%s", secret.Namespace, secret.Name)
+			return nil
+		}
+
+		secret.Data = newSecret.Data
+		_, err = e.kclient.Secrets(secret.Namespace).Update(secret)
+		if err != nil {
+			logger.Errorf("SyncCertificates attempt %d/%d failed: %s", i, syncTries, err)
+			continue
+		}
+		logger.Debugf("Synced certificate records %s/%s", secret.Namespace, secret.Name)
+		return nil
+	}
+
+	return fmt.Errorf("syncing certificate records '%s/%s' failed: %s", newSecret.Namespace, newSecret.Name, err)
+}
+
+func (e *DbAccountEntry) AddCertificates(namespace string, certificates ...*cert.Certificate) {
+	e.certificatesMutex.Lock()
+	records := make([]*accountlib.CertificateRecord, 0, len(certificates))
+	for _, c := range certificates {
+		records = append(records, &accountlib.CertificateRecord{
+			Namespace:   namespace,
+			Certificate: c,
+		})
+	}
+	e.account.Certificates = append(e.account.Certificates, records...)
+	for _, record := range records {
+		if record.Certificate != nil && record.Certificate.Certificate != nil {
+			e.pruneCertificateRecords(namespace, record.Domains())
+		}
+	}
+	e.certificatesMutex.Unlock()
+
+	// the consumer takes certificatesMutex to sync the records so we can't hold it while sending
+	e.syncCertificatesChannel <- records
+
+	return
+}
+
+func (e *DbAccountEntry) RemoveCertificate(namespace string, c *cert.Certificate) {
+	e.certificatesMutex.Lock()
+	records := make([]*accountlib.CertificateRecord, 0, len(e.account.Certificates))
+	var removed []*accountlib.CertificateRecord
+	for _, record := range e.account.Certificates {
+		if record.Namespace == namespace && record.Certificate != nil && record.Certificate.Equal(c) {
+			removed = append(removed, record)
+			continue
+		}
+		records = append(records, record)
+	}
+	if len(removed) == 0 {
+		e.certificatesMutex.Unlock()
+		return
+	}
+	e.account.Certificates = records
+	e.certificatesMutex.Unlock()
 
-	e.syncCertificatesChannel <- c
+	e.syncCertificatesChannel <- removed
 
 	return
 }
 
 type CertDB struct {
-	kclient   v1core.CoreV1Interface
-	db        map[string]*DbAccountEntry
-	dbMutex   sync.Mutex
-	ctx       context.Context
-	ctxCancel context.CancelFunc
+	kclient       v1core.CoreV1Interface
+	db            map[string]*DbAccountEntry
+	objectEntries map[string]*DbCertEntry // object UID => entry the object belongs to
+	objects       map[string]AcmeObject   // object UID => object
+	dryRun        *dryrun.Recorder
+	dbMutex       sync.Mutex
+	ctx           context.Context
+	ctxCancel     context.CancelFunc
+	// issuerAccount is passed to account entries to get accounts of fallback issuers
+	issuerAccount IssuerAccountFunc
+	// queue is passed to account entries to obtain certificates through it
+	queue *IssuanceQueue
 }
 
-func NewCertDB(ctx context.Context, kclient v1core.CoreV1Interface) *CertDB {
+func NewCertDB(ctx context.Context, kclient v1core.CoreV1Interface, dryRun *dryrun.Recorder) *CertDB {
 	ctx, cancel := context.WithCancel(ctx)
 	return &CertDB{
-		db:        make(map[string]*DbAccountEntry),
-		ctx:       ctx,
-		ctxCancel: cancel,
-		kclient:   kclient,
+		db:            make(map[string]*DbAccountEntry),
+		objectEntries: make(map[string]*DbCertEntry),
+		objects:       make(map[string]AcmeObject),
+		ctx:           ctx,
+		ctxCancel:     cancel,
+		kclient:       kclient,
+		dryRun:        dryRun,
 	}
 }
 
@@ -159,7 +322,9 @@ func (d *CertDB) getAccountEntry(account *accountlib.Account) (entry *DbAccountE
 	key := accountKeyString(account)
 	entry, present := d.db[key]
 	if !present {
-		entry = NewDbAccountEntry(d.ctx, account, d.kclient)
+		entry = NewDbAccountEntry(d.ctx, account, d.kclient, d.dryRun)
+		entry.issuerAccount = d.issuerAccount
+		entry.queue = d.queue
 		d.db[key] = entry
 	}
 
@@ -167,40 +332,101 @@ func (d *CertDB) getAccountEntry(account *accountlib.Account) (entry *DbAccountE
 }
 
 // mutex is held by calling method
-func (d *CertDB) getCertEntry(account *accountlib.Account, domainsKey string) *DbCertEntry {
-	return d.getAccountEntry(account).GetCertEntry(domainsKey)
+func (d *CertDB) getCertEntry(account *accountlib.Account, namespace string, domains ...string) *DbCertEntry {
+	return d.getAccountEntry(account).GetCertEntry(namespace, domains...)
 }
 
-func (d *CertDB) AddObject(account *accountlib.Account, o AcmeObject) {
-	// FIXME: do this properly with account key for case of cross-namespace accounts
-	domainsKey := hashDomains(o.GetDomains()...)
+// AddObject starts managing the object with the account of its issuer; fallbacks are tried in order
+// when the issuer's ACME server is unavailable
+func (d *CertDB) AddObject(account *accountlib.Account, issuer *issuerlib.Issuer, fallbacks []*issuerlib.Issuer, o AcmeObject) {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
 
+	entry := d.getCertEntry(account, o.GetNamespace(), o.GetDomains()...)
+	// the object could have changed its domains or issuer
+	previousEntry, found := d.objectEntries[o.GetUID()]
+	if found && previousEntry != entry {
+		previousEntry.RemoveObject(o)
+	}
+	d.objectEntries[o.GetUID()] = entry
+	d.objects[o.GetUID()] = o
+	entry.AddObject(o, issuer, fallbacks)
+}
+
+func (d *CertDB) HasObject(o AcmeObject) bool {
 	d.dbMutex.Lock()
 	defer d.dbMutex.Unlock()
 
-	entry := d.getCertEntry(account, domainsKey)
-	entry.AddObject(o)
+	_, found := d.objectEntries[o.GetUID()]
+	return found
 }
 
-func (d *CertDB) RemoveObject(account *accountlib.Account, o AcmeObject) {
-	// FIXME: do this properly with account key for case of cross-namespace accounts
-	domainsKey := hashDomains(o.GetDomains()...)
+// GetObjectsSnapshot returns all tracked objects in the namespace; empty namespace means all namespaces
+func (d *CertDB) GetObjectsSnapshot(namespace string) []AcmeObject {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	r := make([]AcmeObject, 0, len(d.objects))
+	for _, o := range d.objects {
+		if namespace == "" || o.GetNamespace() == namespace {
+			r = append(r, o)
+		}
+	}
 
+	return r
+}
+
+// RemoveObject stops tracking the object and returns the certificate it used
+// and whether it was the last object using it
+func (d *CertDB) RemoveObject(o AcmeObject) (account *accountlib.Account, certificate *cert.Certificate, lastObject bool) {
 	d.dbMutex.Lock()
 	defer d.dbMutex.Unlock()
 
-	entry := d.getCertEntry(account, domainsKey)
-	entry.RemoveObject(o)
+	entry, found := d.objectEntries[o.GetUID()]
+	if !found {
+		return
+	}
+	delete(d.objectEntries, o.GetUID())
+	delete(d.objects, o.GetUID())
+	certificate, lastObject = entry.RemoveObject(o)
+	account = entry.accountEntry.account
+	return
 }
 
-func (d *CertDB) AddCertificate(account *accountlib.Account, certificate *cert.Certificate) {
+// RemoveCertificate forgets the certificate so it won't be used anymore, e.g. after it was revoked
+func (d *CertDB) RemoveCertificate(account *accountlib.Account, namespace string, certificate *cert.Certificate) {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	accountEntry := d.getAccountEntry(account)
+	accountEntry.GetCertEntry(namespace, certificate.Domains()...).ForgetCertificate(certificate)
+	accountEntry.RemoveCertificate(namespace, certificate)
+}
+
+// HasCertificate returns true if there is a current certificate for domains in namespace
+func (d *CertDB) HasCertificate(account *accountlib.Account, namespace string, domains ...string) bool {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	return d.getCertEntry(account, namespace, domains...).HasCertificate()
+}
+
+// AdoptCertificate uses a certificate that wasn't issued by the controller for domains in namespace
+// unless there already is a current one; it returns true if the certificate was adopted
+func (d *CertDB) AdoptCertificate(account *accountlib.Account, namespace string, domains []string, certificate *cert.Certificate) bool {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	return d.getCertEntry(account, namespace, domains...).AdoptCertificate(certificate)
+}
+
+func (d *CertDB) AddCertificate(account *accountlib.Account, namespace string, certificate *cert.Certificate) {
 	log.Debug("Adding object")
-	domainsKey := hashDomains(certificate.Domains()...)
 
 	d.dbMutex.Lock()
 	defer d.dbMutex.Unlock()
 
-	entry := d.getCertEntry(account, domainsKey)
+	entry := d.getCertEntry(account, namespace, certificate.Domains()...)
 	entry.UpdateCertificate(certificate)
 
 	return
@@ -223,14 +449,15 @@ func (d *CertDB) GetCertEntryShallowSnapshot() []*DbCertEntry {
 	return r
 }
 
-func (db *CertDB) LoadAccount(ctx context.Context, secret *api_v1.Secret, acmeurl string, updateAccounts bool, updateStatus bool) (err error) {
+func (db *CertDB) LoadAccount(ctx context.Context, secret *api_v1.Secret, acmeurl string, httpClient *http.Client, updateAccounts bool, updateStatus bool) (err error) {
 	account, err := accountlib.NewAccountFromSecret(secret, acmeurl)
 	if err != nil {
 		err = fmt.Errorf("failed to create an account from secret '%s/%s': %s", secret.Namespace, secret.Name, err)
 		return
 	}
+	account.Client.Client.HTTPClient = httpClient
 
-	if updateAccounts {
+	if updateAccounts && !db.dryRun.Enabled() {
 		log.Debugf("Updating account '%s/%s' (%s)", secret.Namespace, secret.Name, account.Client.Account.URI)
 		err = account.UpdateRemote(ctx)
 		if err != nil {
@@ -253,28 +480,109 @@ func (db *CertDB) LoadAccount(ctx context.Context, secret *api_v1.Secret, acmeur
 		}
 	}
 
-	// we need to choose only one certificate per domains if there are more
-	certificatesByDomain := make(map[string]*cert.Certificate)
-	t := time.Now()
+	recordSecrets, err := db.kclient.Secrets(secret.Namespace).List(api_v1.ListOptions{
+		LabelSelector: accountlib.LabelSelectorAcmeCertificate,
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to list certificate records for account '%s/%s': %s", secret.Namespace, secret.Name, err)
+		return err
+	}
+	account.LoadCertificateRecords(recordSecrets.Items)
+
+	// keep only the current and previous certificate per namespace and domains
+	// and write back the records that got pruned or come from the legacy account data
+	legacy := account.HasLegacyCertificates()
+	groups := make(map[string][]*accountlib.CertificateRecord)
+	var keys []string
 	for _, c := range account.Certificates {
-		h := hashDomains(c.Domains()...)
-		existingCert, found := certificatesByDomain[h]
-		if found {
-			certificatesByDomain[h] = cert.FresherCertificate(existingCert, c, t)
-		} else {
-			certificatesByDomain[h] = c
+		if c.Certificate == nil || c.Certificate.Certificate == nil {
+			continue
+		}
+		h := certKey(c.Namespace, c.Domains()...)
+		if _, found := groups[h]; !found {
+			keys = append(keys, h)
+		}
+		groups[h] = append(groups[h], c)
+	}
+
+	t := time.Now()
+	account.Certificates = nil
+	var outdated []*accountlib.CertificateRecord
+	for _, h := range keys {
+		group := groups[h]
+		records := accountlib.PruneCertificateRecords(group, t)
+		account.Certificates = append(account.Certificates, records...)
+		if legacy || len(records) != len(group) {
+			outdated = append(outdated, group[0])
+		}
+		if len(records) == 0 {
+			continue
+		}
+
+		logging.New(
+			log.F(logging.FieldAccount, accountURI(account)),
+			log.F(logging.FieldNamespace, records[0].Namespace),
+			log.F(logging.FieldDomains, records[0].Domains()),
+		).Debug("Loading certificate")
+		db.AddCertificate(account, records[0].Namespace, records[0].Certificate)
+	}
+
+	db.dbMutex.Lock()
+	accountEntry := db.getAccountEntry(account)
+	db.dbMutex.Unlock()
+	for _, record := range outdated {
+		err = accountEntry.SyncCertificateRecords(record.Namespace, record.Domains())
+		if err != nil {
+			return fmt.Errorf("failed to store certificate records for account '%s/%s': %s", secret.Namespace, secret.Name, err)
 		}
 	}
 
-	for _, value := range certificatesByDomain {
-		log.Debugf("Loading certificate for account %s; domains=%#v", account.Client.Account.URI, value.Domains())
-		db.AddCertificate(account, value)
+	if legacy {
+		err = db.removeLegacyCertificates(secret)
+		if err != nil {
+			return fmt.Errorf("failed to migrate certificate records for account '%s/%s': %s", secret.Namespace, secret.Name, err)
+		}
 	}
 
 	return
 }
 
-func (db *CertDB) Bootstrap(ctx context.Context, namespace string, acmeUrl string, updateAccounts bool, updateStatus bool) (err error) {
+// removeLegacyCertificates drops certificate records from the account secret once they are stored in their own secrets
+func (db *CertDB) removeLegacyCertificates(secret *api_v1.Secret) error {
+	log.Infof("Migrated certificate records out of account '%s/%s'", secret.Namespace, secret.Name)
+
+	if db.dryRun.Enabled() {
+		db.dryRun.Record(dryrun.VerbUpdate, "secret", secret.Namespace, secret.Name, "to remove migrated certificate records")
+		return nil
+	}
+
+	var err error
+	maxAttempts := 3
+	for i := 0; i < maxAttempts; i++ {
+		var current *api_v1.Secret
+		current, err = db.kclient.Secrets(secret.Namespace).Get(secret.Name)
+		if err != nil {
+			return err
+		}
+		if _, found := current.Data[accountlib.DataAcmeAccountCertificatesKey]; !found {
+			return nil
+		}
+
+		delete(current.Data, accountlib.DataAcmeAccountCertificatesKey)
+		_, err = db.kclient.Secrets(current.Namespace).Update(current)
+		if err == nil {
+			return nil
+		}
+		if !kerrors.IsConflict(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// Bootstrap loads accounts in namespace; httpClient returns the client for requests to the ACME server of an account
+func (db *CertDB) Bootstrap(ctx context.Context, namespace string, acmeUrl string, httpClient func(secret *api_v1.Secret) *http.Client, updateAccounts bool, updateStatus bool) (err error) {
 	secretList, err := db.kclient.Secrets(namespace).List(api_v1.ListOptions{
 		LabelSelector: accountlib.LabelSelectorAcmeAccount,
 	})
@@ -283,7 +591,7 @@ func (db *CertDB) Bootstrap(ctx context.Context, namespace string, acmeUrl strin
 	}
 
 	for _, secret := range secretList.Items {
-		err = db.LoadAccount(ctx, &secret, acmeUrl, updateAccounts, updateStatus)
+		err = db.LoadAccount(ctx, &secret, acmeUrl, httpClient(&secret), updateAccounts, updateStatus)
 		if err != nil {
 			log.Warn(err)
 			continue
@@ -2,43 +2,73 @@ package acme
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-playground/log"
 	"github.com/tnozicka/openshift-acme/pkg/acme"
 	"github.com/tnozicka/openshift-acme/pkg/cert"
+	"github.com/tnozicka/openshift-acme/pkg/dryrun"
+	"github.com/tnozicka/openshift-acme/pkg/logging"
+	accountlib "github.com/tnozicka/openshift-acme/pkg/openshift/account"
+	issuerlib "github.com/tnozicka/openshift-acme/pkg/openshift/issuer"
 )
 
 type DbCertEntry struct {
 	mutex         sync.Mutex
 	accountEntry  *DbAccountEntry
+	namespace     string
+	parentCtx     context.Context
 	ctx           context.Context
 	ctxCancel     context.CancelFunc
 	inProgress    bool
 	certificate   *cert.Certificate
 	objects       map[string]AcmeObject
+	issuer        *issuerlib.Issuer
+	fallbacks     []*issuerlib.Issuer
 	failedCounter int
 }
 
-func NewDbCertEntry(ctx context.Context, accountEntry *DbAccountEntry) *DbCertEntry {
-	ctx, cancel := context.WithCancel(ctx)
+func NewDbCertEntry(ctx context.Context, accountEntry *DbAccountEntry, namespace string) *DbCertEntry {
 	d := &DbCertEntry{
 		objects:      make(map[string]AcmeObject),
 		accountEntry: accountEntry,
-		ctx:          ctx,
-		ctxCancel:    cancel,
+		namespace:    namespace,
+		parentCtx:    ctx,
 	}
+	d.ctx, d.ctxCancel = context.WithCancel(ctx)
 
 	return d
 }
 
+// newAttemptID identifies one attempt to obtain a certificate in logs
+func newAttemptID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// logger returns logger of one of the objects using the certificate
+func (e *DbCertEntry) logger() *logging.Logger {
+	for _, o := range e.objects {
+		return o.GetLogger()
+	}
+	return logging.New(log.F(logging.FieldNamespace, e.namespace))
+}
+
 func (e *DbCertEntry) updateCertificate() {
 	// update certificate on all objects
 	for _, o := range e.objects {
 		go func(o AcmeObject) {
-			log.Debugf("Updating certificate for %s", o.GetUID())
+			logger := o.GetLogger()
+			logger.Debug("Updating certificate")
 			if err := o.UpdateCertificate(e.certificate); err != nil {
-				log.Error(err)
+				logger.Error(err)
 				// FIXME: write error into object's status/annotation
 				return
 			}
@@ -55,8 +85,29 @@ func (e *DbCertEntry) UpdateCertificate(certificate *cert.Certificate) {
 	e.updateCertificate()
 }
 
+func (e *DbCertEntry) HasCertificate() bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.certificate != nil
+}
+
+// AdoptCertificate sets the certificate unless there already is one; renewal is then scheduled from its validity
+func (e *DbCertEntry) AdoptCertificate(certificate *cert.Certificate) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.certificate != nil {
+		return false
+	}
+
+	e.certificate = certificate
+	e.failedCounter = 0
+	e.updateCertificate()
+	return true
+}
+
 func (e *DbCertEntry) obtainCertificate() {
-	log.Info("Obtaining certificate start")
 	defer func() {
 		e.inProgress = false
 	}()
@@ -64,7 +115,7 @@ func (e *DbCertEntry) obtainCertificate() {
 
 	if len(e.objects) < 1 {
 		// at this point we can only log an error; this code should be never reached
-		log.Error("obtainCertificate: there are no objects")
+		e.logger().Error("obtainCertificate: there are no objects")
 		return
 	}
 	var o AcmeObject
@@ -72,27 +123,124 @@ func (e *DbCertEntry) obtainCertificate() {
 		break // take 1st object from a map
 	}
 
-	log.Info("Obtaining certificate")
-	certificate, err := e.accountEntry.account.Client.ObtainCertificate(e.ctx, o.GetDomains(), o.GetExposers(), false)
-	switch err.(type) {
-	case acme.DomainsAuthorizationError:
-		log.Error(err)
+	attempt := newAttemptID()
+	logger := o.GetLogger().With(logging.FieldAccount, accountURI(e.accountEntry.account)).With(logging.FieldAttempt, attempt)
+	// fallback issuers use their own accounts
+	accountLogger := func(account *accountlib.Account) *logging.Logger {
+		return o.GetLogger().With(logging.FieldAccount, accountURI(account)).With(logging.FieldAttempt, attempt)
+	}
+	logger.Infof("Obtaining certificate start (previous failed attempts: %d)", e.failedCounter)
+
+	if e.accountEntry.dryRun.Enabled() {
+		exposers := o.GetExposers()
+		if e.issuer != nil {
+			exposers = e.issuer.FilterExposers(exposers)
+		}
+		e.planCertificate(o, exposers, logger)
+		return
+	}
+
+	var certificate *cert.Certificate
+	var err error
+	issuers := e.issuerCandidates()
+	for i, issuer := range issuers {
+		account := e.accountEntry.account
+		if issuer != e.issuer {
+			account, err = e.accountEntry.issuerAccount(e.namespace, issuer)
+			if err != nil {
+				logger.Errorf("Unable to get account for issuer '%s/%s': %s", issuer.Namespace, issuer.Name, err)
+				continue
+			}
+		}
+
+		certificate, err = obtainCertificateFrom(e.ctx, o, issuer, account, accountLogger(account))
+		if err == nil || !acme.IsCAUnavailable(err) || e.ctx.Err() != nil || i == len(issuers)-1 {
+			break
+		}
+		logger.Warnf("ACME server '%s' is unavailable, failing over to '%s': %s", account.Client.Client.DirectoryURL, issuers[i+1].DirectoryUrl, err)
+	}
+	if err != nil {
+		logger.Error(err)
 		e.failedCounter = e.failedCounter + 1
 		// FIXME: write error into object's status/annotation
 		return
-	default:
-		log.Error(err)
+	}
+
+	logger.Infof("Obtained certificate %s from '%s'", certificate, certificate.IssuerUrl)
+	e.certificate = certificate
+	e.failedCounter = 0
+	e.updateCertificate()
+	go e.accountEntry.AddCertificates(e.namespace, certificate)
+}
+
+// issuerCandidates returns the issuers to try in order: the primary one followed by its fallbacks.
+// Renewals start with the issuer of the current certificate unless the primary issuer fails back.
+func (e *DbCertEntry) issuerCandidates() []*issuerlib.Issuer {
+	issuers := append([]*issuerlib.Issuer{e.issuer}, e.fallbacks...)
+	if e.issuer == nil || e.issuer.FailBack || e.certificate == nil || e.certificate.IssuerUrl == "" {
+		return issuers
+	}
+
+	for i, issuer := range issuers {
+		if issuer.DirectoryUrl == e.certificate.IssuerUrl {
+			r := make([]*issuerlib.Issuer, 0, len(issuers))
+			r = append(r, issuers[i:]...)
+			return append(r, issuers[:i]...)
+		}
+	}
+
+	return issuers
+}
+
+// obtainCertificateFrom obtains a certificate for the object's domains using the issuer's account; issuer may be nil
+func obtainCertificateFrom(ctx context.Context, o AcmeObject, issuer *issuerlib.Issuer, account *accountlib.Account, logger *logging.Logger) (*cert.Certificate, error) {
+	exposers := o.GetExposers()
+	keyType := cert.DefaultKeyType
+	if issuer != nil {
+		exposers = issuer.FilterExposers(exposers)
+		keyType = issuer.KeyType
+	}
+
+	client := account.Client
+	client.Logger = logger
+	certificate, err := client.ObtainCertificate(ctx, o.GetDomains(), exposers, keyType, false)
+	if err != nil {
+		return nil, err
+	}
+	certificate.IssuerUrl = client.Client.DirectoryURL
+
+	return certificate, nil
+}
+
+// planCertificate records what obtainCertificate would do and uses a placeholder certificate
+// so the objects can plan their updates as well
+func (e *DbCertEntry) planCertificate(o AcmeObject, exposers map[string]acme.ChallengeExposer, logger *logging.Logger) {
+	dryRun := e.accountEntry.dryRun
+	domains := o.GetDomains()
+	dryRun.Record(dryrun.VerbRequest, "certificate", e.namespace, strings.Join(domains, ","), "from "+e.accountEntry.account.Client.Client.DirectoryURL)
+
+	for _, domain := range domains {
+		for _, exposer := range exposers {
+			if err := exposer.Expose(nil, domain, dryrun.Token); err != nil {
+				logger.Errorf("DRY-RUN: exposing challenge for '%s': %s", domain, err)
+			}
+			if err := exposer.Remove(nil, domain, dryrun.Token); err != nil {
+				logger.Errorf("DRY-RUN: removing challenge for '%s': %s", domain, err)
+			}
+		}
+	}
+
+	certificate, err := dryrun.PlaceholderCertificate(domains)
+	if err != nil {
+		logger.Errorf("DRY-RUN: %s", err)
 		e.failedCounter = e.failedCounter + 1
-		// FIXME: write error into object's status/annotation
 		return
-	case nil:
 	}
 
-	log.Debugf("updating cert %p", certificate)
 	e.certificate = certificate
 	e.failedCounter = 0
 	e.updateCertificate()
-	go e.accountEntry.AddCertificates(certificate)
+	go e.accountEntry.AddCertificates(e.namespace, certificate)
 }
 
 func (e *DbCertEntry) ObtainCertificate() {
@@ -102,12 +250,55 @@ func (e *DbCertEntry) ObtainCertificate() {
 	e.obtainCertificate()
 }
 
+// obtainQueuedCertificate is called by the issuance queue once the entry's turn has come
+func (e *DbCertEntry) obtainQueuedCertificate(priority Priority, wait time.Duration) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if len(e.objects) < 1 || e.ctx.Err() != nil {
+		// the last object was removed while waiting
+		e.inProgress = false
+		return
+	}
+
+	e.logger().Debugf("Waited %s in issuance queue with priority '%s'", wait, priority)
+	e.obtainCertificate()
+}
+
+// priority tells how urgent obtaining a certificate for the entry is; certificates with less than
+// a tenth of their lifetime left are considered to be expiring soon
+func (e *DbCertEntry) priority(now time.Time) Priority {
+	if e.certificate == nil || e.certificate.Certificate == nil {
+		return PriorityNew
+	}
+
+	notBefore := e.certificate.Certificate.NotBefore
+	notAfter := e.certificate.Certificate.NotAfter
+	if notAfter.Sub(now) < notAfter.Sub(notBefore)/10 {
+		return PriorityExpiring
+	}
+	return PriorityRenewal
+}
+
 func (e *DbCertEntry) startObtainingCertificate() {
+	e.startObtainingCertificateWithPriority(e.priority(time.Now()))
+}
+
+func (e *DbCertEntry) startObtainingCertificateWithPriority(priority Priority) {
+	queue := e.accountEntry.queue
 	if e.inProgress {
+		if queue != nil {
+			queue.Raise(e, priority)
+		}
 		return
 	}
 
-	go e.ObtainCertificate()
+	e.inProgress = true
+	if queue == nil {
+		go e.ObtainCertificate()
+		return
+	}
+	queue.Add(e, priority)
 }
 
 func (e *DbCertEntry) StartObtainingCertificate() {
@@ -122,39 +313,70 @@ func (e *DbCertEntry) cancelObtainingCertificate() {
 		return
 	}
 
+	if queue := e.accountEntry.queue; queue != nil && queue.Remove(e) {
+		// it hasn't started yet
+		e.inProgress = false
+		return
+	}
+
 	e.ctxCancel()
 }
 
-func (e *DbCertEntry) AddObject(o AcmeObject) {
-	log.Debug("Adding object")
+func (e *DbCertEntry) AddObject(o AcmeObject, issuer *issuerlib.Issuer, fallbacks []*issuerlib.Issuer) {
+	logger := o.GetLogger()
+	logger.Debug("Adding object")
 	e.mutex.Lock()
 	defer e.mutex.Unlock()
 
+	// obtaining was cancelled when the last object went away; the entry stays in the DB so it can be used again
+	if e.ctx.Err() != nil {
+		e.ctx, e.ctxCancel = context.WithCancel(e.parentCtx)
+	}
+
 	key := o.GetUID()
 	// we want to create the object or update it if it was caused by MODIFIED event
 	e.objects[key] = o
+	e.issuer = issuer
+	e.fallbacks = fallbacks
 
 	if e.certificate == nil {
-		log.Debug("AddObject starting new certificate request")
+		logger.Debug("AddObject starting new certificate request")
 		e.startObtainingCertificate()
 	} else {
 		currentCert := o.GetCertificate()
 		// check if object isn't already using this certificate
 		if !currentCert.Equal(e.certificate) {
-			log.Debug("AddObject using existing certificate")
+			logger.Debug("AddObject using existing certificate")
 			o.UpdateCertificate(e.certificate)
 		}
 	}
 }
 
-func (e *DbCertEntry) RemoveObject(o AcmeObject) {
+// RemoveObject returns current certificate and whether the object was the last one using it
+func (e *DbCertEntry) RemoveObject(o AcmeObject) (certificate *cert.Certificate, lastObject bool) {
 	e.mutex.Lock()
 	defer e.mutex.Unlock()
 
 	key := o.GetUID()
+	_, found := e.objects[key]
+	if !found {
+		return
+	}
 	delete(e.objects, key)
 
 	if len(e.objects) < 1 {
 		e.cancelObtainingCertificate()
 	}
+
+	return e.certificate, len(e.objects) < 1
+}
+
+// ForgetCertificate drops the certificate if it is the current one
+func (e *DbCertEntry) ForgetCertificate(certificate *cert.Certificate) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.certificate != nil && e.certificate.Equal(certificate) {
+		e.certificate = nil
+	}
 }
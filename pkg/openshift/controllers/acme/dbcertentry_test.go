@@ -0,0 +1,126 @@
+package acme
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tnozicka/openshift-acme/pkg/acme"
+	"github.com/tnozicka/openshift-acme/pkg/cert"
+	"github.com/tnozicka/openshift-acme/pkg/logging"
+	issuerlib "github.com/tnozicka/openshift-acme/pkg/openshift/issuer"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+)
+
+type testObject struct {
+	uid string
+}
+
+func (o *testObject) GetDomains() []string                          { return []string{"app.example.com"} }
+func (o *testObject) GetNamespace() string                          { return "test" }
+func (o *testObject) GetUID() string                                { return o.uid }
+func (o *testObject) GetIssuerName() string                         { return "" }
+func (o *testObject) GetCertificate() *cert.Certificate             { return nil }
+func (o *testObject) GetExistingCertificates() []*cert.Certificate  { return nil }
+func (o *testObject) UpdateCertificate(c *cert.Certificate) error   { return nil }
+func (o *testObject) GetExposers() map[string]acme.ChallengeExposer { return nil }
+func (o *testObject) GetLifecyclePolicy() LifecyclePolicy           { return LifecyclePolicyRetain }
+func (o *testObject) GetObjectReference() api_v1.ObjectReference    { return api_v1.ObjectReference{} }
+func (o *testObject) GetLogger() *logging.Logger                    { return nil }
+func (o *testObject) DeleteCertificate(objectDeleted bool) error    { return nil }
+
+func TestIssuerCandidates(t *testing.T) {
+	primary := &issuerlib.Issuer{Name: "primary", DirectoryUrl: "https://primary.example.com/directory"}
+	failBack := &issuerlib.Issuer{Name: "primary", DirectoryUrl: primary.DirectoryUrl, FailBack: true}
+	secondary := &issuerlib.Issuer{Name: "secondary", DirectoryUrl: "https://secondary.example.com/directory"}
+	tertiary := &issuerlib.Issuer{Name: "tertiary", DirectoryUrl: "https://tertiary.example.com/directory"}
+	fallbacks := []*issuerlib.Issuer{secondary, tertiary}
+
+	testTable := []struct {
+		name        string
+		issuer      *issuerlib.Issuer
+		certificate *cert.Certificate
+		expected    []*issuerlib.Issuer
+	}{
+		{
+			name:     "new certificate",
+			issuer:   primary,
+			expected: []*issuerlib.Issuer{primary, secondary, tertiary},
+		},
+		{
+			name:        "issued by primary",
+			issuer:      primary,
+			certificate: &cert.Certificate{IssuerUrl: primary.DirectoryUrl},
+			expected:    []*issuerlib.Issuer{primary, secondary, tertiary},
+		},
+		{
+			name:        "renewal stays with fallback",
+			issuer:      primary,
+			certificate: &cert.Certificate{IssuerUrl: tertiary.DirectoryUrl},
+			expected:    []*issuerlib.Issuer{tertiary, primary, secondary},
+		},
+		{
+			name:        "renewal fails back to primary",
+			issuer:      failBack,
+			certificate: &cert.Certificate{IssuerUrl: tertiary.DirectoryUrl},
+			expected:    []*issuerlib.Issuer{failBack, secondary, tertiary},
+		},
+		{
+			name:        "unknown issuer",
+			issuer:      primary,
+			certificate: &cert.Certificate{IssuerUrl: "https://removed.example.com/directory"},
+			expected:    []*issuerlib.Issuer{primary, secondary, tertiary},
+		},
+	}
+
+	for _, item := range testTable {
+		e := &DbCertEntry{
+			issuer:      item.issuer,
+			fallbacks:   fallbacks,
+			certificate: item.certificate,
+		}
+		got := e.issuerCandidates()
+		if !reflect.DeepEqual(got, item.expected) {
+			t.Errorf("%s: expected %v, got %v", item.name, item.expected, got)
+		}
+	}
+}
+
+func TestDbCertEntryReAddObject(t *testing.T) {
+	q := NewIssuanceQueue(1)
+	e := NewDbCertEntry(context.Background(), &DbAccountEntry{queue: q}, "test")
+	o := &testObject{uid: "app"}
+
+	e.AddObject(o, nil, nil)
+	q.mutex.Lock()
+	req := q.pop()
+	q.mutex.Unlock()
+	if req == nil || req.entry != e {
+		t.Fatalf("expected the entry to be queued, got %#v", req)
+	}
+
+	// the object is deleted after the request left the queue so obtaining it is cancelled
+	if _, lastObject := e.RemoveObject(o); !lastObject {
+		t.Fatal("expected the object to be the last one")
+	}
+	if e.ctx.Err() == nil {
+		t.Fatal("expected obtaining the certificate to be cancelled")
+	}
+	e.obtainQueuedCertificate(req.priority, time.Since(req.queued))
+	if e.inProgress {
+		t.Fatal("expected the cancelled request to be finished")
+	}
+
+	// the object is recreated with the same host
+	e.AddObject(&testObject{uid: "app-recreated"}, nil, nil)
+	if e.ctx.Err() != nil {
+		t.Error("expected a new context for obtaining the certificate")
+	}
+	q.mutex.Lock()
+	req = q.pop()
+	q.mutex.Unlock()
+	if req == nil || req.entry != e || req.priority != PriorityNew {
+		t.Errorf("expected the entry to be queued again, got %#v", req)
+	}
+}
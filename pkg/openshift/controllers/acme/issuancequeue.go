@@ -0,0 +1,308 @@
+package acme
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-playground/log"
+)
+
+const (
+	// MetricIssuanceQueue is the name under which the issuance queue is published at the metrics endpoint
+	MetricIssuanceQueue = "acme_issuance_queue"
+
+	// DefaultIssuanceConcurrency is how many certificates are obtained at the same time by default
+	DefaultIssuanceConcurrency = 5
+)
+
+// Priority orders requests in the issuance queue; higher priorities are served first
+type Priority int
+
+const (
+	// PriorityRenewal is a routine renewal of a certificate with plenty of validity left
+	PriorityRenewal Priority = iota
+	// PriorityNew is a request for an object which has no certificate yet
+	PriorityNew
+	// PriorityExpiring is a renewal of a certificate which is about to expire or was revoked
+	PriorityExpiring
+
+	priorityCount = int(PriorityExpiring) + 1
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityRenewal:
+		return "renewal"
+	case PriorityNew:
+		return "new"
+	case PriorityExpiring:
+		return "expiring"
+	default:
+		return fmt.Sprintf("Priority(%d)", int(p))
+	}
+}
+
+type issuanceRequest struct {
+	entry    *DbCertEntry
+	priority Priority
+	queued   time.Time
+}
+
+// queueLevel holds requests of one priority; namespaces take turns so a namespace with many requests can't starve others
+type queueLevel struct {
+	namespaces []string // round-robin order of namespaces with queued requests
+	requests   map[string][]*issuanceRequest
+}
+
+// IssuanceQueue limits how many certificates are obtained at the same time. Requests are served by priority
+// and within the same priority fairly across namespaces, first come first served inside a namespace.
+type IssuanceQueue struct {
+	mutex       sync.Mutex
+	cond        *sync.Cond
+	concurrency int
+	running     int
+	levels      [priorityCount]queueLevel
+	queued      map[*DbCertEntry]*issuanceRequest
+	// started and waited sum up requests which left the queue
+	started int64
+	waited  time.Duration
+	// obtain is called for each request outside of the mutex
+	obtain func(req *issuanceRequest, wait time.Duration)
+}
+
+func NewIssuanceQueue(concurrency int) *IssuanceQueue {
+	q := &IssuanceQueue{
+		concurrency: concurrency,
+		queued:      make(map[*DbCertEntry]*issuanceRequest),
+		obtain: func(req *issuanceRequest, wait time.Duration) {
+			req.entry.obtainQueuedCertificate(req.priority, wait)
+		},
+	}
+	q.cond = sync.NewCond(&q.mutex)
+	for i := range q.levels {
+		q.levels[i].requests = make(map[string][]*issuanceRequest)
+	}
+
+	return q
+}
+
+// SetConcurrency changes how many certificates can be obtained at the same time; it can be called while running
+func (q *IssuanceQueue) SetConcurrency(concurrency int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.concurrency = concurrency
+	q.cond.Broadcast()
+}
+
+// Add queues obtaining a certificate for the entry. An entry which is already queued is only moved
+// to the higher priority if needed.
+func (q *IssuanceQueue) Add(e *DbCertEntry, priority Priority) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if req, ok := q.queued[e]; ok {
+		q.raise(req, priority)
+		return
+	}
+
+	req := &issuanceRequest{
+		entry:    e,
+		priority: priority,
+		queued:   time.Now(),
+	}
+	q.queued[e] = req
+	q.push(req)
+	q.cond.Broadcast()
+}
+
+// Raise moves the entry to the higher priority if it is queued; it returns whether it was
+func (q *IssuanceQueue) Raise(e *DbCertEntry, priority Priority) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	req, ok := q.queued[e]
+	if !ok {
+		return false
+	}
+	q.raise(req, priority)
+	return true
+}
+
+// raise moves the request to a higher priority keeping its original queue time; it has to be called with mutex held
+func (q *IssuanceQueue) raise(req *issuanceRequest, priority Priority) {
+	if priority <= req.priority {
+		return
+	}
+	q.remove(req)
+	req.priority = priority
+	q.push(req)
+}
+
+// Remove drops the entry from the queue; it returns whether it was queued
+func (q *IssuanceQueue) Remove(e *DbCertEntry) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	req, ok := q.queued[e]
+	if !ok {
+		return false
+	}
+	q.remove(req)
+	delete(q.queued, e)
+	return true
+}
+
+// push appends the request to its namespace in its level; it has to be called with mutex held
+func (q *IssuanceQueue) push(req *issuanceRequest) {
+	level := &q.levels[req.priority]
+	namespace := req.entry.namespace
+	if len(level.requests[namespace]) == 0 {
+		level.namespaces = append(level.namespaces, namespace)
+	}
+	level.requests[namespace] = append(level.requests[namespace], req)
+}
+
+// remove takes the request out of its level; it has to be called with mutex held
+func (q *IssuanceQueue) remove(req *issuanceRequest) {
+	level := &q.levels[req.priority]
+	namespace := req.entry.namespace
+	requests := level.requests[namespace]
+	for i, r := range requests {
+		if r == req {
+			requests = append(requests[:i:i], requests[i+1:]...)
+			break
+		}
+	}
+	if len(requests) != 0 {
+		level.requests[namespace] = requests
+		return
+	}
+
+	delete(level.requests, namespace)
+	for i, ns := range level.namespaces {
+		if ns == namespace {
+			level.namespaces = append(level.namespaces[:i:i], level.namespaces[i+1:]...)
+			break
+		}
+	}
+}
+
+// pop returns the next request or nil if the queue is empty; it has to be called with mutex held
+func (q *IssuanceQueue) pop() *issuanceRequest {
+	for p := priorityCount - 1; p >= 0; p-- {
+		level := &q.levels[p]
+		if len(level.namespaces) == 0 {
+			continue
+		}
+
+		namespace := level.namespaces[0]
+		requests := level.requests[namespace]
+		req := requests[0]
+		// the namespace goes to the end of the line if it has more requests
+		level.namespaces = level.namespaces[1:]
+		if len(requests) > 1 {
+			level.requests[namespace] = requests[1:]
+			level.namespaces = append(level.namespaces, namespace)
+		} else {
+			delete(level.requests, namespace)
+		}
+
+		delete(q.queued, req.entry)
+		return req
+	}
+
+	return nil
+}
+
+// Run starts obtaining queued certificates while less than the configured number is in progress until ctx is done
+func (q *IssuanceQueue) Run(ctx context.Context) {
+	defer log.Info("IssuanceQueue finished")
+
+	go func() {
+		<-ctx.Done()
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+		q.cond.Broadcast()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for {
+		var req *issuanceRequest
+		for ctx.Err() == nil {
+			if q.running < q.concurrency {
+				req = q.pop()
+				if req != nil {
+					break
+				}
+			}
+			q.cond.Wait()
+		}
+		if req == nil {
+			return
+		}
+
+		wait := time.Since(req.queued)
+		q.running++
+		q.started++
+		q.waited += wait
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.obtain(req, wait)
+
+			q.mutex.Lock()
+			defer q.mutex.Unlock()
+			q.running--
+			q.cond.Broadcast()
+		}()
+	}
+}
+
+// String returns JSON with the queue depth and wait times; it makes IssuanceQueue an expvar.Var
+func (q *IssuanceQueue) String() string {
+	now := time.Now()
+
+	q.mutex.Lock()
+	stats := struct {
+		Concurrency       int            `json:"concurrency"`
+		Running           int            `json:"running"`
+		Queued            map[string]int `json:"queued"`
+		QueuedByNamespace map[string]int `json:"queuedByNamespace"`
+		OldestWaitSeconds float64        `json:"oldestWaitSeconds"`
+		Started           int64          `json:"started"`
+		WaitSecondsTotal  float64        `json:"waitSecondsTotal"`
+	}{
+		Concurrency:       q.concurrency,
+		Running:           q.running,
+		Queued:            make(map[string]int),
+		QueuedByNamespace: make(map[string]int),
+		Started:           q.started,
+		WaitSecondsTotal:  q.waited.Seconds(),
+	}
+	for p := range q.levels {
+		stats.Queued[Priority(p).String()] = 0
+	}
+	for _, req := range q.queued {
+		stats.Queued[req.priority.String()]++
+		stats.QueuedByNamespace[req.entry.namespace]++
+		if wait := now.Sub(req.queued).Seconds(); wait > stats.OldestWaitSeconds {
+			stats.OldestWaitSeconds = wait
+		}
+	}
+	q.mutex.Unlock()
+
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return fmt.Sprintf("%q", err.Error())
+	}
+	return string(data)
+}
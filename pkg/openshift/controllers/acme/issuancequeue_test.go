@@ -0,0 +1,168 @@
+package acme
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tnozicka/openshift-acme/pkg/cert"
+)
+
+func TestIssuanceQueueOrder(t *testing.T) {
+	entries := make(map[string]*DbCertEntry)
+	entry := func(name, namespace string) *DbCertEntry {
+		e := &DbCertEntry{namespace: namespace}
+		entries[name] = e
+		return e
+	}
+
+	q := NewIssuanceQueue(1)
+	q.Add(entry("a1", "a"), PriorityNew)
+	q.Add(entry("a2", "a"), PriorityNew)
+	q.Add(entry("a3", "a"), PriorityNew)
+	q.Add(entry("b1", "b"), PriorityNew)
+	q.Add(entry("c1", "c"), PriorityRenewal)
+	q.Add(entry("c2", "c"), PriorityRenewal)
+	q.Add(entry("a4", "a"), PriorityExpiring)
+	q.Add(entry("d1", "d"), PriorityRenewal)
+	// queued entries are moved to higher priority only
+	q.Add(entries["c2"], PriorityExpiring)
+	q.Add(entries["a4"], PriorityRenewal)
+	if q.Raise(&DbCertEntry{namespace: "x"}, PriorityExpiring) {
+		t.Error("entry which isn't queued was raised")
+	}
+	q.Add(entry("e1", "e"), PriorityNew)
+	if !q.Remove(entries["e1"]) {
+		t.Error("queued entry wasn't removed")
+	}
+
+	var stats struct {
+		Queued            map[string]int `json:"queued"`
+		QueuedByNamespace map[string]int `json:"queuedByNamespace"`
+	}
+	if err := json.Unmarshal([]byte(q.String()), &stats); err != nil {
+		t.Fatal(err)
+	}
+	expectedQueued := map[string]int{"expiring": 2, "new": 4, "renewal": 2}
+	if !reflect.DeepEqual(stats.Queued, expectedQueued) {
+		t.Errorf("expected queued %v, got %v", expectedQueued, stats.Queued)
+	}
+	expectedByNamespace := map[string]int{"a": 4, "b": 1, "c": 2, "d": 1}
+	if !reflect.DeepEqual(stats.QueuedByNamespace, expectedByNamespace) {
+		t.Errorf("expected queued by namespace %v, got %v", expectedByNamespace, stats.QueuedByNamespace)
+	}
+
+	names := make(map[*DbCertEntry]string)
+	for name, e := range entries {
+		names[e] = name
+	}
+	var got []string
+	for req := q.pop(); req != nil; req = q.pop() {
+		got = append(got, names[req.entry])
+	}
+
+	expected := []string{"a4", "c2", "a1", "b1", "a2", "a3", "c1", "d1"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected order %v, got %v", expected, got)
+	}
+	if len(q.queued) != 0 {
+		t.Errorf("queue isn't empty: %v", q.queued)
+	}
+}
+
+func TestIssuanceQueueConcurrency(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := NewIssuanceQueue(2)
+	var mutex sync.Mutex
+	running, maxRunning, done := 0, 0, 0
+	finished := make(chan struct{}, 10)
+	q.obtain = func(req *issuanceRequest, wait time.Duration) {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mutex.Lock()
+		running--
+		done++
+		mutex.Unlock()
+		finished <- struct{}{}
+	}
+
+	for i := 0; i < 6; i++ {
+		q.Add(&DbCertEntry{namespace: "test"}, PriorityNew)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		q.Run(ctx)
+		close(stopped)
+	}()
+
+	for i := 0; i < 6; i++ {
+		select {
+		case <-finished:
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for the queue")
+		}
+	}
+	cancel()
+	<-stopped
+
+	if maxRunning != 2 {
+		t.Errorf("expected 2 certificates to be obtained at the same time, got %d", maxRunning)
+	}
+	if done != 6 || q.started != 6 {
+		t.Errorf("expected 6 requests to be served, got %d (started %d)", done, q.started)
+	}
+}
+
+func TestDbCertEntryPriority(t *testing.T) {
+	now := time.Now()
+	certificate := func(notBefore, notAfter time.Time) *cert.Certificate {
+		return &cert.Certificate{Certificate: &x509.Certificate{NotBefore: notBefore, NotAfter: notAfter}}
+	}
+
+	testTable := []struct {
+		name        string
+		certificate *cert.Certificate
+		expected    Priority
+	}{
+		{
+			name:     "no certificate",
+			expected: PriorityNew,
+		},
+		{
+			name:        "renewal",
+			certificate: certificate(now.Add(-60*24*time.Hour), now.Add(30*24*time.Hour)),
+			expected:    PriorityRenewal,
+		},
+		{
+			name:        "expiring soon",
+			certificate: certificate(now.Add(-85*24*time.Hour), now.Add(5*24*time.Hour)),
+			expected:    PriorityExpiring,
+		},
+		{
+			name:        "expired",
+			certificate: certificate(now.Add(-90*24*time.Hour), now.Add(-time.Hour)),
+			expected:    PriorityExpiring,
+		},
+	}
+
+	for _, item := range testTable {
+		e := &DbCertEntry{certificate: item.certificate}
+		if got := e.priority(now); got != item.expected {
+			t.Errorf("%s: expected priority %s, got %s", item.name, item.expected, got)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package acme
+
+import (
+	"fmt"
+)
+
+// LifecyclePolicy says what happens to the generated secret and the object's TLS configuration
+// when the object is deleted or it isn't supposed to be managed anymore
+type LifecyclePolicy string
+
+const (
+	// LifecyclePolicyRetain keeps the secret and the object's TLS configuration untouched
+	LifecyclePolicyRetain LifecyclePolicy = "retain"
+	// LifecyclePolicyDelete deletes the secret and removes the certificate from the object
+	LifecyclePolicyDelete LifecyclePolicy = "delete"
+	// LifecyclePolicyRevokeAndDelete revokes the certificate if no other object uses it and does what LifecyclePolicyDelete does
+	LifecyclePolicyRevokeAndDelete LifecyclePolicy = "revoke-and-delete"
+
+	DefaultLifecyclePolicy = LifecyclePolicyRetain
+)
+
+func ParseLifecyclePolicy(s string) (LifecyclePolicy, error) {
+	switch p := LifecyclePolicy(s); p {
+	case LifecyclePolicyRetain, LifecyclePolicyDelete, LifecyclePolicyRevokeAndDelete:
+		return p, nil
+	case "":
+		return DefaultLifecyclePolicy, nil
+	default:
+		return "", fmt.Errorf("unknown lifecycle policy '%s'", s)
+	}
+}
@@ -0,0 +1,133 @@
+package acme
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"time"
+
+	"github.com/go-playground/log"
+	"github.com/tnozicka/openshift-acme/pkg/cert"
+	"github.com/tnozicka/openshift-acme/pkg/dryrun"
+	"golang.org/x/crypto/ocsp"
+	"k8s.io/client-go/pkg/api/unversioned"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// EventReasonCertificateRevoked is the reason of events on objects whose certificate was found revoked
+	EventReasonCertificateRevoked = "CertificateRevoked"
+
+	eventSourceComponent = "openshift-acme"
+	ocspTimeout          = 30 * time.Second
+)
+
+var (
+	// RevokedCertificates counts certificates found revoked by OCSP checks
+	RevokedCertificates = expvar.NewInt("acme_revoked_certificates")
+	// OCSPCheckErrors counts OCSP checks which didn't get a valid response
+	OCSPCheckErrors = expvar.NewInt("acme_ocsp_check_errors")
+)
+
+func (ac *AcmeController) ocspLoop() {
+	defer ac.wg.Done()
+	defer log.Info("AcmeController - ocspLoop - finished")
+
+loop:
+	for {
+		// when disabled we still wake up from time to time in case it gets enabled while running
+		wait := ac.RenewalPolicy().OCSPCheckInterval
+		if wait <= 0 {
+			wait = ac.RenewalPolicy().CheckInterval
+		}
+
+		select {
+		case <-time.After(wait):
+			if ac.RenewalPolicy().OCSPCheckInterval <= 0 {
+				continue
+			}
+			log.Debug("OCSP check triggered by schedule.")
+			ac.CheckRevocations()
+
+		case <-ac.ctx.Done():
+			break loop
+		}
+	}
+}
+
+// CheckRevocations asks OCSP responders for the status of current certificates
+// and immediately starts obtaining new ones for those which were revoked
+func (ac *AcmeController) CheckRevocations() {
+	for _, certEntry := range ac.Db.GetCertEntryShallowSnapshot() {
+		certEntry.mutex.Lock()
+		certificate := certEntry.certificate
+		skip := certificate == nil || certEntry.inProgress
+		certEntry.mutex.Unlock()
+		if skip {
+			continue
+		}
+
+		response, err := ac.checkOCSP(certEntry, certificate)
+		if err == cert.ErrNoOCSPServer {
+			certEntry.logger().Debugf("Not checking revocation of certificate %s: %s", certificate, err)
+			continue
+		}
+		if err != nil {
+			OCSPCheckErrors.Add(1)
+			certEntry.logger().Warnf("Unable to check revocation of certificate %s: %s", certificate, err)
+			continue
+		}
+		if response.Status != ocsp.Revoked {
+			continue
+		}
+
+		RevokedCertificates.Add(1)
+		message := fmt.Sprintf("Certificate %s was revoked at %s; obtaining a new one", certificate, response.RevokedAt.Format(time.RFC3339))
+
+		certEntry.mutex.Lock()
+		if certEntry.certificate == certificate {
+			certEntry.logger().Warn(message)
+			for _, o := range certEntry.objects {
+				ac.RecordEvent(o, api_v1.EventTypeWarning, EventReasonCertificateRevoked, message)
+			}
+			certEntry.startObtainingCertificateWithPriority(PriorityExpiring)
+		}
+		certEntry.mutex.Unlock()
+	}
+}
+
+// checkOCSP uses the HTTP client of the entry's account so OCSP requests go through the same proxy
+func (ac *AcmeController) checkOCSP(certEntry *DbCertEntry, certificate *cert.Certificate) (*ocsp.Response, error) {
+	ctx, cancel := context.WithTimeout(ac.ctx, ocspTimeout)
+	defer cancel()
+
+	return certificate.CheckOCSP(ctx, certEntry.accountEntry.account.Client.Client.HTTPClient)
+}
+
+// RecordEvent creates an event for the object; failures are only logged
+func (ac *AcmeController) RecordEvent(o AcmeObject, eventType, reason, message string) {
+	ref := o.GetObjectReference()
+	if ac.dryRun.Enabled() {
+		ac.dryRun.Record(dryrun.VerbCreate, "event", ref.Namespace, ref.Name, fmt.Sprintf("%s: %s", reason, message))
+		return
+	}
+
+	now := unversioned.Now()
+	event := &api_v1.Event{
+		ObjectMeta: api_v1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", ref.Name, now.UnixNano()),
+			Namespace: ref.Namespace,
+		},
+		InvolvedObject: ref,
+		Reason:         reason,
+		Message:        message,
+		Source:         api_v1.EventSource{Component: eventSourceComponent},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           eventType,
+	}
+	if _, err := ac.kclient.Events(ref.Namespace).Create(event); err != nil {
+		o.GetLogger().Errorf("Failed to create event '%s': %s", reason, err)
+	}
+}
@@ -0,0 +1,256 @@
+package route
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tnozicka/openshift-acme/pkg/cert"
+	oapi "github.com/tnozicka/openshift-acme/pkg/openshift/api"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// MetricRouteCertificates is the name under which the monitor is published at the metrics endpoint
+	MetricRouteCertificates = "acme_route_certificates"
+
+	// DefaultExpiryWarning is how long before expiry certificates are reported as expiring
+	DefaultExpiryWarning = 21 * 24 * time.Hour
+
+	EventReasonCertificateExpiring         = "CertificateExpiring"
+	EventReasonCertificateExpired          = "CertificateExpired"
+	EventReasonCertificateHostnameMismatch = "CertificateHostnameMismatch"
+	EventReasonCertificateInvalid          = "CertificateInvalid"
+)
+
+// CertificateStatus describes the certificate a route serves
+type CertificateStatus struct {
+	Namespace        string    `json:"namespace"`
+	Route            string    `json:"route"`
+	Host             string    `json:"host"`
+	Managed          bool      `json:"managed"`
+	Issuer           string    `json:"issuer,omitempty"`
+	NotAfter         time.Time `json:"notAfter,omitempty"`
+	ExpiresInSeconds int64     `json:"expiresInSeconds"`
+	HostnameMismatch bool      `json:"hostnameMismatch"`
+	Error            string    `json:"error,omitempty"`
+}
+
+type byNamespaceAndRoute []CertificateStatus
+
+func (s byNamespaceAndRoute) Len() int      { return len(s) }
+func (s byNamespaceAndRoute) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byNamespaceAndRoute) Less(i, j int) bool {
+	if s[i].Namespace != s[j].Namespace {
+		return s[i].Namespace < s[j].Namespace
+	}
+	return s[i].Route < s[j].Route
+}
+
+type monitoredRoute struct {
+	route       oapi.Route
+	certificate string
+	status      CertificateStatus
+	// reported holds event reasons already reported for the current certificate
+	reported map[string]bool
+}
+
+type monitorEvent struct {
+	route   oapi.Route
+	reason  string
+	message string
+}
+
+// Monitor keeps track of certificates of all routes, including those not managed by the controller,
+// and reports the ones which are about to expire, expired, don't cover the route's host or can't be parsed.
+// It is published as an expvar.
+type Monitor struct {
+	expiryWarning time.Duration
+	recordEvent   func(route oapi.Route, eventType, reason, message string)
+
+	mutex  sync.Mutex
+	routes map[string]*monitoredRoute // UID => route
+}
+
+func NewMonitor(expiryWarning time.Duration) *Monitor {
+	return &Monitor{
+		expiryWarning: expiryWarning,
+		routes:        make(map[string]*monitoredRoute),
+	}
+}
+
+// Update starts tracking the route's certificate or updates it; routes without a certificate are forgotten
+func (m *Monitor) Update(route oapi.Route, managed bool) {
+	if route.Spec.Tls == nil || route.Spec.Tls.Certificate == "" {
+		m.Forget(route)
+		return
+	}
+
+	m.mutex.Lock()
+	r, ok := m.routes[string(route.UID)]
+	if !ok || r.certificate != route.Spec.Tls.Certificate || r.status.Host != route.Spec.Host {
+		r = &monitoredRoute{
+			certificate: route.Spec.Tls.Certificate,
+			status:      parseCertificateStatus(route),
+			reported:    make(map[string]bool),
+		}
+		m.routes[string(route.UID)] = r
+	}
+	r.route = route
+	r.status.Namespace = route.Namespace
+	r.status.Route = route.Name
+	r.status.Managed = managed
+	events := m.evaluate(r, time.Now())
+	m.mutex.Unlock()
+
+	m.report(events)
+}
+
+// Forget stops tracking the route
+func (m *Monitor) Forget(route oapi.Route) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.routes, string(route.UID))
+}
+
+// Retain forgets routes from the namespace whose UID isn't present; it is used after relisting
+// to drop routes deleted while we weren't watching
+func (m *Monitor) Retain(namespace string, present map[string]bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for uid, r := range m.routes {
+		if (namespace == "" || r.route.Namespace == namespace) && !present[uid] {
+			delete(m.routes, uid)
+		}
+	}
+}
+
+// Check reevaluates expiry of all tracked certificates
+func (m *Monitor) Check() {
+	now := time.Now()
+
+	m.mutex.Lock()
+	var events []monitorEvent
+	for _, r := range m.routes {
+		events = append(events, m.evaluate(r, now)...)
+	}
+	m.mutex.Unlock()
+
+	m.report(events)
+}
+
+// Statuses returns the state of all tracked certificates sorted by namespace and route name
+func (m *Monitor) Statuses() []CertificateStatus {
+	now := time.Now()
+
+	m.mutex.Lock()
+	statuses := make([]CertificateStatus, 0, len(m.routes))
+	for _, r := range m.routes {
+		status := r.status
+		if !status.NotAfter.IsZero() {
+			status.ExpiresInSeconds = int64(status.NotAfter.Sub(now) / time.Second)
+		}
+		statuses = append(statuses, status)
+	}
+	m.mutex.Unlock()
+
+	sort.Sort(byNamespaceAndRoute(statuses))
+
+	return statuses
+}
+
+// String returns JSON with the statuses and number of problematic certificates; it makes Monitor an expvar.Var
+func (m *Monitor) String() string {
+	statuses := m.Statuses()
+	summary := struct {
+		Certificates       []CertificateStatus `json:"certificates"`
+		Expiring           int                 `json:"expiring"`
+		Expired            int                 `json:"expired"`
+		HostnameMismatches int                 `json:"hostnameMismatches"`
+		Invalid            int                 `json:"invalid"`
+	}{
+		Certificates: statuses,
+	}
+	for _, status := range statuses {
+		switch {
+		case status.Error != "":
+			summary.Invalid++
+		case status.ExpiresInSeconds <= 0:
+			summary.Expired++
+		case time.Duration(status.ExpiresInSeconds)*time.Second < m.expiryWarning:
+			summary.Expiring++
+		}
+		if status.HostnameMismatch {
+			summary.HostnameMismatches++
+		}
+	}
+
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return fmt.Sprintf("%q", err.Error())
+	}
+	return string(data)
+}
+
+func parseCertificateStatus(route oapi.Route) CertificateStatus {
+	status := CertificateStatus{
+		Host: route.Spec.Host,
+	}
+
+	c := &cert.Certificate{Crt: []byte(route.Spec.Tls.Certificate)}
+	if err := c.UpdateTargetCertificate(); err != nil {
+		status.Error = err.Error()
+		return status
+	}
+
+	status.Issuer = c.Certificate.Issuer.CommonName
+	if status.Issuer == "" {
+		status.Issuer = c.Certificate.Issuer.String()
+	}
+	status.NotAfter = c.Certificate.NotAfter
+	status.HostnameMismatch = c.Certificate.VerifyHostname(route.Spec.Host) != nil
+
+	return status
+}
+
+// evaluate returns events which haven't been reported for the current certificate yet; it has to be called with mutex held
+func (m *Monitor) evaluate(r *monitoredRoute, now time.Time) []monitorEvent {
+	var events []monitorEvent
+	add := func(reason, message string) {
+		if r.reported[reason] {
+			return
+		}
+		r.reported[reason] = true
+		events = append(events, monitorEvent{route: r.route, reason: reason, message: message})
+	}
+
+	if r.status.Error != "" {
+		add(EventReasonCertificateInvalid, fmt.Sprintf("Unable to parse certificate of route: %s", r.status.Error))
+		return events
+	}
+
+	if r.status.HostnameMismatch {
+		add(EventReasonCertificateHostnameMismatch, fmt.Sprintf("Certificate issued by '%s' doesn't cover host '%s'", r.status.Issuer, r.status.Host))
+	}
+
+	switch left := r.status.NotAfter.Sub(now); {
+	case left <= 0:
+		add(EventReasonCertificateExpired, fmt.Sprintf("Certificate issued by '%s' expired at %s", r.status.Issuer, r.status.NotAfter.Format(time.RFC3339)))
+	case left < m.expiryWarning:
+		add(EventReasonCertificateExpiring, fmt.Sprintf("Certificate issued by '%s' expires at %s", r.status.Issuer, r.status.NotAfter.Format(time.RFC3339)))
+	}
+
+	return events
+}
+
+func (m *Monitor) report(events []monitorEvent) {
+	for _, e := range events {
+		if m.recordEvent != nil {
+			m.recordEvent(e.route, api_v1.EventTypeWarning, e.reason, e.message)
+		}
+	}
+}
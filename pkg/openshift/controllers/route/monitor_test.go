@@ -0,0 +1,177 @@
+package route
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	oapi "github.com/tnozicka/openshift-acme/pkg/openshift/api"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/types"
+)
+
+// newSelfSignedCertificate returns PEM encoded self-signed certificate for the domain expiring at notAfter
+func newSelfSignedCertificate(t *testing.T, domain string, notAfter time.Time) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func newMonitoredRoute(name, host, certificate string) oapi.Route {
+	route := oapi.Route{
+		ObjectMeta: api_v1.ObjectMeta{
+			Name:      name,
+			Namespace: "test",
+			UID:       types.UID(name),
+		},
+		Spec: oapi.RouteSpec{
+			Host: host,
+		},
+	}
+	if certificate != "" {
+		route.Spec.Tls = &oapi.TlsConfig{Certificate: certificate}
+	}
+	return route
+}
+
+func TestMonitor(t *testing.T) {
+	now := time.Now()
+	valid := newSelfSignedCertificate(t, "valid.example.com", now.Add(60*24*time.Hour))
+
+	testTable := []struct {
+		name     string
+		route    oapi.Route
+		expected []string
+		tracked  bool
+	}{
+		{
+			name:    "valid",
+			route:   newMonitoredRoute("valid", "valid.example.com", valid),
+			tracked: true,
+		},
+		{
+			name:     "expiring",
+			route:    newMonitoredRoute("expiring", "expiring.example.com", newSelfSignedCertificate(t, "expiring.example.com", now.Add(7*24*time.Hour))),
+			expected: []string{EventReasonCertificateExpiring},
+			tracked:  true,
+		},
+		{
+			name:     "expired and for another host",
+			route:    newMonitoredRoute("expired", "expired.example.com", newSelfSignedCertificate(t, "old.example.com", now.Add(-time.Hour))),
+			expected: []string{EventReasonCertificateExpired, EventReasonCertificateHostnameMismatch},
+			tracked:  true,
+		},
+		{
+			name:     "invalid",
+			route:    newMonitoredRoute("invalid", "invalid.example.com", "not a certificate"),
+			expected: []string{EventReasonCertificateInvalid},
+			tracked:  true,
+		},
+		{
+			name:  "without certificate",
+			route: newMonitoredRoute("plain", "plain.example.com", ""),
+		},
+	}
+
+	for _, item := range testTable {
+		var reasons []string
+		m := NewMonitor(DefaultExpiryWarning)
+		m.recordEvent = func(route oapi.Route, eventType, reason, message string) {
+			if route.Name != item.route.Name || eventType != api_v1.EventTypeWarning {
+				t.Errorf("%s: unexpected event %s/%s for route %s", item.name, eventType, reason, route.Name)
+			}
+			reasons = append(reasons, reason)
+		}
+
+		m.Update(item.route, false)
+		sort.Strings(reasons)
+		if !reflect.DeepEqual(reasons, item.expected) {
+			t.Errorf("%s: expected events %v, got %v", item.name, item.expected, reasons)
+		}
+
+		// problems are reported only once for the same certificate
+		reasons = nil
+		m.Update(item.route, false)
+		m.Check()
+		if len(reasons) != 0 {
+			t.Errorf("%s: events reported again: %v", item.name, reasons)
+		}
+
+		if tracked := len(m.Statuses()) == 1; tracked != item.tracked {
+			t.Errorf("%s: expected tracked=%t, got %t", item.name, item.tracked, tracked)
+		}
+	}
+}
+
+func TestMonitorUpdate(t *testing.T) {
+	m := NewMonitor(DefaultExpiryWarning)
+	var reasons []string
+	m.recordEvent = func(route oapi.Route, eventType, reason, message string) {
+		reasons = append(reasons, reason)
+	}
+
+	route := newMonitoredRoute("app", "app.example.com", newSelfSignedCertificate(t, "app.example.com", time.Now().Add(time.Hour)))
+	m.Update(route, false)
+	other := newMonitoredRoute("other", "other.example.com", newSelfSignedCertificate(t, "other.example.com", time.Now().Add(60*24*time.Hour)))
+	m.Update(other, true)
+
+	var metrics struct {
+		Certificates []CertificateStatus `json:"certificates"`
+		Expiring     int                 `json:"expiring"`
+	}
+	if err := json.Unmarshal([]byte(m.String()), &metrics); err != nil {
+		t.Fatal(err)
+	}
+	if metrics.Expiring != 1 || len(metrics.Certificates) != 2 {
+		t.Fatalf("unexpected metrics %s", m.String())
+	}
+	status := metrics.Certificates[0]
+	if status.Route != "app" || status.Managed || status.Issuer != "app.example.com" || status.ExpiresInSeconds <= 0 || status.ExpiresInSeconds > 3600 {
+		t.Errorf("unexpected status %#v", status)
+	}
+	if !metrics.Certificates[1].Managed {
+		t.Errorf("expected route 'other' to be managed: %#v", metrics.Certificates[1])
+	}
+
+	// a replaced certificate is reported again
+	route.Spec.Tls.Certificate = newSelfSignedCertificate(t, "app.example.com", time.Now().Add(2*time.Hour))
+	reasons = nil
+	m.Update(route, false)
+	if !reflect.DeepEqual(reasons, []string{EventReasonCertificateExpiring}) {
+		t.Errorf("expected the new certificate to be reported as expiring, got %v", reasons)
+	}
+
+	// routes which disappeared while not watching are dropped after relist
+	m.Retain("test", map[string]bool{string(other.UID): true})
+	if statuses := m.Statuses(); len(statuses) != 1 || statuses[0].Route != "other" {
+		t.Errorf("expected only route 'other' to be tracked, got %#v", statuses)
+	}
+
+	m.Forget(other)
+	if statuses := m.Statuses(); len(statuses) != 0 {
+		t.Errorf("expected no routes to be tracked, got %#v", statuses)
+	}
+}
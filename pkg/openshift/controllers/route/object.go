@@ -5,13 +5,19 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/go-playground/log"
 	"github.com/tnozicka/openshift-acme/pkg/acme"
+	"github.com/tnozicka/openshift-acme/pkg/acme/challengeexposers"
 	"github.com/tnozicka/openshift-acme/pkg/cert"
+	"github.com/tnozicka/openshift-acme/pkg/dryrun"
+	"github.com/tnozicka/openshift-acme/pkg/logging"
 	oapi "github.com/tnozicka/openshift-acme/pkg/openshift/api"
 	oschallengeexposers "github.com/tnozicka/openshift-acme/pkg/openshift/challengeexposers"
+	acme_controller "github.com/tnozicka/openshift-acme/pkg/openshift/controllers/acme"
+	issuerlib "github.com/tnozicka/openshift-acme/pkg/openshift/issuer"
 	"github.com/tnozicka/openshift-acme/pkg/openshift/untypedclient"
 	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
 	kerrors "k8s.io/client-go/pkg/api/errors"
@@ -19,6 +25,23 @@ import (
 	api_v1 "k8s.io/client-go/pkg/api/v1"
 )
 
+const (
+	// SecretDataLeafKey holds only the leaf certificate (tls.crt contains the full chain)
+	SecretDataLeafKey = "tls-leaf.crt"
+	// SecretDataChainKey holds the intermediate certificates
+	SecretDataChainKey = "tls-chain.crt"
+	// SecretDataCAKey holds the top-most certificate of the chain sent by the ACME server; empty if it sent only the leaf
+	SecretDataCAKey = "ca.crt"
+
+	// AnnotationLifecyclePolicyKey overrides the default lifecycle policy for a route
+	AnnotationLifecyclePolicyKey = "kubernetes.io/tls-acme.lifecycle-policy"
+	// AnnotationInsecureEdgeTerminationPolicyKey sets spec.tls.insecureEdgeTerminationPolicy (None, Allow or Redirect)
+	// once the route has a certificate
+	AnnotationInsecureEdgeTerminationPolicyKey = "kubernetes.io/tls-acme.insecure-edge-termination-policy"
+	// AnnotationIssuerUrlKey records on the route and its secret the directory URL of the ACME server which issued the certificate
+	AnnotationIssuerUrlKey = "kubernetes.io/tls-acme.issuer-url"
+)
+
 func AcmeRouteHash(r oapi.Route) string {
 	s := ""
 
@@ -45,6 +68,19 @@ type RouteObject struct {
 	selfService                ServiceID
 	exposers                   map[string]acme.ChallengeExposer
 	SelfServiceEndpointSubsets []api_v1.EndpointSubset
+	inFlight                   *oschallengeexposers.InFlight
+	defaultLifecyclePolicy     acme_controller.LifecyclePolicy
+	routerShardLabels          []string
+	dryRun                     *dryrun.Recorder
+}
+
+// GetLogger returns logger with the route and its domains
+func (o *RouteObject) GetLogger() *logging.Logger {
+	return logging.New(
+		log.F(logging.FieldNamespace, o.GetNamespace()),
+		log.F(logging.FieldRoute, o.GetName()),
+		log.F(logging.FieldDomains, o.GetDomains()),
+	)
 }
 
 func (o *RouteObject) GetDomains() []string {
@@ -63,17 +99,98 @@ func (o *RouteObject) GetUID() string {
 	return fmt.Sprintf("route/%s/%s", o.GetNamespace(), o.GetName())
 }
 
+func (o *RouteObject) GetIssuerName() string {
+	return o.route.Annotations[issuerlib.AnnotationRouteIssuerKey]
+}
+
+// isPassthrough returns true if TLS is terminated by the pods; they use the certificate from the secret
+func (o *RouteObject) isPassthrough() bool {
+	return o.route.Spec.Tls != nil && o.route.Spec.Tls.Termination == oapi.TlsTerminationPassthrough
+}
+
+// insecureEdgeTerminationPolicy returns the policy requested by annotation if it is valid for the route
+func (o *RouteObject) insecureEdgeTerminationPolicy() (policy string, found bool) {
+	policy, found = o.route.Annotations[AnnotationInsecureEdgeTerminationPolicyKey]
+	if !found {
+		return
+	}
+
+	switch policy {
+	case oapi.InsecureEdgeTerminationPolicyNone, oapi.InsecureEdgeTerminationPolicyRedirect:
+		return policy, true
+	case oapi.InsecureEdgeTerminationPolicyAllow:
+		if !o.isPassthrough() {
+			return policy, true
+		}
+		o.GetLogger().Warnf("Ignoring annotation '%s': policy '%s' isn't supported for passthrough routes", AnnotationInsecureEdgeTerminationPolicyKey, policy)
+	default:
+		o.GetLogger().Warnf("Ignoring annotation '%s': unknown policy '%s'", AnnotationInsecureEdgeTerminationPolicyKey, policy)
+	}
+
+	return "", false
+}
+
+// secretCertificate returns the certificate from the route's secret
+func (o *RouteObject) secretCertificate() (*cert.Certificate, error) {
+	secret, err := o.client.Secrets(o.GetNamespace()).Get(o.GetSecretName())
+	if err != nil {
+		return nil, err
+	}
+	if secret.Type != api_v1.SecretTypeTLS {
+		return nil, fmt.Errorf("secret '%s' has type '%s'", secret.Name, secret.Type)
+	}
+
+	return &cert.Certificate{
+		Crt:       secret.Data[api_v1.TLSCertKey],
+		Key:       secret.Data[api_v1.TLSPrivateKeyKey],
+		IssuerUrl: secret.Annotations[AnnotationIssuerUrlKey],
+	}, nil
+}
+
 func (o *RouteObject) GetCertificate() *cert.Certificate {
 	c := &cert.Certificate{}
 
+	if o.isPassthrough() {
+		// passthrough routes can't hold certificates
+		secretCertificate, err := o.secretCertificate()
+		if err != nil {
+			if !kerrors.IsNotFound(err) {
+				o.GetLogger().Debugf("Unable to get certificate from secret: %s", err)
+			}
+			return c
+		}
+		return secretCertificate
+	}
+
 	if o.route.Spec.Tls != nil {
 		c.Key = []byte(o.route.Spec.Tls.Key)
-		c.Crt = []byte(o.route.Spec.Tls.Certificate)
+		// intermediates are stored separately in caCertificate
+		c.Crt = cert.JoinPEM(o.route.Spec.Tls.Certificate, o.route.Spec.Tls.CaCertificate)
+		c.IssuerUrl = o.route.Annotations[AnnotationIssuerUrlKey]
 	}
 
 	return c
 }
 
+// GetExistingCertificates returns the certificate in the route and the one in its secret
+func (o *RouteObject) GetExistingCertificates() []*cert.Certificate {
+	certificates := []*cert.Certificate{o.GetCertificate()}
+	if o.isPassthrough() {
+		// the route's certificate already comes from the secret
+		return certificates
+	}
+
+	secretCertificate, err := o.secretCertificate()
+	if err != nil {
+		if !kerrors.IsNotFound(err) {
+			o.GetLogger().Debugf("Unable to get certificate from secret: %s", err)
+		}
+		return certificates
+	}
+
+	return append(certificates, secretCertificate)
+}
+
 func (o *RouteObject) GetName() string {
 	return o.route.Name
 }
@@ -82,10 +199,159 @@ func (o *RouteObject) GetNamespace() string {
 	return o.route.Namespace
 }
 
+func (o *RouteObject) GetObjectReference() api_v1.ObjectReference {
+	return api_v1.ObjectReference{
+		Kind:            "Route",
+		APIVersion:      "v1",
+		Namespace:       o.route.Namespace,
+		Name:            o.route.Name,
+		UID:             o.route.UID,
+		ResourceVersion: o.route.ResourceVersion,
+	}
+}
+
 func (o *RouteObject) GetAcmeHash() string {
 	return AcmeRouteHash(o.route)
 }
 
+func (o *RouteObject) ownerReference() *api_v1.OwnerReference {
+	return &api_v1.OwnerReference{
+		APIVersion: "v1",
+		Kind:       "Route",
+		Name:       o.route.Name,
+		UID:        o.route.UID,
+	}
+}
+
+func (o *RouteObject) GetLifecyclePolicy() acme_controller.LifecyclePolicy {
+	v, found := o.route.Annotations[AnnotationLifecyclePolicyKey]
+	if !found {
+		return o.defaultLifecyclePolicy
+	}
+
+	policy, err := acme_controller.ParseLifecyclePolicy(v)
+	if err != nil {
+		o.GetLogger().Warnf("Route '%s/%s': %s; using '%s'", o.GetNamespace(), o.GetName(), err, o.defaultLifecyclePolicy)
+		return o.defaultLifecyclePolicy
+	}
+
+	return policy
+}
+
+// setSecretOwner makes the route owner of the secret if the secret shouldn't outlive it
+func (o *RouteObject) setSecretOwner(secret *api_v1.Secret) {
+	ownerReferences := []api_v1.OwnerReference{}
+	for _, ref := range secret.OwnerReferences {
+		if ref.Kind == "Route" && ref.Name == o.route.Name {
+			continue
+		}
+		ownerReferences = append(ownerReferences, ref)
+	}
+
+	if o.GetLifecyclePolicy() != acme_controller.LifecyclePolicyRetain {
+		ownerReferences = append(ownerReferences, *o.ownerReference())
+	}
+
+	secret.OwnerReferences = ownerReferences
+}
+
+func (o *RouteObject) putRoute() error {
+	name := o.GetName()
+	namespace := o.GetNamespace()
+
+	if o.dryRun.Enabled() {
+		o.dryRun.Record(dryrun.VerbUpdate, "route", namespace, name, "TLS configuration and annotations")
+		return nil
+	}
+
+	url := fmt.Sprintf("/oapi/v1/namespaces/%s/routes/%s", namespace, name)
+	data, err := json.Marshal(&o.route)
+	if err != nil {
+		o.GetLogger().Error(err)
+		return err
+	}
+	o.GetLogger().Infof("Updating route '%s' in namespace '%s'", name, namespace)
+	// TODO: use PATCH in the future to avoid 409
+	body, err := untypedclient.Put(o.client.RESTClient(), url, data)
+	if err != nil {
+		return fmt.Errorf("%s; detail: '%s'", err, string(body))
+	}
+	o.GetLogger().Infof("Route '%s' in namespace '%s' UPDATED.", name, namespace)
+
+	return nil
+}
+
+func (o *RouteObject) DeleteCertificate(objectDeleted bool) error {
+	namespace := o.GetNamespace()
+	secretName := o.GetSecretName()
+
+	secret, err := o.client.Secrets(namespace).Get(secretName)
+	if err != nil {
+		if !kerrors.IsNotFound(err) {
+			return err
+		}
+	} else {
+		// don't delete secrets we haven't created
+		_, managed := secret.Annotations["kubernetes.io/tls-acme.last-update-time"]
+		if managed && o.dryRun.Enabled() {
+			o.dryRun.Record(dryrun.VerbDelete, "secret", namespace, secretName, fmt.Sprintf("(lifecycle policy: %s)", o.GetLifecyclePolicy()))
+		} else if managed {
+			o.GetLogger().Infof("Deleting secret '%s' in namespace '%s' for route '%s'", secretName, namespace, o.GetName())
+			err = o.client.Secrets(namespace).Delete(secretName, &api_v1.DeleteOptions{})
+			if err != nil && !kerrors.IsNotFound(err) {
+				return err
+			}
+		} else {
+			o.GetLogger().Warnf("Not deleting secret '%s' in namespace '%s' because it wasn't created by this controller", secretName, namespace)
+		}
+	}
+
+	if objectDeleted {
+		return nil
+	}
+
+	route := &o.route
+	if route.Spec.Tls != nil && !o.isPassthrough() {
+		route.Spec.Tls.Key = ""
+		route.Spec.Tls.Certificate = ""
+		route.Spec.Tls.CaCertificate = ""
+	}
+	for _, annotation := range []string{
+		"kubernetes.io/tls-acme.last-update-time",
+		"kubernetes.io/tls-acme.valid-not-before",
+		"kubernetes.io/tls-acme.valid-not-after",
+		"kubernetes.io/tls-acme.hash",
+	} {
+		delete(route.Annotations, annotation)
+	}
+
+	return o.putRoute()
+}
+
+// admittingRouters returns the router shards that have admitted the route
+func (o *RouteObject) admittingRouters() []string {
+	var routers []string
+	for router, admitted := range o.route.Status.RouterAdmission() {
+		if admitted {
+			routers = append(routers, router)
+		}
+	}
+	sort.Strings(routers)
+	return routers
+}
+
+// shardLabels returns the route's labels routers can be sharded by; other labels may belong to tools
+// which would treat the temporary route as their own
+func (o *RouteObject) shardLabels() map[string]string {
+	labels := make(map[string]string)
+	for _, key := range o.routerShardLabels {
+		if value, found := o.route.Labels[key]; found {
+			labels[key] = value
+		}
+	}
+	return labels
+}
+
 func (o *RouteObject) GetExposers() map[string]acme.ChallengeExposer {
 	exposers := make(map[string]acme.ChallengeExposer)
 
@@ -96,13 +362,39 @@ func (o *RouteObject) GetExposers() map[string]acme.ChallengeExposer {
 			Client:                     o.client,
 			Namespace:                  o.GetNamespace(),
 			SelfServiceEndpointSubsets: o.SelfServiceEndpointSubsets,
+			InFlight:                   o.inFlight,
+			Owner:                      o.ownerReference(),
+			DryRun:                     o.dryRun,
+			Logger:                     o.GetLogger(),
+			Labels:                     o.shardLabels(),
+			RouterNames:                o.admittingRouters(),
 		}
 		exposers["http-01"] = &routeHttp01
 	}
 
+	// dns-01 doesn't need anything in the cluster
+	dns01, found := o.exposers["dns-01"]
+	if found {
+		if hook, ok := dns01.(*challengeexposers.Dns01Hook); ok {
+			objectHook := *hook
+			objectHook.Logger = o.GetLogger()
+			dns01 = &objectHook
+		}
+		exposers["dns-01"] = dns01
+	}
+
 	return exposers
 }
 
+// setIssuerUrl records the ACME server which issued the certificate; adopted certificates may not know it
+func setIssuerUrl(annotations map[string]string, c *cert.Certificate) {
+	if c.IssuerUrl == "" {
+		delete(annotations, AnnotationIssuerUrlKey)
+		return
+	}
+	annotations[AnnotationIssuerUrlKey] = c.IssuerUrl
+}
+
 func (o *RouteObject) UpdateCertificate(c *cert.Certificate) error {
 	o.route.Annotations["kubernetes.io/tls-acme.last-update-time"] = time.Now().Format(time.RFC3339)
 	name := o.GetName()
@@ -120,34 +412,75 @@ func (o *RouteObject) UpdateCertificate(c *cert.Certificate) error {
 		secretExists = true
 	}
 
+	// secrets of others can be in use elsewhere; we would overwrite them and have them collected with the route
+	if secretExists {
+		_, managed := secret.Annotations["kubernetes.io/tls-acme.last-update-time"]
+		if !managed {
+			return fmt.Errorf("refusing to overwrite secret '%s/%s' of type '%s' not created by this controller", namespace, secret.Name, secret.Type)
+		}
+	}
+
+	// Secret type is immutable so secrets created as Opaque by previous versions have to be recreated
+	if secretExists && secret.Type != api_v1.SecretTypeTLS {
+		o.GetLogger().Infof("Migrating secret '%s' in namespace '%s' from type '%s' to '%s'", secret.Name, namespace, secret.Type, api_v1.SecretTypeTLS)
+		if o.dryRun.Enabled() {
+			o.dryRun.Record(dryrun.VerbDelete, "secret", namespace, secret.Name, fmt.Sprintf("to migrate it from type '%s' to '%s'", secret.Type, api_v1.SecretTypeTLS))
+		} else {
+			uid := secret.UID
+			err = o.client.Secrets(namespace).Delete(secret.Name, &api_v1.DeleteOptions{
+				Preconditions: &api_v1.Preconditions{UID: &uid},
+			})
+			if err != nil && !kerrors.IsNotFound(err) {
+				return fmt.Errorf("failed to delete secret '%s/%s' for migration: %s", namespace, secret.Name, err)
+			}
+		}
+
+		secret.ResourceVersion = ""
+		secret.UID = ""
+		secret.SelfLink = ""
+		secret.CreationTimestamp = unversioned.Time{}
+		secretExists = false
+	}
+
 	// create a secret representing the certificate as well
 	// with routes it is not necessary but it is consistent with how ingress works
 	// also this secret can be mounted into pods for TLS passthrough
-	// TODO: replace Opaque with proper type if there is one
-	secret.Type = "Opaque"
+	secret.Type = api_v1.SecretTypeTLS
 	secret.Name = o.GetSecretName()
+	o.setSecretOwner(secret)
 	if secret.Annotations == nil {
 		secret.Annotations = map[string]string{}
 	}
 	secret.Annotations["kubernetes.io/tls-acme.last-update-time"] = time.Now().Format(time.RFC3339)
 	secret.Annotations["kubernetes.io/tls-acme.valid-not-before"] = c.Certificate.NotBefore.Format(time.RFC3339)
 	secret.Annotations["kubernetes.io/tls-acme.valid-not-after"] = c.Certificate.NotAfter.Format(time.RFC3339)
+	setIssuerUrl(secret.Annotations, c)
 	if secret.Data == nil {
 		secret.Data = map[string][]byte{}
 	}
-	secret.Data["tls.key"] = c.Key
-	secret.Data["tls.crt"] = c.Crt
+	secret.Data[api_v1.TLSPrivateKeyKey] = c.Key
+	secret.Data[api_v1.TLSCertKey] = c.Crt
+	secret.Data[SecretDataLeafKey] = c.Leaf()
+	secret.Data[SecretDataChainKey] = c.Chain()
+	secret.Data[SecretDataCAKey] = c.CA()
 
-	if !secretExists {
-		log.Infof("Creating new secret '%s' in namespace '%s' for route '%s'", secret.Name, secret.Namespace, name)
+	if o.dryRun.Enabled() {
+		verb := dryrun.VerbUpdate
+		if !secretExists {
+			verb = dryrun.VerbCreate
+		}
+		o.dryRun.Record(verb, "secret", namespace, secret.Name, fmt.Sprintf("with certificate valid until %s", c.Certificate.NotAfter.Format(time.RFC3339)))
+		err = nil
+	} else if !secretExists {
+		o.GetLogger().Infof("Creating new secret '%s' in namespace '%s' for route '%s'", secret.Name, namespace, name)
 		_, err = o.client.Secrets(namespace).Create(secret)
 	} else {
-		log.Infof("Updating secret '%s' in namespace '%s' for route '%s'", secret.Name, secret.Namespace, name)
+		o.GetLogger().Infof("Updating secret '%s' in namespace '%s' for route '%s'", secret.Name, namespace, name)
 		// TODO: consider using PATCH in the future
 		_, err = o.client.Secrets(namespace).Update(secret)
 	}
 	if err != nil {
-		log.Error(err)
+		o.GetLogger().Error(err)
 		return err
 	}
 
@@ -157,32 +490,26 @@ func (o *RouteObject) UpdateCertificate(c *cert.Certificate) error {
 		route.Annotations = map[string]string{}
 	}
 	route.Annotations["kubernetes.io/tls-acme.last-update-time"] = time.Now().Format(time.RFC3339)
-	secret.Annotations["kubernetes.io/tls-acme.valid-not-before"] = c.Certificate.NotBefore.Format(time.RFC3339)
-	secret.Annotations["kubernetes.io/tls-acme.valid-not-after"] = c.Certificate.NotAfter.Format(time.RFC3339)
+	route.Annotations["kubernetes.io/tls-acme.valid-not-before"] = c.Certificate.NotBefore.Format(time.RFC3339)
+	route.Annotations["kubernetes.io/tls-acme.valid-not-after"] = c.Certificate.NotAfter.Format(time.RFC3339)
+	setIssuerUrl(route.Annotations, c)
 	if route.Spec.Tls == nil {
 		route.Spec.Tls = &oapi.TlsConfig{}
 	}
-	route.Spec.Tls.Key = string(c.Key)
-	route.Spec.Tls.Certificate = string(c.Crt)
-	route.Annotations["kubernetes.io/tls-acme.hash"] = o.GetAcmeHash()
-
-	url := fmt.Sprintf("/oapi/v1/namespaces/%s/routes/%s", namespace, name)
-	data, err := json.Marshal(route)
-	if err != nil {
-		log.Error(err)
-		return err
+	if route.Spec.Tls.Termination == "" {
+		route.Spec.Tls.Termination = oapi.TlsTerminationEdge
 	}
-	log.Infof("Updating route '%s' in namespace '%s'", name, namespace)
-	// TODO: use PATCH in the future to avoid 409
-	route.ResourceVersion = ""
-	route.CreationTimestamp = unversioned.Time{}
-	route.SelfLink = ""
-	route.UID = ""
-	body, err := untypedclient.Put(o.client.RESTClient(), url, data)
-	if err != nil {
-		return fmt.Errorf("%s; detail: '%s'", err, string(body))
+	// the router rejects certificates in passthrough routes; pods mount the secret instead.
+	// Reencrypt routes keep their destinationCACertificate.
+	if route.Spec.Tls.Termination != oapi.TlsTerminationPassthrough {
+		route.Spec.Tls.Key = string(c.Key)
+		route.Spec.Tls.Certificate = string(c.Leaf())
+		route.Spec.Tls.CaCertificate = string(c.Chain())
+	}
+	if policy, found := o.insecureEdgeTerminationPolicy(); found {
+		route.Spec.Tls.InsecureEdgeTerminationPolicy = policy
 	}
-	log.Infof("Route '%s' in namespace '%s' UPDATED.", name, namespace)
+	route.Annotations["kubernetes.io/tls-acme.hash"] = o.GetAcmeHash()
 
-	return nil
+	return o.putRoute()
 }
@@ -0,0 +1,381 @@
+package route
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tnozicka/openshift-acme/pkg/acme"
+	"github.com/tnozicka/openshift-acme/pkg/cert"
+	oapi "github.com/tnozicka/openshift-acme/pkg/openshift/api"
+	oschallengeexposers "github.com/tnozicka/openshift-acme/pkg/openshift/challengeexposers"
+	acme_controller "github.com/tnozicka/openshift-acme/pkg/openshift/controllers/acme"
+	"github.com/tnozicka/openshift-acme/pkg/openshift/fakeapi"
+	acmelib "golang.org/x/crypto/acme"
+	"k8s.io/client-go/kubernetes"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+)
+
+// newTestCertificate returns a certificate for domain issued by a throwaway CA
+func newTestCertificate(t *testing.T, domain string) *cert.Certificate {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := cert.NewCertificateFromDER([][]byte{der, caDer}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestUpdateCertificate(t *testing.T) {
+	api := fakeapi.NewServer(fakeapi.Config{})
+	defer api.Close()
+	clientset, err := kubernetes.NewForConfig(api.RESTConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestCertificate(t, "app.example.com")
+	edge := &oapi.TlsConfig{
+		Termination:   oapi.TlsTerminationEdge,
+		Key:           string(c.Key),
+		Certificate:   string(c.Leaf()),
+		CaCertificate: string(c.Chain()),
+	}
+
+	testTable := []struct {
+		name        string
+		annotations map[string]string
+		tls         *oapi.TlsConfig
+		expected    *oapi.TlsConfig
+	}{
+		{
+			name:     "no TLS gets edge termination",
+			tls:      nil,
+			expected: edge,
+		},
+		{
+			name: "edge",
+			tls:  &oapi.TlsConfig{Termination: oapi.TlsTerminationEdge, InsecureEdgeTerminationPolicy: oapi.InsecureEdgeTerminationPolicyAllow},
+			expected: &oapi.TlsConfig{
+				Termination:                   oapi.TlsTerminationEdge,
+				Key:                           edge.Key,
+				Certificate:                   edge.Certificate,
+				CaCertificate:                 edge.CaCertificate,
+				InsecureEdgeTerminationPolicy: oapi.InsecureEdgeTerminationPolicyAllow,
+			},
+		},
+		{
+			name: "reencrypt keeps destination CA",
+			tls:  &oapi.TlsConfig{Termination: oapi.TlsTerminationReencrypt, DestinationCACertificate: "destination CA"},
+			expected: &oapi.TlsConfig{
+				Termination:              oapi.TlsTerminationReencrypt,
+				Key:                      edge.Key,
+				Certificate:              edge.Certificate,
+				CaCertificate:            edge.CaCertificate,
+				DestinationCACertificate: "destination CA",
+			},
+		},
+		{
+			name:     "passthrough gets only the secret",
+			tls:      &oapi.TlsConfig{Termination: oapi.TlsTerminationPassthrough},
+			expected: &oapi.TlsConfig{Termination: oapi.TlsTerminationPassthrough},
+		},
+		{
+			name:        "insecure edge termination policy",
+			annotations: map[string]string{AnnotationInsecureEdgeTerminationPolicyKey: oapi.InsecureEdgeTerminationPolicyRedirect},
+			tls:         nil,
+			expected: &oapi.TlsConfig{
+				Termination:                   oapi.TlsTerminationEdge,
+				Key:                           edge.Key,
+				Certificate:                   edge.Certificate,
+				CaCertificate:                 edge.CaCertificate,
+				InsecureEdgeTerminationPolicy: oapi.InsecureEdgeTerminationPolicyRedirect,
+			},
+		},
+		{
+			name:        "unsupported insecure edge termination policy for passthrough",
+			annotations: map[string]string{AnnotationInsecureEdgeTerminationPolicyKey: oapi.InsecureEdgeTerminationPolicyAllow},
+			tls:         &oapi.TlsConfig{Termination: oapi.TlsTerminationPassthrough},
+			expected:    &oapi.TlsConfig{Termination: oapi.TlsTerminationPassthrough},
+		},
+	}
+
+	for i, item := range testTable {
+		name := fmt.Sprintf("route-%d", i)
+		annotations := map[string]string{"kubernetes.io/tls-acme": "true"}
+		for k, v := range item.annotations {
+			annotations[k] = v
+		}
+		route := oapi.Route{
+			ObjectMeta: api_v1.ObjectMeta{
+				Name:        name,
+				Namespace:   "test",
+				Annotations: annotations,
+			},
+			Spec: oapi.RouteSpec{
+				Host: "app.example.com",
+				Tls:  item.tls,
+			},
+		}
+		if err := api.Create(fakeapi.ResourceRoutes, "test", &route); err != nil {
+			t.Fatalf("%s: %v", item.name, err)
+		}
+		if err := api.Get(fakeapi.ResourceRoutes, "test", name, &route); err != nil {
+			t.Fatalf("%s: %v", item.name, err)
+		}
+
+		o := &RouteObject{
+			route:                  route,
+			client:                 clientset.CoreV1(),
+			defaultLifecyclePolicy: acme_controller.LifecyclePolicyRetain,
+		}
+		if err := o.UpdateCertificate(c); err != nil {
+			t.Errorf("%s: %v", item.name, err)
+			continue
+		}
+
+		if err := api.Get(fakeapi.ResourceRoutes, "test", name, &route); err != nil {
+			t.Fatalf("%s: %v", item.name, err)
+		}
+		if !reflect.DeepEqual(route.Spec.Tls, item.expected) {
+			t.Errorf("%s: expected TLS config %#v, got %#v", item.name, item.expected, route.Spec.Tls)
+		}
+
+		var secret api_v1.Secret
+		if err := api.Get(fakeapi.ResourceSecrets, "test", o.GetSecretName(), &secret); err != nil {
+			t.Fatalf("%s: secret: %v", item.name, err)
+		}
+		if string(secret.Data[api_v1.TLSPrivateKeyKey]) != string(c.Key) {
+			t.Errorf("%s: secret doesn't hold the certificate's key", item.name)
+		}
+
+		// the certificate in use is read back the same way regardless of termination
+		o.route = route
+		if !o.GetCertificate().Equal(c) {
+			t.Errorf("%s: GetCertificate doesn't return the certificate in use", item.name)
+		}
+	}
+}
+
+func TestUpdateCertificateExistingSecret(t *testing.T) {
+	api := fakeapi.NewServer(fakeapi.Config{})
+	defer api.Close()
+	clientset, err := kubernetes.NewForConfig(api.RESTConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestCertificate(t, "app.example.com")
+	managed := map[string]string{"kubernetes.io/tls-acme.last-update-time": time.Now().Format(time.RFC3339)}
+
+	testTable := []struct {
+		name        string
+		secretType  api_v1.SecretType
+		annotations map[string]string
+		expectedErr bool
+	}{
+		{
+			name:        "foreign TLS secret",
+			secretType:  api_v1.SecretTypeTLS,
+			expectedErr: true,
+		},
+		{
+			name:        "foreign opaque secret",
+			secretType:  api_v1.SecretTypeOpaque,
+			expectedErr: true,
+		},
+		{
+			name:        "managed TLS secret",
+			secretType:  api_v1.SecretTypeTLS,
+			annotations: managed,
+		},
+		{
+			name:        "managed opaque secret is migrated",
+			secretType:  api_v1.SecretTypeOpaque,
+			annotations: managed,
+		},
+	}
+
+	for i, item := range testTable {
+		name := fmt.Sprintf("route-%d", i)
+		secretName := fmt.Sprintf("existing-%d", i)
+		existing := &api_v1.Secret{
+			ObjectMeta: api_v1.ObjectMeta{
+				Name:        secretName,
+				Annotations: item.annotations,
+			},
+			Type: item.secretType,
+			Data: map[string][]byte{
+				api_v1.TLSCertKey:       []byte("user's certificate"),
+				api_v1.TLSPrivateKeyKey: []byte("user's key"),
+			},
+		}
+		if err := api.Create(fakeapi.ResourceSecrets, "test", existing); err != nil {
+			t.Fatalf("%s: %v", item.name, err)
+		}
+
+		route := oapi.Route{
+			ObjectMeta: api_v1.ObjectMeta{
+				Name: name,
+				Annotations: map[string]string{
+					"kubernetes.io/tls-acme":            "true",
+					"kubernetes.io/tls-acme-secretname": secretName,
+				},
+			},
+			Spec: oapi.RouteSpec{Host: "app.example.com"},
+		}
+		if err := api.Create(fakeapi.ResourceRoutes, "test", &route); err != nil {
+			t.Fatalf("%s: %v", item.name, err)
+		}
+		if err := api.Get(fakeapi.ResourceRoutes, "test", name, &route); err != nil {
+			t.Fatalf("%s: %v", item.name, err)
+		}
+
+		o := &RouteObject{
+			route:                  route,
+			client:                 clientset.CoreV1(),
+			defaultLifecyclePolicy: acme_controller.LifecyclePolicyDelete,
+		}
+		err := o.UpdateCertificate(c)
+		if item.expectedErr != (err != nil) {
+			t.Errorf("%s: expected error=%t, got %v", item.name, item.expectedErr, err)
+		}
+
+		var secret api_v1.Secret
+		if err := api.Get(fakeapi.ResourceSecrets, "test", secretName, &secret); err != nil {
+			t.Fatalf("%s: secret: %v", item.name, err)
+		}
+		if item.expectedErr {
+			if string(secret.Data[api_v1.TLSPrivateKeyKey]) != "user's key" || len(secret.OwnerReferences) != 0 || secret.Type != item.secretType {
+				t.Errorf("%s: foreign secret was modified: %#v", item.name, secret)
+			}
+			if err := api.Get(fakeapi.ResourceRoutes, "test", name, &route); err != nil {
+				t.Fatalf("%s: %v", item.name, err)
+			}
+			if route.Spec.Tls != nil {
+				t.Errorf("%s: route was updated: %#v", item.name, route.Spec.Tls)
+			}
+			continue
+		}
+		if string(secret.Data[api_v1.TLSPrivateKeyKey]) != string(c.Key) || secret.Type != api_v1.SecretTypeTLS {
+			t.Errorf("%s: secret doesn't hold the certificate: %#v", item.name, secret)
+		}
+		if len(secret.OwnerReferences) != 1 || secret.OwnerReferences[0].Name != name {
+			t.Errorf("%s: expected the route to own the secret, got %#v", item.name, secret.OwnerReferences)
+		}
+	}
+}
+
+type nopExposer struct{}
+
+func (nopExposer) Expose(a *acmelib.Client, domain string, token string) error { return nil }
+func (nopExposer) Remove(a *acmelib.Client, domain string, token string) error { return nil }
+
+func TestGetExposersShardLabels(t *testing.T) {
+	defer func(delay time.Duration) { oschallengeexposers.RouterPropagationDelay = delay }(oschallengeexposers.RouterPropagationDelay)
+	oschallengeexposers.RouterPropagationDelay = 0
+
+	api := fakeapi.NewServer(fakeapi.Config{
+		AdmitRoutes: true,
+		Routers: map[string]string{
+			"public":   "shard=public",
+			"internal": "shard=internal",
+		},
+	})
+	defer api.Close()
+	clientset, err := kubernetes.NewForConfig(api.RESTConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := map[string]string{
+		"shard": "public",
+		"app":   "web",
+		// a tool selecting its routes by labels must not adopt the temporary route
+		"managed-by": "another-tool",
+	}
+	if err := api.Create(fakeapi.ResourceRoutes, "test", &oapi.Route{
+		ObjectMeta: api_v1.ObjectMeta{Name: "app", Labels: labels},
+		Spec:       oapi.RouteSpec{Host: "app.example.com"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var route oapi.Route
+	if err := api.Get(fakeapi.ResourceRoutes, "test", "app", &route); err != nil {
+		t.Fatal(err)
+	}
+
+	o := &RouteObject{
+		route:             route,
+		client:            clientset.CoreV1(),
+		exposers:          map[string]acme.ChallengeExposer{"http-01": nopExposer{}},
+		inFlight:          oschallengeexposers.NewInFlight(),
+		routerShardLabels: []string{"shard", "router"},
+	}
+	exposer := o.GetExposers()["http-01"]
+	a := &acmelib.Client{}
+	if err := exposer.Expose(a, "app.example.com", "token"); err != nil {
+		t.Fatal(err)
+	}
+	defer exposer.Remove(a, "app.example.com", "token")
+
+	var tmpRoutes []oapi.Route
+	if err := api.List(fakeapi.ResourceRoutes, "test", oschallengeexposers.LabelSelectorRouteExposer, &tmpRoutes); err != nil {
+		t.Fatal(err)
+	}
+	if len(tmpRoutes) != 1 {
+		t.Fatalf("expected 1 temporary route, got %d", len(tmpRoutes))
+	}
+	tmpLabels := tmpRoutes[0].Labels
+	if tmpLabels["shard"] != "public" {
+		t.Errorf("shard label wasn't copied onto the temporary route: %v", tmpLabels)
+	}
+	for _, key := range []string{"app", "managed-by", "router"} {
+		if _, found := tmpLabels[key]; found {
+			t.Errorf("label '%s' was copied onto the temporary route: %v", key, tmpLabels)
+		}
+	}
+	if tmpLabels[oschallengeexposers.LabelExposerKey] != oschallengeexposers.LabelExposerRoute {
+		t.Errorf("temporary route is missing its exposer labels: %v", tmpLabels)
+	}
+}
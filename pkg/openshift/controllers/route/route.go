@@ -10,12 +10,15 @@ import (
 
 	"github.com/go-playground/log"
 	"github.com/tnozicka/openshift-acme/pkg/acme"
+	"github.com/tnozicka/openshift-acme/pkg/dryrun"
 	oapi "github.com/tnozicka/openshift-acme/pkg/openshift/api"
+	oschallengeexposers "github.com/tnozicka/openshift-acme/pkg/openshift/challengeexposers"
 	acme_controller "github.com/tnozicka/openshift-acme/pkg/openshift/controllers/acme"
 	"github.com/tnozicka/openshift-acme/pkg/openshift/untypedclient"
 	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/pkg/api/unversioned"
 	api_v1 "k8s.io/client-go/pkg/api/v1"
+	utilerrors "k8s.io/client-go/pkg/util/errors"
 )
 
 type ServiceID struct {
@@ -34,10 +37,19 @@ type RouteController struct {
 	selfServiceEndpointSubsets []api_v1.EndpointSubset
 	watchNamespaces            []string
 	resourceVersions           map[string]string // namespace => resourceVersion
+	inFlight                   *oschallengeexposers.InFlight
+	sweeper                    *oschallengeexposers.Sweeper
+	sweepInterval              time.Duration
+	lifecyclePolicy            acme_controller.LifecyclePolicy
+	routerShardLabels          []string
+	relistInterval             time.Duration
+	dryRun                     *dryrun.Recorder
+	monitor                    *Monitor
 }
 
 func NewRouteController(ctx context.Context, client v1core.CoreV1Interface, acme *acme_controller.AcmeController,
-	exposers map[string]acme.ChallengeExposer, selfService ServiceID, watchNamespaces []string) (rc RouteController, err error) {
+	exposers map[string]acme.ChallengeExposer, selfService ServiceID, watchNamespaces []string,
+	lifecyclePolicy acme_controller.LifecyclePolicy, routerShardLabels []string, relistInterval time.Duration, dryRun *dryrun.Recorder, monitor *Monitor) (rc RouteController, err error) {
 	rc.client = client
 	rc.acme = acme
 	rc.exposers = exposers
@@ -48,6 +60,28 @@ func NewRouteController(ctx context.Context, client v1core.CoreV1Interface, acme
 		return
 	}
 	rc.watchNamespaces = watchNamespaces
+	rc.lifecyclePolicy = lifecyclePolicy
+	rc.routerShardLabels = routerShardLabels
+	rc.relistInterval = relistInterval
+	rc.dryRun = dryRun
+	rc.monitor = monitor
+	if monitor != nil {
+		monitor.recordEvent = func(route oapi.Route, eventType, reason, message string) {
+			obj := rc.newRouteObject(route)
+			obj.GetLogger().Warn(message)
+			rc.acme.RecordEvent(obj, eventType, reason, message)
+		}
+	}
+
+	rc.inFlight = oschallengeexposers.NewInFlight()
+	rc.sweeper = &oschallengeexposers.Sweeper{
+		Client:     client,
+		InFlight:   rc.inFlight,
+		Namespaces: watchNamespaces,
+		MinAge:     1 * time.Minute,
+		DryRun:     dryRun,
+	}
+	rc.sweepInterval = 10 * time.Minute
 
 	rc.resourceVersions = make(map[string]string)
 	// we have to initialize the array here to make subsequent access race free
@@ -58,7 +92,143 @@ func NewRouteController(ctx context.Context, client v1core.CoreV1Interface, acme
 	return
 }
 
-func (rc *RouteController) doWatchIteration(namespace string) error {
+func (rc *RouteController) newRouteObject(route oapi.Route) *RouteObject {
+	return &RouteObject{
+		route:                      route,
+		client:                     rc.client,
+		exposers:                   rc.exposers,
+		SelfServiceEndpointSubsets: rc.selfServiceEndpointSubsets,
+		inFlight:                   rc.inFlight,
+		defaultLifecyclePolicy:     rc.lifecyclePolicy,
+		routerShardLabels:          rc.routerShardLabels,
+		dryRun:                     rc.dryRun,
+	}
+}
+
+var (
+	errResourceVersionExpired = errors.New("resourceVersion expired")
+	errRelistDue              = errors.New("relist is due")
+)
+
+// handleRoute brings the state of the controller in line with the route
+func (rc *RouteController) handleRoute(eventType string, route oapi.Route) error {
+	if rc.monitor != nil {
+		if eventType == "DELETED" {
+			rc.monitor.Forget(route)
+		} else {
+			rc.monitor.Update(route, route.Annotations["kubernetes.io/tls-acme"] == "true")
+		}
+	}
+
+	if eventType == "DELETED" {
+		// deleted routes have to be released regardless of their annotations or admission
+		err := rc.acme.Done(rc.newRouteObject(route), true)
+		if err != nil {
+			return fmt.Errorf("acme.Done failed: %s", err)
+		}
+		return nil
+	}
+
+	if route.Annotations["kubernetes.io/tls-acme"] != "true" {
+		// the route has opted out
+		obj := rc.newRouteObject(route)
+		_, updated := route.Annotations["kubernetes.io/tls-acme.last-update-time"]
+		if updated || rc.acme.IsManaged(obj) {
+			err := rc.acme.Done(obj, false)
+			if err != nil {
+				return fmt.Errorf("acme.Done failed: %s", err)
+			}
+		}
+		return nil
+	}
+
+	obj := rc.newRouteObject(route)
+	logger := obj.GetLogger()
+	logger.Debugf("Type: %s", eventType)
+	// We need to check first if the route has been admitted by the router.
+	// The assumption is that we wait for all ingresses
+	admittedSet := false
+	admittedValue := true
+	for _, ingress := range route.Status.Ingress {
+		for _, condition := range ingress.Conditions {
+			if condition.Type == "Admitted" {
+				admittedSet = true
+				if condition.Status != "True" {
+					admittedValue = false
+				}
+			}
+		}
+	}
+	if !(admittedSet && admittedValue) {
+		logger.Debugf("RouteController: skipping route (not admitted) [admittedSet=%t, admittedValue=%t]", admittedSet, admittedValue)
+		return nil
+	}
+
+	logger.Debug("RouteController: processing route")
+	err := rc.acme.Manage(obj)
+	if err != nil {
+		return fmt.Errorf("acme.Manage failed: %s", err)
+	}
+
+	return nil
+}
+
+// reconcile lists all routes in the namespace and makes the controller track exactly those;
+// objects deleted while we weren't watching are released here
+func (rc *RouteController) reconcile(namespace string) error {
+	var url string
+	if namespace == "" {
+		url = "/oapi/v1/routes"
+	} else {
+		url = fmt.Sprintf("/oapi/v1/namespaces/%s/routes", namespace)
+	}
+	body, err := untypedclient.Get(rc.client.RESTClient(), url)
+	if err != nil {
+		return fmt.Errorf("listing routes failed: %s", err)
+	}
+
+	var routeList oapi.RouteList
+	if err := json.Unmarshal(body, &routeList); err != nil {
+		return fmt.Errorf("unmarshaling RouteList failed: %s", err)
+	}
+
+	log.Debugf("RouteController: reconciling %d route(s) in namespace '%s'", len(routeList.Items), namespace)
+	// a broken route must not block the other routes in the namespace; they are all handled and errors returned together
+	var errs []error
+	present := make(map[string]bool)
+	for _, route := range routeList.Items {
+		obj := rc.newRouteObject(route)
+		present[obj.GetUID()] = true
+
+		if err := rc.handleRoute("ADDED", route); err != nil {
+			obj.GetLogger().Errorf("RouteController: reconciling route failed: %s", err)
+			errs = append(errs, fmt.Errorf("route '%s/%s': %s", route.Namespace, route.Name, err))
+		}
+	}
+
+	if rc.monitor != nil {
+		rc.monitor.Retain(namespace, present)
+	}
+
+	for _, o := range rc.acme.Objects(namespace) {
+		obj, ok := o.(*RouteObject)
+		if !ok || present[obj.GetUID()] {
+			continue
+		}
+
+		obj.GetLogger().Info("RouteController: route disappeared without a watch event")
+		if err := rc.handleRoute("DELETED", obj.route); err != nil {
+			obj.GetLogger().Errorf("RouteController: releasing deleted route failed: %s", err)
+			errs = append(errs, fmt.Errorf("deleted route '%s/%s': %s", obj.route.Namespace, obj.route.Name, err))
+		}
+	}
+
+	rc.resourceVersions[namespace] = routeList.ResourceVersion
+
+	return utilerrors.NewAggregate(errs)
+}
+
+func (rc *RouteController) doWatchIteration(namespace string, relist <-chan time.Time) error {
 	var url string
 	if namespace == "" {
 		url = "/oapi/v1/watch/routes"
@@ -75,6 +245,8 @@ func (rc *RouteController) doWatchIteration(namespace string) error {
 		select {
 		case <-rc.ctx.Done():
 			return nil
+		case <-relist:
+			return errRelistDue
 		case rawEvent, ok := <-w.ResultChan():
 			if !ok {
 				return errors.New("RouteController ResultChannel closed")
@@ -95,10 +267,8 @@ func (rc *RouteController) doWatchIteration(namespace string) error {
 				}
 
 				if status.Code == 410 {
-					log.Warnf("RouteController: resetting resourceVersion: caused by 'ERROR' (%#v)", status)
-					rc.resourceVersions[namespace] = "0"
-					// FIXME: clean db because some objects could escape getting deleted this way
-					continue
+					log.Warnf("RouteController: relisting: caused by 'ERROR' (%d %s: %s)", status.Code, status.Reason, status.Message)
+					return errResourceVersionExpired
 				}
 
 				err := fmt.Errorf("RouteController: unknown 'ERROR' (%s)", event.Object)
@@ -116,56 +286,9 @@ func (rc *RouteController) doWatchIteration(namespace string) error {
 				return fmt.Errorf("RouteController: failed to unmarshal Route: '%s'", err)
 			}
 
-			if route.Annotations["kubernetes.io/tls-acme"] != "true" {
-				rc.resourceVersions[namespace] = route.ResourceVersion
-				continue
-			}
-
-			log.Debugf("Type: %s", event.Type)
-			// We need to check first if the route has been admitted by the router.
-			// The assumption is that we wait for all ingresses
-			admittedSet := false
-			admittedValue := true
-			for _, ingress := range route.Status.Ingress {
-				for _, condition := range ingress.Conditions {
-					if condition.Type == "Admitted" {
-						admittedSet = true
-						if condition.Status != "True" {
-							admittedValue = false
-						}
-					}
-				}
-			}
-			if !(admittedSet && admittedValue) {
-				log.Debugf("RouteController: skipping route (not admitted) [admittedSet=%t, admittedValue=%t]", admittedSet, admittedValue)
-				rc.resourceVersions[namespace] = route.ResourceVersion
-				continue
-			}
-
-			switch event.Type {
-			case "ADDED", "MODIFIED":
-				log.Debugf("RouteController: processing route '%s'", route.Spec.Host)
-				err = rc.acme.Manage(&RouteObject{
-					route:                      route,
-					client:                     rc.client,
-					exposers:                   rc.exposers,
-					SelfServiceEndpointSubsets: rc.selfServiceEndpointSubsets,
-				})
-				if err != nil {
-					return fmt.Errorf("acme.Manage failed: %s", err)
-				}
-			case "DELETED":
-				err = rc.acme.Done(&RouteObject{
-					route:                      route,
-					client:                     rc.client,
-					exposers:                   rc.exposers,
-					SelfServiceEndpointSubsets: rc.selfServiceEndpointSubsets,
-				})
-				if err != nil {
-					return fmt.Errorf("acme.Done failed: %s", err)
-				}
-			default:
-				return fmt.Errorf("Unknown Route event '%s'", event.Type)
+			// failed routes are retried on the next relist; the watch goes on with other routes
+			if err := rc.handleRoute(event.Type, route); err != nil {
+				rc.newRouteObject(route).GetLogger().Errorf("RouteController: handling '%s' event failed: %s", event.Type, err)
 			}
 
 			rc.resourceVersions[namespace] = route.ResourceVersion
@@ -177,6 +300,7 @@ func (rc *RouteController) watch(namespace string) {
 	defer rc.wg.Done()
 	log.Infof("RouteController: watching namespace '%s'", namespace)
 
+	relist := true
 	for {
 		select {
 		case <-rc.ctx.Done():
@@ -184,12 +308,36 @@ func (rc *RouteController) watch(namespace string) {
 		default:
 		}
 
-		err := rc.doWatchIteration(namespace)
+		var err error
+		if relist {
+			err = rc.reconcile(namespace)
+			if _, partial := err.(utilerrors.Aggregate); partial {
+				// the list succeeded and the other routes were handled so we can watch; failed routes are retried on the next relist
+				log.Errorf("RouteController: reconcile of namespace '%s' failed for some routes: %s", namespace, err)
+				err = nil
+			} else if err != nil {
+				err = fmt.Errorf("reconcile failed: %s", err)
+			}
+		}
+
 		if err == nil {
-			break // cancelling due to ctx.Done() from doWatchIteration
+			var relistTimer <-chan time.Time // periodic relist is disabled for nil channel
+			if rc.relistInterval > 0 {
+				relistTimer = time.After(rc.relistInterval)
+			}
+			err = rc.doWatchIteration(namespace, relistTimer)
+			switch err {
+			case nil:
+				return // cancelling due to ctx.Done() from doWatchIteration
+			case errRelistDue, errResourceVersionExpired:
+				relist = true
+				continue
+			default:
+				relist = false
+			}
 		}
 
-		log.Errorf("RouteController: doWatchIteration failed: %s", err)
+		log.Errorf("RouteController: %s", err)
 		// TODO: raise error counter for health check
 
 		// TODO: exponential backoff
@@ -201,6 +349,39 @@ func (rc *RouteController) watch(namespace string) {
 	}
 }
 
+// sweepLoop removes temporary objects left behind by challenge exposers at startup and periodically
+func (rc *RouteController) sweepLoop() {
+	defer rc.wg.Done()
+	defer log.Info("RouteController - sweepLoop - finished")
+
+	for {
+		if err := rc.sweeper.Sweep(); err != nil {
+			log.Errorf("RouteController: %s", err)
+		}
+
+		select {
+		case <-rc.ctx.Done():
+			return
+		case <-time.After(rc.sweepInterval):
+		}
+	}
+}
+
+// monitorLoop reevaluates expiry of monitored certificates as often as the renewal check runs
+func (rc *RouteController) monitorLoop() {
+	defer rc.wg.Done()
+	defer log.Info("RouteController - monitorLoop - finished")
+
+	for {
+		select {
+		case <-rc.ctx.Done():
+			return
+		case <-time.After(rc.acme.RenewalPolicy().CheckInterval):
+			rc.monitor.Check()
+		}
+	}
+}
+
 func (rc *RouteController) Start() {
 	rc.Wait() // make sure it can't be started twice at the same time
 
@@ -209,6 +390,14 @@ func (rc *RouteController) Start() {
 		go rc.watch(namespace)
 	}
 
+	rc.wg.Add(1)
+	go rc.sweepLoop()
+
+	if rc.monitor != nil {
+		rc.wg.Add(1)
+		go rc.monitorLoop()
+	}
+
 	go func() {
 		rc.wg.Wait()
 		log.Info("RouteController finished")
@@ -256,7 +445,7 @@ func (rc *RouteController) UpdateSelfServiceEndpointSubsets() (err error) {
 		}
 	}
 
-	log.Debugf("Detected subsets for selfService: '%+v'", rc.selfServiceEndpointSubsets)
+	log.Debugf("Detected %d subset(s) for selfService", len(rc.selfServiceEndpointSubsets))
 
 	return nil
 }
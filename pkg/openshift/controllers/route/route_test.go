@@ -0,0 +1,778 @@
+package route
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-playground/log"
+	"github.com/tnozicka/openshift-acme/pkg/acme"
+	"github.com/tnozicka/openshift-acme/pkg/acme/challengeexposers"
+	"github.com/tnozicka/openshift-acme/pkg/acme/fakeacme"
+	"github.com/tnozicka/openshift-acme/pkg/cert"
+	accountlib "github.com/tnozicka/openshift-acme/pkg/openshift/account"
+	oapi "github.com/tnozicka/openshift-acme/pkg/openshift/api"
+	oschallengeexposers "github.com/tnozicka/openshift-acme/pkg/openshift/challengeexposers"
+	acme_controller "github.com/tnozicka/openshift-acme/pkg/openshift/controllers/acme"
+	"github.com/tnozicka/openshift-acme/pkg/openshift/fakeapi"
+	issuerlib "github.com/tnozicka/openshift-acme/pkg/openshift/issuer"
+	"k8s.io/client-go/kubernetes"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+)
+
+// testEnv holds the servers the controllers under test talk to
+type testEnv struct {
+	ctx    context.Context
+	http01 *challengeexposers.Http01
+	ca     *fakeacme.Server
+	api    *fakeapi.Server
+
+	hosts   []string
+	closers []func()
+}
+
+// newTestEnv starts an http-01 exposer, a fake CA validating hosts through it and a fake API server admitting routes
+// which holds the controller's Service. RouterPropagationDelay is disabled until cleanup stops everything.
+func newTestEnv(t *testing.T, hosts ...string) (env *testEnv, cleanup func()) {
+	delay := oschallengeexposers.RouterPropagationDelay
+	oschallengeexposers.RouterPropagationDelay = 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	env = &testEnv{ctx: ctx, hosts: hosts}
+	cleanup = func() {
+		cancel()
+		for i := len(env.closers) - 1; i >= 0; i-- {
+			env.closers[i]()
+		}
+		oschallengeexposers.RouterPropagationDelay = delay
+	}
+
+	var err error
+	env.http01, err = challengeexposers.NewHttp01(ctx, "127.0.0.1:0", log.Logger)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	env.ca, err = env.newCA()
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	env.api = fakeapi.NewServer(fakeapi.Config{AdmitRoutes: true})
+	env.closers = append(env.closers, env.api.Close)
+	err = env.api.Create(fakeapi.ResourceServices, "acme", &api_v1.Service{
+		ObjectMeta: api_v1.ObjectMeta{Name: "acme-controller"},
+		Spec: api_v1.ServiceSpec{
+			ClusterIP: "172.30.0.10",
+			Ports:     []api_v1.ServicePort{{Port: 80}},
+		},
+	})
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	return env, cleanup
+}
+
+// newCA starts another fake CA validating the environment's hosts; it's closed by cleanup
+func (env *testEnv) newCA() (*fakeacme.Server, error) {
+	config := fakeacme.Config{
+		HTTP01Addrs: make(map[string]string),
+	}
+	for _, host := range env.hosts {
+		config.HTTP01Addrs[host] = env.http01.Addr
+	}
+	ca, err := fakeacme.NewServer(config)
+	if err != nil {
+		return nil, err
+	}
+	env.closers = append(env.closers, ca.Close)
+	return ca, nil
+}
+
+// startControllers runs AcmeController using the environment's CA and RouteController watching namespace "test"
+func (env *testEnv) startControllers(t *testing.T) (ac *acme_controller.AcmeController, stop func()) {
+	return env.startControllersWithSharedAccount(t, "")
+}
+
+// startControllersWithSharedAccount starts the controllers keeping the global issuer's account in sharedAccountNamespace unless it's empty
+func (env *testEnv) startControllersWithSharedAccount(t *testing.T, sharedAccountNamespace string) (ac *acme_controller.AcmeController, stop func()) {
+	clientset, err := kubernetes.NewForConfig(env.api.RESTConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	namespaces := []string{"test"}
+
+	ctx, cancel := context.WithCancel(env.ctx)
+	ac = acme_controller.NewAcmeController(ctx, clientset.CoreV1(), env.ca.DirectoryURL(), nil, sharedAccountNamespace, namespaces, nil)
+	if err := ac.BootstrapDB(true, true); err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	ac.Start()
+
+	exposers := map[string]acme.ChallengeExposer{
+		"http-01": env.http01,
+	}
+	rc, err := NewRouteController(ctx, clientset.CoreV1(), ac, exposers, ServiceID{Name: "acme-controller", Namespace: "acme"},
+		namespaces, acme_controller.LifecyclePolicyRetain, nil, 0, nil, nil)
+	if err != nil {
+		cancel()
+		ac.Wait()
+		t.Fatal(err)
+	}
+	rc.Start()
+
+	return ac, func() {
+		cancel()
+		rc.Wait()
+		ac.Wait()
+	}
+}
+
+type testObject struct {
+	resource  string
+	namespace string
+	object    interface{}
+}
+
+// testObjects returns default issuer "fake" using ca and route test/app for app.example.com
+func testObjects(ca *fakeacme.Server) []testObject {
+	return []testObject{
+		{fakeapi.ResourceConfigMaps, "test", testIssuer("fake", ca, true)},
+		{fakeapi.ResourceRoutes, "test", testRoute("app", "app.example.com")},
+	}
+}
+
+// testIssuer returns an issuer using and trusting ca
+func testIssuer(name string, ca *fakeacme.Server, isDefault bool) *api_v1.ConfigMap {
+	issuer := &api_v1.ConfigMap{
+		ObjectMeta: api_v1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{accountlib.LabelAcmeTypeKey: issuerlib.LabelAcmeIssuerType},
+		},
+		Data: map[string]string{
+			issuerlib.DataDirectoryUrlKey:   ca.DirectoryURL(),
+			issuerlib.DataKeyTypeKey:        string(cert.KeyTypeECDSA256),
+			issuerlib.DataChallengeTypesKey: "http-01",
+			issuerlib.DataCaBundleKey:       string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.CACertificate().Raw})),
+		},
+	}
+	if isDefault {
+		issuer.Annotations = map[string]string{issuerlib.AnnotationAcmeIssuerDefaultKey: "true"}
+	}
+	return issuer
+}
+
+// testRoute returns a route for host which asks for a certificate
+func testRoute(name, host string) *oapi.Route {
+	return &oapi.Route{
+		ObjectMeta: api_v1.ObjectMeta{
+			Name:        name,
+			Annotations: map[string]string{"kubernetes.io/tls-acme": "true"},
+		},
+		Spec: oapi.RouteSpec{
+			Host: host,
+			To:   oapi.RouteTargetReference{Kind: "Service", Name: "app"},
+		},
+	}
+}
+
+func createObjects(t *testing.T, api *fakeapi.Server, objects []testObject) {
+	for _, item := range objects {
+		if err := api.Create(item.resource, item.namespace, item.object); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// parseLeaf returns the route's leaf certificate
+func parseLeaf(t *testing.T, route oapi.Route) *x509.Certificate {
+	block, _ := pem.Decode([]byte(route.Spec.Tls.Certificate))
+	if block == nil {
+		t.Fatalf("route has invalid certificate %q", route.Spec.Tls.Certificate)
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+// waitForCertificate returns route test/app once it has a certificate
+func waitForCertificate(t *testing.T, api *fakeapi.Server) oapi.Route {
+	return waitForRouteCertificate(t, api, "app")
+}
+
+// waitForRouteCertificate returns route test/<name> once it has a certificate
+func waitForRouteCertificate(t *testing.T, api *fakeapi.Server, name string) oapi.Route {
+	var route oapi.Route
+	for deadline := time.Now().Add(30 * time.Second); ; {
+		if err := api.Get(fakeapi.ResourceRoutes, "test", name, &route); err != nil {
+			t.Fatal(err)
+		}
+		if route.Spec.Tls != nil && route.Spec.Tls.Certificate != "" {
+			return route
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("route hasn't got a certificate; actions: %v", api.Actions())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestRouteController(t *testing.T) {
+	env, cleanup := newTestEnv(t, "app.example.com")
+	defer cleanup()
+	ca, api := env.ca, env.api
+
+	createObjects(t, api, testObjects(ca))
+
+	_, stop := env.startControllers(t)
+	route := waitForCertificate(t, api)
+
+	certificate := parseLeaf(t, route)
+	if _, err := certificate.Verify(x509.VerifyOptions{DNSName: "app.example.com", Roots: ca.Roots()}); err != nil {
+		t.Error(err)
+	}
+	if route.Annotations["kubernetes.io/tls-acme.last-update-time"] == "" {
+		t.Error("route is missing last update time annotation")
+	}
+
+	var secret api_v1.Secret
+	if err := api.Get(fakeapi.ResourceSecrets, "test", "acme.app", &secret); err != nil {
+		t.Fatalf("secret: %v", err)
+	}
+	if secret.Type != api_v1.SecretTypeTLS || string(secret.Data[api_v1.TLSPrivateKeyKey]) != route.Spec.Tls.Key {
+		t.Errorf("secret doesn't hold the route's key: %#v", secret)
+	}
+
+	// the certificate is recorded for the account in its own secret
+	var records api_v1.Secret
+	recordsName := accountlib.CertificateSecretName("acme-account.fake", "test", []string{"app.example.com"})
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		err := api.Get(fakeapi.ResourceSecrets, "test", recordsName, &records)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("certificate records: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if records.Labels[accountlib.LabelAcmeTypeKey] != accountlib.LabelAcmeCertificateType {
+		t.Errorf("certificate records secret has labels %v", records.Labels)
+	}
+
+	// the http-01 challenge was exposed through a temporary route which has been removed afterwards
+	created := make(map[string]bool)
+	deleted := make(map[string]bool)
+	for _, action := range api.Actions() {
+		if action.Namespace != "test" || !strings.HasPrefix(action.Name, "acme-") {
+			continue
+		}
+		switch action.Verb {
+		case fakeapi.VerbCreate:
+			created[action.Resource] = true
+		case fakeapi.VerbDelete:
+			deleted[action.Resource] = true
+		}
+	}
+	for _, resource := range []string{fakeapi.ResourceRoutes, fakeapi.ResourceServices, fakeapi.ResourceEndpoints} {
+		if !created[resource] || !deleted[resource] {
+			t.Errorf("temporary %s: created=%t, deleted=%t", resource, created[resource], deleted[resource])
+		}
+	}
+	var leftovers []oapi.Route
+	if err := api.List(fakeapi.ResourceRoutes, "test", oschallengeexposers.LabelSelectorRouteExposer, &leftovers); err != nil {
+		t.Fatal(err)
+	}
+	if len(leftovers) != 0 {
+		t.Errorf("temporary routes left behind: %d", len(leftovers))
+	}
+
+	// forgetAccount removes the account and its certificate records as if the controller lost them
+	forgetAccount := func() {
+		for _, selector := range []string{accountlib.LabelSelectorAcmeAccount, accountlib.LabelSelectorAcmeCertificate} {
+			var secrets []api_v1.Secret
+			if err := api.List(fakeapi.ResourceSecrets, "test", selector, &secrets); err != nil {
+				t.Fatal(err)
+			}
+			for _, secret := range secrets {
+				if err := api.Delete(fakeapi.ResourceSecrets, secret.Namespace, secret.Name); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	// a restarted controller which lost its account adopts the certificate from the route's secret
+	stop()
+	forgetAccount()
+	route.Spec.Tls = nil
+	if err := api.Update(fakeapi.ResourceRoutes, "test", &route); err != nil {
+		t.Fatal(err)
+	}
+
+	_, stop = env.startControllers(t)
+	adopted := waitForCertificate(t, api)
+	if adopted.Spec.Tls.Certificate != string(secret.Data[SecretDataLeafKey]) {
+		t.Error("route got a different certificate than the one in its secret")
+	}
+	if n := ca.Requests(fakeacme.ResourceNewCert); n != 1 {
+		t.Errorf("expected the certificate to be issued once, got %d requests", n)
+	}
+
+	// the certificate adopted from the route is written to the route's secret as well
+	stop()
+	forgetAccount()
+	if err := api.Delete(fakeapi.ResourceSecrets, "test", "acme.app"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, stop = env.startControllers(t)
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		err := api.Get(fakeapi.ResourceSecrets, "test", "acme.app", &secret)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("secret of the adopted certificate: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if string(secret.Data[SecretDataLeafKey]) != adopted.Spec.Tls.Certificate {
+		t.Error("secret got a different certificate than the adopted one")
+	}
+	if n := ca.Requests(fakeacme.ResourceNewCert); n != 1 {
+		t.Errorf("expected the certificate to be issued once, got %d requests", n)
+	}
+
+	// a certificate which doesn't chain to a trusted root isn't adopted
+	stop()
+	forgetAccount()
+	var issuer api_v1.ConfigMap
+	if err := api.Get(fakeapi.ResourceConfigMaps, "test", "fake", &issuer); err != nil {
+		t.Fatal(err)
+	}
+	delete(issuer.Data, issuerlib.DataCaBundleKey)
+	if err := api.Update(fakeapi.ResourceConfigMaps, "test", &issuer); err != nil {
+		t.Fatal(err)
+	}
+
+	_, stop = env.startControllers(t)
+	defer stop()
+	for deadline := time.Now().Add(30 * time.Second); ; {
+		if err := api.Get(fakeapi.ResourceRoutes, "test", "app", &route); err != nil {
+			t.Fatal(err)
+		}
+		if route.Spec.Tls != nil && route.Spec.Tls.Certificate != adopted.Spec.Tls.Certificate {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("untrusted certificate has not been replaced")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := ca.Requests(fakeacme.ResourceNewCert); n != 2 {
+		t.Errorf("expected the certificate to be issued twice, got %d requests", n)
+	}
+}
+
+func TestRouteControllerFailover(t *testing.T) {
+	env, cleanup := newTestEnv(t, "app.example.com")
+	defer cleanup()
+	api := env.api
+
+	primary := env.ca
+	secondary, err := env.newCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary.FailNext(fakeacme.ResourceNewAuthz, 100, fakeacme.Problem{Type: fakeacme.ProblemRateLimited, Status: http.StatusTooManyRequests})
+
+	primaryIssuer := testIssuer("primary", primary, true)
+	primaryIssuer.Data[issuerlib.DataFallbackIssuersKey] = "missing,secondary"
+	createObjects(t, api, []testObject{
+		{fakeapi.ResourceConfigMaps, "test", primaryIssuer},
+		{fakeapi.ResourceConfigMaps, "test", testIssuer("secondary", secondary, false)},
+		{fakeapi.ResourceRoutes, "test", testRoute("app", "app.example.com")},
+	})
+
+	_, stop := env.startControllers(t)
+	defer stop()
+	route := waitForCertificate(t, api)
+
+	certificate := parseLeaf(t, route)
+	if _, err := certificate.Verify(x509.VerifyOptions{DNSName: "app.example.com", Roots: secondary.Roots()}); err != nil {
+		t.Errorf("certificate wasn't issued by the fallback CA: %v", err)
+	}
+	if got := route.Annotations[AnnotationIssuerUrlKey]; got != secondary.DirectoryURL() {
+		t.Errorf("expected issuer URL %q, got %q", secondary.DirectoryURL(), got)
+	}
+	if n := primary.Requests(fakeacme.ResourceNewCert); n != 0 {
+		t.Errorf("expected no certificate requests to the primary CA, got %d", n)
+	}
+
+	// each issuer has its own account in the namespace
+	var accounts []api_v1.Secret
+	if err := api.List(fakeapi.ResourceSecrets, "test", accountlib.LabelSelectorAcmeAccount, &accounts); err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 2 {
+		t.Errorf("expected accounts for both issuers, got %d", len(accounts))
+	}
+}
+
+func TestRouteControllerRevocation(t *testing.T) {
+	env, cleanup := newTestEnv(t, "app.example.com")
+	defer cleanup()
+	ca, api := env.ca, env.api
+
+	createObjects(t, api, testObjects(ca))
+
+	ac, stop := env.startControllers(t)
+	defer stop()
+	route := waitForCertificate(t, api)
+	revoked := parseLeaf(t, route)
+
+	// a good certificate is left alone
+	ac.CheckRevocations()
+	if n := ca.Requests(fakeacme.ResourceOCSP); n != 1 {
+		t.Fatalf("expected 1 OCSP request, got %d", n)
+	}
+
+	revokedBefore := acme_controller.RevokedCertificates.Value()
+	if !ca.Revoke(revoked) {
+		t.Fatal("fake CA doesn't know the certificate")
+	}
+	ac.CheckRevocations()
+	if n := acme_controller.RevokedCertificates.Value() - revokedBefore; n != 1 {
+		t.Errorf("expected 1 revoked certificate to be counted, got %d", n)
+	}
+
+	for deadline := time.Now().Add(20 * time.Second); ; {
+		if err := api.Get(fakeapi.ResourceRoutes, "test", "app", &route); err != nil {
+			t.Fatal(err)
+		}
+		if route.Spec.Tls != nil && parseLeaf(t, route).SerialNumber.Cmp(revoked.SerialNumber) != 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("revoked certificate wasn't replaced")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if ca.IsRevoked(parseLeaf(t, route)) {
+		t.Error("route got a revoked certificate")
+	}
+	if n := ca.Requests(fakeacme.ResourceNewCert); n != 2 {
+		t.Errorf("expected the certificate to be issued twice, got %d requests", n)
+	}
+
+	var events []api_v1.Event
+	if err := api.List(fakeapi.ResourceEvents, "test", "", &events); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, event := range events {
+		if event.Reason == acme_controller.EventReasonCertificateRevoked && event.InvolvedObject.Name == "app" && event.Type == api_v1.EventTypeWarning {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("no %s event for the route in %#v", acme_controller.EventReasonCertificateRevoked, events)
+	}
+}
+
+func TestRouteControllerReconcileBrokenRoute(t *testing.T) {
+	env, cleanup := newTestEnv(t, "app.example.com")
+	defer cleanup()
+	ca, api := env.ca, env.api
+
+	// nothing listens there so registering the account fails
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	// the broken route is listed before its sibling
+	broken := testRoute("aaa-broken", "broken.example.com")
+	broken.Annotations[issuerlib.AnnotationRouteIssuerKey] = "unreachable"
+	createObjects(t, api, append(testObjects(ca), []testObject{
+		{fakeapi.ResourceConfigMaps, "test", &api_v1.ConfigMap{
+			ObjectMeta: api_v1.ObjectMeta{
+				Name:   "unreachable",
+				Labels: map[string]string{accountlib.LabelAcmeTypeKey: issuerlib.LabelAcmeIssuerType},
+			},
+			Data: map[string]string{
+				issuerlib.DataDirectoryUrlKey: unreachable.URL + "/directory",
+			},
+		}},
+		{fakeapi.ResourceRoutes, "test", broken},
+	}...))
+
+	_, stop := env.startControllers(t)
+	defer stop()
+	waitForCertificate(t, api)
+
+	var route oapi.Route
+	if err := api.Get(fakeapi.ResourceRoutes, "test", "aaa-broken", &route); err != nil {
+		t.Fatal(err)
+	}
+	if route.Spec.Tls != nil {
+		t.Errorf("broken route got a certificate")
+	}
+}
+
+// managedRoutes returns sorted names of routes the AcmeController manages in namespace "test"
+func managedRoutes(ac *acme_controller.AcmeController) []string {
+	var names []string
+	for _, o := range ac.Objects("test") {
+		if obj, ok := o.(*RouteObject); ok {
+			names = append(names, obj.route.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// waitForManagedRoutes waits until the AcmeController manages exactly the named routes in namespace "test"
+func waitForManagedRoutes(t *testing.T, ac *acme_controller.AcmeController, timeout time.Duration, names ...string) {
+	sort.Strings(names)
+	for deadline := time.Now().Add(timeout); ; {
+		managed := managedRoutes(ac)
+		if reflect.DeepEqual(managed, names) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected managed routes %v, got %v", names, managed)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestRouteControllerReconcile(t *testing.T) {
+	env, cleanup := newTestEnv(t, "app.example.com", "late.example.com", "later.example.com", "latest.example.com")
+	defer cleanup()
+	ca, api := env.ca, env.api
+
+	createObjects(t, api, testObjects(ca))
+
+	clientset, err := kubernetes.NewForConfig(api.RESTConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, stop := context.WithCancel(env.ctx)
+	defer stop()
+	ac := acme_controller.NewAcmeController(ctx, clientset.CoreV1(), ca.DirectoryURL(), nil, "", []string{"test"}, nil)
+	if err := ac.BootstrapDB(true, true); err != nil {
+		t.Fatal(err)
+	}
+	ac.Start()
+	defer ac.Wait()
+
+	// the watch isn't running so changes are seen only by reconcile and doWatchIteration called here
+	rc, err := NewRouteController(ctx, clientset.CoreV1(), ac, map[string]acme.ChallengeExposer{"http-01": env.http01},
+		ServiceID{Name: "acme-controller", Namespace: "acme"}, []string{"test"}, acme_controller.LifecyclePolicyRetain, nil, 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Wait()
+
+	if err := rc.reconcile("test"); err != nil {
+		t.Fatal(err)
+	}
+	if managed := managedRoutes(ac); !reflect.DeepEqual(managed, []string{"app"}) {
+		t.Fatalf("expected route app to be managed after the initial list, got %v", managed)
+	}
+	waitForCertificate(t, api)
+
+	// while the watch is down route app disappears and route late is created; their events are compacted away
+	if err := api.Delete(fakeapi.ResourceRoutes, "test", "app"); err != nil {
+		t.Fatal(err)
+	}
+	late := testRoute("late", "late.example.com")
+	if err := api.Create(fakeapi.ResourceRoutes, "test", late); err != nil {
+		t.Fatal(err)
+	}
+	api.Compact()
+
+	// resuming the watch from the old resourceVersion gets 410 Gone which asks for a relist
+	if err := rc.doWatchIteration("test", nil); err != errResourceVersionExpired {
+		t.Fatalf("expected %q from the watch, got %v", errResourceVersionExpired, err)
+	}
+	if err := rc.reconcile("test"); err != nil {
+		t.Fatal(err)
+	}
+	if managed := managedRoutes(ac); !reflect.DeepEqual(managed, []string{"late"}) {
+		t.Errorf("expected only route late to be managed after the relist, got %v", managed)
+	}
+	waitForRouteCertificate(t, api, "late")
+
+	// the watch loop relists right away on 410 Gone instead of backing off and keeps watching afterwards
+	rc.wg.Add(1)
+	go rc.watch("test")
+	defer stop()
+	if err := api.Create(fakeapi.ResourceRoutes, "test", testRoute("later", "later.example.com")); err != nil {
+		t.Fatal(err)
+	}
+	waitForManagedRoutes(t, ac, 5*time.Second, "late", "later")
+	waitForRouteCertificate(t, api, "later")
+
+	// a change to another resource moves the history past the watch's last route event
+	if err := api.Create(fakeapi.ResourceConfigMaps, "other", &api_v1.ConfigMap{ObjectMeta: api_v1.ObjectMeta{Name: "unrelated"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.Delete(fakeapi.ResourceRoutes, "test", "late"); err != nil {
+		t.Fatal(err)
+	}
+	api.Compact()
+	waitForManagedRoutes(t, ac, 5*time.Second, "later")
+
+	if err := api.Create(fakeapi.ResourceRoutes, "test", testRoute("latest", "latest.example.com")); err != nil {
+		t.Fatal(err)
+	}
+	waitForManagedRoutes(t, ac, 5*time.Second, "later", "latest")
+}
+
+func TestRouteControllerSharedAccount(t *testing.T) {
+	env, cleanup := newTestEnv(t, "app.example.com")
+	defer cleanup()
+	ca, api := env.ca, env.api
+
+	// without the namespace's issuer the route uses the global one whose account is shared
+	createObjects(t, api, []testObject{{fakeapi.ResourceRoutes, "test", testRoute("app", "app.example.com")}})
+
+	_, stop := env.startControllersWithSharedAccount(t, "acme")
+	route := waitForCertificate(t, api)
+
+	var account api_v1.Secret
+	if err := api.Get(fakeapi.ResourceSecrets, "acme", "acme-account", &account); err != nil {
+		t.Fatalf("shared account: %v", err)
+	}
+	var records api_v1.Secret
+	recordsName := accountlib.CertificateSecretName("acme-account", "test", []string{"app.example.com"})
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		err := api.Get(fakeapi.ResourceSecrets, "acme", recordsName, &records)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("certificate records: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if records.Annotations[accountlib.AnnotationAcmeNamespaceKey] != "test" {
+		t.Errorf("certificate records secret has annotations %v", records.Annotations)
+	}
+	for _, selector := range []string{accountlib.LabelSelectorAcmeAccount, accountlib.LabelSelectorAcmeCertificate} {
+		var secrets []api_v1.Secret
+		if err := api.List(fakeapi.ResourceSecrets, "test", selector, &secrets); err != nil {
+			t.Fatal(err)
+		}
+		if len(secrets) != 0 {
+			t.Errorf("expected no secrets matching '%s' in the route's namespace, got %d", selector, len(secrets))
+		}
+	}
+
+	// a restarted controller which lost the route's secret finds the certificate in the shared records
+	stop()
+	if err := api.Delete(fakeapi.ResourceSecrets, "test", "acme.app"); err != nil {
+		t.Fatal(err)
+	}
+	issued := route.Spec.Tls.Certificate
+	route.Spec.Tls = nil
+	if err := api.Update(fakeapi.ResourceRoutes, "test", &route); err != nil {
+		t.Fatal(err)
+	}
+
+	_, stop = env.startControllersWithSharedAccount(t, "acme")
+	defer stop()
+	restored := waitForCertificate(t, api)
+	if restored.Spec.Tls.Certificate != issued {
+		t.Error("route got a different certificate than the recorded one")
+	}
+	if n := ca.Requests(fakeacme.ResourceNewCert); n != 1 {
+		t.Errorf("expected the certificate to be issued once, got %d requests", n)
+	}
+}
+
+func TestRouteControllerLifecyclePolicy(t *testing.T) {
+	env, cleanup := newTestEnv(t, "app.example.com", "kept.example.com")
+	defer cleanup()
+	ca, api := env.ca, env.api
+
+	newRoute := func(name, host string, policy acme_controller.LifecyclePolicy) testObject {
+		route := testRoute(name, host)
+		route.Annotations[AnnotationLifecyclePolicyKey] = string(policy)
+		return testObject{fakeapi.ResourceRoutes, "test", route}
+	}
+	createObjects(t, api, []testObject{
+		{fakeapi.ResourceConfigMaps, "test", testIssuer("fake", ca, true)},
+		newRoute("app", "app.example.com", acme_controller.LifecyclePolicyRevokeAndDelete),
+		newRoute("app-copy", "app.example.com", acme_controller.LifecyclePolicyRevokeAndDelete),
+		newRoute("kept", "kept.example.com", acme_controller.LifecyclePolicyRetain),
+		// the CA can't validate the host so the route never gets a certificate
+		newRoute("pending", "pending.example.com", acme_controller.LifecyclePolicyRevokeAndDelete),
+	})
+
+	_, stop := env.startControllers(t)
+	defer stop()
+	shared := parseLeaf(t, waitForRouteCertificate(t, api, "app"))
+	if copied := parseLeaf(t, waitForRouteCertificate(t, api, "app-copy")); copied.SerialNumber.Cmp(shared.SerialNumber) != 0 {
+		t.Fatal("routes for the same host got different certificates")
+	}
+	kept := parseLeaf(t, waitForRouteCertificate(t, api, "kept"))
+
+	// routes are handled in order so once a later route's secret is gone the earlier ones are done too
+	waitForSecretDeleted := func(name string) {
+		var secret api_v1.Secret
+		for deadline := time.Now().Add(20 * time.Second); ; {
+			if err := api.Get(fakeapi.ResourceSecrets, "test", name, &secret); err != nil {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("secret '%s' wasn't deleted", name)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	for _, name := range []string{"kept", "pending", "app-copy"} {
+		if err := api.Delete(fakeapi.ResourceRoutes, "test", name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForSecretDeleted("acme.app-copy")
+	if ca.IsRevoked(shared) {
+		t.Error("certificate was revoked while another route uses it")
+	}
+
+	if err := api.Delete(fakeapi.ResourceRoutes, "test", "app"); err != nil {
+		t.Fatal(err)
+	}
+	waitForSecretDeleted("acme.app")
+	if !ca.IsRevoked(shared) {
+		t.Error("certificate of the last route wasn't revoked")
+	}
+	if n := ca.Requests(fakeacme.ResourceRevokeCert); n != 1 {
+		t.Errorf("expected 1 revocation request, got %d", n)
+	}
+
+	var secret api_v1.Secret
+	if err := api.Get(fakeapi.ResourceSecrets, "test", "acme.kept", &secret); err != nil {
+		t.Errorf("retained secret: %v", err)
+	}
+	if ca.IsRevoked(kept) {
+		t.Error("retained certificate was revoked")
+	}
+}
@@ -0,0 +1,64 @@
+package fakeapi
+
+import (
+	"fmt"
+	"strings"
+)
+
+type requirement struct {
+	key      string
+	value    string
+	exists   bool
+	negative bool
+}
+
+// labelSelector supports equality based requirements: k=v, k==v, k!=v, k and !k
+type labelSelector []requirement
+
+func parseLabelSelector(s string) (labelSelector, error) {
+	var selector labelSelector
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		if strings.ContainsAny(term, "() ") {
+			return nil, fmt.Errorf("unsupported label selector '%s'", s)
+		}
+
+		var r requirement
+		switch {
+		case strings.Contains(term, "!="):
+			parts := strings.SplitN(term, "!=", 2)
+			r = requirement{key: parts[0], value: parts[1], negative: true}
+		case strings.Contains(term, "=="):
+			parts := strings.SplitN(term, "==", 2)
+			r = requirement{key: parts[0], value: parts[1]}
+		case strings.Contains(term, "="):
+			parts := strings.SplitN(term, "=", 2)
+			r = requirement{key: parts[0], value: parts[1]}
+		case strings.HasPrefix(term, "!"):
+			r = requirement{key: term[1:], exists: true, negative: true}
+		default:
+			r = requirement{key: term, exists: true}
+		}
+		selector = append(selector, r)
+	}
+	return selector, nil
+}
+
+func (ls labelSelector) matches(labels map[string]string) bool {
+	for _, r := range ls {
+		value, found := labels[r.key]
+		var match bool
+		if r.exists {
+			match = found
+		} else {
+			match = found && value == r.value
+		}
+		if match == r.negative {
+			return false
+		}
+	}
+	return true
+}
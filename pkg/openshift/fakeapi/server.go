@@ -0,0 +1,793 @@
+// Package fakeapi implements an in-memory API server with the subset of Kubernetes and OpenShift API
+// used by the controllers so they can be tested without a cluster.
+//
+// Objects are kept as JSON. Routes live under /oapi/v1; Services, Endpoints, Secrets, ConfigMaps
+// and Namespaces under /api/v1. Lists support label selectors and resourceVersion, watches stream
+// events from a given resourceVersion and report 410 Gone for compacted history. Patches are applied
+// as JSON merge patches. Routes can be admitted automatically as if a router picked them up.
+package fakeapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/rest"
+)
+
+const (
+	ResourceRoutes     = "routes"
+	ResourceServices   = "services"
+	ResourceEndpoints  = "endpoints"
+	ResourceSecrets    = "secrets"
+	ResourceConfigMaps = "configmaps"
+	ResourceNamespaces = "namespaces"
+	ResourceEvents     = "events"
+
+	VerbCreate = "create"
+	VerbUpdate = "update"
+	VerbPatch  = "patch"
+	VerbDelete = "delete"
+
+	// RouterName is the name of the router admitting routes
+	RouterName = "router"
+)
+
+type resourceInfo struct {
+	prefix     string
+	kind       string
+	namespaced bool
+}
+
+var resources = map[string]resourceInfo{
+	ResourceRoutes:     {prefix: "/oapi/v1", kind: "Route", namespaced: true},
+	ResourceServices:   {prefix: "/api/v1", kind: "Service", namespaced: true},
+	ResourceEndpoints:  {prefix: "/api/v1", kind: "Endpoints", namespaced: true},
+	ResourceSecrets:    {prefix: "/api/v1", kind: "Secret", namespaced: true},
+	ResourceConfigMaps: {prefix: "/api/v1", kind: "ConfigMap", namespaced: true},
+	ResourceNamespaces: {prefix: "/api/v1", kind: "Namespace", namespaced: false},
+	ResourceEvents:     {prefix: "/api/v1", kind: "Event", namespaced: true},
+}
+
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrAlreadyExists = errors.New("already exists")
+	ErrConflict      = errors.New("conflict")
+)
+
+type Config struct {
+	// AdmitRoutes makes the routers admit routes right after they are created
+	AdmitRoutes bool
+	// Routers maps names of router shards to label selectors of routes they serve;
+	// if empty a single router named RouterName serves all routes
+	Routers map[string]string
+}
+
+// Action is a change requested through the API
+type Action struct {
+	Verb      string
+	Resource  string
+	Namespace string
+	Name      string
+}
+
+func (a Action) String() string {
+	return fmt.Sprintf("%s %s %s/%s", a.Verb, a.Resource, a.Namespace, a.Name)
+}
+
+type object map[string]interface{}
+
+type event struct {
+	Type            string `json:"type"`
+	Object          object `json:"object"`
+	resource        string
+	resourceVersion uint64
+}
+
+// Server is a fake API server listening on a local address
+type Server struct {
+	config     Config
+	httpServer *httptest.Server
+	done       chan struct{}
+
+	mutex           sync.Mutex
+	resourceVersion uint64
+	lastUID         int
+	objects         map[string]object // resource/namespace/name => object
+	events          []event
+	compacted       uint64
+	changed         chan struct{} // closed and replaced on every change
+	actions         []Action
+}
+
+// NewServer starts serving the API on a local address; call Close to stop it
+func NewServer(config Config) *Server {
+	s := &Server{
+		config:  config,
+		done:    make(chan struct{}),
+		objects: make(map[string]object),
+		changed: make(chan struct{}),
+	}
+	s.httpServer = httptest.NewServer(s)
+	return s
+}
+
+func (s *Server) Close() {
+	close(s.done)
+	s.httpServer.Close()
+}
+
+// RESTConfig returns client configuration for this server; client side rate limiting is effectively disabled
+func (s *Server) RESTConfig() *rest.Config {
+	return &rest.Config{
+		Host:  s.httpServer.URL,
+		QPS:   1000,
+		Burst: 1000,
+	}
+}
+
+// Actions returns changes requested through the API so far
+func (s *Server) Actions() []Action {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]Action(nil), s.actions...)
+}
+
+// Compact drops the event history so watches from older resource versions expire
+func (s *Server) Compact() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.compacted = s.resourceVersion
+	s.events = nil
+	s.notify()
+}
+
+func objectKey(resource, namespace, name string) string {
+	return resource + "/" + namespace + "/" + name
+}
+
+func (o object) metadata() map[string]interface{} {
+	m, ok := o["metadata"].(map[string]interface{})
+	if !ok {
+		m = make(map[string]interface{})
+		o["metadata"] = m
+	}
+	return m
+}
+
+func (o object) metaString(key string) string {
+	s, _ := o.metadata()[key].(string)
+	return s
+}
+
+func (o object) labels() map[string]string {
+	labels := make(map[string]string)
+	m, _ := o.metadata()["labels"].(map[string]interface{})
+	for k, v := range m {
+		labels[k], _ = v.(string)
+	}
+	return labels
+}
+
+// copy returns a deep copy so stored objects are never shared
+func (o object) copy() object {
+	data, err := json.Marshal(o)
+	if err != nil {
+		panic(err)
+	}
+	var c object
+	if err := json.Unmarshal(data, &c); err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func toObject(v interface{}) (object, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var o object
+	if err := json.Unmarshal(data, &o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// notify wakes up watches; has to be called with the mutex held
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// store saves the object with a new resource version and records the event; has to be called with the mutex held
+func (s *Server) store(eventType, resource string, o object) object {
+	s.resourceVersion++
+	o.metadata()["resourceVersion"] = strconv.FormatUint(s.resourceVersion, 10)
+	key := objectKey(resource, o.metaString("namespace"), o.metaString("name"))
+	if eventType == "DELETED" {
+		delete(s.objects, key)
+	} else {
+		s.objects[key] = o
+	}
+	s.events = append(s.events, event{
+		Type:            eventType,
+		Object:          o.copy(),
+		resource:        resource,
+		resourceVersion: s.resourceVersion,
+	})
+	s.notify()
+	return o.copy()
+}
+
+func (s *Server) create(resource, namespace string, o object) (object, error) {
+	info := resources[resource]
+	o["kind"] = info.kind
+	o["apiVersion"] = "v1"
+	meta := o.metadata()
+	if info.namespaced {
+		meta["namespace"] = namespace
+	} else {
+		delete(meta, "namespace")
+		namespace = ""
+	}
+	name := o.metaString("name")
+	if name == "" {
+		return nil, errors.New("name is required")
+	}
+	if _, found := s.objects[objectKey(resource, namespace, name)]; found {
+		return nil, ErrAlreadyExists
+	}
+
+	s.lastUID++
+	meta["uid"] = fmt.Sprintf("00000000-0000-0000-0000-%012d", s.lastUID)
+	meta["creationTimestamp"] = time.Now().UTC().Format(time.RFC3339)
+	meta["selfLink"] = selfLink(resource, namespace, name)
+	if resource == ResourceRoutes {
+		delete(o, "status")
+	}
+
+	created := s.store("ADDED", resource, o)
+	if resource == ResourceRoutes && s.config.AdmitRoutes {
+		s.setAdmitted(o, true)
+	}
+	return created, nil
+}
+
+// update replaces the object keeping the fields managed by the server; has to be called with the mutex held
+func (s *Server) update(resource, namespace, name string, o object) (object, error) {
+	current, found := s.objects[objectKey(resource, namespace, name)]
+	if !found {
+		return nil, ErrNotFound
+	}
+	if rv := o.metaString("resourceVersion"); rv != "" && rv != current.metaString("resourceVersion") {
+		return nil, ErrConflict
+	}
+
+	o["kind"] = current["kind"]
+	o["apiVersion"] = current["apiVersion"]
+	meta := o.metadata()
+	for _, key := range []string{"name", "namespace", "uid", "creationTimestamp", "selfLink"} {
+		if v, found := current.metadata()[key]; found {
+			meta[key] = v
+		} else {
+			delete(meta, key)
+		}
+	}
+	// route status is owned by the router
+	if resource == ResourceRoutes {
+		if status, found := current["status"]; found {
+			o["status"] = status
+		} else {
+			delete(o, "status")
+		}
+	}
+
+	return s.store("MODIFIED", resource, o), nil
+}
+
+// mergePatch applies a JSON merge patch (RFC 7386)
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+	return t
+}
+
+func (s *Server) patch(resource, namespace, name string, patch object) (object, error) {
+	current, found := s.objects[objectKey(resource, namespace, name)]
+	if !found {
+		return nil, ErrNotFound
+	}
+	patched := object(mergePatch(current.copy(), map[string]interface{}(patch)).(map[string]interface{}))
+	// patches can't conflict unless they set resourceVersion explicitly
+	if patch.metaString("resourceVersion") == "" {
+		patched.metadata()["resourceVersion"] = current.metaString("resourceVersion")
+	}
+	return s.update(resource, namespace, name, patched)
+}
+
+func (s *Server) delete(resource, namespace, name string, uid string) (object, error) {
+	current, found := s.objects[objectKey(resource, namespace, name)]
+	if !found {
+		return nil, ErrNotFound
+	}
+	if uid != "" && uid != current.metaString("uid") {
+		return nil, ErrConflict
+	}
+	return s.store("DELETED", resource, current.copy()), nil
+}
+
+// setAdmitted sets the route's status as the routers serving it would; has to be called with the mutex held
+func (s *Server) setAdmitted(route object, admitted bool) {
+	route = route.copy()
+	status := "False"
+	if admitted {
+		status = "True"
+	}
+	spec, _ := route["spec"].(map[string]interface{})
+	host, _ := spec["host"].(string)
+
+	routers := s.config.Routers
+	if len(routers) == 0 {
+		routers = map[string]string{RouterName: ""}
+	}
+	var names []string
+	for name, selector := range routers {
+		ls, err := parseLabelSelector(selector)
+		if err != nil || !ls.matches(route.labels()) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ingress := []interface{}{}
+	for _, name := range names {
+		ingress = append(ingress, map[string]interface{}{
+			"host":       host,
+			"routerName": name,
+			"conditions": []interface{}{
+				map[string]interface{}{
+					"type":               "Admitted",
+					"status":             status,
+					"lastTransitionTime": time.Now().UTC().Format(time.RFC3339),
+				},
+			},
+		})
+	}
+	route["status"] = map[string]interface{}{
+		"ingress": ingress,
+	}
+	s.store("MODIFIED", ResourceRoutes, route)
+}
+
+func (s *Server) list(resource, namespace string, selector labelSelector) []object {
+	var items []object
+	for key, o := range s.objects {
+		if !strings.HasPrefix(key, resource+"/") {
+			continue
+		}
+		if namespace != "" && o.metaString("namespace") != namespace {
+			continue
+		}
+		if !selector.matches(o.labels()) {
+			continue
+		}
+		items = append(items, o.copy())
+	}
+	sort.Sort(byNamespaceAndName(items))
+	return items
+}
+
+type byNamespaceAndName []object
+
+func (l byNamespaceAndName) Len() int      { return len(l) }
+func (l byNamespaceAndName) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l byNamespaceAndName) Less(i, j int) bool {
+	if l[i].metaString("namespace") != l[j].metaString("namespace") {
+		return l[i].metaString("namespace") < l[j].metaString("namespace")
+	}
+	return l[i].metaString("name") < l[j].metaString("name")
+}
+
+// Create stores a new object as if it was created through the API
+func (s *Server) Create(resource, namespace string, v interface{}) error {
+	o, err := toObject(v)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err = s.create(resource, namespace, o)
+	return err
+}
+
+// Get decodes the stored object into v
+func (s *Server) Get(resource, namespace, name string, v interface{}) error {
+	s.mutex.Lock()
+	o, found := s.objects[objectKey(resource, namespace, name)]
+	s.mutex.Unlock()
+	if !found {
+		return ErrNotFound
+	}
+
+	data, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// List decodes stored objects matching the label selector into a slice pointed to by v
+func (s *Server) List(resource, namespace, selector string, v interface{}) error {
+	ls, err := parseLabelSelector(selector)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	items := s.list(resource, namespace, ls)
+	s.mutex.Unlock()
+
+	data, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Update replaces a stored object as if it was updated through the API
+func (s *Server) Update(resource, namespace string, v interface{}) error {
+	o, err := toObject(v)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err = s.update(resource, namespace, o.metaString("name"), o)
+	return err
+}
+
+// Delete removes a stored object as if it was deleted through the API
+func (s *Server) Delete(resource, namespace, name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.delete(resource, namespace, name, "")
+	return err
+}
+
+// AdmitRoute sets the Admitted condition of the route as the routers serving it would
+func (s *Server) AdmitRoute(namespace, name string, admitted bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	route, found := s.objects[objectKey(ResourceRoutes, namespace, name)]
+	if !found {
+		return ErrNotFound
+	}
+	s.setAdmitted(route, admitted)
+	return nil
+}
+
+func selfLink(resource, namespace, name string) string {
+	info := resources[resource]
+	if !info.namespaced {
+		return fmt.Sprintf("%s/%s/%s", info.prefix, resource, name)
+	}
+	return fmt.Sprintf("%s/namespaces/%s/%s/%s", info.prefix, namespace, resource, name)
+}
+
+// request identifies what an API path refers to
+type request struct {
+	resource  string
+	namespace string
+	name      string
+	watch     bool
+}
+
+func parsePath(path string) (*request, error) {
+	var prefix string
+	for _, p := range []string{"/api/v1/", "/oapi/v1/"} {
+		if strings.HasPrefix(path, p) {
+			prefix = p
+		}
+	}
+	if prefix == "" {
+		return nil, ErrNotFound
+	}
+
+	r := &request{}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(path, prefix), "/"), "/")
+	if parts[0] == "watch" {
+		r.watch = true
+		parts = parts[1:]
+	}
+
+	switch {
+	case len(parts) == 1:
+		r.resource = parts[0]
+	case len(parts) == 2:
+		r.resource, r.name = parts[0], parts[1]
+	case len(parts) == 3 && parts[0] == "namespaces":
+		r.namespace, r.resource = parts[1], parts[2]
+	case len(parts) == 4 && parts[0] == "namespaces":
+		r.namespace, r.resource, r.name = parts[1], parts[2], parts[3]
+	default:
+		return nil, ErrNotFound
+	}
+
+	info, found := resources[r.resource]
+	if !found || "/"+strings.Trim(prefix, "/") != info.prefix {
+		return nil, ErrNotFound
+	}
+	if (info.namespaced && r.name != "" && r.namespace == "") || (!info.namespaced && r.namespace != "") {
+		return nil, ErrNotFound
+	}
+
+	return r, nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func status(code int, reason, message string) map[string]interface{} {
+	st := "Failure"
+	if code < 300 {
+		st = "Success"
+	}
+	return map[string]interface{}{
+		"kind":       "Status",
+		"apiVersion": "v1",
+		"metadata":   map[string]interface{}{},
+		"status":     st,
+		"message":    message,
+		"reason":     reason,
+		"code":       code,
+	}
+}
+
+func writeStatus(w http.ResponseWriter, code int, reason, message string) {
+	writeJSON(w, code, status(code, reason, message))
+}
+
+func writeError(w http.ResponseWriter, r *request, err error) {
+	switch err {
+	case ErrNotFound:
+		writeStatus(w, http.StatusNotFound, "NotFound", fmt.Sprintf("%s \"%s\" not found", r.resource, r.name))
+	case ErrAlreadyExists:
+		writeStatus(w, http.StatusConflict, "AlreadyExists", fmt.Sprintf("%s \"%s\" already exists", r.resource, r.name))
+	case ErrConflict:
+		writeStatus(w, http.StatusConflict, "Conflict", fmt.Sprintf("the object %s \"%s\" has been modified; please apply your changes to the latest version and try again", r.resource, r.name))
+	default:
+		writeStatus(w, http.StatusBadRequest, "BadRequest", err.Error())
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, hr *http.Request) {
+	r, err := parsePath(hr.URL.Path)
+	if err != nil {
+		writeStatus(w, http.StatusNotFound, "NotFound", fmt.Sprintf("the server could not find the requested resource (%s %s)", hr.Method, hr.URL.Path))
+		return
+	}
+	query := hr.URL.Query()
+	if w := query.Get("watch"); w == "true" || w == "1" {
+		r.watch = true
+	}
+
+	if hr.Method == "GET" {
+		selector, err := parseLabelSelector(query.Get("labelSelector"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		switch {
+		case r.watch:
+			s.serveWatch(w, hr, r, selector, query.Get("resourceVersion"))
+		case r.name != "":
+			s.mutex.Lock()
+			o, found := s.objects[objectKey(r.resource, r.namespace, r.name)]
+			if found {
+				o = o.copy()
+			}
+			s.mutex.Unlock()
+			if !found {
+				writeError(w, r, ErrNotFound)
+				return
+			}
+			writeJSON(w, http.StatusOK, o)
+		default:
+			s.mutex.Lock()
+			items := s.list(r.resource, r.namespace, selector)
+			rv := strconv.FormatUint(s.resourceVersion, 10)
+			s.mutex.Unlock()
+			if items == nil {
+				items = []object{}
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"kind":       resources[r.resource].kind + "List",
+				"apiVersion": "v1",
+				"metadata":   map[string]interface{}{"resourceVersion": rv},
+				"items":      items,
+			})
+		}
+		return
+	}
+
+	body, err := ioutil.ReadAll(hr.Body)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	var o object
+	if len(body) != 0 {
+		if err := json.Unmarshal(body, &o); err != nil {
+			writeError(w, r, fmt.Errorf("invalid body: %v", err))
+			return
+		}
+	}
+
+	var verb string
+	var result object
+	code := http.StatusOK
+	s.mutex.Lock()
+	switch {
+	case hr.Method == "POST" && r.name == "":
+		verb = VerbCreate
+		if o == nil {
+			err = errors.New("missing body")
+			break
+		}
+		r.name = o.metaString("name")
+		result, err = s.create(r.resource, r.namespace, o)
+		code = http.StatusCreated
+	case hr.Method == "PUT" && r.name != "":
+		verb = VerbUpdate
+		if o == nil {
+			err = errors.New("missing body")
+			break
+		}
+		if name := o.metaString("name"); name != r.name {
+			err = fmt.Errorf("name '%s' in the body doesn't match '%s'", name, r.name)
+			break
+		}
+		result, err = s.update(r.resource, r.namespace, r.name, o)
+	case hr.Method == "PATCH" && r.name != "":
+		verb = VerbPatch
+		result, err = s.patch(r.resource, r.namespace, r.name, o)
+	case hr.Method == "DELETE" && r.name != "":
+		verb = VerbDelete
+		var uid string
+		if preconditions, ok := o["preconditions"].(map[string]interface{}); ok {
+			uid, _ = preconditions["uid"].(string)
+		}
+		_, err = s.delete(r.resource, r.namespace, r.name, uid)
+		result = status(http.StatusOK, "", "")
+	default:
+		s.mutex.Unlock()
+		writeStatus(w, http.StatusMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("method %s is not supported on %s", hr.Method, hr.URL.Path))
+		return
+	}
+	s.actions = append(s.actions, Action{Verb: verb, Resource: r.resource, Namespace: r.namespace, Name: r.name})
+	s.mutex.Unlock()
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, code, result)
+}
+
+func (s *Server) serveWatch(w http.ResponseWriter, hr *http.Request, r *request, selector labelSelector, resourceVersion string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeStatus(w, http.StatusInternalServerError, "InternalError", "streaming unsupported")
+		return
+	}
+
+	var last uint64
+	s.mutex.Lock()
+	var initial []event
+	if resourceVersion == "" || resourceVersion == "0" {
+		// start with the current state
+		for _, o := range s.list(r.resource, r.namespace, selector) {
+			initial = append(initial, event{Type: "ADDED", Object: o})
+		}
+		last = s.resourceVersion
+	} else {
+		var err error
+		last, err = strconv.ParseUint(resourceVersion, 10, 64)
+		if err != nil {
+			s.mutex.Unlock()
+			writeError(w, r, fmt.Errorf("invalid resourceVersion '%s'", resourceVersion))
+			return
+		}
+	}
+	s.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	for _, e := range initial {
+		encoder.Encode(&e)
+	}
+	flusher.Flush()
+
+	for {
+		s.mutex.Lock()
+		var events []event
+		expired := last < s.compacted
+		if !expired {
+			for _, e := range s.events {
+				if e.resourceVersion <= last || e.resource != r.resource {
+					continue
+				}
+				last = e.resourceVersion
+				if r.namespace != "" && e.Object.metaString("namespace") != r.namespace {
+					continue
+				}
+				if r.name != "" && e.Object.metaString("name") != r.name {
+					continue
+				}
+				if !selector.matches(e.Object.labels()) {
+					continue
+				}
+				events = append(events, e)
+			}
+		}
+		changed := s.changed
+		s.mutex.Unlock()
+
+		if expired {
+			encoder.Encode(map[string]interface{}{
+				"type":   "ERROR",
+				"object": status(http.StatusGone, "Expired", fmt.Sprintf("too old resource version: %d", last)),
+			})
+			flusher.Flush()
+			return
+		}
+
+		for _, e := range events {
+			encoder.Encode(&e)
+		}
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-s.done:
+			return
+		case <-hr.Context().Done():
+			return
+		}
+	}
+}
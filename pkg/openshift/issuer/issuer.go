@@ -0,0 +1,196 @@
+package issuer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tnozicka/openshift-acme/pkg/acme"
+	"github.com/tnozicka/openshift-acme/pkg/cert"
+	accountlib "github.com/tnozicka/openshift-acme/pkg/openshift/account"
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// LabelAcmeIssuerType marks a ConfigMap as an issuer (value of account.LabelAcmeTypeKey)
+	LabelAcmeIssuerType = "issuer"
+	// LabelAcmeIssuerKey binds an account secret to the issuer it was registered for
+	LabelAcmeIssuerKey = "kubernetes.io/acme.issuer"
+	// AnnotationAcmeIssuerDefaultKey marks the issuer used for routes in the namespace that don't select one
+	AnnotationAcmeIssuerDefaultKey = "kubernetes.io/acme.default-issuer"
+	// AnnotationRouteIssuerKey selects an issuer for a route
+	AnnotationRouteIssuerKey = "kubernetes.io/tls-acme.issuer"
+
+	DataDirectoryUrlKey   = "directory-url"
+	DataContactsKey       = "contacts"
+	DataKeyTypeKey        = "key-type"
+	DataChallengeTypesKey = "challenge-types"
+	DataCaBundleKey       = "ca-bundle"
+	DataProxyUrlKey       = "proxy-url"
+	DataTimeoutKey        = "timeout"
+	// DataClientCertificateSecretKey names a kubernetes.io/tls secret in the issuer's namespace
+	// with the client certificate presented to the ACME server
+	DataClientCertificateSecretKey = "client-certificate-secret"
+	// DataFallbackIssuersKey lists issuers in the same namespace tried in order when the ACME server is unavailable
+	DataFallbackIssuersKey = "fallback-issuers"
+	// DataFailBackKey makes renewals of certificates issued by a fallback issuer start with this issuer again
+	DataFailBackKey = "fail-back"
+	// DataEabSecretKey is rejected; the ACME v1 client can't do external account binding
+	DataEabSecretKey = "eab-secret"
+)
+
+var (
+	LabelSelectorAcmeIssuer = fmt.Sprintf("%s=%s", accountlib.LabelAcmeTypeKey, LabelAcmeIssuerType)
+)
+
+// Issuer describes an ACME server and how to use it.
+// Empty Name refers to the global issuer configured by flags.
+type Issuer struct {
+	Name           string
+	Namespace      string
+	DirectoryUrl   string
+	Contacts       []string
+	KeyType        cert.KeyType
+	ChallengeTypes []string
+	// HTTPClient configures requests to the ACME server; the client certificate is loaded
+	// from ClientCertificateSecretName when set
+	HTTPClient                  acme.HTTPClientConfig
+	ClientCertificateSecretName string
+	// Fallbacks are names of issuers used when this one can't issue certificates (rate limits, server errors, unreachable)
+	Fallbacks []string
+	FailBack  bool
+}
+
+func splitList(s string) (r []string) {
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			r = append(r, item)
+		}
+	}
+	return
+}
+
+// NormalizeContacts makes sure every contact is a mailto: URI
+func NormalizeContacts(contacts []string) (r []string) {
+	for _, contact := range contacts {
+		contact = strings.TrimSpace(contact)
+		if contact == "" {
+			continue
+		}
+		if !strings.HasPrefix(contact, "mailto:") {
+			contact = "mailto:" + contact
+		}
+		r = append(r, contact)
+	}
+	return
+}
+
+// ParseContacts parses comma separated list of emails
+func ParseContacts(s string) []string {
+	return NormalizeContacts(splitList(s))
+}
+
+func NewIssuerFromConfigMap(cm *api_v1.ConfigMap) (i *Issuer, err error) {
+	if cm.Data == nil {
+		err = fmt.Errorf("malformed issuer '%s/%s': missing Data", cm.Namespace, cm.Name)
+		return
+	}
+
+	i = &Issuer{
+		Name:           cm.Name,
+		Namespace:      cm.Namespace,
+		DirectoryUrl:   cm.Data[DataDirectoryUrlKey],
+		ChallengeTypes: splitList(cm.Data[DataChallengeTypesKey]),
+		HTTPClient: acme.HTTPClientConfig{
+			CABundle: []byte(cm.Data[DataCaBundleKey]),
+			ProxyURL: strings.TrimSpace(cm.Data[DataProxyUrlKey]),
+		},
+		ClientCertificateSecretName: cm.Data[DataClientCertificateSecretKey],
+		Fallbacks:                   splitList(cm.Data[DataFallbackIssuersKey]),
+	}
+
+	if i.DirectoryUrl == "" {
+		err = fmt.Errorf("malformed issuer '%s/%s': missing Data.'%s'", cm.Namespace, cm.Name, DataDirectoryUrlKey)
+		return
+	}
+
+	if _, found := cm.Data[DataEabSecretKey]; found {
+		err = fmt.Errorf("malformed issuer '%s/%s': Data.'%s' isn't supported, external account binding requires ACME v2", cm.Namespace, cm.Name, DataEabSecretKey)
+		return
+	}
+
+	i.Contacts = ParseContacts(cm.Data[DataContactsKey])
+
+	i.KeyType, err = cert.ParseKeyType(cm.Data[DataKeyTypeKey])
+	if err != nil {
+		err = fmt.Errorf("malformed issuer '%s/%s': %s", cm.Namespace, cm.Name, err)
+		return
+	}
+
+	for _, fallback := range i.Fallbacks {
+		if fallback == i.Name {
+			err = fmt.Errorf("malformed issuer '%s/%s': Data.'%s' can't contain the issuer itself", cm.Namespace, cm.Name, DataFallbackIssuersKey)
+			return
+		}
+	}
+
+	if failBack, found := cm.Data[DataFailBackKey]; found {
+		i.FailBack, err = strconv.ParseBool(failBack)
+		if err != nil {
+			err = fmt.Errorf("malformed issuer '%s/%s': invalid Data.'%s': %s", cm.Namespace, cm.Name, DataFailBackKey, err)
+			return
+		}
+	}
+
+	if timeout, found := cm.Data[DataTimeoutKey]; found {
+		i.HTTPClient.Timeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			err = fmt.Errorf("malformed issuer '%s/%s': invalid Data.'%s': %s", cm.Namespace, cm.Name, DataTimeoutKey, err)
+			return
+		}
+	}
+
+	// client certificate is loaded later, everything else can be checked now
+	_, err = i.HTTPClient.NewHTTPClient()
+	if err != nil {
+		err = fmt.Errorf("malformed issuer '%s/%s': %s", cm.Namespace, cm.Name, err)
+		return
+	}
+
+	return
+}
+
+func (i *Issuer) AllowsChallenge(challengeType string) bool {
+	if len(i.ChallengeTypes) == 0 {
+		return true
+	}
+
+	for _, t := range i.ChallengeTypes {
+		if t == challengeType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FilterExposers returns only exposers for challenge types allowed by the issuer
+func (i *Issuer) FilterExposers(exposers map[string]acme.ChallengeExposer) map[string]acme.ChallengeExposer {
+	r := make(map[string]acme.ChallengeExposer)
+	for t, exposer := range exposers {
+		if i.AllowsChallenge(t) {
+			r[t] = exposer
+		}
+	}
+	return r
+}
+
+// AccountSecretName is the name of the secret holding ACME account for this issuer
+func (i *Issuer) AccountSecretName() string {
+	if i.Name == "" {
+		return "acme-account"
+	}
+	return "acme-account." + i.Name
+}
@@ -0,0 +1,65 @@
+package issuer
+
+import (
+	"testing"
+
+	api_v1 "k8s.io/client-go/pkg/api/v1"
+)
+
+func TestNewIssuerFromConfigMap(t *testing.T) {
+	testTable := []struct {
+		name        string
+		data        map[string]string
+		expectedErr bool
+	}{
+		{
+			name: "valid",
+			data: map[string]string{
+				DataDirectoryUrlKey: "https://acme.example.com/directory",
+				DataContactsKey:     "admin@example.com",
+			},
+		},
+		{
+			name:        "missing directory",
+			data:        map[string]string{},
+			expectedErr: true,
+		},
+		{
+			name: "external account binding",
+			data: map[string]string{
+				DataDirectoryUrlKey: "https://acme.example.com/directory",
+				DataEabSecretKey:    "eab",
+			},
+			expectedErr: true,
+		},
+		{
+			name: "empty external account binding",
+			data: map[string]string{
+				DataDirectoryUrlKey: "https://acme.example.com/directory",
+				DataEabSecretKey:    "",
+			},
+			expectedErr: true,
+		},
+	}
+
+	for _, item := range testTable {
+		cm := &api_v1.ConfigMap{
+			ObjectMeta: api_v1.ObjectMeta{Name: "test", Namespace: "test"},
+			Data:       item.data,
+		}
+		issuer, err := NewIssuerFromConfigMap(cm)
+		if item.expectedErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got issuer %#v", item.name, issuer)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", item.name, err)
+			continue
+		}
+		if issuer.DirectoryUrl != item.data[DataDirectoryUrlKey] || len(issuer.Contacts) != 1 || issuer.Contacts[0] != "mailto:admin@example.com" {
+			t.Errorf("%s: unexpected issuer %#v", item.name, issuer)
+		}
+	}
+}